@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// gcPercentMu serializes reads of GOGC, which can only be observed by setting it.
+var gcPercentMu sync.Mutex
+
+// currentGCPercent returns the GOGC value in effect.
+func currentGCPercent() int {
+	gcPercentMu.Lock()
+	defer gcPercentMu.Unlock()
+	percent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(percent)
+	return percent
+}
+
+type runtimeHeapStats struct {
+	Alloc    uint64 `json:"alloc"`
+	Sys      uint64 `json:"sys"`
+	InUse    uint64 `json:"inuse"`
+	Idle     uint64 `json:"idle"`
+	Released uint64 `json:"released"`
+	Objects  uint64 `json:"objects"`
+}
+
+type runtimeGCStats struct {
+	NumGC        uint32    `json:"num_gc"`
+	PauseTotalNs uint64    `json:"pause_total_ns"`
+	LastGC       time.Time `json:"last_gc"`
+	NextGC       uint64    `json:"next_gc"`
+}
+
+type runtimeInfo struct {
+	GOGC       int              `json:"gogc"`
+	GOMEMLIMIT int64            `json:"gomemlimit"`
+	GOMAXPROCS int              `json:"gomaxprocs"`
+	NumCPU     int              `json:"num_cpu"`
+	Goroutines int              `json:"goroutines"`
+	Heap       runtimeHeapStats `json:"heap"`
+	GC         runtimeGCStats   `json:"gc"`
+}
+
+// patchRuntimeRequest holds the knobs PATCH /admin/runtime may change.
+// GOGC of -1 disables the collector; a GOMEMLIMIT of math.MaxInt64 removes the limit.
+type patchRuntimeRequest struct {
+	GOGC       *int   `json:"gogc"`
+	GOMEMLIMIT *int64 `json:"gomemlimit"`
+}
+
+func readRuntimeInfo() runtimeInfo {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return runtimeInfo{
+		GOGC:       currentGCPercent(),
+		GOMEMLIMIT: debug.SetMemoryLimit(-1),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		NumCPU:     runtime.NumCPU(),
+		Goroutines: runtime.NumGoroutine(),
+		Heap: runtimeHeapStats{
+			Alloc:    ms.HeapAlloc,
+			Sys:      ms.HeapSys,
+			InUse:    ms.HeapInuse,
+			Idle:     ms.HeapIdle,
+			Released: ms.HeapReleased,
+			Objects:  ms.HeapObjects,
+		},
+		GC: runtimeGCStats{
+			NumGC:        ms.NumGC,
+			PauseTotalNs: ms.PauseTotalNs,
+			LastGC:       time.Unix(0, int64(ms.LastGC)).UTC(),
+			NextGC:       ms.NextGC,
+		},
+	}
+}
+
+// serveAdminRuntime handles GET/PATCH /admin/runtime.
+func serveAdminRuntime(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var req patchRuntimeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if req.GOGC != nil && *req.GOGC < -1 {
+			writeError(w, http.StatusBadRequest, "gogc must be -1 (off) or a non-negative percentage")
+			return
+		}
+		if req.GOMEMLIMIT != nil && *req.GOMEMLIMIT < 0 {
+			writeError(w, http.StatusBadRequest, "gomemlimit must be a non-negative byte count")
+			return
+		}
+		if req.GOGC != nil {
+			gcPercentMu.Lock()
+			debug.SetGCPercent(*req.GOGC)
+			gcPercentMu.Unlock()
+		}
+		if req.GOMEMLIMIT != nil {
+			debug.SetMemoryLimit(*req.GOMEMLIMIT)
+		}
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPatch)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(readRuntimeInfo())
+}
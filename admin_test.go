@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+)
+
+func TestHTTP_AdminRuntime(t *testing.T) {
+	cache := NewCacheSystem(1024, 999999, 60, 999999)
+	defer cache.Stop()
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	// Restore the process-wide knobs for other tests
+	prevGC := currentGCPercent()
+	prevLimit := debug.SetMemoryLimit(-1)
+	defer debug.SetGCPercent(prevGC)
+	defer debug.SetMemoryLimit(prevLimit)
+
+	resp, err := http.Get(server.URL + "/admin/runtime")
+	if err != nil {
+		t.Fatalf("GET /admin/runtime => %v", err)
+	}
+	var info runtimeInfo
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("decode => %v", err)
+	}
+	resp.Body.Close()
+	if info.Goroutines < 1 || info.Heap.Sys == 0 || info.GOGC != prevGC {
+		t.Fatalf("unexpected runtime info: %+v", info)
+	}
+
+	req, _ := http.NewRequest(http.MethodPatch, server.URL+"/admin/runtime",
+		bytes.NewReader([]byte(`{"gogc":250,"gomemlimit":1073741824}`)))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PATCH /admin/runtime => %v", err)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("decode => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || info.GOGC != 250 || info.GOMEMLIMIT != 1<<30 {
+		t.Fatalf("PATCH => expected gogc=250 gomemlimit=1GiB, got %d %+v", resp.StatusCode, info)
+	}
+
+	req, _ = http.NewRequest(http.MethodPatch, server.URL+"/admin/runtime", bytes.NewReader([]byte(`{"gogc":-5}`)))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PATCH /admin/runtime => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PATCH with invalid gogc => expected 400, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"sync/atomic"
+)
+
+// TinyLFU admission. With it on, a key that isn't in the cache is only
+// admitted if doing so would evict nothing, or if it has been asked for more
+// often than every entry it would push out. A scan of one-off keys then
+// bounces off the cache instead of flushing the entries that are actually
+// hot. How often a key has been asked for is estimated by frequencySketch
+// over both hits and misses, so a key that keeps missing earns its place.
+//
+// Unlike W-TinyLFU there is no separate admission window in front of the
+// main LRU; entries share one list. A newcomer that ties with what it would
+// displace is turned away, so under steady pressure a key needs a second
+// request (typically the miss that precedes a cache-aside write) before it
+// gets in.
+
+// Sketch dimensions: four rows of 4-bit counters, sized from the cache's byte
+// limit on the assumption that entries average at least sketchBytesPerKey.
+const (
+	sketchRows        = 4
+	sketchBytesPerKey = 64
+	sketchMinWidth    = 1 << 10
+	sketchMaxWidth    = 1 << 22
+	sketchSampleRatio = 10 // increments per counter slot before counts are halved
+)
+
+// frequencySketch is a count-min sketch with 4-bit saturating counters, eight
+// to a word. Every sampleSize increments all counters are halved, so old
+// popularity fades. It is safe for concurrent use without locks; racing
+// updates can lose an increment, which only makes the estimate rougher.
+type frequencySketch struct {
+	seed       maphash.Seed
+	mask       uint32 // width-1, width a power of two
+	rows       [sketchRows][]atomic.Uint32
+	additions  atomic.Int64
+	sampleSize int64
+	rejects    atomic.Int64 // writes turned away, see admitLocked
+}
+
+// newFrequencySketch sizes a sketch for a cache limited to maxSize bytes.
+func newFrequencySketch(maxSize int64) *frequencySketch {
+	width := maxSize / sketchBytesPerKey
+	if width < sketchMinWidth {
+		width = sketchMinWidth
+	}
+	if width > sketchMaxWidth {
+		width = sketchMaxWidth
+	}
+	width = 1 << bits.Len64(uint64(width-1)) // round up to a power of two
+	s := &frequencySketch{seed: maphash.MakeSeed(), mask: uint32(width - 1), sampleSize: sketchSampleRatio * width}
+	for i := range s.rows {
+		s.rows[i] = make([]atomic.Uint32, width/8)
+	}
+	return s
+}
+
+// hash returns the two halves used for double hashing across rows.
+func (s *frequencySketch) hash(bucket, key string) (h1, h2 uint32) {
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	h.WriteString(bucket)
+	h.WriteByte(0)
+	h.WriteString(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// counter locates row i's counter for a hash: its word and bit offset.
+func (s *frequencySketch) counter(i int, h1, h2 uint32) (*atomic.Uint32, uint) {
+	idx := (h1 + uint32(i)*h2) & s.mask
+	return &s.rows[i][idx/8], uint(idx%8) * 4
+}
+
+// increment counts one access to bucket/key.
+func (s *frequencySketch) increment(bucket, key string) {
+	h1, h2 := s.hash(bucket, key)
+	for i := 0; i < sketchRows; i++ {
+		word, shift := s.counter(i, h1, h2)
+		for {
+			old := word.Load()
+			if (old>>shift)&0xf == 0xf {
+				break
+			}
+			if word.CompareAndSwap(old, old+1<<shift) {
+				break
+			}
+		}
+	}
+	if s.additions.Add(1) == s.sampleSize {
+		s.age()
+	}
+}
+
+// estimate returns how often bucket/key has been accessed, at most 15.
+func (s *frequencySketch) estimate(bucket, key string) uint32 {
+	h1, h2 := s.hash(bucket, key)
+	min := uint32(0xf)
+	for i := 0; i < sketchRows; i++ {
+		word, shift := s.counter(i, h1, h2)
+		if c := (word.Load() >> shift) & 0xf; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// age halves every counter and restarts the sample.
+func (s *frequencySketch) age() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			word := &s.rows[i][j]
+			for {
+				old := word.Load()
+				if word.CompareAndSwap(old, (old>>1)&0x77777777) {
+					break
+				}
+			}
+		}
+	}
+	s.additions.Store(0)
+}
+
+// SetTinyLFU turns TinyLFU admission on or off (it is off by default). Turning
+// it on starts from an empty frequency sketch. It has no effect on a cache
+// without a size limit, which never evicts to make room.
+func (cs *CacheSystem) SetTinyLFU(on bool) {
+	if on {
+		cs.admission.Store(newFrequencySketch(cs.maxSize))
+	} else {
+		cs.admission.Store(nil)
+	}
+}
+
+// AdmissionRejects returns the number of writes TinyLFU admission turned away.
+func (cs *CacheSystem) AdmissionRejects() int64 {
+	if s := cs.admission.Load(); s != nil {
+		return s.rejects.Load()
+	}
+	return 0
+}
+
+// recordAccess feeds a read or write of bucket/key to the admission sketch.
+func (cs *CacheSystem) recordAccess(bucket, key string) {
+	if s := cs.admission.Load(); s != nil {
+		s.increment(bucket, key)
+	}
+}
+
+// admitLocked reports whether item may be stored under TinyLFU admission: it
+// is already cached, fits without evicting, or is estimated to be accessed
+// more often than each entry, from the LRU end, that would be evicted to make
+// room for it. cs.mu must be held.
+func (cs *CacheSystem) admitLocked(bucket string, item BulkItem) bool {
+	s := cs.admission.Load()
+	if s == nil || cs.maxSize <= 0 {
+		return true
+	}
+	if _, ok := cs.items[[2]string{bucket, item.Key}]; ok {
+		return true
+	}
+	need := cs.currentSize + int64(len(bucket)+len(item.Key)+len(item.Value)) - cs.maxSize
+	if need <= 0 {
+		return true
+	}
+	freq := s.estimate(bucket, item.Key)
+	for e := cs.entries.Back(); e != nil && need > 0; e = e.Prev() {
+		victim := e.Value.(*CacheEntry)
+		if !cs.isStale(victim) && s.estimate(victim.Bucket, victim.Key) >= freq {
+			s.rejects.Add(1)
+			return false
+		}
+		need -= int64(victim.Size)
+	}
+	return true
+}
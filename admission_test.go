@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	s := newFrequencySketch(0)
+	for i := 0; i < 5; i++ {
+		s.increment("b", "hot")
+	}
+	s.increment("b", "warm")
+	if got := s.estimate("b", "hot"); got != 5 {
+		t.Fatalf("estimate(hot) = %d, want 5", got)
+	}
+	if got := s.estimate("b", "warm"); got != 1 {
+		t.Fatalf("estimate(warm) = %d, want 1", got)
+	}
+	if got := s.estimate("other", "hot"); got != 0 {
+		t.Fatalf("expected buckets to be counted apart, got %d", got)
+	}
+	for i := 0; i < 20; i++ {
+		s.increment("b", "hot")
+	}
+	if got := s.estimate("b", "hot"); got != 15 {
+		t.Fatalf("expected counters to saturate at 15, got %d", got)
+	}
+	s.age()
+	if got := s.estimate("b", "hot"); got != 7 {
+		t.Fatalf("expected aging to halve counts, got %d", got)
+	}
+}
+
+func TestCacheSystem_TinyLFU(t *testing.T) {
+	run := func(tinyLFU bool) (hot int, cache *CacheSystem) {
+		// Room for ten 20-byte entries
+		cache = NewCacheSystem(20, 200, 60, 999999)
+		cache.SetTinyLFU(tinyLFU)
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("hot%02d", i)
+			cache.Set("b", key, "0123456789abcd")
+			for j := 0; j < 3; j++ {
+				cache.Get("b", key)
+			}
+		}
+		for i := 0; i < 100; i++ {
+			cache.Set("b", fmt.Sprintf("one%02d", i), "0123456789abcd")
+		}
+		for i := 0; i < 10; i++ {
+			if _, found, _ := cache.Peek("b", fmt.Sprintf("hot%02d", i)); found {
+				hot++
+			}
+		}
+		return hot, cache
+	}
+
+	hot, cache := run(false)
+	cache.Stop()
+	if hot != 0 {
+		t.Fatalf("expected plain LRU to let the scan flush the hot keys, %d survived", hot)
+	}
+
+	hot, cache = run(true)
+	defer cache.Stop()
+	if hot != 10 {
+		t.Fatalf("expected TinyLFU to keep all hot keys, %d survived", hot)
+	}
+	if got := cache.AdmissionRejects(); got != 100 {
+		t.Fatalf("expected 100 rejected one-off keys, got %d", got)
+	}
+
+	// Overwrites are always admitted
+	cache.Set("b", "hot00", "abcdefghijklmn")
+	if got := cache.Get("b", "hot00"); got != "abcdefghijklmn" {
+		t.Fatalf("expected an overwrite to be stored, got %q", got)
+	}
+	// and a key that keeps being asked for eventually gets in
+	for i := 0; i < 6; i++ {
+		cache.Get("b", "persistent")
+	}
+	cache.Set("b", "persistent", "0123456789")
+	if _, found, _ := cache.Peek("b", "persistent"); !found {
+		t.Fatalf("expected a frequently requested key to be admitted")
+	}
+}
+
+// BenchmarkAdmission compares hit ratios of plain LRU and TinyLFU admission
+// on a cache-aside workload: Zipf-distributed reads over 10k keys, of which
+// the cache holds about 1k, interleaved with scans of keys read only once.
+func BenchmarkAdmission(b *testing.B) {
+	for _, policy := range []string{"lru", "tinylfu"} {
+		b.Run(policy, func(b *testing.B) {
+			cache := NewCacheSystem(1024, 1000*32, 0, 999999)
+			defer cache.Stop()
+			cache.SetTinyLFU(policy == "tinylfu")
+			rng := rand.New(rand.NewSource(1))
+			zipf := rand.NewZipf(rng, 1.1, 1, 9999)
+			value := "0123456789abcdef0123"
+
+			var hits, reads int
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := "k" + strconv.FormatUint(zipf.Uint64(), 10)
+				if i%4 == 3 {
+					key = "scan" + strconv.Itoa(i)
+				}
+				reads++
+				if _, found, _ := cache.Lookup("b", key); found {
+					hits++
+				} else {
+					cache.Set("b", key, value)
+				}
+			}
+			b.ReportMetric(100*float64(hits)/float64(reads), "hit%")
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotBitmap is returned by the bitmap operations when the key holds
+// something other than a bitmap.
+var ErrNotBitmap = errors.New("value is not a bitmap")
+
+// ErrBitOffset is returned for a bit offset outside [0, MaxBitOffset].
+var ErrBitOffset = fmt.Errorf("bit offset must be between 0 and %d", MaxBitOffset)
+
+// ErrInvalidBitOp is returned by BitOp for an unknown operation.
+var ErrInvalidBitOp = errors.New("invalid bit operation")
+
+// MaxBitOffset is the highest bit a bitmap can have, making the largest
+// bitmap 512 MB before encoding.
+const MaxBitOffset = 1<<32 - 1
+
+// bitmapPrefix marks an entry as a bitmap, ahead of its bytes in base64, so
+// the bitmap is readable as an ordinary key.
+const bitmapPrefix = "bitmap:"
+
+// Operations for BitOp.
+const (
+	BitOpAnd = "and"
+	BitOpOr  = "or"
+	BitOpXor = "xor"
+)
+
+// BitmapOptions controls a write of a bitmap. Bitmaps are entries holding
+// bits packed eight to a byte, bit 0 being the highest bit of the first
+// byte, and are as long as their highest bit ever set, rounded up to a
+// byte. Bits past the end read as 0.
+type BitmapOptions struct {
+	WriteOptions
+	// TTL, if set, restarts the bitmap's expiration. Otherwise a new bitmap
+	// gets the default TTL and an existing one keeps its own.
+	TTL time.Duration
+}
+
+// SetBit sets the bit at offset in the bitmap at key to on, creating a
+// missing bitmap and growing a short one, and returns the bit's previous
+// value.
+func (cs *CacheSystem) SetBit(bucket, key string, offset int64, on bool, opts BitmapOptions) (bool, error) {
+	if offset < 0 || offset > MaxBitOffset {
+		return false, ErrBitOffset
+	}
+	if (offset/8+1)*4/3 > cs.entryLimit() {
+		return false, ErrEntryTooLarge
+	}
+	if err := cs.lock(); err != nil {
+		return false, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return false, err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return false, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	b, err := decodeBitmap(entry)
+	if err != nil {
+		return false, err
+	}
+	prev := bitAt(b, offset)
+	if prev == on {
+		// Nothing changed, so don't count a write.
+		return prev, nil
+	}
+	if n := int(offset/8 + 1); n > len(b) {
+		b = append(b, make([]byte, n-len(b))...)
+	}
+	mask := byte(0x80 >> (offset % 8))
+	if on {
+		b[offset/8] |= mask
+	} else {
+		b[offset/8] &^= mask
+	}
+	return prev, cs.rewriteLocked(bucket, key, entry, encodeBitmap(b), opts.TTL, opts.WriteOptions, s)
+}
+
+// GetBit returns the bit at offset in the bitmap at key. found is false if
+// the bitmap is missing. It reads the bitmap like LookupValue but never
+// from the loader.
+func (cs *CacheSystem) GetBit(bucket, key string, offset int64) (on, found bool, err error) {
+	if offset < 0 || offset > MaxBitOffset {
+		return false, false, ErrBitOffset
+	}
+	b, found, err := cs.lookupBitmap(bucket, key)
+	if err != nil || !found {
+		return false, false, err
+	}
+	return bitAt(b, offset), true, nil
+}
+
+// BitCount returns how many bits are set in the bitmap at key, and its
+// length in bits.
+func (cs *CacheSystem) BitCount(bucket, key string) (count, length int64, found bool, err error) {
+	b, found, err := cs.lookupBitmap(bucket, key)
+	if err != nil || !found {
+		return 0, 0, false, err
+	}
+	for _, c := range b {
+		count += int64(bits.OnesCount8(c))
+	}
+	return count, int64(len(b)) * 8, true, nil
+}
+
+// BitOp stores at key the bitwise op (BitOpAnd, BitOpOr or BitOpXor) of the
+// bitmaps at sources, in the same bucket, replacing whatever key held, and
+// returns how many bits the result has set. Missing sources count as all
+// zeros, and shorter ones as padded with zeros. If every source is
+// missing, key is removed.
+func (cs *CacheSystem) BitOp(bucket, key, op string, sources []string, opts BitmapOptions) (int64, error) {
+	if op != BitOpAnd && op != BitOpOr && op != BitOpXor {
+		return 0, fmt.Errorf("%w %q: expected and, or or xor", ErrInvalidBitOp, op)
+	}
+	if err := cs.lock(); err != nil {
+		return 0, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return 0, err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return 0, err
+	}
+
+	var maps [][]byte
+	n := 0
+	for _, src := range sources {
+		b, err := decodeBitmap(cs.liveEntryLocked(bucket, src))
+		if err != nil {
+			return 0, err
+		}
+		maps = append(maps, b)
+		n = max(n, len(b))
+	}
+	entry := cs.liveEntryLocked(bucket, key)
+	if n == 0 {
+		if entry != nil {
+			cs.emit(EventDelete, bucket, key, "")
+			cs.removeElement(cs.items[[2]string{bucket, key}])
+		}
+		return 0, nil
+	}
+	out := make([]byte, n)
+	copy(out, maps[0])
+	for _, b := range maps[1:] {
+		for i := range out {
+			var c byte
+			if i < len(b) {
+				c = b[i]
+			}
+			switch op {
+			case BitOpAnd:
+				out[i] &= c
+			case BitOpOr:
+				out[i] |= c
+			case BitOpXor:
+				out[i] ^= c
+			}
+		}
+	}
+	var count int64
+	for _, c := range out {
+		count += int64(bits.OnesCount8(c))
+	}
+	// Whatever key held is replaced, so it is written afresh.
+	if err := cs.rewriteLocked(bucket, key, nil, encodeBitmap(out), opts.TTL, opts.WriteOptions, s); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (cs *CacheSystem) lookupBitmap(bucket, key string) ([]byte, bool, error) {
+	v, found, err := cs.lookupCachedValue(bucket, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	b, err := decodeBitmap(&CacheEntry{Value: v.Value, Encoding: v.Encoding})
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func bitAt(b []byte, offset int64) bool {
+	return offset/8 < int64(len(b)) && b[offset/8]&(0x80>>(offset%8)) != 0
+}
+
+// decodeBitmap returns the bytes entry holds, which are none for a nil
+// entry.
+func decodeBitmap(entry *CacheEntry) ([]byte, error) {
+	if entry == nil {
+		return nil, nil
+	}
+	s, ok := strings.CutPrefix(entry.Value, bitmapPrefix)
+	if entry.Encoding != "" || !ok {
+		return nil, ErrNotBitmap
+	}
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrNotBitmap
+	}
+	return b, nil
+}
+
+func encodeBitmap(b []byte) string {
+	return bitmapPrefix + base64.RawStdEncoding.EncodeToString(b)
+}
+
+// bitmapRequest is the body of POST /bitmaps/{bucket}/{key}/setbit and
+// .../op.
+type bitmapRequest struct {
+	Offset *int64   `json:"offset"` // setbit
+	Value  *jsonBit `json:"value"`  // setbit
+	Op     string   `json:"op"`     // op: and, or or xor
+	From   []string `json:"from"`   // op, keys in the same bucket
+	TTL    jsonTTL  `json:"ttl"`    // restarts the expiration if set
+}
+
+// jsonBit is a bit in a request body, given as 0 or 1 or as a bool.
+type jsonBit bool
+
+func (b *jsonBit) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "0", "false":
+		*b = false
+	case "1", "true":
+		*b = true
+	default:
+		return fmt.Errorf("invalid bit %s: want 0 or 1", data)
+	}
+	return nil
+}
+
+// serveBitmap handles the bitmap endpoints:
+//
+//	GET    /bitmaps/{bucket}/{key}          => {"count": n, "length": bits}
+//	GET    /bitmaps/{bucket}/{key}?bit=n    => {"bit": n, "value": 0 or 1}
+//	DELETE /bitmaps/{bucket}/{key}          => remove
+//	POST   /bitmaps/{bucket}/{key}/setbit   => {"offset": n, "value": 1, "ttl": ...}
+//	POST   /bitmaps/{bucket}/{key}/op       => {"op": "and", "from": [k...], "ttl": ...}
+//
+// In buckets with HashKeys, the keys are hashed like any other.
+func serveBitmap(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, key, _ := strings.Cut(r.URL.Path[len("/bitmaps/"):], "/")
+	op := ""
+	for _, o := range []string{"setbit", "op"} {
+		if k, ok := strings.CutSuffix(key, "/"+o); ok && k != "" {
+			key, op = k, o
+			break
+		}
+	}
+	if bucket == "" || key == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	cfg := cache.GetBucketConfig(bucket)
+	key, _ = storedKey(cfg, key)
+
+	allowed := []string{http.MethodGet, http.MethodDelete}
+	if op != "" {
+		allowed = []string{http.MethodPost}
+	}
+	if !slices.Contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, allowed...)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var out interface{}
+		var found bool
+		var err error
+		if s := r.URL.Query().Get("bit"); s != "" {
+			offset, perr := strconv.ParseInt(s, 10, 64)
+			if perr != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid bit: %s", s))
+				return
+			}
+			var on bool
+			on, found, err = cache.GetBit(bucket, key, offset)
+			out = map[string]int64{"bit": offset, "value": bitValue(on)}
+		} else {
+			var count, length int64
+			count, length, found, err = cache.BitCount(bucket, key)
+			out = map[string]int64{"count": count, "length": length}
+		}
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	case http.MethodDelete:
+		if _, err := cache.Delete(bucket, key); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req bitmapRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TTL < 0 {
+		writeError(w, http.StatusBadRequest, "ttl must not be negative")
+		return
+	}
+	opts := BitmapOptions{WriteOptions: writeOptions(r), TTL: time.Duration(req.TTL)}
+	if op == "op" {
+		if len(req.From) == 0 {
+			writeError(w, http.StatusBadRequest, "from must not be empty")
+			return
+		}
+		for i, k := range req.From {
+			req.From[i], _ = storedKey(cfg, k)
+		}
+		count, err := cache.BitOp(bucket, key, req.Op, req.From, opts)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int64{"count": count})
+		return
+	}
+	if req.Offset == nil || req.Value == nil {
+		writeError(w, http.StatusBadRequest, "offset and value are required")
+		return
+	}
+	prev, err := cache.SetBit(bucket, key, *req.Offset, bool(*req.Value), opts)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"previous": bitValue(prev)})
+}
+
+func bitValue(on bool) int64 {
+	if on {
+		return 1
+	}
+	return 0
+}
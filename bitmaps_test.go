@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Bitmap(t *testing.T) {
+	cache := NewCacheSystem(256, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	for _, offset := range []int64{0, 7, 100} {
+		if prev, err := cache.SetBit("b", "mon", offset, true, BitmapOptions{TTL: time.Hour}); err != nil || prev {
+			t.Fatalf("SetBit(%d) => %v, %v", offset, prev, err)
+		}
+	}
+	if prev, _ := cache.SetBit("b", "mon", 7, true, BitmapOptions{}); !prev {
+		t.Fatalf("expected the previous bit to be returned")
+	}
+	if got := cache.Get("b", "mon"); !strings.HasPrefix(got, bitmapPrefix+"gQ") {
+		t.Fatalf("expected bit 0 to be the highest bit of the first byte, got %s", got)
+	}
+	if count, length, found, err := cache.BitCount("b", "mon"); err != nil || !found || count != 3 || length != 104 {
+		t.Fatalf("BitCount => %d, %d, %v, %v", count, length, found, err)
+	}
+	for offset, want := range map[int64]bool{0: true, 1: false, 100: true, 5000: false} {
+		if on, found, _ := cache.GetBit("b", "mon", offset); !found || on != want {
+			t.Fatalf("GetBit(%d) => %v, %v", offset, on, found)
+		}
+	}
+	cache.SetBit("b", "mon", 0, false, BitmapOptions{})
+	if on, _, _ := cache.GetBit("b", "mon", 0); on {
+		t.Fatalf("expected the bit to be cleared")
+	}
+	if ttl, _ := cache.TTL("b", "mon"); ttl <= time.Minute {
+		t.Fatalf("expected the bitmap to keep its TTL, got %v", ttl)
+	}
+
+	// Operations pad the shorter bitmaps with zeros
+	cache.SetBit("b", "tue", 7, true, BitmapOptions{})
+	cache.SetBit("b", "tue", 8, true, BitmapOptions{})
+	for op, want := range map[string]int64{BitOpAnd: 1, BitOpOr: 3, BitOpXor: 2} {
+		if count, err := cache.BitOp("b", "out", op, []string{"mon", "tue"}, BitmapOptions{}); err != nil || count != want {
+			t.Fatalf("BitOp %s => %d, %v, want %d", op, count, err, want)
+		}
+	}
+	if count, _ := cache.BitOp("b", "out", BitOpAnd, []string{"mon", "none"}, BitmapOptions{}); count != 0 {
+		t.Fatalf("expected a missing source to count as zeros, got %d", count)
+	}
+	if _, err := cache.BitOp("b", "out", BitOpOr, []string{"none"}, BitmapOptions{}); err != nil {
+		t.Fatalf("BitOp => %v", err)
+	}
+	if _, _, found, _ := cache.BitCount("b", "out"); found {
+		t.Fatalf("expected an operation on only missing sources to remove the key")
+	}
+
+	cache.Set("b", "word", "hello")
+	if _, err := cache.SetBit("b", "word", 1, true, BitmapOptions{}); !errors.Is(err, ErrNotBitmap) {
+		t.Fatalf("expected ErrNotBitmap, got %v", err)
+	}
+	if _, err := cache.BitOp("b", "out", BitOpOr, []string{"word"}, BitmapOptions{}); !errors.Is(err, ErrNotBitmap) {
+		t.Fatalf("expected ErrNotBitmap for a source, got %v", err)
+	}
+	if _, err := cache.BitOp("b", "out", "nand", []string{"mon"}, BitmapOptions{}); !errors.Is(err, ErrInvalidBitOp) {
+		t.Fatalf("expected ErrInvalidBitOp, got %v", err)
+	}
+	for _, c := range []struct {
+		offset int64
+		err    error
+	}{
+		{-1, ErrBitOffset},
+		{MaxBitOffset + 1, ErrBitOffset},
+		{8 * 256, ErrEntryTooLarge},
+	} {
+		if _, err := cache.SetBit("b", "mon", c.offset, true, BitmapOptions{}); !errors.Is(err, c.err) {
+			t.Fatalf("SetBit(%d): expected %v, got %v", c.offset, c.err, err)
+		}
+	}
+}
+
+func TestHTTP_Bitmaps(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	if resp, out := httpJSON(t, "POST", server.URL+"/bitmaps/b/mon/setbit", `{"offset":5,"value":true,"ttl":"1h"}`); resp.StatusCode != http.StatusOK || out["previous"] != 0.0 {
+		t.Fatalf("expected setbit to create the bitmap, got %d %v", resp.StatusCode, out)
+	}
+	httpJSON(t, "POST", server.URL+"/bitmaps/b/tue/setbit", `{"offset":6,"value":1}`)
+	if resp, out := httpJSON(t, "POST", server.URL+"/bitmaps/b/any/op", `{"op":"or","from":["mon","tue"]}`); resp.StatusCode != http.StatusOK || out["count"] != 2.0 {
+		t.Fatalf("expected op to return the bits set, got %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "GET", server.URL+"/bitmaps/b/any?bit=6", ""); resp.StatusCode != http.StatusOK || out["value"] != 1.0 {
+		t.Fatalf("unexpected GET ?bit= %d %v", resp.StatusCode, out)
+	}
+
+	cache.Set("b", "word", "hello")
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/bitmaps/b/any", "", http.StatusOK},
+		{"POST", "/bitmaps/b/word/setbit", `{"offset":1,"value":1}`, http.StatusConflict},
+		{"GET", "/bitmaps/b/word", "", http.StatusConflict},
+		{"POST", "/bitmaps/b/mon/setbit", `{"offset":1}`, http.StatusBadRequest},
+		{"POST", "/bitmaps/b/mon/setbit", `{"offset":-1,"value":1}`, http.StatusBadRequest},
+		{"POST", "/bitmaps/b/mon/setbit", `{"offset":100000,"value":1}`, http.StatusRequestEntityTooLarge},
+		{"POST", "/bitmaps/b/mon/op", `{"op":"nand","from":["tue"]}`, http.StatusBadRequest},
+		{"POST", "/bitmaps/b/mon/op", `{"op":"and"}`, http.StatusBadRequest},
+		{"GET", "/bitmaps/b/mon?bit=x", "", http.StatusBadRequest},
+		{"PUT", "/bitmaps/b/mon", "", http.StatusMethodNotAllowed},
+		{"GET", "/bitmaps/b/mon/op", "", http.StatusMethodNotAllowed},
+		{"GET", "/bitmaps/b", "", http.StatusNotFound},
+		{"DELETE", "/bitmaps/b/mon", "", http.StatusOK},
+		{"GET", "/bitmaps/b/mon?bit=5", "", http.StatusNotFound},
+	} {
+		if resp, _ := httpJSON(t, c.method, server.URL+c.path, c.body); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotBloom is returned by the Bloom filter operations when the key holds
+// something other than a Bloom filter.
+var ErrNotBloom = errors.New("value is not a Bloom filter")
+
+// ErrInvalidBloom is returned for a Bloom filter sized with a capacity that
+// isn't positive or an error rate outside (0, 1).
+var ErrInvalidBloom = errors.New("capacity must be positive and error_rate between 0 and 1")
+
+// Sizing of a Bloom filter created by its first add.
+const (
+	DefaultBloomCapacity  = 1000
+	DefaultBloomErrorRate = 0.01
+)
+
+// bloomPrefix marks an entry as a Bloom filter, ahead of its sizing and its
+// bits in base64, so the filter is readable as an ordinary key.
+const bloomPrefix = "bloom:"
+
+// BloomOptions controls a write of a Bloom filter. Bloom filters are entries
+// holding a fixed-size bit array, sized when the filter is created to keep
+// the false positive rate at ErrorRate for up to Capacity items.
+type BloomOptions struct {
+	WriteOptions
+	// TTL, if set, restarts the filter's expiration. Otherwise a new filter
+	// gets the default TTL and an existing one keeps its own.
+	TTL time.Duration
+}
+
+// BloomInfo describes a Bloom filter.
+type BloomInfo struct {
+	Capacity  int     `json:"capacity"`
+	ErrorRate float64 `json:"error_rate"`
+	Hashes    int     `json:"hashes"` // bits set per item
+	Bits      int     `json:"bits"`
+}
+
+// bloomFilter is a decoded Bloom filter.
+type bloomFilter struct {
+	BloomInfo
+	bits []byte
+}
+
+// newBloomFilter sizes an empty filter for capacity items at errorRate. It
+// fails with ErrEntryTooLarge, before allocating, if the filter would take
+// more than limit bytes encoded.
+func newBloomFilter(capacity int, errorRate float64, limit int64) (*bloomFilter, error) {
+	if capacity <= 0 || !(errorRate > 0 && errorRate < 1) {
+		return nil, ErrInvalidBloom
+	}
+	m := math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+	// Base64 takes 4 bytes for every 3; a filter of 2 GiB is plenty anyway.
+	if m/8*4/3 > float64(limit) || m/8 > math.MaxInt32 {
+		return nil, ErrEntryTooLarge
+	}
+	n := int(m+7) / 8
+	return &bloomFilter{
+		BloomInfo: BloomInfo{
+			Capacity:  capacity,
+			ErrorRate: errorRate,
+			Hashes:    max(1, int(math.Round(m/float64(capacity)*math.Ln2))),
+			Bits:      n * 8,
+		},
+		bits: make([]byte, n),
+	}, nil
+}
+
+// positions calls f with each bit item maps to, by double hashing.
+func (f *bloomFilter) positions(item string, fn func(i uint64)) {
+	h1 := itemHash(item)
+	h2 := mix64(h1) | 1
+	for k := uint64(0); k < uint64(f.Hashes); k++ {
+		fn((h1 + k*h2) % uint64(f.Bits))
+	}
+}
+
+// add sets item's bits and reports whether any of them was clear, that is
+// whether item was certainly not in the filter before.
+func (f *bloomFilter) add(item string) bool {
+	added := false
+	f.positions(item, func(i uint64) {
+		if f.bits[i/8]&(1<<(i%8)) == 0 {
+			f.bits[i/8] |= 1 << (i % 8)
+			added = true
+		}
+	})
+	return added
+}
+
+// mightContain reports whether item may have been added: false is certain,
+// true is wrong at about the filter's error rate while it is within its
+// capacity.
+func (f *bloomFilter) mightContain(item string) bool {
+	in := true
+	f.positions(item, func(i uint64) {
+		in = in && f.bits[i/8]&(1<<(i%8)) != 0
+	})
+	return in
+}
+
+func (f *bloomFilter) encode() string {
+	return bloomPrefix + strconv.Itoa(f.Capacity) + ":" + strconv.FormatFloat(f.ErrorRate, 'g', -1, 64) + ":" +
+		strconv.Itoa(f.Hashes) + ":" + base64.RawStdEncoding.EncodeToString(f.bits)
+}
+
+// decodeBloom returns the filter entry holds, or nil for a nil entry.
+func decodeBloom(entry *CacheEntry) (*bloomFilter, error) {
+	if entry == nil {
+		return nil, nil
+	}
+	s, ok := strings.CutPrefix(entry.Value, bloomPrefix)
+	parts := strings.SplitN(s, ":", 4)
+	if entry.Encoding != "" || !ok || len(parts) != 4 {
+		return nil, ErrNotBloom
+	}
+	f := &bloomFilter{}
+	var err1, err2, err3, err4 error
+	f.Capacity, err1 = strconv.Atoi(parts[0])
+	f.ErrorRate, err2 = strconv.ParseFloat(parts[1], 64)
+	f.Hashes, err3 = strconv.Atoi(parts[2])
+	f.bits, err4 = base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || f.Hashes <= 0 || len(f.bits) == 0 {
+		return nil, ErrNotBloom
+	}
+	f.Bits = len(f.bits) * 8
+	return f, nil
+}
+
+// entryLimit is the most bytes a single value may take.
+func (cs *CacheSystem) entryLimit() int64 {
+	return min(cs.maxEntrySize, cs.maxSize)
+}
+
+// CreateBloom stores an empty Bloom filter at key, sized for capacity items
+// at errorRate, replacing any value the key held.
+func (cs *CacheSystem) CreateBloom(bucket, key string, capacity int, errorRate float64, opts BloomOptions) (BloomInfo, error) {
+	f, err := newBloomFilter(capacity, errorRate, cs.entryLimit())
+	if err != nil {
+		return BloomInfo{}, err
+	}
+	if err := cs.lock(); err != nil {
+		return BloomInfo{}, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return BloomInfo{}, err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return BloomInfo{}, err
+	}
+	if err := cs.rewriteLocked(bucket, key, nil, f.encode(), opts.TTL, opts.WriteOptions, s); err != nil {
+		return BloomInfo{}, err
+	}
+	return f.BloomInfo, nil
+}
+
+// AddBloom adds items to the Bloom filter at key, creating a missing one
+// with DefaultBloomCapacity and DefaultBloomErrorRate, and returns how many
+// of them were certainly not in it before.
+func (cs *CacheSystem) AddBloom(bucket, key string, items []string, opts BloomOptions) (int, error) {
+	if err := cs.lock(); err != nil {
+		return 0, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return 0, err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	f, err := decodeBloom(entry)
+	if err != nil {
+		return 0, err
+	}
+	if f == nil {
+		if f, err = newBloomFilter(DefaultBloomCapacity, DefaultBloomErrorRate, cs.entryLimit()); err != nil {
+			return 0, err
+		}
+	}
+	added := 0
+	for _, item := range items {
+		if f.add(item) {
+			added++
+		}
+	}
+	if added == 0 && entry != nil {
+		// Nothing changed, so don't count a write.
+		return 0, nil
+	}
+	if err := cs.rewriteLocked(bucket, key, entry, f.encode(), opts.TTL, opts.WriteOptions, s); err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// BloomContains reports, for each of items, whether it may have been added
+// to the Bloom filter at key, along with the filter's sizing. It reads the
+// filter like LookupValue but never from the loader.
+func (cs *CacheSystem) BloomContains(bucket, key string, items []string) ([]bool, BloomInfo, bool, error) {
+	v, found, err := cs.lookupCachedValue(bucket, key)
+	if err != nil || !found {
+		return nil, BloomInfo{}, false, err
+	}
+	f, err := decodeBloom(&CacheEntry{Value: v.Value, Encoding: v.Encoding})
+	if err != nil {
+		return nil, BloomInfo{}, false, err
+	}
+	in := make([]bool, len(items))
+	for i, item := range items {
+		in[i] = f.mightContain(item)
+	}
+	return in, f.BloomInfo, true, nil
+}
+
+// bloomRequest is the body of PUT /blooms/{bucket}/{key} and POST .../add.
+type bloomRequest struct {
+	Capacity  int      `json:"capacity"`   // PUT
+	ErrorRate float64  `json:"error_rate"` // PUT
+	Items     []string `json:"items"`      // add
+	TTL       jsonTTL  `json:"ttl"`        // restarts the expiration if set
+}
+
+// serveBloom handles the Bloom filter endpoints:
+//
+//	GET    /blooms/{bucket}/{key}?item=a...  => {"items": {"a": true, ...}}
+//	GET    /blooms/{bucket}/{key}            => the filter's sizing
+//	PUT    /blooms/{bucket}/{key}            => create empty, {"capacity": n, "error_rate": p, "ttl": ...}
+//	DELETE /blooms/{bucket}/{key}            => remove
+//	POST   /blooms/{bucket}/{key}/add        => {"items": [...], "ttl": ...}
+//
+// In buckets with HashKeys, the key is hashed like any other.
+func serveBloom(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, key, _ := strings.Cut(r.URL.Path[len("/blooms/"):], "/")
+	add := false
+	if k, ok := strings.CutSuffix(key, "/add"); ok && k != "" {
+		key, add = k, true
+	}
+	if bucket == "" || key == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	key, _ = storedKey(cache.GetBucketConfig(bucket), key)
+
+	allowed := []string{http.MethodGet, http.MethodPut, http.MethodDelete}
+	if add {
+		allowed = []string{http.MethodPost}
+	}
+	if !slices.Contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, allowed...)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		items := r.URL.Query()["item"]
+		in, info, found, err := cache.BloomContains(bucket, key, items)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if len(items) == 0 {
+			_ = json.NewEncoder(w).Encode(info)
+			return
+		}
+		out := make(map[string]bool, len(items))
+		for i, item := range items {
+			out[item] = in[i]
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"items": out})
+		return
+	case http.MethodDelete:
+		if _, err := cache.Delete(bucket, key); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req bloomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TTL < 0 {
+		writeError(w, http.StatusBadRequest, "ttl must not be negative")
+		return
+	}
+	opts := BloomOptions{WriteOptions: writeOptions(r), TTL: time.Duration(req.TTL)}
+	if !add {
+		info, err := cache.CreateBloom(bucket, key, req.Capacity, req.ErrorRate, opts)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(info)
+		return
+	}
+	if len(req.Items) == 0 {
+		writeError(w, http.StatusBadRequest, "items must not be empty")
+		return
+	}
+	added, err := cache.AddBloom(bucket, key, req.Items, opts)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"added": added})
+}
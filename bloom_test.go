@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Bloom(t *testing.T) {
+	cache := NewCacheSystem(16384, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	info, err := cache.CreateBloom("b", "users", 5000, 0.01, BloomOptions{TTL: time.Hour})
+	if err != nil || info.Hashes != 7 || info.Bits < 47_000 {
+		t.Fatalf("CreateBloom => %+v, %v", info, err)
+	}
+	items := make([]string, 5000)
+	for i := range items {
+		items[i] = "user-" + strconv.Itoa(i)
+	}
+	if added, err := cache.AddBloom("b", "users", items, BloomOptions{}); err != nil || added < 4990 {
+		t.Fatalf("AddBloom => %d, %v", added, err)
+	}
+	if added, _ := cache.AddBloom("b", "users", items[:10], BloomOptions{}); added != 0 {
+		t.Fatalf("expected items already added not to count, got %d", added)
+	}
+
+	// No false negatives, and false positives near the error rate
+	in, _, found, err := cache.BloomContains("b", "users", items)
+	if err != nil || !found {
+		t.Fatalf("BloomContains => %v, %v", found, err)
+	}
+	for i, ok := range in {
+		if !ok {
+			t.Fatalf("expected %s to be in the filter", items[i])
+		}
+	}
+	others := make([]string, 10_000)
+	for i := range others {
+		others[i] = "other-" + strconv.Itoa(i)
+	}
+	in, _, _, _ = cache.BloomContains("b", "users", others)
+	positives := 0
+	for _, ok := range in {
+		if ok {
+			positives++
+		}
+	}
+	if positives > 200 {
+		t.Fatalf("expected about 1%% false positives, got %d in %d", positives, len(others))
+	}
+	if ttl, _ := cache.TTL("b", "users"); ttl <= time.Minute {
+		t.Fatalf("expected the filter to keep its TTL, got %v", ttl)
+	}
+
+	// A first add creates a filter with the default sizing
+	cache.AddBloom("b", "new", []string{"a"}, BloomOptions{})
+	if _, info, _, _ := cache.BloomContains("b", "new", nil); info.Capacity != DefaultBloomCapacity || info.ErrorRate != DefaultBloomErrorRate {
+		t.Fatalf("expected the default sizing, got %+v", info)
+	}
+
+	for _, c := range []struct {
+		capacity int
+		rate     float64
+		err      error
+	}{
+		{0, 0.01, ErrInvalidBloom},
+		{100, 0, ErrInvalidBloom},
+		{100, 1, ErrInvalidBloom},
+		{1_000_000, 0.01, ErrEntryTooLarge},
+		{1 << 62, 1e-300, ErrEntryTooLarge},
+	} {
+		if _, err := cache.CreateBloom("b", "bad", c.capacity, c.rate, BloomOptions{}); !errors.Is(err, c.err) {
+			t.Fatalf("CreateBloom(%d, %g): expected %v, got %v", c.capacity, c.rate, c.err, err)
+		}
+	}
+
+	cache.Set("b", "word", "hello")
+	cache.Set("b", "fake", bloomPrefix+"10:0.1:x:AAAA")
+	for _, key := range []string{"word", "fake"} {
+		if _, err := cache.AddBloom("b", key, []string{"a"}, BloomOptions{}); !errors.Is(err, ErrNotBloom) {
+			t.Fatalf("%s: expected ErrNotBloom, got %v", key, err)
+		}
+	}
+	if _, err := cache.CreateBloom("b", "word", 10, 0.1, BloomOptions{}); err != nil {
+		t.Fatalf("expected CreateBloom to replace any value, got %v", err)
+	}
+}
+
+func TestHTTP_Blooms(t *testing.T) {
+	cache := NewCacheSystem(4096, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	if resp, out := httpJSON(t, "PUT", server.URL+"/blooms/b/f", `{"capacity":100,"error_rate":0.01,"ttl":"1h"}`); resp.StatusCode != http.StatusOK || out["hashes"] != 7.0 {
+		t.Fatalf("expected PUT to create the filter, got %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "POST", server.URL+"/blooms/b/f/add", `{"items":["ada","bob"]}`); resp.StatusCode != http.StatusOK || out["added"] != 2.0 {
+		t.Fatalf("expected add to count new items, got %d %v", resp.StatusCode, out)
+	}
+	resp, out := httpJSON(t, "GET", server.URL+"/blooms/b/f?item=ada&item=cy", "")
+	if items, _ := out["items"].(map[string]interface{}); resp.StatusCode != http.StatusOK || items["ada"] != true || items["cy"] != false {
+		t.Fatalf("unexpected GET ?item= %d %v", resp.StatusCode, out)
+	}
+
+	cache.Set("b", "word", "hello")
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/blooms/b/f", "", http.StatusOK},
+		{"POST", "/blooms/b/word/add", `{"items":["a"]}`, http.StatusConflict},
+		{"GET", "/blooms/b/word?item=a", "", http.StatusConflict},
+		{"PUT", "/blooms/b/f", `{"capacity":0,"error_rate":0.01}`, http.StatusBadRequest},
+		{"PUT", "/blooms/b/big", `{"capacity":100000,"error_rate":0.01}`, http.StatusRequestEntityTooLarge},
+		{"POST", "/blooms/b/f/add", `{"items":[]}`, http.StatusBadRequest},
+		{"POST", "/blooms/b/f/add", `{"items":["a"],"ttl":-1}`, http.StatusBadRequest},
+		{"PATCH", "/blooms/b/f", "", http.StatusMethodNotAllowed},
+		{"GET", "/blooms/b/f/add", "", http.StatusMethodNotAllowed},
+		{"GET", "/blooms/b", "", http.StatusNotFound},
+		{"GET", "/blooms/b/none?item=a", "", http.StatusNotFound},
+		{"DELETE", "/blooms/b/f", "", http.StatusOK},
+		{"GET", "/blooms/b/f", "", http.StatusNotFound},
+	} {
+		if resp, _ := httpJSON(t, c.method, server.URL+c.path, c.body); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+}
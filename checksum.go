@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+)
+
+// ErrChecksumMismatch is returned by reads, under ChecksumsFail, of a value
+// that no longer matches the checksum taken when it was written.
+var ErrChecksumMismatch = errors.New("value does not match its checksum")
+
+// What a read does about a value that fails its checksum.
+const (
+	ChecksumsOff   = "off"   // take no checksums
+	ChecksumsCount = "count" // count the failure and serve the value
+	ChecksumsLog   = "log"   // also log it
+	ChecksumsFail  = "fail"  // also fail the read and drop the entry, so the next read misses
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// SetChecksums makes every write store a CRC-32C of the value and every read
+// verify it, to catch memory corruption in long-lived processes; mode says
+// what a mismatch does. Entries written while checksums were off aren't
+// verified.
+func (cs *CacheSystem) SetChecksums(mode string) error {
+	switch mode {
+	case ChecksumsOff, ChecksumsCount, ChecksumsLog, ChecksumsFail:
+	default:
+		return fmt.Errorf("unknown checksum mode %q (want %s, %s, %s or %s)", mode, ChecksumsOff, ChecksumsCount, ChecksumsLog, ChecksumsFail)
+	}
+	cs.mu.Lock()
+	defer cs.unlock()
+	cs.checksums = mode
+	return nil
+}
+
+// ChecksumFailures returns how many reads found a value that didn't match
+// its checksum.
+func (cs *CacheSystem) ChecksumFailures() int64 {
+	return cs.checksumFailures.Load()
+}
+
+// sumLocked records the checksum of entry's value, if checksums are on.
+// cs.mu must be held for writing.
+func (cs *CacheSystem) sumLocked(entry *CacheEntry) {
+	if cs.checksums == "" || cs.checksums == ChecksumsOff {
+		entry.summed = false
+		return
+	}
+	entry.sum = crc32.Checksum([]byte(entry.Value), castagnoli)
+	entry.summed = true
+}
+
+// verifyLocked checks entry's value against its checksum for a read,
+// returning ErrChecksumMismatch if it fails and the read should too. The
+// caller drops the entry if it can. cs.mu must be held.
+func (cs *CacheSystem) verifyLocked(entry *CacheEntry) error {
+	if !entry.summed || cs.checksums == "" || cs.checksums == ChecksumsOff {
+		return nil
+	}
+	if crc32.Checksum([]byte(entry.Value), castagnoli) == entry.sum {
+		return nil
+	}
+	cs.checksumFailures.Add(1)
+	if cs.checksums != ChecksumsCount {
+		log.Printf("checksum: %s/%s (version %d, %d bytes) does not match the checksum it was written with", entry.Bucket, entry.Key, entry.Version, len(entry.Value))
+	}
+	if cs.checksums == ChecksumsFail {
+		return fmt.Errorf("%w: %s/%s", ErrChecksumMismatch, entry.Bucket, entry.Key)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// corrupt flips a byte of bucket/key's value in place, as bad memory would.
+func corrupt(t *testing.T, cache *CacheSystem, bucket, key string) {
+	t.Helper()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem, ok := cache.items[[2]string{bucket, key}]
+	if !ok {
+		t.Fatalf("no entry %s/%s to corrupt", bucket, key)
+	}
+	entry := elem.Value.(*CacheEntry)
+	b := []byte(entry.Value)
+	b[0] ^= 0x20
+	entry.Value = string(b)
+}
+
+func TestCacheSystem_Checksums(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	if err := cache.SetChecksums("sometimes"); err == nil {
+		t.Fatalf("expected an unknown mode to be rejected")
+	}
+
+	// Written before checksums were on, so never checked
+	cache.Set("b", "old", "value")
+	corrupt(t, cache, "b", "old")
+	cache.SetChecksums(ChecksumsCount)
+	if _, found, err := cache.Lookup("b", "old"); !found || err != nil || cache.ChecksumFailures() != 0 {
+		t.Fatalf("expected an unsummed entry to be served unchecked, got %v, %v, %d", found, err, cache.ChecksumFailures())
+	}
+
+	// Intact values pass, however they were written
+	cache.Set("b", "k", "value")
+	cache.Append("b", "k", "!")
+	cache.IncrBy("b", "n", 5)
+	for key, want := range map[string]string{"k": "value!", "n": "5"} {
+		if got, _, err := cache.Lookup("b", key); got != want || err != nil {
+			t.Fatalf("expected %s=%q, got %q, %v", key, want, got, err)
+		}
+	}
+	if cache.ChecksumFailures() != 0 {
+		t.Fatalf("expected no failures, got %d", cache.ChecksumFailures())
+	}
+
+	// count and log serve the corrupted value
+	corrupt(t, cache, "b", "k")
+	if got, found, err := cache.Lookup("b", "k"); !found || err != nil || got != "Value!" {
+		t.Fatalf("expected the value to be served, got %q, %v, %v", got, found, err)
+	}
+	cache.SetChecksums(ChecksumsLog)
+	if _, found, _ := cache.Peek("b", "k"); !found || cache.ChecksumFailures() != 2 {
+		t.Fatalf("expected each read to count, got %d", cache.ChecksumFailures())
+	}
+
+	// fail fails the read and drops the entry
+	cache.SetChecksums(ChecksumsFail)
+	if _, _, err := cache.Peek("b", "k"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch from Peek, got %v", err)
+	}
+	if _, _, err := cache.Lookup("b", "k"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if _, found, err := cache.Lookup("b", "k"); found || err != nil {
+		t.Fatalf("expected the entry to be dropped, got %v, %v", found, err)
+	}
+
+	cache.Set("b", "once", "token")
+	corrupt(t, cache, "b", "once")
+	if _, _, _, err := cache.GetDel("b", "once"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch from GetDel, got %v", err)
+	}
+
+	cache.Set("b", "m1", "one")
+	cache.Set("b", "m2", "two")
+	corrupt(t, cache, "b", "m2")
+	results, err := cache.MGet([]KeyRef{{Bucket: "b", Key: "m1"}, {Bucket: "b", Key: "m2"}})
+	if err != nil || !results[0].Found || !errors.Is(results[1].Err, ErrChecksumMismatch) {
+		t.Fatalf("expected only the corrupted key to fail, got %+v, %v", results, err)
+	}
+	if st := cache.CacheStats(); st.ChecksumFailures != 6 {
+		t.Fatalf("expected 6 failures in stats, got %d", st.ChecksumFailures)
+	}
+}
+
+func TestCacheSystem_ChecksumFailureKeepsStore(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.SetChecksums(ChecksumsFail)
+	store := &memoryStore{values: make(map[string]string)}
+	if err := cache.SetStore(store, StoreOptions{Mode: StoreWriteThrough}); err != nil {
+		t.Fatalf("SetStore => %v", err)
+	}
+
+	cache.Set("b", "k", "value")
+	cache.Set("b", "once", "token")
+	corrupt(t, cache, "b", "k")
+	corrupt(t, cache, "b", "once")
+	if _, _, err := cache.Lookup("b", "k"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if _, _, _, err := cache.GetDel("b", "once"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch from GetDel, got %v", err)
+	}
+	if _, found, _ := cache.Lookup("b", "k"); found {
+		t.Fatalf("expected the corrupted entry to be dropped from the cache")
+	}
+
+	// Only the cached copies were bad, so the store keeps both
+	ops, values := store.snapshot()
+	if got := strings.Join(ops, ","); got != "put b/k,put b/once" {
+		t.Fatalf("expected no deletes to reach the store, got %s", got)
+	}
+	if values["b/k"] != "value" || values["b/once"] != "token" {
+		t.Fatalf("expected the stored values to survive, got %v", values)
+	}
+}
+
+func TestHTTP_ChecksumFailure(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.SetChecksums(ChecksumsFail)
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	resp, err := httpPut(server.URL+"/buckets/b/k", "application/json", strings.NewReader(`{"value":"hello"}`))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	corrupt(t, cache, "b", "k")
+
+	resp, err = http.Get(server.URL + "/buckets/b/k")
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", resp.StatusCode)
+	}
+	if _, found, _ := cache.Lookup("b", "k"); found {
+		t.Fatalf("expected the corrupted entry to be dropped")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Codec validates the values of a bucket. A bucket that names a codec in
+// BucketConfig.Codec exchanges raw values typed with the codec's content
+// type instead of the JSON envelope, and every value written to it, through
+// any endpoint, must pass Validate. A Codec never transforms values: they
+// are stored and served exactly as sent. Builds add their own with
+// RegisterCodec.
+type Codec interface {
+	// ContentType is the media type values are sent and served with.
+	ContentType() string
+	// Validate returns an error if value is not well-formed.
+	Validate(value string) error
+}
+
+// codec is a Codec made of a content type and an optional validator.
+type codec struct {
+	contentType string
+	validate    func(value string) error
+}
+
+// NewCodec returns a Codec for contentType that checks values with validate,
+// or accepts any value if validate is nil.
+func NewCodec(contentType string, validate func(value string) error) Codec {
+	return codec{contentType: contentType, validate: validate}
+}
+
+func (c codec) ContentType() string { return c.contentType }
+
+func (c codec) Validate(value string) error {
+	if c.validate == nil {
+		return nil
+	}
+	return c.validate(value)
+}
+
+// validates reports whether c looks at values at all, so that compressed
+// values are only inflated when something will check them.
+func validates(c Codec) bool {
+	if c, ok := c.(codec); ok {
+		return c.validate != nil
+	}
+	return true
+}
+
+var (
+	codecsMu sync.RWMutex
+	// codecs maps a codec name (as used in BucketConfig.Codec) to its definition.
+	codecs = map[string]Codec{
+		"raw":      codec{contentType: "application/octet-stream"},
+		"json":     codec{contentType: "application/json", validate: validateJSON},
+		"msgpack":  codec{contentType: "application/msgpack", validate: validateMsgpack},
+		"protobuf": codec{contentType: "application/x-protobuf", validate: validateProtobuf},
+	}
+)
+
+// RegisterCodec makes c available to bucket configs under name. It panics if
+// name is empty or already taken, so it is best called from an init function.
+func RegisterCodec(name string, c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if name == "" || c == nil {
+		panic("kitsune: RegisterCodec needs a name and a codec")
+	}
+	if _, dup := codecs[name]; dup {
+		panic("kitsune: RegisterCodec called twice for codec " + name)
+	}
+	codecs[name] = c
+}
+
+// lookupCodec returns the codec registered under name.
+func lookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// mediaType strips any parameters from a Content-Type header value.
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+func validateJSON(value string) error {
+	if !json.Valid([]byte(value)) {
+		return errors.New("value is not valid JSON")
+	}
+	return nil
+}
+
+// validateMsgpack checks that value holds exactly one well-formed MessagePack object.
+func validateMsgpack(value string) error {
+	rest, err := skipMsgpack([]byte(value), 0)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errors.New("trailing bytes after MessagePack object")
+	}
+	return nil
+}
+
+var errMsgpackTruncated = errors.New("truncated MessagePack object")
+
+// skipMsgpack consumes one MessagePack object from b and returns the remainder.
+func skipMsgpack(b []byte, depth int) ([]byte, error) {
+	if depth > 256 {
+		return nil, errors.New("MessagePack object nested too deeply")
+	}
+	if len(b) == 0 {
+		return nil, errMsgpackTruncated
+	}
+	t := b[0]
+	b = b[1:]
+
+	// take consumes n bytes, or fails if fewer remain.
+	take := func(n uint64) ([]byte, error) {
+		if uint64(len(b)) < n {
+			return nil, errMsgpackTruncated
+		}
+		return b[n:], nil
+	}
+	// length reads an n-byte big-endian length prefix.
+	length := func(n int) (uint64, []byte, error) {
+		if len(b) < n {
+			return 0, nil, errMsgpackTruncated
+		}
+		var l uint64
+		switch n {
+		case 1:
+			l = uint64(b[0])
+		case 2:
+			l = uint64(binary.BigEndian.Uint16(b))
+		case 4:
+			l = uint64(binary.BigEndian.Uint32(b))
+		}
+		return l, b[n:], nil
+	}
+	// elements skips count nested objects.
+	elements := func(rest []byte, count uint64) ([]byte, error) {
+		var err error
+		for i := uint64(0); i < count; i++ {
+			if rest, err = skipMsgpack(rest, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+	}
+
+	switch {
+	case t <= 0x7f, t >= 0xe0, t == 0xc0, t == 0xc2, t == 0xc3:
+		return b, nil
+	case t >= 0x80 && t <= 0x8f:
+		return elements(b, 2*uint64(t&0x0f))
+	case t >= 0x90 && t <= 0x9f:
+		return elements(b, uint64(t&0x0f))
+	case t >= 0xa0 && t <= 0xbf:
+		return take(uint64(t & 0x1f))
+	}
+
+	switch t {
+	case 0xc4, 0xd9: // bin8, str8
+		l, rest, err := length(1)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		return take(l)
+	case 0xc5, 0xda: // bin16, str16
+		l, rest, err := length(2)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		return take(l)
+	case 0xc6, 0xdb: // bin32, str32
+		l, rest, err := length(4)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		return take(l)
+	case 0xc7, 0xc8, 0xc9: // ext8, ext16, ext32
+		l, rest, err := length(1 << (t - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		return take(l + 1)
+	case 0xcc, 0xd0:
+		return take(1)
+	case 0xcd, 0xd1:
+		return take(2)
+	case 0xca, 0xce, 0xd2:
+		return take(4)
+	case 0xcb, 0xcf, 0xd3:
+		return take(8)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1/2/4/8/16
+		return take(1 + (1 << (t - 0xd4)))
+	case 0xdc, 0xdd: // array16, array32
+		l, rest, err := length(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return elements(rest, l)
+	case 0xde, 0xdf: // map16, map32
+		l, rest, err := length(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return elements(rest, 2*l)
+	}
+	return nil, fmt.Errorf("invalid MessagePack type byte 0x%02x", t)
+}
+
+// validateProtobuf checks that value is a well-formed protobuf wire-format message.
+// Without a schema registry only the framing can be verified, not field types.
+func validateProtobuf(value string) error {
+	b := []byte(value)
+	var groups []uint64
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("malformed protobuf field tag")
+		}
+		b = b[n:]
+		field, wireType := tag>>3, tag&7
+		if field == 0 {
+			return errors.New("protobuf field number 0 is invalid")
+		}
+		switch wireType {
+		case 0:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("malformed protobuf varint")
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return errors.New("truncated protobuf fixed-width field")
+			}
+			b = b[size:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("truncated protobuf length-delimited field")
+			}
+			b = b[n+int(l):]
+		case 3:
+			groups = append(groups, field)
+		case 4:
+			if len(groups) == 0 || groups[len(groups)-1] != field {
+				return errors.New("unbalanced protobuf group")
+			}
+			groups = groups[:len(groups)-1]
+		default:
+			return fmt.Errorf("invalid protobuf wire type %d", wireType)
+		}
+	}
+	if len(groups) != 0 {
+		return errors.New("unterminated protobuf group")
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateMsgpack(t *testing.T) {
+	valid := map[string]string{
+		"positive fixint": "\x05",
+		"fixstr":          "\xa3foo",
+		"fixmap":          "\x81\xa1a\x01",
+		"array16":         "\xdc\x00\x02\xc0\xc3",
+		"float64":         "\xcb\x00\x00\x00\x00\x00\x00\x00\x00",
+		"fixext4":         "\xd6\x01\x00\x00\x00\x00",
+	}
+	for name, v := range valid {
+		if err := validateMsgpack(v); err != nil {
+			t.Fatalf("%s: expected valid, got %v", name, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"empty":          "",
+		"never used":     "\xc1",
+		"truncated str":  "\xa3fo",
+		"truncated map":  "\x82\xa1a\x01",
+		"trailing bytes": "\x01\x02",
+	}
+	for name, v := range invalid {
+		if err := validateMsgpack(v); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestValidateProtobuf(t *testing.T) {
+	// field 1 varint 150, field 2 string "hi"
+	if err := validateProtobuf("\x08\x96\x01\x12\x02hi"); err != nil {
+		t.Fatalf("expected valid message, got %v", err)
+	}
+	if err := validateProtobuf(""); err != nil {
+		t.Fatalf("expected empty message to be valid, got %v", err)
+	}
+	if err := validateProtobuf("\x12\x05hi"); err == nil {
+		t.Fatalf("expected error for truncated length-delimited field")
+	}
+	if err := validateProtobuf("\x0f"); err == nil {
+		t.Fatalf("expected error for invalid wire type")
+	}
+}
+
+func TestHTTP_BucketCodec(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	// Unknown codecs are rejected
+	resp, err := httpPut(server.URL+"/buckets/docs/config", "application/json", bytes.NewReader([]byte(`{"codec":"yaml"}`)))
+	if err != nil {
+		t.Fatalf("PUT config => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT config with unknown codec => expected 400, got %d", resp.StatusCode)
+	}
+
+	resp, err = httpPut(server.URL+"/buckets/docs/config", "application/json", bytes.NewReader([]byte(`{"codec":"json"}`)))
+	if err != nil {
+		t.Fatalf("PUT config => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT config => expected 200, got %d", resp.StatusCode)
+	}
+
+	// Wrong Content-Type => 415
+	resp, err = httpPut(server.URL+"/buckets/docs/a", "text/plain", bytes.NewReader([]byte(`{"x":1}`)))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("PUT with wrong Content-Type => expected 415, got %d", resp.StatusCode)
+	}
+
+	// Payload that doesn't match the codec => 415
+	resp, err = httpPut(server.URL+"/buckets/docs/a", "application/json", bytes.NewReader([]byte(`{"x":`)))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("PUT with invalid JSON => expected 415, got %d", resp.StatusCode)
+	}
+
+	// Valid payload is stored raw and served with the codec's type
+	resp, err = httpPut(server.URL+"/buckets/docs/a", "application/json; charset=utf-8", bytes.NewReader([]byte(`{"x":1}`)))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT valid JSON => expected 200, got %d", resp.StatusCode)
+	}
+	if got := cache.Get("docs", "a"); got != `{"x":1}` {
+		t.Fatalf("expected raw value to be stored, got %q", got)
+	}
+
+	resp, err = http.Get(server.URL + "/buckets/docs/a")
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("GET => expected application/json, got %q", ct)
+	}
+	if string(body) != `{"x":1}` {
+		t.Fatalf("GET => expected raw body, got %q", body)
+	}
+
+	resp, err = http.Get(server.URL + "/buckets/docs/missing")
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET missing key in codec bucket => expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	// A length-prefixed frame: one byte of length, then that many bytes
+	RegisterCodec("test-frame", NewCodec("application/X-Test-Frame", func(value string) error {
+		if len(value) == 0 || int(value[0]) != len(value)-1 {
+			return errors.New("bad frame length")
+		}
+		return nil
+	}))
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected registering a taken name to panic")
+			}
+		}()
+		RegisterCodec("json", NewCodec("text/json", nil))
+	}()
+
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	resp, err := httpPut(server.URL+"/buckets/framed/config", "application/json", strings.NewReader(`{"codec":"test-frame"}`))
+	if err != nil {
+		t.Fatalf("PUT config => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT config with a registered codec => expected 200, got %d", resp.StatusCode)
+	}
+
+	for value, want := range map[string]int{"\x03abc": http.StatusOK, "\x05abc": http.StatusUnsupportedMediaType} {
+		resp, err := httpPut(server.URL+"/buckets/framed/k", "application/x-test-frame", strings.NewReader(value))
+		if err != nil {
+			t.Fatalf("PUT => %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("PUT %q => expected %d, got %d", value, want, resp.StatusCode)
+		}
+	}
+	// Bulk writes are checked by the same codec
+	resp, err = httpPut(server.URL+"/buckets/framed", "application/json", strings.NewReader(`{"k2":"\u0001"}`))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("bulk PUT of a bad frame => expected 415, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/buckets/framed/k")
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/X-Test-Frame" {
+		t.Fatalf("GET => expected the codec's content type, got %q", ct)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// encodingGzip is the only Content-Encoding values can be stored in.
+const encodingGzip = "gzip"
+
+// maxInflatedSize caps how large a gzip value may grow when the server has to
+// decompress it, so a small compression bomb can't exhaust memory.
+const maxInflatedSize = 256 << 20
+
+var (
+	errInflatedTooLarge    = fmt.Errorf("decompressed value exceeds %d bytes", maxInflatedSize)
+	errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+)
+
+// requestEncoding returns the request body's Content-Encoding: "" for
+// identity or encodingGzip. Anything else is an error.
+func requestEncoding(r *http.Request) (string, error) {
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return "", nil
+	case encodingGzip, "x-gzip":
+		return encodingGzip, nil
+	default:
+		return "", fmt.Errorf("%w %q", errUnsupportedEncoding, enc)
+	}
+}
+
+// decodedBody returns the request body with any Content-Encoding removed,
+// for endpoints that parse the body rather than store it. A decompressed
+// body is held to the same RequestLimits cap as the body as sent, or to
+// maxInflatedSize without one, so a small compression bomb can't get past
+// it; going over is a *http.MaxBytesError, as for the body itself.
+func decodedBody(r *http.Request) (io.Reader, error) {
+	return decodedBodyCapped(r, maxInflatedSize)
+}
+
+// decodedBodyCapped is decodedBody with fallback as the cap on a
+// decompressed body that RequestLimits sets none for; 0 leaves it uncapped,
+// for bodies read as a stream.
+func decodedBodyCapped(r *http.Request, fallback int64) (io.Reader, error) {
+	enc, err := requestEncoding(r)
+	if err != nil || enc == "" {
+		return r.Body, err
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, badGzip(err)
+	}
+	limit, onLimit := fallback, func() {}
+	if body, ok := r.Body.(*limitedBody); ok {
+		limit, onLimit = body.limit, body.trip
+	}
+	if limit <= 0 {
+		return zr, nil
+	}
+	return &limitedBody{ReadCloser: http.MaxBytesReader(nil, zr, limit), limit: limit, onLimit: onLimit}, nil
+}
+
+// badGzip passes through body size errors, which writeBodyError maps to 413,
+// and otherwise explains that the body didn't decompress.
+func badGzip(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+	return fmt.Errorf("invalid gzip body: %v", err)
+}
+
+// gunzip decompresses a stored gzip value.
+func gunzip(value string) (string, error) {
+	zr, err := gzip.NewReader(strings.NewReader(value))
+	if err != nil {
+		return "", err
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, maxInflatedSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(out) > maxInflatedSize {
+		return "", errInflatedTooLarge
+	}
+	return string(out), nil
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header value allows enc.
+// An explicit entry for enc takes precedence over "*".
+func acceptsEncoding(header, enc string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != enc && name != "*" {
+			continue
+		}
+		ok := true
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			v, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+			ok = err == nil && v > 0
+		}
+		if name == enc {
+			return ok
+		}
+		wildcard = ok
+	}
+	return wildcard
+}
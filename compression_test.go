@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatalf("gzip => %v", err)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := map[string]bool{
+		"":                      false,
+		"gzip":                  true,
+		"deflate, GZIP":         true,
+		"gzip;q=0":              false,
+		"gzip;q=0.5, br":        true,
+		"*":                     true,
+		"*;q=0":                 false,
+		"gzip;q=0, *":           false,
+		"br, deflate, identity": false,
+	}
+	for header, want := range cases {
+		if got := acceptsEncoding(header, encodingGzip); got != want {
+			t.Fatalf("acceptsEncoding(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestHTTP_CompressedValues(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	do := func(method, path string, headers map[string]string, body []byte) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s => %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+
+	for _, codec := range []string{"raw", "json"} {
+		resp, _ := do(http.MethodPut, "/buckets/"+codec+"/config", nil, []byte(`{"codec":"`+codec+`"}`))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("PUT config => %d", resp.StatusCode)
+		}
+	}
+
+	doc := `{"name":"kitsune","tails":9}`
+	compressed := gzipBytes(t, doc)
+	put := map[string]string{"Content-Type": "application/octet-stream", "Content-Encoding": "gzip"}
+	if resp, _ := do(http.MethodPut, "/buckets/raw/doc", put, compressed); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT gzip => %d", resp.StatusCode)
+	}
+
+	// Stored as sent, so the compressed size is what counts
+	meta, _, _ := cache.Info("raw", "doc")
+	if meta.Encoding != encodingGzip || meta.Size != len("raw")+len("doc")+len(compressed) {
+		t.Fatalf("expected compressed value to be stored as-is, got %+v", meta)
+	}
+
+	// Passthrough for clients that accept gzip
+	resp, body := do(http.MethodGet, "/buckets/raw/doc", map[string]string{"Accept-Encoding": "gzip"}, nil)
+	if resp.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(body, compressed) {
+		t.Fatalf("expected gzip passthrough, got %q %q", resp.Header.Get("Content-Encoding"), body)
+	}
+	if resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected Vary: Accept-Encoding, got %q", resp.Header.Get("Vary"))
+	}
+
+	// Decompressed for everyone else
+	resp, body = do(http.MethodGet, "/buckets/raw/doc", map[string]string{"Accept-Encoding": "identity"}, nil)
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != doc {
+		t.Fatalf("expected decompressed value, got %q %q", resp.Header.Get("Content-Encoding"), body)
+	}
+
+	// Validating codecs inspect the decompressed value
+	putJSON := map[string]string{"Content-Type": "application/json", "Content-Encoding": "gzip"}
+	if resp, _ := do(http.MethodPut, "/buckets/json/ok", putJSON, compressed); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT valid gzip JSON => %d", resp.StatusCode)
+	}
+	if resp, _ := do(http.MethodPut, "/buckets/json/bad", putJSON, gzipBytes(t, "{nope")); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("PUT invalid gzip JSON => expected 415, got %d", resp.StatusCode)
+	}
+	if resp, _ := do(http.MethodPut, "/buckets/json/corrupt", putJSON, []byte("not gzip")); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT corrupt gzip => expected 400, got %d", resp.StatusCode)
+	}
+	brotli := map[string]string{"Content-Type": "application/octet-stream", "Content-Encoding": "br"}
+	if resp, _ := do(http.MethodPut, "/buckets/raw/br", brotli, []byte("x")); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("PUT br => expected 415, got %d", resp.StatusCode)
+	}
+
+	// Envelope endpoints decode a compressed request body before parsing it
+	envelope := map[string]string{"Content-Type": "application/json", "Content-Encoding": "gzip"}
+	if resp, _ := do(http.MethodPut, "/keys/k", envelope, gzipBytes(t, `{"value":"v"}`)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT gzip envelope => %d", resp.StatusCode)
+	}
+	if got := cache.Get("__root__", "k"); got != "v" {
+		t.Fatalf("expected envelope value to be decoded, got %q", got)
+	}
+}
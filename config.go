@@ -0,0 +1,282 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// serverConfig holds the settings the server is started with. It is filled
+// from command-line flags so that subcommands can share the same definitions.
+type serverConfig struct {
+	Preset             string
+	Host               string
+	Port               int64
+	TLSSelfSigned      bool
+	MaxEntrySize       int64
+	MaxSize            int64
+	TTL                time.Duration
+	CleanupInterval    time.Duration
+	CleanupAdaptive    bool
+	CleanupMinInterval time.Duration
+	DefaultKeyspace    string
+	MaxBodySize        int64
+	EndpointBodySize   string
+	MaxHeaderSize      int
+	MaxURLLength       int
+	LockTimeout        time.Duration
+	SlidingExpiration  bool
+	TinyLFU            bool
+	Checksums          string
+	StrictStatus       bool
+	SLO                sloConfig
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+
+	DistributionExport   string
+	DistributionInterval time.Duration
+
+	ImportBytesPerSec int64
+	ImportOpsPerSec   int64
+
+	TrustedProxies   string
+	ForwardedHeaders string
+
+	DisableEndpoints string
+
+	MaxConcurrentRequests int64
+	AdminReservedRequests int64
+	MaxConnsPerClient     int
+
+	ShedEndpoints string
+	ShedStatus    int
+
+	HandoverSocket  string
+	HandoverPartial bool
+
+	LoaderURL     string
+	LoaderTimeout time.Duration
+
+	MaintenanceWindow        string
+	MaintenanceForcePressure float64
+
+	StoreDir   string
+	StoreMode  string
+	StoreQueue int
+}
+
+// registerFlags binds every server flag on fs to a field of cfg.
+func (cfg *serverConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Preset, "preset", "", "Start from a set of defaults suited to production or dev; flags given explicitly still win")
+	fs.StringVar(&cfg.Host, "host", "0.0.0.0", "Addresses to bind: comma-separated IPs (IPv6 too), host names or interface names like eth0")
+	fs.Int64Var(&cfg.Port, "port", 42069, "Port to bind")
+	fs.BoolVar(&cfg.TLSSelfSigned, "tls-self-signed", false, "Serve HTTPS with a certificate generated at startup for the -host names (development only)")
+	fs.Int64Var(&cfg.MaxEntrySize, "max-entry-size", DEFAULT_MAX_ENTRY_SIZE, "Max entry size (bytes)")
+	fs.Int64Var(&cfg.MaxSize, "max-size", DEFAULT_MAX_SIZE, "Max total cache size (bytes)")
+	ttlFlagVar(fs, &cfg.TTL, "ttl", DEFAULT_TTL*time.Second, "Default TTL, in seconds or as a duration like 250ms (0 = never expire)")
+	ttlFlagVar(fs, &cfg.CleanupInterval, "cleanup-interval", DEFAULT_CLEANUP_INTERVAL*time.Second, "Cleanup interval, in seconds or as a duration like 100ms")
+	fs.BoolVar(&cfg.CleanupAdaptive, "cleanup-adaptive", false, "Shorten the cleanup interval while expired entries pile up and lengthen it back to -cleanup-interval when idle")
+	ttlFlagVar(fs, &cfg.CleanupMinInterval, "cleanup-min-interval", defaultMinCleanupInterval, "Shortest interval -cleanup-adaptive may sweep at")
+	fs.StringVar(&cfg.DefaultKeyspace, "default-keyspace", DEFAULT_KEYSPACE, "Default keyspace")
+	fs.Int64Var(&cfg.MaxBodySize, "max-body-size", 0, "Max request body size in bytes (0 = unlimited)")
+	fs.StringVar(&cfg.EndpointBodySize, "max-body-size-per-endpoint", "", "Per-endpoint body limits, e.g. keys=1048576,config=65536")
+	fs.IntVar(&cfg.MaxHeaderSize, "max-header-size", 0, "Max total request header size in bytes (0 = unlimited)")
+	fs.IntVar(&cfg.MaxURLLength, "max-url-length", 0, "Max request URI length in bytes (0 = unlimited)")
+	fs.DurationVar(&cfg.LockTimeout, "lock-timeout", 0, "Max wait for the cache lock before answering 503, e.g. 50ms (0 = wait forever)")
+	fs.BoolVar(&cfg.SlidingExpiration, "sliding-expiration", false, "Reset an entry's TTL every time it is read (time-to-idle)")
+	fs.BoolVar(&cfg.TinyLFU, "tinylfu", false, "Only admit a new key under memory pressure if it is requested more often than the entries it would evict")
+	fs.StringVar(&cfg.Checksums, "checksums", ChecksumsOff, "Store a CRC-32C with each value and verify it on read; on a mismatch: count, log, or fail the read (off = no checksums)")
+	fs.BoolVar(&cfg.StrictStatus, "strict-status", false, "Answer 404 for a GET of a missing key instead of 200 with an empty value")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", 0, "Max time to read a request's headers (0 = no limit)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", 0, "Max time to read a whole request, body included (0 = no limit)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 0, "Max time a keep-alive connection may sit idle between requests (0 = -read-timeout)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "Max time to let in-flight requests finish on SIGINT or SIGTERM")
+	fs.Float64Var(&cfg.SLO.AvailabilityTarget, "slo-availability", 0.999, "Availability objective: fraction of requests that must not fail with 5xx")
+	fs.DurationVar(&cfg.SLO.Latency, "slo-latency", 0, "Latency objective threshold, e.g. 50ms (0 = no latency SLO)")
+	fs.Float64Var(&cfg.SLO.LatencyTarget, "slo-latency-target", 0.99, "Fraction of requests that must finish within -slo-latency")
+	fs.Float64Var(&cfg.SLO.BurnAlert, "slo-burn-alert", 14.4, "Burn rate over both the 5m and 1h windows that fires an alert (0 = never alert)")
+	fs.StringVar(&cfg.SLO.Webhook, "slo-webhook", "", "URL to POST SLO alerts to")
+	fs.StringVar(&cfg.DistributionExport, "distribution-export", "", "File to periodically write value size, TTL and hit distributions to (JSON)")
+	fs.DurationVar(&cfg.DistributionInterval, "distribution-interval", 5*time.Minute, "How often to write -distribution-export")
+	fs.Int64Var(&cfg.ImportBytesPerSec, "import-rate-bytes", 0, "Max bytes per second read by imports and bulk writes, shared across requests (0 = unlimited)")
+	fs.Int64Var(&cfg.ImportOpsPerSec, "import-rate-ops", 0, "Max entries per second written by imports and bulk writes, shared across requests (0 = unlimited)")
+	fs.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "Comma-separated CIDRs of reverse proxies whose forwarding headers name the client")
+	fs.StringVar(&cfg.ForwardedHeaders, "forwarded-headers", "X-Forwarded-For,X-Real-IP,Forwarded", "Forwarding headers to honor from -trusted-proxies, in order of preference")
+	fs.StringVar(&cfg.DisableEndpoints, "disable-endpoints", "", "Comma-separated API surfaces to turn off (404), e.g. keys,bucket-delete,admin")
+	fs.Int64Var(&cfg.MaxConcurrentRequests, "max-concurrent-requests", 0, "Max requests served at once; the excess gets 503 (0 = unlimited)")
+	fs.IntVar(&cfg.MaxConnsPerClient, "max-conns-per-client", 0, "Max connections one client IP may hold open; more are closed on accept (0 = unlimited)")
+	fs.StringVar(&cfg.ShedEndpoints, "shed-endpoints", "", "Endpoint classes to turn away under pressure, with the pressure (0-1) to start at, e.g. bulk=0.6,scan=0.8,keys=0.95")
+	fs.IntVar(&cfg.ShedStatus, "shed-status", http.StatusServiceUnavailable, "Status for shed requests: 429 or 503")
+	fs.StringVar(&cfg.LoaderURL, "loader-url", "", "Upstream to fill misses from with GET {url}/{bucket}/{key} (read-through)")
+	fs.DurationVar(&cfg.LoaderTimeout, "loader-timeout", 5*time.Second, "Max time a -loader-url request may take")
+	fs.StringVar(&cfg.MaintenanceWindow, "maintenance-window", "", "Daily local time range to confine expiry sweeps and distribution exports to, e.g. 02:00-04:30")
+	fs.Float64Var(&cfg.MaintenanceForcePressure, "maintenance-force-pressure", 0.9, "Memory pressure (Go memory over GOMEMLIMIT) that runs them outside the window anyway (0 = never)")
+	fs.StringVar(&cfg.StoreDir, "store-dir", "", "Directory to propagate every write and delete to, one file per entry")
+	fs.StringVar(&cfg.StoreMode, "store-mode", StoreWriteThrough, "How writes reach -store-dir: write-through or write-behind")
+	fs.IntVar(&cfg.StoreQueue, "store-queue", 10000, "Writes a write-behind -store-mode may queue before writers wait")
+	fs.StringVar(&cfg.HandoverSocket, "handover-socket", "", "Unix socket to take the cache over from a previous process on start, and to hand it to the next one")
+	fs.BoolVar(&cfg.HandoverPartial, "handover-partial", false, "Serve while the -handover-socket transfer is still arriving; /readyz answers 503 until it is done")
+	fs.Int64Var(&cfg.AdminReservedRequests, "admin-reserved-requests", 2, "Of -max-concurrent-requests, slots only admin, stats and metrics requests may use")
+}
+
+// concurrencyLimit builds the ConcurrencyLimit described by the config.
+func (cfg *serverConfig) concurrencyLimit() (*ConcurrencyLimit, error) {
+	c, err := parseConcurrencyLimit(cfg.MaxConcurrentRequests, cfg.AdminReservedRequests)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -max-concurrent-requests or -admin-reserved-requests: %v", err)
+	}
+	return c, nil
+}
+
+// connectionTracker builds the ConnectionTracker described by the config.
+func (cfg *serverConfig) connectionTracker() (*ConnectionTracker, error) {
+	t, err := parseConnectionTracker(cfg.MaxConnsPerClient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -max-conns-per-client: %v", err)
+	}
+	return t, nil
+}
+
+// loadShedding builds the LoadShedding described by the config, measuring
+// load against concurrency.
+func (cfg *serverConfig) loadShedding(concurrency *ConcurrencyLimit) (*LoadShedding, error) {
+	s, err := parseLoadShedding(cfg.ShedEndpoints, cfg.ShedStatus, concurrency)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -shed-endpoints or -shed-status: %v", err)
+	}
+	return s, nil
+}
+
+// loader builds the read-through Loader described by the config, or returns
+// nil if there is none.
+func (cfg *serverConfig) loader() (Loader, error) {
+	if cfg.LoaderURL == "" {
+		return nil, nil
+	}
+	if cfg.LoaderTimeout <= 0 {
+		return nil, fmt.Errorf("-loader-timeout %s must be positive", cfg.LoaderTimeout)
+	}
+	l, err := newHTTPLoader(cfg.LoaderURL, cfg.LoaderTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -loader-url: %v", err)
+	}
+	return l, nil
+}
+
+// validateStore checks the -store-* flags without touching -store-dir.
+func (cfg *serverConfig) validateStore() error {
+	if cfg.StoreDir == "" {
+		return nil
+	}
+	if cfg.StoreMode != StoreWriteThrough && cfg.StoreMode != StoreWriteBehind {
+		return fmt.Errorf("invalid -store-mode %q: want %s or %s", cfg.StoreMode, StoreWriteThrough, StoreWriteBehind)
+	}
+	if cfg.StoreMode == StoreWriteBehind && cfg.StoreQueue <= 0 {
+		return fmt.Errorf("-store-queue %d must be positive", cfg.StoreQueue)
+	}
+	return nil
+}
+
+// store builds the backing Store described by the config, or returns nil if
+// there is none.
+func (cfg *serverConfig) store() (Store, StoreOptions, error) {
+	opts := StoreOptions{Mode: cfg.StoreMode, QueueSize: cfg.StoreQueue}
+	if cfg.StoreDir == "" {
+		return nil, opts, nil
+	}
+	if err := cfg.validateStore(); err != nil {
+		return nil, opts, err
+	}
+	s, err := newFileStore(cfg.StoreDir)
+	if err != nil {
+		return nil, opts, fmt.Errorf("invalid -store-dir: %v", err)
+	}
+	return s, opts, nil
+}
+
+// maintenanceWindow builds the MaintenanceWindow described by the config, or
+// returns nil if there is none.
+func (cfg *serverConfig) maintenanceWindow() (*MaintenanceWindow, error) {
+	if cfg.MaintenanceWindow == "" {
+		return nil, nil
+	}
+	w, err := parseMaintenanceWindow(cfg.MaintenanceWindow, cfg.MaintenanceForcePressure)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -maintenance-window or -maintenance-force-pressure: %v", err)
+	}
+	return w, nil
+}
+
+// validateChecksums checks the -checksums mode.
+func (cfg *serverConfig) validateChecksums() error {
+	switch cfg.Checksums {
+	case ChecksumsOff, ChecksumsCount, ChecksumsLog, ChecksumsFail:
+		return nil
+	}
+	return fmt.Errorf("invalid -checksums %q: want %s, %s, %s or %s", cfg.Checksums, ChecksumsOff, ChecksumsCount, ChecksumsLog, ChecksumsFail)
+}
+
+// validateTimeouts checks the server timeouts.
+func (cfg *serverConfig) validateTimeouts() error {
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"read-header-timeout", cfg.ReadHeaderTimeout},
+		{"read-timeout", cfg.ReadTimeout},
+		{"idle-timeout", cfg.IdleTimeout},
+		{"shutdown-timeout", cfg.ShutdownTimeout},
+	} {
+		if t.d < 0 {
+			return fmt.Errorf("-%s %s must not be negative", t.name, t.d)
+		}
+	}
+	return nil
+}
+
+// validateSLO checks that the SLO targets are usable fractions.
+func (cfg *serverConfig) validateSLO() error {
+	if cfg.SLO.AvailabilityTarget <= 0 || cfg.SLO.AvailabilityTarget >= 1 {
+		return fmt.Errorf("-slo-availability %g must be between 0 and 1 (exclusive)", cfg.SLO.AvailabilityTarget)
+	}
+	if cfg.SLO.LatencyTarget <= 0 || cfg.SLO.LatencyTarget >= 1 {
+		return fmt.Errorf("-slo-latency-target %g must be between 0 and 1 (exclusive)", cfg.SLO.LatencyTarget)
+	}
+	return nil
+}
+
+// requestLimits builds the RequestLimits described by the config.
+func (cfg *serverConfig) requestLimits() (*RequestLimits, error) {
+	endpointBodySize, err := parseEndpointLimits(cfg.EndpointBodySize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -max-body-size-per-endpoint: %v", err)
+	}
+	return &RequestLimits{
+		MaxBodySize:      cfg.MaxBodySize,
+		EndpointBodySize: endpointBodySize,
+		MaxHeaderSize:    cfg.MaxHeaderSize,
+		MaxURLLength:     cfg.MaxURLLength,
+	}, nil
+}
+
+// trustedProxies builds the TrustedProxies described by the config.
+func (cfg *serverConfig) trustedProxies() (*TrustedProxies, error) {
+	p, err := parseTrustedProxies(cfg.TrustedProxies, cfg.ForwardedHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -trusted-proxies or -forwarded-headers: %v", err)
+	}
+	return p, nil
+}
+
+// disabledEndpoints builds the DisabledEndpoints described by the config.
+func (cfg *serverConfig) disabledEndpoints() (DisabledEndpoints, error) {
+	d, err := parseDisabledEndpoints(cfg.DisableEndpoints)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -disable-endpoints: %v", err)
+	}
+	return d, nil
+}
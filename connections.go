@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxConnectionClients is how many clients ConnectionStats lists, those with
+// the most open connections first.
+const maxConnectionClients = 20
+
+// ConnectionTracker counts the TCP connections accepted by the listeners it
+// wraps, by client IP address, and optionally caps how many one client may
+// hold open at once. Connections are counted where they are accepted, so a
+// client leaking connections shows up even if it never completes a request.
+// Behind a proxy, the client is the proxy. A zero MaxPerClient means
+// unlimited.
+type ConnectionTracker struct {
+	MaxPerClient int
+
+	mu      sync.Mutex
+	clients map[netip.Addr]map[*trackedConn]struct{}
+
+	accepted atomic.Int64
+	rejected atomic.Int64
+	closed   atomic.Int64
+	lifetime atomic.Int64 // nanoseconds, summed over closed connections
+}
+
+// parseConnectionTracker checks a -max-conns-per-client.
+func parseConnectionTracker(maxPerClient int) (*ConnectionTracker, error) {
+	if maxPerClient < 0 {
+		return nil, fmt.Errorf("%d must not be negative", maxPerClient)
+	}
+	return &ConnectionTracker{MaxPerClient: maxPerClient}, nil
+}
+
+// Listener returns ln counting its connections. A connection over the
+// per-client cap is closed as soon as it is accepted, before anything is
+// read from it.
+func (t *ConnectionTracker) Listener(ln net.Listener) net.Listener {
+	return &trackedListener{Listener: ln, tracker: t}
+}
+
+type trackedListener struct {
+	net.Listener
+	tracker *ConnectionTracker
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if tc := l.tracker.open(c); tc != nil {
+			return tc, nil
+		}
+		c.Close()
+	}
+}
+
+// trackedConn is an accepted connection, removed from its client's set when
+// closed.
+type trackedConn struct {
+	net.Conn
+	tracker *ConnectionTracker
+	client  netip.Addr
+	opened  time.Time
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.tracker.release(c) })
+	return c.Conn.Close()
+}
+
+// open records c, or returns nil if its client is at the cap.
+func (t *ConnectionTracker) open(c net.Conn) *trackedConn {
+	client := connClient(c)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := t.clients[client]
+	if t.MaxPerClient > 0 && len(conns) >= t.MaxPerClient {
+		t.rejected.Add(1)
+		return nil
+	}
+	if conns == nil {
+		if t.clients == nil {
+			t.clients = make(map[netip.Addr]map[*trackedConn]struct{})
+		}
+		conns = make(map[*trackedConn]struct{})
+		t.clients[client] = conns
+	}
+	tc := &trackedConn{Conn: c, tracker: t, client: client, opened: time.Now()}
+	conns[tc] = struct{}{}
+	t.accepted.Add(1)
+	return tc
+}
+
+func (t *ConnectionTracker) release(c *trackedConn) {
+	t.mu.Lock()
+	conns := t.clients[c.client]
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(t.clients, c.client)
+	}
+	t.mu.Unlock()
+	t.closed.Add(1)
+	t.lifetime.Add(int64(time.Since(c.opened)))
+}
+
+// connClient returns the IP address c comes from, without an IPv4-in-IPv6
+// prefix, or the zero Addr if it has none, e.g. over a Unix socket.
+func connClient(c net.Conn) netip.Addr {
+	if ap, err := netip.ParseAddrPort(c.RemoteAddr().String()); err == nil {
+		return ap.Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// ClientConnections is one client's share of the open connections.
+type ClientConnections struct {
+	Client string  `json:"client"`
+	Open   int     `json:"open"`
+	Oldest float64 `json:"oldest_seconds"` // age of its longest-open connection
+}
+
+// ConnectionStats describes the connections accepted since the server
+// started.
+type ConnectionStats struct {
+	Open         int                 `json:"open"`
+	Accepted     int64               `json:"accepted"`
+	Rejected     int64               `json:"rejected"` // closed at once for being over -max-conns-per-client
+	Closed       int64               `json:"closed"`
+	MeanLifetime float64             `json:"mean_lifetime_seconds"` // over closed connections
+	MaxPerClient int                 `json:"max_per_client,omitempty"`
+	Clients      []ClientConnections `json:"clients"` // the 20 with the most open connections
+}
+
+// Stats returns the tracker's counters and the clients holding the most
+// connections.
+func (t *ConnectionTracker) Stats() ConnectionStats {
+	now := time.Now()
+	st := ConnectionStats{
+		Accepted:     t.accepted.Load(),
+		Rejected:     t.rejected.Load(),
+		Closed:       t.closed.Load(),
+		MaxPerClient: t.MaxPerClient,
+		Clients:      []ClientConnections{},
+	}
+	if st.Closed > 0 {
+		st.MeanLifetime = time.Duration(t.lifetime.Load() / st.Closed).Seconds()
+	}
+
+	t.mu.Lock()
+	for client, conns := range t.clients {
+		cc := ClientConnections{Client: client.String(), Open: len(conns)}
+		for c := range conns {
+			cc.Oldest = max(cc.Oldest, now.Sub(c.opened).Seconds())
+		}
+		if !client.IsValid() {
+			cc.Client = "local"
+		}
+		st.Open += len(conns)
+		st.Clients = append(st.Clients, cc)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(st.Clients, func(i, j int) bool {
+		a, b := st.Clients[i], st.Clients[j]
+		if a.Open != b.Open {
+			return a.Open > b.Open
+		}
+		return a.Client < b.Client
+	})
+	if len(st.Clients) > maxConnectionClients {
+		st.Clients = st.Clients[:maxConnectionClients]
+	}
+	return st
+}
+
+// serverStats is the GET /stats response: the cache's stats, plus the
+// connections when they are tracked.
+type serverStats struct {
+	CacheStats
+	Connections *ConnectionStats `json:"connections,omitempty"`
+}
+
+// statsHandler serves GET /stats, including conns' stats unless it is nil.
+func statsHandler(cache *CacheSystem, conns *ConnectionTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		out := serverStats{CacheStats: cache.CacheStats()}
+		if conns != nil {
+			st := conns.Stats()
+			out.Connections = &st
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
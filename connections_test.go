@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectionTracker(t *testing.T) {
+	conns, err := parseConnectionTracker(2)
+	if err != nil {
+		t.Fatalf("parseConnectionTracker => %v", err)
+	}
+	if _, err := parseConnectionTracker(-1); err == nil {
+		t.Fatalf("expected a negative cap to be rejected")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen => %v", err)
+	}
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := &http.Server{Handler: statsHandler(cache, conns)}
+	go server.Serve(conns.Listener(ln))
+	defer server.Close()
+
+	stats := func() ConnectionStats {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		statsHandler(cache, conns).ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+		var out serverStats
+		if err := json.NewDecoder(rec.Body).Decode(&out); err != nil || out.Connections == nil {
+			t.Fatalf("expected connections in /stats, got %s, %v", rec.Body, err)
+		}
+		return *out.Connections
+	}
+	waitFor := func(what string, ok func(ConnectionStats) bool) ConnectionStats {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			if st := stats(); ok(st) {
+				return st
+			} else if time.Now().After(deadline) {
+				t.Fatalf("expected %s, got %+v", what, st)
+			}
+		}
+	}
+
+	// Two idle connections, as from a client that leaks them
+	var open []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial => %v", err)
+		}
+		defer c.Close()
+		open = append(open, c)
+	}
+	st := waitFor("two open connections", func(st ConnectionStats) bool { return st.Open == 2 })
+	if len(st.Clients) != 1 || st.Clients[0].Client != "127.0.0.1" || st.Clients[0].Open != 2 || st.MaxPerClient != 2 {
+		t.Fatalf("unexpected connection stats %+v", st)
+	}
+
+	// A third is closed without being served
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial => %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	waitFor("a rejected connection", func(st ConnectionStats) bool { return st.Rejected == 1 && st.Open == 2 })
+
+	// Closing one makes room, and its lifetime is recorded
+	open[0].Close()
+	waitFor("a closed connection", func(st ConnectionStats) bool { return st.Closed == 1 && st.Open == 1 && st.MeanLifetime > 0 })
+	resp, err := http.Get("http://" + ln.Addr().String() + "/stats")
+	if err != nil {
+		t.Fatalf("GET /stats => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || stats().Accepted != 3 {
+		t.Fatalf("expected a new connection to be served, got %d, %+v", resp.StatusCode, stats())
+	}
+
+	// Without a tracker, /stats leaves connections out
+	rec := httptest.NewRecorder()
+	statsHandler(cache, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	var out map[string]interface{}
+	json.NewDecoder(rec.Body).Decode(&out)
+	if _, ok := out["connections"]; ok || out["entries"] == nil {
+		t.Fatalf("unexpected stats without a tracker %v", out)
+	}
+}
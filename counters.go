@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCounterOverflow is returned when adding to a counter would take it past
+// the range of an int64 and the update doesn't saturate.
+var ErrCounterOverflow = errors.New("counter would overflow")
+
+// CounterOptions controls an update of a counter. Counters are entries
+// holding a base-10 int64, so they are also readable as ordinary keys.
+type CounterOptions struct {
+	WriteOptions
+	// TTL, if set, restarts the counter's expiration. Otherwise a new
+	// counter gets the default TTL and an existing one keeps its own, so
+	// refreshing a TTL never resets the count.
+	TTL time.Duration
+	// Saturate clamps the counter at the int64 limits instead of failing
+	// with ErrCounterOverflow.
+	Saturate bool
+}
+
+// AddCounter atomically adds delta to the counter and returns the result. A
+// missing counter starts from 0.
+func (cs *CacheSystem) AddCounter(bucket, name string, delta int64, opts CounterOptions) (int64, error) {
+	return cs.updateCounter(bucket, name, opts, func(n int64) (int64, error) {
+		sum := n + delta
+		if (delta > 0 && sum < n) || (delta < 0 && sum > n) {
+			switch {
+			case !opts.Saturate:
+				return 0, fmt.Errorf("%w: %d %+d", ErrCounterOverflow, n, delta)
+			case delta > 0:
+				return math.MaxInt64, nil
+			default:
+				return math.MinInt64, nil
+			}
+		}
+		return sum, nil
+	})
+}
+
+// SetCounter creates the counter, or resets an existing one, to value.
+func (cs *CacheSystem) SetCounter(bucket, name string, value int64, opts CounterOptions) error {
+	_, err := cs.updateCounter(bucket, name, opts, func(int64) (int64, error) { return value, nil })
+	return err
+}
+
+// Counter returns the counter's value, reading it like LookupValue but
+// never from the loader. It fails with ErrNotInteger if the key holds
+// something other than a counter.
+func (cs *CacheSystem) Counter(bucket, name string) (int64, bool, error) {
+	v, found, err := cs.lookupCachedValue(bucket, name)
+	if err != nil || !found {
+		return 0, false, err
+	}
+	if v.Encoding != "" {
+		return 0, false, ErrNotInteger
+	}
+	n, err := strconv.ParseInt(v.Value, 10, 64)
+	if err != nil {
+		return 0, false, ErrNotInteger
+	}
+	return n, true, nil
+}
+
+// updateCounter replaces the counter's value n (0 if it is missing) with
+// update(n) under one lock acquisition. Keys holding anything but a counter
+// are left alone and fail with ErrNotInteger.
+func (cs *CacheSystem) updateCounter(bucket, name string, opts CounterOptions, update func(n int64) (int64, error)) (int64, error) {
+	if err := cs.lock(); err != nil {
+		return 0, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return 0, err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, name)
+	var n int64
+	if entry != nil {
+		if entry.Encoding != "" {
+			return 0, ErrNotInteger
+		}
+		if n, err = strconv.ParseInt(entry.Value, 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	if n, err = update(n); err != nil {
+		return 0, err
+	}
+	if err := cs.rewriteLocked(bucket, name, entry, strconv.FormatInt(n, 10), opts.TTL, opts.WriteOptions, s); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// counterRequest is the optional body of the counter endpoints.
+type counterRequest struct {
+	Value      int64   `json:"value"`       // PUT: the value to set
+	By         *int64  `json:"by"`          // incr and decr: the amount, 1 if absent
+	TTL        jsonTTL `json:"ttl"`         // restarts the expiration if set
+	OnOverflow string  `json:"on_overflow"` // incr and decr: "error" (the default) or "saturate"
+}
+
+// serveCounter handles the counter endpoints:
+//
+//	GET    /counters/{bucket}/{name}       => {"value": n}
+//	PUT    /counters/{bucket}/{name}       => create or set, {"value": n, "ttl": ...}
+//	DELETE /counters/{bucket}/{name}       => remove
+//	POST   /counters/{bucket}/{name}/incr  => add, {"by": n, "ttl": ..., "on_overflow": ...}
+//	POST   /counters/{bucket}/{name}/decr  => subtract, likewise
+//	POST   /counters/{bucket}/{name}/reset => set to 0, {"ttl": ...}
+//
+// In buckets with HashKeys, the name is hashed like a key.
+func serveCounter(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, name, _ := strings.Cut(r.URL.Path[len("/counters/"):], "/")
+	action := ""
+	if i := strings.LastIndexByte(name, '/'); i > 0 {
+		switch name[i+1:] {
+		case "incr", "decr", "reset":
+			name, action = name[:i], name[i+1:]
+		}
+	}
+	if bucket == "" || name == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	name, _ = storedKey(cache.GetBucketConfig(bucket), name)
+
+	allowed := []string{http.MethodGet, http.MethodPut, http.MethodDelete}
+	if action != "" {
+		allowed = []string{http.MethodPost}
+	}
+	if !slices.Contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, allowed...)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		n, found, err := cache.Counter(bucket, name)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		writeCounter(w, n)
+		return
+	case http.MethodDelete:
+		if _, err := cache.Delete(bucket, name); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req counterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TTL < 0 {
+		writeError(w, http.StatusBadRequest, "ttl must not be negative")
+		return
+	}
+	opts := CounterOptions{WriteOptions: writeOptions(r), TTL: time.Duration(req.TTL)}
+	switch req.OnOverflow {
+	case "", "error":
+	case "saturate":
+		opts.Saturate = true
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown on_overflow %q, expected error or saturate", req.OnOverflow))
+		return
+	}
+
+	var n int64
+	var err error
+	switch action {
+	case "":
+		n = req.Value
+		err = cache.SetCounter(bucket, name, n, opts)
+	case "reset":
+		err = cache.SetCounter(bucket, name, 0, opts)
+	default:
+		delta := int64(1)
+		if req.By != nil {
+			if *req.By == math.MinInt64 {
+				writeError(w, http.StatusBadRequest, "by is out of range")
+				return
+			}
+			delta = *req.By
+		}
+		if action == "decr" {
+			delta = -delta
+		}
+		n, err = cache.AddCounter(bucket, name, delta, opts)
+	}
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	writeCounter(w, n)
+}
+
+func writeCounter(w http.ResponseWriter, n int64) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"value": n})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Counter(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	if n, err := cache.AddCounter("b", "c", 5, CounterOptions{TTL: time.Hour}); err != nil || n != 5 {
+		t.Fatalf("expected a new counter to start from 0, got %d, %v", n, err)
+	}
+	if ttl, _ := cache.TTL("b", "c"); ttl <= time.Minute {
+		t.Fatalf("expected the counter to take the given TTL, got %v", ttl)
+	}
+
+	// Counting without a TTL keeps the expiration; a TTL refresh keeps the count
+	if n, _ := cache.AddCounter("b", "c", -2, CounterOptions{}); n != 3 {
+		t.Fatalf("expected 3, got %d", n)
+	}
+	if ttl, _ := cache.TTL("b", "c"); ttl <= time.Minute {
+		t.Fatalf("expected the counter to keep its TTL, got %v", ttl)
+	}
+	if n, _ := cache.AddCounter("b", "c", 1, CounterOptions{TTL: 2 * time.Hour}); n != 4 {
+		t.Fatalf("expected a TTL refresh to keep the count, got %d", n)
+	}
+	if ttl, _ := cache.TTL("b", "c"); ttl <= time.Hour {
+		t.Fatalf("expected the TTL to restart, got %v", ttl)
+	}
+	if n, found, err := cache.Counter("b", "c"); err != nil || !found || n != 4 {
+		t.Fatalf("Counter => %d, %v, %v", n, found, err)
+	}
+
+	if err := cache.SetCounter("b", "c", math.MaxInt64-1, CounterOptions{}); err != nil {
+		t.Fatalf("SetCounter => %v", err)
+	}
+	if _, err := cache.AddCounter("b", "c", 2, CounterOptions{}); !errors.Is(err, ErrCounterOverflow) {
+		t.Fatalf("expected ErrCounterOverflow, got %v", err)
+	}
+	if n, _, _ := cache.Counter("b", "c"); n != math.MaxInt64-1 {
+		t.Fatalf("expected an overflow to leave the counter alone, got %d", n)
+	}
+	if n, err := cache.AddCounter("b", "c", 2, CounterOptions{Saturate: true}); err != nil || n != math.MaxInt64 {
+		t.Fatalf("expected the counter to saturate, got %d, %v", n, err)
+	}
+	if n, _ := cache.AddCounter("b", "low", math.MinInt64, CounterOptions{}); n != math.MinInt64 {
+		t.Fatalf("expected %d, got %d", int64(math.MinInt64), n)
+	}
+	if n, err := cache.AddCounter("b", "low", -1, CounterOptions{Saturate: true}); err != nil || n != math.MinInt64 {
+		t.Fatalf("expected the counter to saturate, got %d, %v", n, err)
+	}
+
+	cache.Set("b", "word", "hello")
+	if _, err := cache.AddCounter("b", "word", 1, CounterOptions{}); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("expected ErrNotInteger, got %v", err)
+	}
+	if _, _, err := cache.Counter("b", "word"); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("expected ErrNotInteger, got %v", err)
+	}
+	if got := cache.Get("b", "word"); got != "hello" {
+		t.Fatalf("expected the key to be left alone, got %q", got)
+	}
+}
+
+func TestHTTP_Counters(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	if resp, _ := httpDo(t, "GET", server.URL+"/counters/b/hits", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing counter, got %d", resp.StatusCode)
+	}
+	if resp, body := httpDo(t, "POST", server.URL+"/counters/b/hits/incr", ""); resp.StatusCode != http.StatusOK || body != `{"value":1}` {
+		t.Fatalf("expected incr to create the counter at 1, got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := httpDo(t, "POST", server.URL+"/counters/b/hits/incr", `{"by":10,"ttl":"1h"}`); resp.StatusCode != http.StatusOK || body != `{"value":11}` {
+		t.Fatalf("expected 11, got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := httpDo(t, "POST", server.URL+"/counters/b/hits/decr", `{"by":4}`); resp.StatusCode != http.StatusOK || body != `{"value":7}` {
+		t.Fatalf("expected 7, got %d %s", resp.StatusCode, body)
+	}
+	if resp, body := httpDo(t, "GET", server.URL+"/counters/b/hits", ""); resp.StatusCode != http.StatusOK || body != `{"value":7}` {
+		t.Fatalf("expected 7, got %d %s", resp.StatusCode, body)
+	}
+	if got := cache.Get("b", "hits"); got != "7" {
+		t.Fatalf("expected the counter to be readable as a key, got %q", got)
+	}
+	if resp, body := httpDo(t, "POST", server.URL+"/counters/b/hits/reset", ""); resp.StatusCode != http.StatusOK || body != `{"value":0}` {
+		t.Fatalf("expected reset to 0, got %d %s", resp.StatusCode, body)
+	}
+	if ttl, _ := cache.TTL("b", "hits"); ttl <= time.Minute {
+		t.Fatalf("expected reset to keep the TTL, got %v", ttl)
+	}
+
+	if resp, body := httpDo(t, "PUT", server.URL+"/counters/b/max", `{"value":9223372036854775807}`); resp.StatusCode != http.StatusOK || body != `{"value":9223372036854775807}` {
+		t.Fatalf("expected PUT to set the counter, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := httpDo(t, "POST", server.URL+"/counters/b/max/incr", ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 on overflow, got %d", resp.StatusCode)
+	}
+	if resp, body := httpDo(t, "POST", server.URL+"/counters/b/max/incr", `{"on_overflow":"saturate"}`); resp.StatusCode != http.StatusOK || body != `{"value":9223372036854775807}` {
+		t.Fatalf("expected the counter to saturate, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := httpDo(t, "POST", server.URL+"/counters/b/max/incr", `{"on_overflow":"wrap"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown on_overflow, got %d", resp.StatusCode)
+	}
+
+	cache.Set("b", "word", "hello")
+	if resp, _ := httpDo(t, "POST", server.URL+"/counters/b/word/incr", ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for a key that isn't a counter, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := httpDo(t, "DELETE", server.URL+"/counters/b/max", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected DELETE to succeed, got %d", resp.StatusCode)
+	}
+	if resp, _ := httpDo(t, "GET", server.URL+"/counters/b/max", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the counter to be gone, got %d", resp.StatusCode)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{"POST", "/counters/b/hits", http.StatusMethodNotAllowed},
+		{"GET", "/counters/b/hits/incr", http.StatusMethodNotAllowed},
+		{"GET", "/counters/b", http.StatusNotFound},
+		{"GET", "/counters/", http.StatusNotFound},
+	} {
+		if resp, _ := httpDo(t, c.method, server.URL+c.path, ""); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("bad time %q: %v", s, err)
+		}
+		return v
+	}
+	cases := []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2024-05-01T12:00:30Z", "2024-05-01T12:01:00Z"},
+		{"*/15 * * * *", "2024-05-01T12:01:00Z", "2024-05-01T12:15:00Z"},
+		{"0 3 * * *", "2024-05-01T03:00:00Z", "2024-05-02T03:00:00Z"},
+		{"30 9-17/4 * * 1-5", "2024-05-03T17:31:00Z", "2024-05-06T09:30:00Z"}, // Friday evening => Monday
+		{"0 0 1,15 * *", "2024-05-02T00:00:00Z", "2024-05-15T00:00:00Z"},
+		{"0 0 13 * 5", "2024-05-01T00:00:00Z", "2024-05-03T00:00:00Z"}, // the 13th or any Friday
+		{"0 0 * * 7", "2024-05-01T00:00:00Z", "2024-05-05T00:00:00Z"},  // 7 is Sunday
+		{"0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"@monthly", "2024-12-15T00:00:00Z", "2025-01-01T00:00:00Z"},
+	}
+	for _, c := range cases {
+		cron, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q) => %v", c.expr, err)
+		}
+		if got := cron.next(at(c.from)); !got.Equal(at(c.want)) {
+			t.Fatalf("%q after %s: expected %s, got %s", c.expr, c.from, c.want, got.Format(time.RFC3339))
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "0 0 30 2 *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Fatalf("expected parseCron(%q) to fail", expr)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Histogram counts observations in power-of-two buckets. Bucket i holds the
+// values v with 2^(i-1) < v <= 2^i (bucket 0 holds v <= 1).
+type Histogram struct {
+	Count   int64             `json:"count"`
+	Sum     int64             `json:"sum"`
+	Max     int64             `json:"max"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// HistogramBucket is one non-empty bucket: Count observations <= LE.
+type HistogramBucket struct {
+	LE    int64 `json:"le"`
+	Count int64 `json:"count"`
+}
+
+// histogram accumulates a Histogram.
+type histogram struct {
+	count, sum, max int64
+	buckets         [64]int64
+}
+
+func (h *histogram) observe(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	h.count++
+	h.sum += v
+	if v > h.max {
+		h.max = v
+	}
+	i := 0
+	if v > 1 {
+		i = bits.Len64(uint64(v - 1))
+	}
+	h.buckets[i]++
+}
+
+func (h *histogram) export() Histogram {
+	out := Histogram{Count: h.count, Sum: h.sum, Max: h.max, Buckets: []HistogramBucket{}}
+	for i, n := range h.buckets {
+		if n > 0 {
+			out.Buckets = append(out.Buckets, HistogramBucket{LE: int64(1) << i, Count: n})
+		}
+	}
+	return out
+}
+
+// Distributions summarizes the cache's contents without naming any bucket
+// or key, for building capacity models offline.
+type Distributions struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Entries     int64     `json:"entries"`
+	ValueBytes  Histogram `json:"value_bytes"`
+	TTLSeconds  Histogram `json:"ttl_seconds"` // remaining lifetime of entries that expire
+	NoExpiry    int64     `json:"no_expiry"`   // entries without an expiration
+	Hits        Histogram `json:"hits"`        // reads served by each entry since it was written
+}
+
+// Distributions computes the current distributions of value sizes, remaining
+// TTLs and per-entry hit counts. It walks every entry under the read lock.
+func (cs *CacheSystem) Distributions() (Distributions, error) {
+	if err := cs.rlock(); err != nil {
+		return Distributions{}, err
+	}
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	var sizes, ttls, hits histogram
+	var d Distributions
+	for e := cs.entries.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*CacheEntry)
+		if cs.isStale(entry) || entry.expiredAt(now) || cs.sessionExpired(entry, now) {
+			continue
+		}
+		d.Entries++
+		sizes.observe(int64(len(entry.Value)))
+		if entry.Expiration.IsZero() {
+			d.NoExpiry++
+		} else {
+			ttls.observe(entry.remainingTTL(now))
+		}
+		hits.observe(entry.hits)
+	}
+	d.GeneratedAt = now.UTC()
+	d.ValueBytes = sizes.export()
+	d.TTLSeconds = ttls.export()
+	d.Hits = hits.export()
+	return d, nil
+}
+
+// serveAdminDistributions handles GET /admin/distributions.
+func serveAdminDistributions(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	d, err := cache.Distributions()
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d)
+}
+
+// maxExpirySlots bounds the number of slots in an expiry histogram.
+const maxExpirySlots = 1440
+
+// ExpirySlot counts the entries due to expire in [From, To).
+type ExpirySlot struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Count int64     `json:"count"`
+	Bytes int64     `json:"bytes"`
+}
+
+// ExpiryHistogram shows how many entries expire in each of a run of equal
+// slots starting now, so a wave of expirations, and the misses that follow
+// it, can be seen coming.
+type ExpiryHistogram struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Width       float64      `json:"width"` // seconds per slot
+	Slots       []ExpirySlot `json:"slots"`
+	Later       int64        `json:"later"`     // entries expiring after the last slot
+	NoExpiry    int64        `json:"no_expiry"` // entries without an expiration
+}
+
+// ExpiryHistogram counts the live entries of bucket, or of the whole cache
+// if bucket is empty, by when they expire, in n slots of width each. It walks
+// the entries under the read lock.
+func (cs *CacheSystem) ExpiryHistogram(bucket string, width time.Duration, n int) (ExpiryHistogram, error) {
+	if err := cs.rlock(); err != nil {
+		return ExpiryHistogram{}, err
+	}
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	h := ExpiryHistogram{GeneratedAt: now.UTC(), Width: width.Seconds(), Slots: make([]ExpirySlot, n)}
+	for i := range h.Slots {
+		h.Slots[i].From = now.Add(time.Duration(i) * width).UTC()
+		h.Slots[i].To = now.Add(time.Duration(i+1) * width).UTC()
+	}
+	observe := func(entry *CacheEntry) {
+		if cs.isStale(entry) || entry.expiredAt(now) || cs.sessionExpired(entry, now) {
+			return
+		}
+		if entry.Expiration.IsZero() {
+			h.NoExpiry++
+			return
+		}
+		i := int64(entry.Expiration.Sub(now) / width)
+		if i >= int64(n) {
+			h.Later++
+			return
+		}
+		h.Slots[i].Count++
+		h.Slots[i].Bytes += int64(entry.Size)
+	}
+	if bucket == "" {
+		for e := cs.entries.Front(); e != nil; e = e.Next() {
+			observe(e.Value.(*CacheEntry))
+		}
+	} else if keys, ok := cs.buckets[bucket]; ok {
+		keys.each(func(key string) {
+			if elem, ok := cs.items[[2]string{bucket, key}]; ok {
+				observe(elem.Value.(*CacheEntry))
+			}
+		})
+	}
+	return h, nil
+}
+
+// serveAdminExpiryHistogram handles GET /admin/expiry-histogram?width=&slots=&bucket=.
+// The default is a slot per minute for the next hour across all buckets.
+func serveAdminExpiryHistogram(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	q := r.URL.Query()
+	width, slots := time.Minute, 60
+	if s := q.Get("width"); s != "" {
+		d, err := parseTTL(s)
+		if err != nil || d < time.Second {
+			writeError(w, http.StatusBadRequest, "width must be at least 1s")
+			return
+		}
+		width = d
+	}
+	if s := q.Get("slots"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxExpirySlots {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("slots must be between 1 and %d", maxExpirySlots))
+			return
+		}
+		slots = n
+	}
+	h, err := cache.ExpiryHistogram(q.Get("bucket"), width, slots)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h)
+}
+
+// writeDistributions writes the current distributions to path as JSON,
+// replacing the previous file atomically.
+func writeDistributions(cache *CacheSystem, path string) error {
+	d, err := cache.Distributions()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// exportDistributions writes the distributions to path every interval until
+// stop is closed.
+func exportDistributions(cache *CacheSystem, path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if !cache.maintenanceAllows(taskExport, now) {
+				continue
+			}
+			if err := writeDistributions(cache, path); err != nil {
+				log.Printf("distribution export to %s failed: %v", path, err)
+			}
+		}
+	}
+}
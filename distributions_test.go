@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, v := range []int64{0, 1, 2, 3, 4, 5, 1000} {
+		h.observe(v)
+	}
+	got := h.export()
+	want := []HistogramBucket{{LE: 1, Count: 2}, {LE: 2, Count: 1}, {LE: 4, Count: 2}, {LE: 8, Count: 1}, {LE: 1024, Count: 1}}
+	if got.Count != 7 || got.Sum != 1015 || got.Max != 1000 || len(got.Buckets) != len(want) {
+		t.Fatalf("unexpected histogram %+v", got)
+	}
+	for i := range want {
+		if got.Buckets[i] != want[i] {
+			t.Fatalf("bucket %d: want %+v, got %+v", i, want[i], got.Buckets[i])
+		}
+	}
+}
+
+func TestCacheSystem_Distributions(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.Set("b", "small", "x")
+	cache.SetWithTTL("b", "big", strings.Repeat("x", 3000), 10*time.Second)
+	cache.Set("b", "forever", "v")
+	cache.Persist("b", "forever")
+	for i := 0; i < 5; i++ {
+		cache.Get("b", "small")
+	}
+
+	d, err := cache.Distributions()
+	if err != nil {
+		t.Fatalf("Distributions => %v", err)
+	}
+	if d.Entries != 3 || d.NoExpiry != 1 || d.TTLSeconds.Count != 2 {
+		t.Fatalf("unexpected counts %+v", d)
+	}
+	if d.ValueBytes.Max != 3000 || d.Hits.Max != 5 || d.Hits.Sum != 5 {
+		t.Fatalf("unexpected histograms %+v %+v", d.ValueBytes, d.Hits)
+	}
+
+	// A rewrite starts the hit count over
+	cache.Set("b", "small", "y")
+	if d, _ = cache.Distributions(); d.Hits.Sum != 0 {
+		t.Fatalf("expected hits to reset on write, got %+v", d.Hits)
+	}
+}
+
+func TestCacheSystem_ExpiryHistogram(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.SetWithTTL("b", "soon", "x", 30*time.Second)
+	cache.SetWithTTL("b", "soon2", "xx", 50*time.Second)
+	cache.SetWithTTL("b", "later", "x", 150*time.Second)
+	cache.SetWithTTL("b", "much-later", "x", time.Hour)
+	cache.Set("b", "forever", "v")
+	cache.Persist("b", "forever")
+	cache.SetWithTTL("other", "soon", "x", 30*time.Second)
+
+	h, err := cache.ExpiryHistogram("b", time.Minute, 3)
+	if err != nil {
+		t.Fatalf("ExpiryHistogram => %v", err)
+	}
+	if len(h.Slots) != 3 || h.Width != 60 || h.Later != 1 || h.NoExpiry != 1 {
+		t.Fatalf("unexpected histogram %+v", h)
+	}
+	if s := h.Slots[0]; s.Count != 2 || s.Bytes != int64(len("b")*2+len("soon")+len("soon2")+3) || s.To.Sub(s.From) != time.Minute {
+		t.Fatalf("unexpected first slot %+v", s)
+	}
+	if h.Slots[1].Count != 0 || h.Slots[2].Count != 1 {
+		t.Fatalf("unexpected slots %+v", h.Slots)
+	}
+
+	if h, _ = cache.ExpiryHistogram("", time.Minute, 1); h.Slots[0].Count != 3 {
+		t.Fatalf("expected the whole cache to be counted, got %+v", h.Slots)
+	}
+}
+
+func TestDistributionExport(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.Set("secret-bucket", "secret-key", "value")
+
+	path := filepath.Join(t.TempDir(), "dist.json")
+	stop := make(chan struct{})
+	go exportDistributions(cache, path, 10*time.Millisecond, stop)
+	defer close(stop)
+
+	var data []byte
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if b, err := os.ReadFile(path); err == nil {
+			data = b
+			break
+		}
+	}
+	var d Distributions
+	if err := json.Unmarshal(data, &d); err != nil || d.Entries != 1 {
+		t.Fatalf("expected an export with one entry, got %s (%v)", data, err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Fatalf("export must not name buckets or keys: %s", data)
+	}
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/admin/distributions")
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(&d); err != nil || resp.StatusCode != http.StatusOK || d.Entries != 1 {
+		t.Fatalf("unexpected endpoint response %d %+v (%v)", resp.StatusCode, d, err)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Finding severities reported by the doctor subcommand.
+const (
+	doctorOK   = "OK"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+)
+
+type doctorFinding struct {
+	Level   string
+	Check   string
+	Message string
+}
+
+// runDoctor implements `kitsune doctor [flags]`: it checks the configuration
+// the server would start with and the host it would run on, prints one line
+// per finding, and returns the process exit code (1 if anything failed).
+func runDoctor(args []string, out io.Writer) int {
+	var cfg serverConfig
+	fs := flag.NewFlagSet("kitsune doctor", flag.ContinueOnError)
+	fs.SetOutput(out)
+	cfg.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// An unknown preset sets nothing; checkConfig reports it.
+	_, _ = cfg.applyPreset(fs)
+
+	var findings []doctorFinding
+	findings = append(findings, checkConfig(&cfg)...)
+	findings = append(findings, checkPort(&cfg))
+	findings = append(findings, checkMemory(&cfg))
+	findings = append(findings, checkDisk())
+	findings = append(findings, checkPersistence(&cfg)...)
+
+	failed := 0
+	for _, f := range findings {
+		fmt.Fprintf(out, "[%-4s] %-12s %s\n", f.Level, f.Check, f.Message)
+		if f.Level == doctorFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(out, "%d check(s) failed; fix them before starting the server.\n", failed)
+		return 1
+	}
+	fmt.Fprintln(out, "All checks passed.")
+	return 0
+}
+
+func checkConfig(cfg *serverConfig) []doctorFinding {
+	var findings []doctorFinding
+	add := func(level, msg string) {
+		findings = append(findings, doctorFinding{level, "config", msg})
+	}
+
+	if _, err := presetFlags(cfg.Preset, 0); err != nil {
+		add(doctorFail, "invalid -preset: "+err.Error())
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		add(doctorFail, fmt.Sprintf("-port %d is outside 1-65535", cfg.Port))
+	}
+	if cfg.TTL < 0 {
+		add(doctorWarn, fmt.Sprintf("-ttl %s is negative and will be treated as 0 (entries never expire)", cfg.TTL))
+	}
+	if cfg.CleanupInterval <= 0 {
+		add(doctorWarn, fmt.Sprintf("-cleanup-interval %s will be raised to 1 second", cfg.CleanupInterval))
+	}
+	if cfg.CleanupAdaptive && cfg.CleanupMinInterval > cfg.CleanupInterval {
+		add(doctorWarn, fmt.Sprintf("-cleanup-min-interval %s is above -cleanup-interval %s and will be lowered to match", cfg.CleanupMinInterval, cfg.CleanupInterval))
+	}
+	if cfg.MaxEntrySize > 0 && cfg.MaxSize > 0 && cfg.MaxSize < cfg.MaxEntrySize {
+		add(doctorWarn, fmt.Sprintf("-max-size %d is below -max-entry-size %d and will be raised to match", cfg.MaxSize, cfg.MaxEntrySize))
+	}
+	if cfg.DefaultKeyspace == "" {
+		add(doctorWarn, "-default-keyspace is empty; /keys/ routes will share the unnamed bucket")
+	}
+	if cfg.LockTimeout < 0 {
+		add(doctorWarn, fmt.Sprintf("-lock-timeout %s is negative and will wait forever", cfg.LockTimeout))
+	}
+	if _, err := cfg.requestLimits(); err != nil {
+		add(doctorFail, err.Error())
+	}
+	if err := cfg.validateTimeouts(); err != nil {
+		add(doctorFail, err.Error())
+	}
+	if _, err := cfg.trustedProxies(); err != nil {
+		add(doctorFail, err.Error())
+	}
+	if _, err := cfg.disabledEndpoints(); err != nil {
+		add(doctorFail, err.Error())
+	}
+	concurrency, err := cfg.concurrencyLimit()
+	if err != nil {
+		add(doctorFail, err.Error())
+	} else if shedding, err := cfg.loadShedding(concurrency); err != nil {
+		add(doctorFail, err.Error())
+	} else if len(shedding.Thresholds) > 0 && concurrency.Max == 0 && debug.SetMemoryLimit(-1) == math.MaxInt64 {
+		add(doctorWarn, "-shed-endpoints has nothing to measure pressure against; set -max-concurrent-requests or GOMEMLIMIT")
+	}
+	if err := cfg.validateChecksums(); err != nil {
+		add(doctorFail, err.Error())
+	}
+	if _, err := cfg.connectionTracker(); err != nil {
+		add(doctorFail, err.Error())
+	}
+	if _, err := cfg.loader(); err != nil {
+		add(doctorFail, err.Error())
+	}
+	if err := cfg.validateStore(); err != nil {
+		add(doctorFail, err.Error())
+	}
+	if cfg.TLSSelfSigned {
+		add(doctorWarn, "-tls-self-signed serves a certificate no client trusts by default; use it for development only")
+	}
+	if w, err := cfg.maintenanceWindow(); err != nil {
+		add(doctorFail, err.Error())
+	} else if w != nil && w.ForcePressure > 0 && debug.SetMemoryLimit(-1) == math.MaxInt64 {
+		add(doctorWarn, "-maintenance-window defers expiry sweeps but nothing can force them; set GOMEMLIMIT for -maintenance-force-pressure to apply")
+	}
+	if err := cfg.validateSLO(); err != nil {
+		add(doctorFail, err.Error())
+	}
+	if cfg.DistributionExport != "" && cfg.DistributionInterval <= 0 {
+		add(doctorFail, fmt.Sprintf("-distribution-interval %s must be positive", cfg.DistributionInterval))
+	}
+	if len(findings) == 0 {
+		add(doctorOK, "flags are valid")
+	}
+	return findings
+}
+
+func checkPort(cfg *serverConfig) doctorFinding {
+	addrs, err := cfg.listenAddrs()
+	if err != nil {
+		return doctorFinding{doctorFail, "port", err.Error()}
+	}
+	listeners, err := listenAll(addrs)
+	if err != nil {
+		return doctorFinding{doctorFail, "port", fmt.Sprintf("cannot bind %v; stop the process holding it or pick another -host/-port", err)}
+	}
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	return doctorFinding{doctorOK, "port", strings.Join(addrs, ", ") + " available"}
+}
+
+func checkMemory(cfg *serverConfig) doctorFinding {
+	avail, source := availableMemory()
+	if avail <= 0 {
+		return doctorFinding{doctorWarn, "memory", "could not determine available memory on this platform"}
+	}
+	if cfg.MaxSize <= 0 || cfg.MaxSize == DEFAULT_MAX_SIZE {
+		return doctorFinding{doctorWarn, "memory", fmt.Sprintf("-max-size is unbounded but only %s is available (%s); set -max-size to leave headroom", formatBytes(avail), source)}
+	}
+	// Entry bookkeeping roughly doubles the footprint of the raw data.
+	if need := 2 * cfg.MaxSize; need > avail {
+		return doctorFinding{doctorFail, "memory", fmt.Sprintf("-max-size %s may need ~%s but only %s is available (%s)", formatBytes(cfg.MaxSize), formatBytes(need), formatBytes(avail), source)}
+	}
+	return doctorFinding{doctorOK, "memory", fmt.Sprintf("%s available (%s) for -max-size %s", formatBytes(avail), source, formatBytes(cfg.MaxSize))}
+}
+
+func checkDisk() doctorFinding {
+	free, err := diskFree(".")
+	if err != nil {
+		return doctorFinding{doctorWarn, "disk", fmt.Sprintf("could not measure free disk space: %v", err)}
+	}
+	if free < 1<<30 {
+		return doctorFinding{doctorWarn, "disk", fmt.Sprintf("only %s free in the working directory (logs and core dumps need room)", formatBytes(free))}
+	}
+	return doctorFinding{doctorOK, "disk", formatBytes(free) + " free in the working directory"}
+}
+
+// checkPersistence verifies the files in -store-dir as verify-backup does.
+// It only reads the directory, which the server creates if it is missing.
+func checkPersistence(cfg *serverConfig) []doctorFinding {
+	if cfg.StoreDir == "" {
+		return []doctorFinding{{doctorOK, "persistence", "no -store-dir is configured; nothing to verify"}}
+	}
+	info, err := os.Stat(cfg.StoreDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []doctorFinding{{doctorOK, "persistence", fmt.Sprintf("-store-dir %s does not exist yet and will be created", cfg.StoreDir)}}
+	} else if err != nil {
+		return []doctorFinding{{doctorFail, "persistence", fmt.Sprintf("cannot read -store-dir: %v", err)}}
+	} else if !info.IsDir() {
+		return []doctorFinding{{doctorFail, "persistence", fmt.Sprintf("-store-dir %s is not a directory", cfg.StoreDir)}}
+	}
+
+	report, err := verifyBackup(cfg.StoreDir, CacheConfig{MaxEntrySize: cfg.MaxEntrySize, MaxSize: cfg.MaxSize})
+	if err != nil {
+		return []doctorFinding{{doctorFail, "persistence", fmt.Sprintf("cannot read -store-dir: %v", err)}}
+	}
+	var findings []doctorFinding
+	for _, w := range report.Warnings {
+		findings = append(findings, doctorFinding{doctorWarn, "persistence", w})
+	}
+	for _, p := range report.Problems {
+		findings = append(findings, doctorFinding{doctorFail, "persistence", p})
+	}
+	if len(findings) == 0 {
+		entries := 0
+		for _, b := range report.Buckets {
+			entries += b.Entries
+		}
+		findings = append(findings, doctorFinding{doctorOK, "persistence", fmt.Sprintf("%d entries in %d buckets of -store-dir verified", entries, len(report.Buckets))})
+	}
+	return findings
+}
+
+// availableMemory returns the memory the process can use, preferring a
+// cgroup limit over the host's MemAvailable, and where the figure came from.
+func availableMemory() (int64, string) {
+	if limit := cgroupMemoryLimit(); limit > 0 {
+		return limit, "cgroup limit"
+	}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err == nil {
+				return kb * 1024, "MemAvailable"
+			}
+		}
+	}
+	return 0, ""
+}
+
+// cgroupMemoryLimit returns the cgroup v2 or v1 memory limit, or 0 if none applies.
+func cgroupMemoryLimit() int64 {
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		// v2 reports "max" and v1 a huge page-aligned number when unlimited.
+		if err == nil && limit > 0 && limit < 1<<62 {
+			return limit
+		}
+	}
+	return 0
+}
+
+// formatBytes renders n using binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
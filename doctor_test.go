@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen => %v", err)
+	}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	// Port held by another listener => failure
+	var out bytes.Buffer
+	code := runDoctor([]string{"-host", "127.0.0.1", "-port", port}, &out)
+	if code != 1 || !strings.Contains(out.String(), "[FAIL] port") {
+		t.Fatalf("expected port failure, got code %d:\n%s", code, out.String())
+	}
+	ln.Close()
+
+	// Free port and sane settings => success
+	out.Reset()
+	code = runDoctor([]string{"-host", "127.0.0.1", "-port", port, "-max-size", "1048576"}, &out)
+	if code != 0 || !strings.Contains(out.String(), "[OK  ] port") {
+		t.Fatalf("expected checks to pass, got code %d:\n%s", code, out.String())
+	}
+
+	// Bad flag values are reported as findings
+	out.Reset()
+	code = runDoctor([]string{"-host", "127.0.0.1", "-port", "70000", "-ttl", "-5", "-max-body-size-per-endpoint", "keys", "-preset", "staging"}, &out)
+	if code != 1 {
+		t.Fatalf("expected failure for invalid config, got code %d:\n%s", code, out.String())
+	}
+	for _, want := range []string{"-port 70000", "-ttl -5", "max-body-size-per-endpoint", "-preset"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected finding mentioning %q in:\n%s", want, out.String())
+		}
+	}
+
+	// -store-dir is verified like a backup, and never created
+	dir := filepath.Join(t.TempDir(), "store")
+	out.Reset()
+	code = runDoctor([]string{"-host", "127.0.0.1", "-port", port, "-max-size", "1048576", "-store-dir", dir}, &out)
+	if code != 0 || !strings.Contains(out.String(), "does not exist yet") {
+		t.Fatalf("expected a missing -store-dir to pass, got code %d:\n%s", code, out.String())
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected doctor not to create -store-dir, got %v", err)
+	}
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatalf("newFileStore => %v", err)
+	}
+	store.Put("users", "a", StoredValue{Value: "1"})
+	out.Reset()
+	code = runDoctor([]string{"-host", "127.0.0.1", "-port", port, "-max-size", "1048576", "-store-dir", dir}, &out)
+	if code != 0 || !strings.Contains(out.String(), "[OK  ] persistence  1 entries in 1 buckets") {
+		t.Fatalf("expected -store-dir to verify, got code %d:\n%s", code, out.String())
+	}
+	os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644)
+	out.Reset()
+	code = runDoctor([]string{"-host", "127.0.0.1", "-port", port, "-max-size", "1048576", "-store-dir", dir}, &out)
+	if code != 1 || !strings.Contains(out.String(), "[FAIL] persistence  stray file notes.txt") {
+		t.Fatalf("expected a stray file to fail, got code %d:\n%s", code, out.String())
+	}
+
+	// Unparseable flags exit with 2
+	out.Reset()
+	if code = runDoctor([]string{"-no-such-flag"}, &out); code != 2 {
+		t.Fatalf("expected exit code 2 for unknown flag, got %d", code)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{512: "512 B", 2048: "2.0 KiB", 3 << 30: "3.0 GiB"}
+	for n, want := range cases {
+		if got := formatBytes(n); got != want {
+			t.Fatalf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
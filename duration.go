@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTTL accepts either a whole number of seconds ("120", as TTLs have
+// always been given) or a Go duration ("250ms", "1m30s").
+func parseTTL(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: use seconds or a duration like 250ms", s)
+	}
+	return d, nil
+}
+
+// ttlFlag is a flag.Value for durations that also accepts plain seconds,
+// so existing command lines like -ttl 3600 keep working.
+type ttlFlag struct{ d *time.Duration }
+
+func (f ttlFlag) String() string {
+	if f.d == nil {
+		return ""
+	}
+	return f.d.String()
+}
+
+func (f ttlFlag) Set(s string) error {
+	d, err := parseTTL(s)
+	if err != nil {
+		return err
+	}
+	*f.d = d
+	return nil
+}
+
+// ttlFlagVar defines a ttlFlag on fs with the given default.
+func ttlFlagVar(fs *flag.FlagSet, p *time.Duration, name string, value time.Duration, usage string) {
+	*p = value
+	fs.Var(ttlFlag{p}, name, usage)
+}
+
+// jsonTTL is a TTL in a request body: a number of seconds (fractions
+// allowed) or a duration string such as "250ms".
+type jsonTTL time.Duration
+
+func (t *jsonTTL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		d, err := parseTTL(s)
+		if err != nil {
+			return err
+		}
+		*t = jsonTTL(d)
+		return nil
+	}
+	var secs float64
+	if err := json.Unmarshal(data, &secs); err != nil {
+		return fmt.Errorf("ttl must be a number of seconds or a duration string")
+	}
+	*t = jsonTTL(secs * float64(time.Second))
+	return nil
+}
+
+// MarshalJSON writes the TTL as a duration string, which UnmarshalJSON
+// reads back.
+func (t jsonTTL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(t).String())
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// endpointSurfaces are the parts of the API that -disable-endpoints can turn
+// off, with what each covers.
+var endpointSurfaces = map[string]string{
+	"keys":          "/keys/, the default keyspace routes",
+	"bucket-delete": "DELETE /buckets and DELETE /buckets/{bucket}",
+	"bulk":          "/mset, /mget, /mdelete and PUT /buckets/{bucket}",
+	"imports":       "/imports",
+	"config":        "/buckets/{bucket}/config",
+	"freeze":        "/buckets/{bucket}/freeze and /thaw",
+	"watch":         "/buckets/{bucket}/watch",
+	"sessions":      "/sessions/",
+	"counters":      "/counters/",
+	"lists":         "/lists/",
+	"hashes":        "/hashes/",
+	"zsets":         "/zsets/",
+	"json":          "/json/",
+	"hlls":          "/hlls/",
+	"blooms":        "/blooms/",
+	"bitmaps":       "/bitmaps/",
+	"ratelimit":     "/ratelimit/",
+	"semaphores":    "/semaphores/",
+	"schedules":     "/schedules",
+	"stats":         "/stats and /buckets/{bucket}/stats",
+	"admin":         "/admin/",
+	"metrics":       "/metrics",
+}
+
+// requestSurface returns the surface r belongs to, or "" if it is part of
+// the core API that can't be disabled.
+func requestSurface(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/metrics":
+		return "metrics"
+	case path == "/stats":
+		return "stats"
+	case strings.HasPrefix(path, "/admin/"):
+		return "admin"
+	case path == "/mset", path == "/mget", path == "/mdelete":
+		return "bulk"
+	case path == "/imports":
+		return "imports"
+	case path == "/schedules", strings.HasPrefix(path, "/schedules/"):
+		return "schedules"
+	case strings.HasPrefix(path, "/sessions/"):
+		return "sessions"
+	case strings.HasPrefix(path, "/keys/"):
+		return "keys"
+	case strings.HasPrefix(path, "/counters/"):
+		return "counters"
+	case strings.HasPrefix(path, "/lists/"):
+		return "lists"
+	case strings.HasPrefix(path, "/hashes/"):
+		return "hashes"
+	case strings.HasPrefix(path, "/zsets/"):
+		return "zsets"
+	case strings.HasPrefix(path, "/json/"):
+		return "json"
+	case strings.HasPrefix(path, "/hlls/"):
+		return "hlls"
+	case strings.HasPrefix(path, "/blooms/"):
+		return "blooms"
+	case strings.HasPrefix(path, "/bitmaps/"):
+		return "bitmaps"
+	case strings.HasPrefix(path, "/ratelimit/"):
+		return "ratelimit"
+	case strings.HasPrefix(path, "/semaphores/"):
+		return "semaphores"
+	case path == "/buckets":
+		if r.Method == http.MethodDelete {
+			return "bucket-delete"
+		}
+	case strings.HasPrefix(path, "/buckets/"):
+		_, sub, ok := strings.Cut(path[len("/buckets/"):], "/")
+		if !ok {
+			switch r.Method {
+			case http.MethodDelete:
+				return "bucket-delete"
+			case http.MethodPut:
+				return "bulk"
+			}
+			return ""
+		}
+		switch sub {
+		case "config", "watch", "stats":
+			return sub
+		case "freeze", "thaw":
+			return "freeze"
+		}
+	}
+	return ""
+}
+
+// DisabledEndpoints is a set of surfaces (see endpointSurfaces) that answer
+// 404 as if they did not exist, to shrink what a hardened deployment exposes.
+type DisabledEndpoints map[string]bool
+
+// parseDisabledEndpoints parses a comma-separated list of surface names.
+func parseDisabledEndpoints(s string) (DisabledEndpoints, error) {
+	disabled := make(DisabledEndpoints)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := endpointSurfaces[name]; !ok {
+			names := make([]string, 0, len(endpointSurfaces))
+			for n := range endpointSurfaces {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown endpoint surface %q (want one of %s)", name, strings.Join(names, ", "))
+		}
+		disabled[name] = true
+	}
+	return disabled, nil
+}
+
+// Middleware answers requests to disabled surfaces with 404.
+func (d DisabledEndpoints) Middleware(next http.Handler) http.Handler {
+	if len(d) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d[requestSurface(r)] {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
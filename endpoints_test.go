@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDisabledEndpoints(t *testing.T) {
+	disabled, err := parseDisabledEndpoints("keys, bucket-delete,admin")
+	if err != nil {
+		t.Fatalf("parseDisabledEndpoints => %v", err)
+	}
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(disabled.Middleware(createHandler(cache, "__root__")))
+	defer server.Close()
+	cache.Set("b", "k", "v")
+
+	cases := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/keys/k", http.StatusNotFound},
+		{http.MethodDelete, "/buckets/b", http.StatusNotFound},
+		{http.MethodDelete, "/buckets", http.StatusNotFound},
+		{http.MethodGet, "/admin/jobs", http.StatusNotFound},
+		{http.MethodGet, "/buckets/b", http.StatusOK},
+		{http.MethodGet, "/buckets/b/k", http.StatusOK},
+		{http.MethodDelete, "/buckets/b/k", http.StatusOK},
+		{http.MethodGet, "/stats", http.StatusOK},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, server.URL+c.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s => %v", c.method, c.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Fatalf("%s %s => %d, want %d", c.method, c.path, resp.StatusCode, c.want)
+		}
+	}
+	if size, _ := cache.GetBucketSize("b"); size != 0 {
+		t.Fatalf("expected the key delete to go through, got %d entries", size)
+	}
+
+	if _, err := parseDisabledEndpoints("keys,nope"); err == nil || !strings.Contains(err.Error(), "bucket-delete") {
+		t.Fatalf("expected an unknown surface to fail listing the valid ones, got %v", err)
+	}
+}
+
+func TestRequestSurface(t *testing.T) {
+	cases := map[string]string{
+		"PUT /buckets/b":          "bulk",
+		"POST /mset":              "bulk",
+		"PUT /buckets/b/config":   "config",
+		"POST /buckets/b/thaw":    "freeze",
+		"GET /buckets/b/stats":    "stats",
+		"GET /buckets/b/watch":    "watch",
+		"POST /imports":           "imports",
+		"GET /schedules/nightly":  "schedules",
+		"POST /sessions/s/renew":  "sessions",
+		"POST /counters/b/c/incr": "counters",
+		"POST /lists/b/q/rpush":   "lists",
+		"PATCH /hashes/b/h":       "hashes",
+		"POST /zsets/b/z/incr":    "zsets",
+		"PUT /json/b/doc":         "json",
+		"POST /hlls/b/h/merge":    "hlls",
+		"GET /blooms/b/f":         "blooms",
+		"POST /bitmaps/b/m/op":    "bitmaps",
+		"POST /ratelimit/b/u":     "ratelimit",
+		"DELETE /semaphores/b/s":  "semaphores",
+		"GET /metrics":            "metrics",
+		"GET /buckets":            "",
+		"GET /buckets/b/k/config": "",
+		"GET /":                   "",
+	}
+	for req, want := range cases {
+		method, path, _ := strings.Cut(req, " ")
+		if got := requestSurface(httptest.NewRequest(method, path, nil)); got != want {
+			t.Fatalf("requestSurface(%s) = %q, want %q", req, got, want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Event types published on the cache's change feed.
+const (
+	EventSet    = "set"
+	EventDelete = "delete"
+	EventExpire = "expire"
+	EventEvict  = "evict"
+	EventClear  = "clear" // Key is empty; an empty Bucket means every bucket
+)
+
+const (
+	// eventHistorySize is how many recent events are kept so that watchers
+	// can resume from a sequence number after reconnecting.
+	eventHistorySize = 4096
+	// subscriberBuffer is how far a subscriber may fall behind before it is
+	// dropped and has to resume.
+	subscriberBuffer = 256
+)
+
+// Event describes one change to the cache.
+type Event struct {
+	Seq    uint64 `json:"seq"`
+	Type   string `json:"type"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+// eventLog sequences events, keeps a bounded history, and fans them out to
+// subscribers. publish is called with CacheSystem.mu held for writing, so a
+// subscriber registered under the read lock sees no gap or overlap.
+type eventLog struct {
+	mu      sync.Mutex
+	seq     uint64
+	history []Event // ring buffer of the last eventHistorySize events
+	next    int     // index in history of the next write
+	subs    map[*subscription]struct{}
+}
+
+// subscription receives the events matching bucket ("" for all) and types
+// (nil for all) on ch. ch is closed if the subscriber falls too far behind.
+type subscription struct {
+	bucket string
+	types  map[string]bool
+	ch     chan Event
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{
+		history: make([]Event, 0, eventHistorySize),
+		subs:    make(map[*subscription]struct{}),
+	}
+}
+
+func (s *subscription) matches(e Event) bool {
+	if s.types != nil && !s.types[e.Type] {
+		return false
+	}
+	return s.bucket == "" || e.Bucket == s.bucket || (e.Type == EventClear && e.Bucket == "")
+}
+
+func (l *eventLog) publish(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	e.Seq = l.seq
+	if len(l.history) < eventHistorySize {
+		l.history = append(l.history, e)
+	} else {
+		l.history[l.next] = e
+	}
+	l.next = (l.next + 1) % eventHistorySize
+
+	for sub := range l.subs {
+		if !sub.matches(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			// Never block the cache on a slow reader.
+			close(sub.ch)
+			delete(l.subs, sub)
+		}
+	}
+}
+
+// subscribeLocked registers a subscriber; l.mu must be held.
+func (l *eventLog) subscribeLocked(bucket string) *subscription {
+	sub := &subscription{bucket: bucket, ch: make(chan Event, subscriberBuffer)}
+	l.subs[sub] = struct{}{}
+	return sub
+}
+
+func (l *eventLog) unsubscribe(sub *subscription) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.subs[sub]; ok {
+		delete(l.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// sinceLocked returns the buffered events after seq that match sub, or ok=false
+// if some of them have already been dropped from history. l.mu must be held.
+func (l *eventLog) sinceLocked(seq uint64, sub *subscription) (events []Event, ok bool) {
+	if seq > l.seq {
+		return nil, false
+	}
+	if seq == l.seq {
+		return nil, true
+	}
+	oldest := l.seq - uint64(len(l.history)) + 1
+	if seq+1 < oldest {
+		return nil, false
+	}
+	for i := range l.history {
+		e := l.history[(l.next+i)%len(l.history)]
+		if e.Seq > seq && sub.matches(e) {
+			events = append(events, e)
+		}
+	}
+	return events, true
+}
+
+// enableEvents turns on the change feed. Until then emit is a no-op, so
+// caches nobody watches pay nothing for it.
+func (cs *CacheSystem) enableEvents() {
+	cs.mu.Lock()
+	defer cs.unlock()
+	if cs.events == nil {
+		cs.events = newEventLog()
+	}
+}
+
+// Subscription is a feed of cache events for library users; see Subscribe.
+type Subscription struct {
+	// C receives the events in order. It is closed by Close, or if the
+	// subscriber falls more than subscriberBuffer events behind.
+	C <-chan Event
+
+	sub *subscription
+	log *eventLog
+}
+
+// Subscribe returns a feed of changes to bucket, or to every bucket if bucket
+// is empty, limited to the given event types (all of them if none are given).
+// Events are handed over without ever blocking the cache: a subscriber that
+// stops reading is dropped by closing C, and should subscribe again and
+// resynchronize. Close the subscription when done with it.
+func (cs *CacheSystem) Subscribe(bucket string, types ...string) (*Subscription, error) {
+	var filter map[string]bool
+	for _, typ := range types {
+		switch typ {
+		case EventSet, EventDelete, EventExpire, EventEvict, EventClear:
+		default:
+			return nil, fmt.Errorf("unknown event type %q", typ)
+		}
+		if filter == nil {
+			filter = make(map[string]bool)
+		}
+		filter[typ] = true
+	}
+
+	cs.enableEvents()
+	l := cs.events
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sub := l.subscribeLocked(bucket)
+	sub.types = filter
+	return &Subscription{C: sub.ch, sub: sub, log: l}, nil
+}
+
+// Close stops the subscription and closes C. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.log.unsubscribe(s.sub)
+}
+
+// emit counts a change in the bucket's stats and publishes it on the change
+// feed, and passes deletes on to the store; cs.mu must be held for writing.
+func (cs *CacheSystem) emit(typ, bucket, key, value string) {
+	if typ != EventClear {
+		cs.stats.record(bucket, typ)
+	}
+	if typ == EventDelete {
+		cs.storeLocked(storeOp{bucket: bucket, key: key, delete: true})
+	}
+	if cs.events != nil {
+		cs.events.publish(Event{Type: typ, Bucket: bucket, Key: key, Value: value})
+	}
+}
+
+// bucketWatch is the starting state of a watch: either the backlog of events
+// since the requested sequence number, or (if that couldn't be honored) a
+// snapshot of the bucket. Seq is the position the subscription starts from.
+type bucketWatch struct {
+	Resumed  bool
+	Backlog  []Event
+	Snapshot []EntryInfo
+	Seq      uint64
+	sub      *subscription
+}
+
+// watchBucket subscribes to changes in bucket. If resume is set and every
+// event after since is still buffered, those are returned instead of a
+// snapshot. The change feed must have been enabled with enableEvents.
+func (cs *CacheSystem) watchBucket(bucket string, since uint64, resume bool) (*bucketWatch, error) {
+	if err := cs.rlock(); err != nil {
+		return nil, err
+	}
+	defer cs.mu.RUnlock()
+
+	l := cs.events
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bw := &bucketWatch{Seq: l.seq, sub: l.subscribeLocked(bucket)}
+	if resume {
+		if bw.Backlog, bw.Resumed = l.sinceLocked(since, bw.sub); bw.Resumed {
+			return bw, nil
+		}
+	}
+
+	bw.Snapshot = cs.bucketSnapshotLocked(bucket, time.Now())
+	return bw, nil
+}
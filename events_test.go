@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// readSSE returns the next event from r, skipping comments.
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event => %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if ev.Event != "" {
+				return ev
+			}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "id: "):
+			ev.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func openWatch(t *testing.T, url, lastEventID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET watch => %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		resp.Body.Close()
+		t.Fatalf("expected 200 event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestHTTP_BucketWatch(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.Set("conf", "b", "2")
+	cache.Set("conf", "a", "1")
+	cache.Set("other", "x", "y")
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	// Snapshot in key order, then ready
+	resp, r := openWatch(t, server.URL+"/buckets/conf/watch", "")
+	for _, want := range []string{"a", "b"} {
+		ev := readSSE(t, r)
+		var entry EntryInfo
+		if err := json.Unmarshal([]byte(ev.Data), &entry); err != nil {
+			t.Fatalf("decode snapshot => %v", err)
+		}
+		if ev.Event != "snapshot" || entry.Key != want {
+			t.Fatalf("expected snapshot of %q, got %+v", want, ev)
+		}
+	}
+	if ev := readSSE(t, r); ev.Event != "ready" {
+		t.Fatalf("expected ready, got %+v", ev)
+	}
+
+	// Live changes; other buckets are filtered out
+	cache.Set("other", "x", "z")
+	cache.Set("conf", "c", "3")
+	cache.Delete("conf", "a")
+	set := readSSE(t, r)
+	var e Event
+	if err := json.Unmarshal([]byte(set.Data), &e); err != nil {
+		t.Fatalf("decode event => %v", err)
+	}
+	if set.Event != EventSet || e.Key != "c" || e.Value != "3" || set.ID == "" {
+		t.Fatalf("unexpected set event %+v", set)
+	}
+	del := readSSE(t, r)
+	if del.Event != EventDelete {
+		t.Fatalf("expected delete, got %+v", del)
+	}
+	resp.Body.Close()
+
+	// Resume after the set: only the delete and what happened since are replayed
+	cache.Clear("conf")
+	resp, r = openWatch(t, server.URL+"/buckets/conf/watch", set.ID)
+	if ev := readSSE(t, r); ev.Event != EventDelete || ev.ID != del.ID {
+		t.Fatalf("expected replayed delete, got %+v", ev)
+	}
+	if ev := readSSE(t, r); ev.Event != EventClear {
+		t.Fatalf("expected replayed clear, got %+v", ev)
+	}
+	resp.Body.Close()
+
+	// A token from the future can't be honored => reset and a fresh snapshot
+	resp, r = openWatch(t, server.URL+"/buckets/conf/watch?since=999999", "")
+	defer resp.Body.Close()
+	if ev := readSSE(t, r); ev.Event != "reset" {
+		t.Fatalf("expected reset, got %+v", ev)
+	}
+	if ev := readSSE(t, r); ev.Event != "ready" {
+		t.Fatalf("expected ready after an empty snapshot, got %+v", ev)
+	}
+
+	// Bad token => 400
+	bad, err := http.Get(server.URL + "/buckets/conf/watch?since=abc")
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad token, got %d", bad.StatusCode)
+	}
+}
+
+func TestEventLog_SlowSubscriberIsDropped(t *testing.T) {
+	l := newEventLog()
+	l.mu.Lock()
+	sub := l.subscribeLocked("b")
+	l.mu.Unlock()
+
+	for i := 0; i < subscriberBuffer+1; i++ {
+		l.publish(Event{Type: EventSet, Bucket: "b", Key: "k"})
+	}
+	deadline := time.After(time.Second)
+	for n := 0; ; n++ {
+		select {
+		case _, open := <-sub.ch:
+			if !open {
+				if n != subscriberBuffer {
+					t.Fatalf("expected %d buffered events before close, got %d", subscriberBuffer, n)
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatalf("expected the lagging subscriber to be closed")
+		}
+	}
+}
+
+func TestCacheSystem_Subscribe(t *testing.T) {
+	cs := NewCacheSystem(20, 40, 60, 999999)
+	defer cs.Stop()
+
+	if _, err := cs.Subscribe("", "bogus"); err == nil {
+		t.Fatalf("expected an error for an unknown event type")
+	}
+	all, err := cs.Subscribe("")
+	if err != nil {
+		t.Fatalf("Subscribe => %v", err)
+	}
+	defer all.Close()
+	removals, err := cs.Subscribe("b", EventExpire, EventEvict)
+	if err != nil {
+		t.Fatalf("Subscribe => %v", err)
+	}
+
+	cs.Set("b", "k1", "0123456789") // 13 bytes
+	cs.Set("other", "k1", "0123456789")
+	cs.Set("b", "k2", "0123456789") // evicts b/k1
+	cs.SetWithTTL("b", "k3", "v", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	cs.Get("b", "k3") // expires on read
+	cs.Delete("b", "k2")
+
+	next := func(s *Subscription) Event {
+		select {
+		case e := <-s.C:
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("expected an event")
+		}
+		return Event{}
+	}
+	var types []string
+	for i := 0; i < 4; i++ {
+		types = append(types, next(all).Type)
+	}
+	if fmt.Sprint(types) != "[set set set evict]" {
+		t.Fatalf("expected every change in order, got %v", types)
+	}
+	if e := next(removals); e.Type != EventEvict || e.Bucket != "b" || e.Key != "k1" {
+		t.Fatalf("expected the eviction of b/k1, got %+v", e)
+	}
+	if e := next(removals); e.Type != EventExpire || e.Key != "k3" {
+		t.Fatalf("expected the expiry of b/k3, got %+v", e)
+	}
+
+	removals.Close()
+	removals.Close()
+	if _, open := <-removals.C; open {
+		t.Fatalf("expected Close to close the channel without the delete being delivered")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_FreezeThaw(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.Set("b", "k", "v")
+	cache.Set("other", "k", "v")
+	if err := cache.Freeze("b", 0); err != nil {
+		t.Fatalf("Freeze => %v", err)
+	}
+
+	writes := map[string]func() error{
+		"Set":    func() error { return cache.Set("b", "k", "v2") },
+		"Delete": func() error { _, err := cache.Delete("b", "k"); return err },
+		"Clear":  func() error { return cache.Clear("b") },
+		"IncrBy": func() error { _, err := cache.IncrBy("b", "n", 1); return err },
+		"Touch":  func() error { _, err := cache.Touch("b", "k", 0); return err },
+		"MSet": func() error {
+			return cache.MSet([]MultiItem{{Bucket: "other", BulkItem: BulkItem{Key: "x"}}, {Bucket: "b", BulkItem: BulkItem{Key: "x"}}}, WriteOptions{})
+		},
+		"ClearAll": cache.ClearAll,
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrBucketFrozen) {
+			t.Fatalf("%s on a frozen bucket => expected ErrBucketFrozen, got %v", name, err)
+		}
+	}
+	if val := cache.Get("b", "k"); val != "v" {
+		t.Fatalf("expected reads to keep working and the value untouched, got %q", val)
+	}
+	if _, found, _ := cache.Lookup("other", "x"); found {
+		t.Fatalf("expected a rejected MSet to write nothing")
+	}
+	if err := cache.Set("other", "k", "v2"); err != nil {
+		t.Fatalf("expected other buckets to stay writable, got %v", err)
+	}
+
+	if was, _ := cache.Thaw("b"); !was {
+		t.Fatalf("expected Thaw to report the bucket was frozen")
+	}
+	if err := cache.Set("b", "k", "v2"); err != nil {
+		t.Fatalf("expected a thawed bucket to be writable, got %v", err)
+	}
+
+	// A freeze with a TTL thaws by itself
+	cache.Freeze("b", 20*time.Millisecond)
+	if frozen, _ := cache.IsFrozen("b"); !frozen {
+		t.Fatalf("expected the bucket to be frozen")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := cache.Set("b", "k", "v3"); err != nil {
+		t.Fatalf("expected the freeze to have lapsed, got %v", err)
+	}
+}
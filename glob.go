@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrBadPattern is returned for a malformed glob pattern.
+var ErrBadPattern = errors.New("syntax error in pattern")
+
+// Glob patterns follow Redis' KEYS syntax rather than path.Match, since keys
+// are not paths: '*' matches any run of characters, '/' and ':' included.
+//
+//	*       any sequence of characters, including none
+//	?       any single character
+//	[abc]   one of the listed characters; [a-z] a range; [^a] or [!a] negates
+//	\c      the character c literally
+
+// validGlob returns an error wrapping ErrBadPattern if pattern is malformed:
+// an unterminated class or a trailing backslash.
+func validGlob(pattern string) error {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i++; i == len(pattern) {
+				return fmt.Errorf("%w: trailing backslash in %q", ErrBadPattern, pattern)
+			}
+		case '[':
+			_, width, ok := matchClass(pattern[i:], 0)
+			if !ok {
+				return fmt.Errorf("%w: unterminated [ in %q", ErrBadPattern, pattern)
+			}
+			i += width - 1
+		}
+	}
+	return nil
+}
+
+// globMatch reports whether s matches pattern, which must be valid.
+// A star remembers where it was so the match can backtrack to it, keeping
+// this linear in practice.
+func globMatch(pattern, s string) bool {
+	px, sx := 0, 0
+	starPx, starSx := -1, 0
+	for px < len(pattern) || sx < len(s) {
+		if px < len(pattern) {
+			switch c := pattern[px]; c {
+			case '*':
+				starPx, starSx = px, sx
+				px++
+				continue
+			case '?':
+				if sx < len(s) {
+					_, n := utf8.DecodeRuneInString(s[sx:])
+					px, sx = px+1, sx+n
+					continue
+				}
+			case '[':
+				if sx < len(s) {
+					r, n := utf8.DecodeRuneInString(s[sx:])
+					if ok, width, _ := matchClass(pattern[px:], r); ok {
+						px, sx = px+width, sx+n
+						continue
+					}
+				}
+			case '\\':
+				if sx < len(s) {
+					r, w := utf8.DecodeRuneInString(pattern[px+1:])
+					if sr, n := utf8.DecodeRuneInString(s[sx:]); sr == r {
+						px, sx = px+1+w, sx+n
+						continue
+					}
+				}
+			default:
+				if sx < len(s) && s[sx] == c {
+					px, sx = px+1, sx+1
+					continue
+				}
+			}
+		}
+		// Mismatch: let the last star swallow one more character and retry.
+		if starPx >= 0 && starSx < len(s) {
+			_, n := utf8.DecodeRuneInString(s[starSx:])
+			starSx += n
+			px, sx = starPx+1, starSx
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// matchClass matches r against the class at the start of pattern, which
+// begins with '['. It returns whether r is in the class, the width of the
+// class in pattern, and ok=false if the class is not terminated.
+func matchClass(pattern string, r rune) (matched bool, width int, ok bool) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '^' || pattern[i] == '!') {
+		negate = true
+		i++
+	}
+	// next reads one possibly escaped character of the class.
+	next := func() (rune, bool) {
+		if i < len(pattern) && pattern[i] == '\\' {
+			i++
+		}
+		if i >= len(pattern) {
+			return 0, false
+		}
+		c, n := utf8.DecodeRuneInString(pattern[i:])
+		i += n
+		return c, true
+	}
+	for i < len(pattern) && pattern[i] != ']' {
+		lo, ok := next()
+		if !ok {
+			return false, 0, false
+		}
+		hi := lo
+		if i+1 < len(pattern) && pattern[i] == '-' && pattern[i+1] != ']' {
+			i++
+			if hi, ok = next(); !ok {
+				return false, 0, false
+			}
+		}
+		if lo <= r && r <= hi {
+			matched = true
+		}
+	}
+	if i >= len(pattern) {
+		return false, 0, false
+	}
+	return matched != negate, i + 1, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "a/b:c", true},
+		{"user:*:profile", "user:42:profile", true},
+		{"user:*:profile", "user:42:posts:profile", true},
+		{"user:*:profile", "user:42:profile:old", false},
+		{"user:?", "user:7", true},
+		{"user:?", "user:42", false},
+		{"h?llo", "héllo", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[!e]llo", "hello", false},
+		{"v[0-9]", "v5", true},
+		{"v[0-9]", "vx", false},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*a*b*c*", "xxaxxbxxcxx", true},
+		{"*a*b*c*", "xxaxxcxxbxx", false},
+		{"a*", "b", false},
+	}
+	for _, c := range cases {
+		if err := validGlob(c.pattern); err != nil {
+			t.Fatalf("validGlob(%q) => %v", c.pattern, err)
+		}
+		if got := globMatch(c.pattern, c.s); got != c.want {
+			t.Fatalf("globMatch(%q, %q) = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+
+	for _, p := range []string{"[abc", `abc\`, "[a-"} {
+		if err := validGlob(p); !errors.Is(err, ErrBadPattern) {
+			t.Fatalf("expected validGlob(%q) to fail with ErrBadPattern, got %v", p, err)
+		}
+	}
+}
+
+func TestCacheSystem_Match(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	for _, k := range []string{"user:1:profile", "user:2:profile", "user:2:posts", "order:1"} {
+		cache.Set("b", k, "v")
+	}
+
+	keys, err := cache.Match("b", "user:*:profile")
+	if err != nil || len(keys) != 2 || keys[0] != "user:1:profile" || keys[1] != "user:2:profile" {
+		t.Fatalf("Match => %v, %v", keys, err)
+	}
+	if _, err := cache.Match("b", "user:[1"); !errors.Is(err, ErrBadPattern) {
+		t.Fatalf("expected ErrBadPattern, got %v", err)
+	}
+
+	var scanned []string
+	for cursor := ""; ; {
+		keys, next, err := cache.Scan("b", cursor, "user:", "*:p?st?", 1)
+		if err != nil {
+			t.Fatalf("Scan => %v", err)
+		}
+		scanned = append(scanned, keys...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if len(scanned) != 1 || scanned[0] != "user:2:posts" {
+		t.Fatalf("expected Scan to apply the pattern, got %v", scanned)
+	}
+}
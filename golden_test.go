@@ -0,0 +1,381 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Run `go test -run TestGolden -update` to re-record testdata/http_api.golden
+// after an intentional API change, then review the diff before committing.
+var updateGolden = flag.Bool("update", false, "rewrite golden files with the current responses")
+
+// goldenRequest is one step of the recorded API conversation. Steps run in
+// order against a single fresh server, so later steps see earlier writes.
+type goldenRequest struct {
+	method  string
+	path    string
+	headers map[string]string
+	body    string
+}
+
+// goldenHeaders are the response headers worth pinning; the rest (Date,
+// Content-Length) vary between runs or are implied by the body.
+var goldenHeaders = []string{"Allow", "Content-Type", "ETag", "Retry-After", "X-Kitsune-Schema-Warning"}
+
+// goldenTimestamp matches wall-clock times in response bodies, which are
+// replaced with a placeholder before comparing. goldenMillis does the same for
+// millisecond TTLs, which tick down while the conversation runs.
+var (
+	goldenTimestamp = regexp.MustCompile(`"\d{4}-\d{2}-\d{2}T[^"]*"`)
+	goldenMillis    = regexp.MustCompile(`"ttl_ms":[1-9]\d*`)
+)
+
+var goldenRequests = []goldenRequest{
+	{method: "GET", path: "/"},
+	{method: "GET", path: "/nope"},
+
+	// Default keyspace
+	{method: "GET", path: "/keys/foo"},
+	{method: "PUT", path: "/keys/foo", body: `{"value":"bar"}`},
+	{method: "GET", path: "/keys/foo"},
+	{method: "PUT", path: "/keys/foo", body: `{"value":`},
+	{method: "POST", path: "/keys/foo"},
+	{method: "DELETE", path: "/keys/foo"},
+	{method: "GET", path: "/keys/foo"},
+	{method: "GET", path: "/keys/"},
+
+	// Buckets
+	{method: "PUT", path: "/buckets/b1/k1", body: `{"value":"v1"}`},
+	{method: "PUT", path: "/buckets/b1/k2", body: `{"value":"v2"}`},
+	{method: "GET", path: "/buckets/b1"},
+	{method: "GET", path: "/buckets/b1/k1"},
+	{method: "GET", path: "/buckets/b1/k1?peek=true"},
+	{method: "HEAD", path: "/buckets/b1/k1"},
+	{method: "HEAD", path: "/buckets/b1/missing"},
+	{method: "PUT", path: "/buckets/b1/k2", headers: map[string]string{"X-Kitsune-Writer": "billing"}, body: `{"value":"v2"}`},
+	{method: "GET", path: "/buckets/b1/k2?info"},
+	{method: "GET", path: "/buckets/b1/missing?info"},
+	{method: "GET", path: "/buckets/b1/k1/ttl"},
+	{method: "GET", path: "/buckets/b1/missing/ttl"},
+	{method: "PUT", path: "/buckets/b1/k1/ttl", body: `{"value":"v"}`},
+	{method: "POST", path: "/buckets/b1/k1/touch", body: `{"ttl":600}`},
+	{method: "POST", path: "/buckets/b1/k1/touch"},
+	{method: "POST", path: "/buckets/b1/missing/touch"},
+	{method: "POST", path: "/buckets/b1/k1/touch", body: `{"ttl":-1}`},
+	{method: "POST", path: "/buckets/b1/k1/persist"},
+	{method: "GET", path: "/buckets/b1/k1/ttl"},
+	{method: "POST", path: "/buckets/b1/missing/persist"},
+	{method: "PUT", path: "/buckets/b1/once", body: `{"value":"claim"}`},
+	{method: "POST", path: "/buckets/b1/once/getdel"},
+	{method: "POST", path: "/buckets/b1/once/getdel"},
+	{method: "PUT", path: "/buckets/b1/once", body: `{"value":"claim"}`},
+	{method: "DELETE", path: "/buckets/b1/once?return=true"},
+	{method: "GET", path: "/buckets/b1/once/getdel"},
+	{method: "PUT", path: "/buckets/b1/lock", body: `{"value":"a","mode":"xx"}`},
+	{method: "PUT", path: "/buckets/b1/lock", body: `{"value":"a","mode":"nx"}`},
+	{method: "PUT", path: "/buckets/b1/lock", body: `{"value":"b","mode":"nx"}`},
+	{method: "PUT", path: "/buckets/b1/lock", body: `{"value":"c","mode":"xx"}`},
+	{method: "GET", path: "/buckets/b1/lock"},
+	{method: "PUT", path: "/buckets/b1/lock", body: `{"value":"d","mode":"maybe"}`},
+	{method: "PUT", path: "/buckets/b1/cas", body: `{"value":"v1"}`},
+	{method: "PUT", path: "/buckets/b1/cas", headers: map[string]string{"If-Match": `"999"`}, body: `{"value":"v2"}`},
+	{method: "GET", path: "/buckets/b1/cas"},
+	{method: "PUT", path: "/buckets/b1/cas", headers: map[string]string{"If-Match": `"9"`}, body: `{"value":"v2"}`},
+	{method: "PUT", path: "/buckets/b1/cas", body: `{"value":"v2","version":999}`},
+	{method: "PUT", path: "/buckets/b1/cas", headers: map[string]string{"If-Match": "soon"}, body: `{"value":"v2"}`},
+	{method: "POST", path: "/buckets/b1/hits/incr"},
+	{method: "POST", path: "/buckets/b1/hits/incr", body: `{"by":10}`},
+	{method: "POST", path: "/buckets/b1/hits/decr", body: `{"by":3}`},
+	{method: "GET", path: "/buckets/b1/hits"},
+	{method: "POST", path: "/buckets/b1/cas/incr"},
+	{method: "PATCH", path: "/buckets/b1/log", body: `{"append":"b,"}`},
+	{method: "PATCH", path: "/buckets/b1/log", body: `{"append":"c,"}`},
+	{method: "PATCH", path: "/buckets/b1/log", body: `{"prepend":"a,"}`},
+	{method: "GET", path: "/buckets/b1/log"},
+	{method: "PATCH", path: "/buckets/b1/log", body: `{"append":"x","prepend":"y"}`},
+	{method: "PUT", path: "/buckets/b1/short", body: `{"value":"v","ttl":"250ms"}`},
+	{method: "GET", path: "/buckets/b1/short/ttl"},
+	{method: "PUT", path: "/buckets/b1/short", body: `{"value":"v","ttl":"soon"}`},
+	{method: "PUT", path: "/buckets/b1/dated", body: `{"value":"v","expires_at":"2999-01-01T00:00:00Z"}`},
+	{method: "PUT", path: "/buckets/b1/dated", body: `{"value":"v","ttl":30,"expires_at":"2999-01-01T00:00:00Z"}`},
+	{method: "PUT", path: "/buckets/b1/dated", body: `{"value":"v","expires_at":"tomorrow"}`},
+	{method: "PATCH", path: "/buckets/b1"},
+	{method: "DELETE", path: "/buckets/b1/k1"},
+	{method: "DELETE", path: "/buckets/b1"},
+	{method: "GET", path: "/buckets/b1"},
+	{method: "GET", path: "/buckets/"},
+	{method: "PUT", path: "/buckets/bulk", body: `{"x":"1","y":{"value":"2","ttl":30}}`},
+	{method: "GET", path: "/buckets/bulk"},
+	{method: "PUT", path: "/buckets/bulk", body: `["not","an","object"]`},
+	{method: "GET", path: "/buckets/bulk/keys"},
+	{method: "GET", path: "/buckets/empty/keys"},
+	{method: "GET", path: "/buckets/bulk/scan"},
+	{method: "GET", path: "/buckets/bulk/scan?limit=1"},
+	{method: "GET", path: "/buckets/bulk/scan?cursor=bm9wZQ"},
+	{method: "GET", path: "/buckets/bulk/keys?match=%5Bxz%5D"},
+	{method: "GET", path: "/buckets/bulk/keys?match=%5Bx"},
+	{method: "GET", path: "/buckets/bulk/scan?match=y*"},
+	{method: "GET", path: "/buckets/bulk/all?limit=1"},
+	{method: "GET", path: "/buckets/bulk/all?limit=1&cursor=eA"},
+	{method: "GET", path: "/buckets/bulk/all?cursor=***"},
+	{method: "PUT", path: "/buckets/b2/k", body: `{"value":"v"}`},
+	{method: "DELETE", path: "/buckets"},
+	{method: "GET", path: "/buckets/b2/k"},
+
+	// Delete by prefix
+	{method: "PUT", path: "/buckets/dp", body: `{"t1:a":"1","t1:b":"2","t2:a":"3"}`},
+	{method: "DELETE", path: "/buckets/dp?prefix=t1:"},
+	{method: "GET", path: "/buckets/dp/keys"},
+	{method: "DELETE", path: "/buckets/dp?prefix="},
+
+	// Freezing
+	{method: "PUT", path: "/buckets/fz/k", body: `{"value":"v"}`},
+	{method: "POST", path: "/buckets/fz/freeze", body: `{"ttl":"10m"}`},
+	{method: "GET", path: "/buckets/fz/freeze"},
+	{method: "PUT", path: "/buckets/fz/k", body: `{"value":"v2"}`},
+	{method: "DELETE", path: "/buckets/fz"},
+	{method: "GET", path: "/buckets/fz/k"},
+	{method: "POST", path: "/buckets/fz/thaw"},
+	{method: "PUT", path: "/buckets/fz/k", body: `{"value":"v2"}`},
+
+	// Imports
+	{method: "POST", path: "/imports?id=warm", body: `{"bucket":"imp","key":"a","value":"1"} {"bucket":"imp","key":"b","value":"2","ttl":60}`},
+	{method: "POST", path: "/imports", body: `{"bucket":"imp","key":""}`},
+	{method: "GET", path: "/admin/jobs/warm"},
+	{method: "GET", path: "/admin/jobs/missing"},
+	{method: "DELETE", path: "/admin/jobs/warm"},
+	{method: "GET", path: "/buckets/imp/b"},
+
+	// Scheduled clears
+	{method: "PUT", path: "/schedules/nightly", body: `{"cron":"0 3 * * *","bucket":"fz","prefix":"k"}`},
+	{method: "PUT", path: "/schedules/bad", body: `{"cron":"0 3 * *","bucket":"fz"}`},
+	{method: "POST", path: "/schedules/nightly/run"},
+	{method: "GET", path: "/schedules"},
+	{method: "GET", path: "/schedules/missing"},
+	{method: "DELETE", path: "/schedules/nightly"},
+
+	// Multi-bucket writes
+	{method: "POST", path: "/mset", body: `[{"bucket":"m1","key":"a","value":"1"},{"key":"b","value":"2","ttl":30}]`},
+	{method: "GET", path: "/buckets/m1/a"},
+	{method: "GET", path: "/keys/b"},
+	{method: "POST", path: "/mset", body: `[{"bucket":"m1","key":"","value":"1"}]`},
+	{method: "POST", path: "/mset", body: `{"a":"1"}`},
+	{method: "GET", path: "/mset"},
+	{method: "POST", path: "/mdelete", body: `[{"bucket":"m1","key":"a"},{"key":"b"},{"bucket":"m1","key":"missing"}]`},
+	{method: "GET", path: "/buckets/m1/a"},
+	{method: "POST", path: "/mdelete", body: `[{"bucket":"m1"}]`},
+
+	// Bucket configuration, codecs, and schemas
+	{method: "GET", path: "/buckets/docs/config"},
+	{method: "PUT", path: "/buckets/docs/config", body: `{"codec":"yaml"}`},
+	{method: "PUT", path: "/buckets/docs/config", body: `{"codec":"json","json_schema":{"type":"object","required":["id"]}}`},
+	{method: "GET", path: "/buckets/docs/config"},
+	{method: "PUT", path: "/buckets/docs/d1", headers: map[string]string{"Content-Type": "text/plain"}, body: `{"id":1}`},
+	{method: "PUT", path: "/buckets/docs/d1", headers: map[string]string{"Content-Type": "application/json"}, body: `{"name":"x"}`},
+	{method: "PUT", path: "/buckets/docs/d1", headers: map[string]string{"Content-Type": "application/json"}, body: `{"id":1}`},
+	{method: "GET", path: "/buckets/docs/d1"},
+	{method: "GET", path: "/buckets/docs/missing"},
+	{method: "DELETE", path: "/buckets/docs/config"},
+	{method: "PUT", path: "/buckets/static/config", body: `{"ttl": "24h"}`},
+	{method: "GET", path: "/buckets/static/config"},
+	{method: "PUT", path: "/buckets/static/config", body: `{"ttl": -5}`},
+
+	// Admin
+	{method: "PATCH", path: "/admin/runtime", body: `{"gogc":-7}`},
+	{method: "POST", path: "/admin/runtime"},
+	{method: "GET", path: "/admin/expiry-histogram?width=1h&slots=1&bucket=imp"},
+	{method: "GET", path: "/admin/expiry-histogram?slots=0"},
+	{method: "GET", path: "/admin/usage?bucket=imp&delimiter=-&depth=1"},
+	{method: "GET", path: "/admin/usage?depth=9"},
+
+	// Rebuild costs
+	{method: "PUT", path: "/buckets/costly/report", body: `{"value":"v","cost":250}`},
+	{method: "GET", path: "/buckets/costly/report?info"},
+	{method: "PUT", path: "/buckets/costly/report", body: `{"value":"v","cost":-1}`},
+	{method: "PUT", path: "/buckets/costly", body: `{"a":{"value":"v","cost":-1}}`},
+
+	// Multi-bucket reads
+	{method: "POST", path: "/mset", body: `[{"bucket":"g1","key":"a","value":"1"},{"key":"b","value":""}]`},
+	{method: "POST", path: "/mget", body: `[{"bucket":"g1","key":"a"},{"key":"b"},{"bucket":"g2","key":"missing"}]`},
+	{method: "POST", path: "/mget", body: `[{"bucket":"g1"}]`},
+	{method: "GET", path: "/mget"},
+
+	// Counters
+	{method: "POST", path: "/counters/ctr/visits/incr", body: `{"by":3,"ttl":"1h"}`},
+	{method: "POST", path: "/counters/ctr/visits/decr"},
+	{method: "GET", path: "/counters/ctr/visits"},
+	{method: "PUT", path: "/counters/ctr/visits", body: `{"value":9223372036854775807}`},
+	{method: "POST", path: "/counters/ctr/visits/incr"},
+	{method: "POST", path: "/counters/ctr/visits/incr", body: `{"on_overflow":"saturate"}`},
+	{method: "POST", path: "/counters/ctr/visits/reset"},
+	{method: "PATCH", path: "/counters/ctr/visits"},
+
+	// Lists
+	{method: "POST", path: "/lists/lst/jobs/rpush", body: `{"values":["a","b","c"]}`},
+	{method: "POST", path: "/lists/lst/jobs/lpush", body: `{"values":["y","z"],"max_len":4}`},
+	{method: "GET", path: "/lists/lst/jobs?start=1&stop=-2"},
+	{method: "POST", path: "/lists/lst/jobs/lpop", body: `{"count":2}`},
+	{method: "POST", path: "/lists/lst/jobs/rpop"},
+	{method: "GET", path: "/buckets/lst/jobs"},
+	{method: "POST", path: "/lists/lst/missing/rpop"},
+
+	// Hashes
+	{method: "PATCH", path: "/hashes/hsh/user", body: `{"fields":{"name":"Ada","plan":"free"},"ttl":"1h"}`},
+	{method: "PATCH", path: "/hashes/hsh/user", body: `{"fields":{"plan":"pro","name":null,"seats":"5"}}`},
+	{method: "GET", path: "/hashes/hsh/user"},
+	{method: "GET", path: "/hashes/hsh/user?field=plan&field=name"},
+	{method: "DELETE", path: "/hashes/hsh/user?field=seats"},
+	{method: "PUT", path: "/hashes/hsh/user"},
+
+	// Sorted sets
+	{method: "PATCH", path: "/zsets/zs/board", body: `{"members":{"ada":30,"bob":10,"cy":20},"ttl":"1h"}`},
+	{method: "POST", path: "/zsets/zs/board/incr", body: `{"member":"bob","by":25}`},
+	{method: "GET", path: "/zsets/zs/board?rev=true&stop=1"},
+	{method: "GET", path: "/zsets/zs/board?min=15&max=+inf&limit=1"},
+	{method: "GET", path: "/zsets/zs/board?member=cy"},
+	{method: "DELETE", path: "/zsets/zs/board?member=cy"},
+	{method: "GET", path: "/zsets/zs/board?min=low"},
+
+	// JSON documents
+	{method: "PUT", path: "/json/doc/user?ttl=1h", body: `{"name": "Ada", "tags": ["admin"], "plan": {"seats": 5}}`},
+	{method: "PUT", path: "/json/doc/user?path=/plan/seats", body: `10`},
+	{method: "PUT", path: "/json/doc/user?path=/tags/-", body: `"beta"`},
+	{method: "GET", path: "/json/doc/user"},
+	{method: "GET", path: "/json/doc/user?path=/tags/1"},
+	{method: "GET", path: "/json/doc/user?path=/missing"},
+	{method: "DELETE", path: "/json/doc/user?path=/tags/0"},
+	{method: "PUT", path: "/json/doc/user", body: `{"name":`},
+	{method: "GET", path: "/json/doc/user?path=name"},
+
+	// HyperLogLogs
+	{method: "POST", path: "/hlls/visits/mon/add", body: `{"items": ["ada", "bob", "cy"], "ttl": "1h"}`},
+	{method: "POST", path: "/hlls/visits/mon/add", body: `{"items": ["ada"]}`},
+	{method: "POST", path: "/hlls/visits/tue/add", body: `{"items": ["ada", "dee"]}`},
+	{method: "GET", path: "/hlls/visits/mon?key=tue"},
+	{method: "POST", path: "/hlls/visits/week/merge", body: `{"from": ["mon", "tue"]}`},
+	{method: "GET", path: "/hlls/visits/week"},
+	{method: "POST", path: "/hlls/visits/week/add", body: `{"items": []}`},
+
+	// Bloom filters
+	{method: "PUT", path: "/blooms/screen/users", body: `{"capacity": 1000, "error_rate": 0.01, "ttl": "1h"}`},
+	{method: "POST", path: "/blooms/screen/users/add", body: `{"items": ["ada", "bob"]}`},
+	{method: "POST", path: "/blooms/screen/users/add", body: `{"items": ["ada"]}`},
+	{method: "GET", path: "/blooms/screen/users?item=ada&item=cy"},
+	{method: "GET", path: "/blooms/screen/users"},
+	{method: "PUT", path: "/blooms/screen/users", body: `{"capacity": 1000, "error_rate": 1.5}`},
+
+	// Bitmaps
+	{method: "POST", path: "/bitmaps/active/mon/setbit", body: `{"offset": 3, "value": 1, "ttl": "1h"}`},
+	{method: "POST", path: "/bitmaps/active/mon/setbit", body: `{"offset": 9, "value": 1}`},
+	{method: "POST", path: "/bitmaps/active/tue/setbit", body: `{"offset": 9, "value": 1}`},
+	{method: "GET", path: "/bitmaps/active/mon"},
+	{method: "GET", path: "/bitmaps/active/mon?bit=3"},
+	{method: "POST", path: "/bitmaps/active/both/op", body: `{"op": "and", "from": ["mon", "tue"]}`},
+	{method: "GET", path: "/buckets/active/both"},
+	{method: "POST", path: "/bitmaps/active/mon/setbit", body: `{"offset": 3, "value": 2}`},
+
+	// Rate limiters
+	{method: "POST", path: "/ratelimit/api/ada", body: `{"limit": 100, "window": "1m"}`},
+	{method: "POST", path: "/ratelimit/api/bob", body: `{"limit": 100, "window": "1m", "cost": 0}`},
+	{method: "POST", path: "/ratelimit/api/cy", body: `{"limit": 100, "window": "1m", "cost": 101}`},
+
+	// Semaphores
+	{method: "GET", path: "/semaphores/jobs/exports"},
+	{method: "POST", path: "/semaphores/jobs/exports", body: `{"limit": 2, "permits": 3}`},
+	{method: "DELETE", path: "/semaphores/jobs/exports?token=nope"},
+	{method: "GET", path: "/semaphores/active/mon"},
+}
+
+// recordGolden replays goldenRequests and renders the exchange as text.
+func recordGolden(t *testing.T) string {
+	t.Helper()
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	var out strings.Builder
+	for _, step := range goldenRequests {
+		var body io.Reader
+		if step.body != "" {
+			body = strings.NewReader(step.body)
+		}
+		req, err := http.NewRequest(step.method, server.URL+step.path, body)
+		if err != nil {
+			t.Fatalf("%s %s => %v", step.method, step.path, err)
+		}
+		for k, v := range step.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s => %v", step.method, step.path, err)
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		fmt.Fprintf(&out, "### %s %s\n", step.method, step.path)
+		names := make([]string, 0, len(step.headers))
+		for k := range step.headers {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			fmt.Fprintf(&out, "> %s: %s\n", k, step.headers[k])
+		}
+		if step.body != "" {
+			fmt.Fprintf(&out, "> %s\n", step.body)
+		}
+		fmt.Fprintf(&out, "< %d\n", resp.StatusCode)
+		for _, h := range goldenHeaders {
+			if v := resp.Header.Get(h); v != "" {
+				fmt.Fprintf(&out, "< %s: %s\n", h, v)
+			}
+		}
+		if b := strings.TrimRight(string(respBody), "\n"); b != "" {
+			b = goldenTimestamp.ReplaceAllString(b, `"<time>"`)
+			b = goldenMillis.ReplaceAllString(b, `"ttl_ms":"<ms>"`)
+			fmt.Fprintf(&out, "< %s\n", b)
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+func TestGolden_HTTPAPI(t *testing.T) {
+	const path = "testdata/http_api.golden"
+	got := recordGolden(t)
+
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatalf("writing %s => %v", path, err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s => %v (run with -update to create it)", path, err)
+	}
+	if got == string(want) {
+		return
+	}
+
+	// Point at the first diverging exchange to keep failures readable.
+	gotSteps := strings.Split(got, "\n\n")
+	wantSteps := strings.Split(string(want), "\n\n")
+	for i := 0; i < len(gotSteps) && i < len(wantSteps); i++ {
+		if gotSteps[i] != wantSteps[i] {
+			t.Fatalf("API response changed (run with -update if intentional):\n--- want\n%s\n--- got\n%s", wantSteps[i], gotSteps[i])
+		}
+	}
+	t.Fatalf("API conversation length changed from %d to %d exchanges (run with -update if intentional)", len(wantSteps), len(gotSteps))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Cache handover lets a binary upgrade keep the cache. Every process started
+// with -handover-socket listens on that Unix socket once it is serving. A new
+// process started with the same path finds its predecessor there and asks
+// for the cache; the old process stops serving HTTP, freeing the port and
+// leaving nothing to write to the cache, streams every live entry and bucket
+// config over the socket, and exits. The new process loads them before it
+// starts listening, so clients see a short pause rather than an empty cache.
+//
+// With -handover-partial the new process starts serving as soon as the
+// transfer begins, answering from whatever has arrived so far; GET /readyz
+// reports the progress and answers 503 until the transfer is done.
+//
+// What is handed over: bucket configs, and every live entry with its value,
+// expiry, soft expiry, max idle time, version, writer, encoding and cost, in LRU order. What is not:
+// sessions and the entries they own, schedules, jobs, frozen buckets and
+// stats. Entries that don't fit the new process's size limits are evicted
+// on arrival as usual.
+
+// handoverHello opens a handover request; the number is the stream format.
+const handoverHello = "KITSUNE-HANDOVER 1"
+
+// handoverDrainTimeout bounds how long the old process waits for in-flight
+// requests before it stops serving and hands over regardless. Watch streams
+// never finish on their own, so this is hit whenever one is open.
+var handoverDrainTimeout = 10 * time.Second
+
+// ErrHandoverTruncated is returned by ReadHandover for a stream that ended
+// before its final record, e.g. because the old process died mid-transfer.
+// The entries read so far are kept.
+var ErrHandoverTruncated = errors.New("handover stream ended early")
+
+// handoverRecord is one line of a handover stream: a bucket config, the
+// number of entries to expect and the highest version among them, an entry,
+// or the final count of entries.
+type handoverRecord struct {
+	Bucket  string         `json:"bucket,omitempty"`
+	Config  *BucketConfig  `json:"config,omitempty"`
+	Total   *int           `json:"total,omitempty"`
+	Version uint64         `json:"version,omitempty"`
+	Entry   *handoverEntry `json:"entry,omitempty"`
+	Done    *int           `json:"done,omitempty"`
+}
+
+// handoverEntry is a CacheEntry as handed over. Version is kept so that
+// ETags clients hold stay valid for compare-and-swap across the upgrade.
+type handoverEntry struct {
+	Key         string        `json:"key"`
+	Value       string        `json:"value"`
+	ExpiresAt   time.Time     `json:"expires_at"` // zero for never
+	TTL         time.Duration `json:"ttl"`        // renewed by sliding expiration; 0 for none
+	WrittenBy   string        `json:"written_by,omitempty"`
+	WrittenAt   time.Time     `json:"written_at"`
+	Encoding    string        `json:"encoding,omitempty"`
+	Version     uint64        `json:"version"`
+	OriginalKey string        `json:"original_key,omitempty"`
+	Cost        float64       `json:"cost,omitempty"`
+	SoftExpires time.Time     `json:"soft_expires_at"` // zero for none
+	IdleExpires time.Time     `json:"idle_expires_at"` // zero for none
+	MaxIdle     time.Duration `json:"max_idle"`
+}
+
+// WriteHandover streams the cache's bucket configs and live entries to w,
+// least recently used first, and returns how many entries it wrote. It holds
+// the read lock throughout, so callers should stop writers first.
+func (cs *CacheSystem) WriteHandover(w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	cs.cfgMu.RLock()
+	for bucket, cfg := range cs.bucketConfigs {
+		cfg := cfg
+		if err := enc.Encode(handoverRecord{Bucket: bucket, Config: &cfg}); err != nil {
+			cs.cfgMu.RUnlock()
+			return 0, err
+		}
+	}
+	cs.cfgMu.RUnlock()
+
+	if err := cs.rlock(); err != nil {
+		return 0, err
+	}
+	defer cs.mu.RUnlock()
+	now := time.Now()
+	handedOver := func(entry *CacheEntry) bool {
+		return !cs.isStale(entry) && !entry.expiredAt(now) && entry.Session == ""
+	}
+	total := 0
+	for e := cs.entries.Front(); e != nil; e = e.Next() {
+		if handedOver(e.Value.(*CacheEntry)) {
+			total++
+		}
+	}
+	if err := enc.Encode(handoverRecord{Total: &total, Version: cs.version}); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for e := cs.entries.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*CacheEntry)
+		if !handedOver(entry) {
+			continue
+		}
+		err := enc.Encode(handoverRecord{Bucket: entry.Bucket, Entry: &handoverEntry{
+			Key:         entry.Key,
+			Value:       entry.Value,
+			ExpiresAt:   entry.Expiration,
+			TTL:         entry.ttl,
+			WrittenBy:   entry.WrittenBy,
+			WrittenAt:   entry.WrittenAt,
+			Encoding:    entry.Encoding,
+			Version:     entry.Version,
+			OriginalKey: entry.OriginalKey,
+			Cost:        entry.Cost,
+			SoftExpires: entry.SoftExpiration,
+			IdleExpires: entry.IdleExpiration,
+			MaxIdle:     entry.maxIdle,
+		}})
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, enc.Encode(handoverRecord{Done: &n})
+}
+
+// ReadHandover loads a stream written by WriteHandover into the cache and
+// returns how many entries it restored. Keys written by clients in the
+// meantime are kept rather than overwritten. Progress is reported by
+// Warmup while it runs.
+func (cs *CacheSystem) ReadHandover(r io.Reader) (int, error) {
+	w := &warmup{Source: "handover", started: time.Now()}
+	w.total.Store(-1)
+	cs.warming.Store(w)
+	defer cs.warming.Store(nil)
+
+	dec := json.NewDecoder(r)
+	n := 0
+	for {
+		var rec handoverRecord
+		if err := dec.Decode(&rec); err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, ErrHandoverTruncated
+		} else if err != nil {
+			return n, err
+		}
+		switch {
+		case rec.Done != nil:
+			return n, nil
+		case rec.Total != nil:
+			w.total.Store(int64(*rec.Total))
+			// Versions handed out from now on must not repeat ones clients hold.
+			if err := cs.lock(); err != nil {
+				return n, err
+			}
+			if rec.Version > cs.version {
+				cs.version = rec.Version
+			}
+			cs.unlock()
+		case rec.Config != nil:
+			if err := rec.Config.Validate(); err != nil {
+				return n, fmt.Errorf("bucket %q: %v", rec.Bucket, err)
+			}
+			cs.SetBucketConfig(rec.Bucket, *rec.Config)
+		case rec.Entry != nil:
+			if err := cs.lock(); err != nil {
+				return n, err
+			}
+			if cs.restoreLocked(rec.Bucket, *rec.Entry) {
+				n++
+			}
+			cs.unlock()
+			w.loaded.Add(1)
+		}
+	}
+}
+
+// restoreLocked inserts a handed-over entry as it was, unless the key has
+// been written since, and reports whether it did; cs.mu must be held.
+func (cs *CacheSystem) restoreLocked(bucket string, he handoverEntry) bool {
+	if cs.liveEntryLocked(bucket, he.Key) != nil {
+		return false
+	}
+	cs.setLocked(bucket, he.Key, he.Value, he.TTL)
+	elem, ok := cs.items[[2]string{bucket, he.Key}]
+	if !ok {
+		return false // too large for this instance
+	}
+	entry := elem.Value.(*CacheEntry)
+	entry.Expiration = he.ExpiresAt
+	entry.ttl = he.TTL
+	entry.WrittenBy = he.WrittenBy
+	entry.WrittenAt = he.WrittenAt
+	entry.Encoding = he.Encoding
+	entry.OriginalKey = he.OriginalKey
+	entry.Cost = he.Cost
+	entry.SoftExpiration = he.SoftExpires
+	entry.IdleExpiration = he.IdleExpires
+	entry.maxIdle = he.MaxIdle
+	entry.Version = he.Version
+	if he.Version > cs.version {
+		cs.version = he.Version
+	}
+	return true
+}
+
+// receiveHandover asks a previous process listening on the socket at path
+// for its cache and loads it. It returns 0 and no error if there is no
+// previous process, removing a socket file left behind by one that died.
+// started, if not nil, is called once the previous process has stopped
+// serving and the entries start to arrive, or as soon as it is clear that
+// none will.
+func receiveHandover(path string, cache *CacheSystem, started func()) (int, error) {
+	if started == nil {
+		started = func() {}
+	}
+	started = sync.OnceFunc(started)
+	defer started()
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return 0, os.Remove(path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, handoverHello); err != nil {
+		return 0, err
+	}
+	return cache.ReadHandover(bufio.NewReader(&notifyReader{r: conn, first: started}))
+}
+
+// notifyReader calls first once r has returned some data.
+type notifyReader struct {
+	r     io.Reader
+	first func()
+}
+
+func (n *notifyReader) Read(p []byte) (int, error) {
+	k, err := n.r.Read(p)
+	if k > 0 {
+		n.first()
+	}
+	return k, err
+}
+
+// serveHandover waits on ln for a newer process to ask for the cache. It
+// then closes ln, calls stop to stop serving HTTP, and streams the cache.
+// It returns the number of entries handed over once the transfer is done,
+// or an error if ln fails before anyone asks.
+func serveHandover(ln net.Listener, cache *CacheSystem, stop func()) (int, error) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return 0, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		hello, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || hello != handoverHello+"\n" {
+			conn.Close()
+			continue
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+		ln.Close()
+		stop()
+
+		w := bufio.NewWriter(conn)
+		n, err := cache.WriteHandover(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		conn.Close()
+		return n, err
+	}
+}
+
+// shutdownForHandover stops server from accepting requests and waits up to
+// handoverDrainTimeout for in-flight ones, then closes what is left.
+func shutdownForHandover(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), handoverDrainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		_ = server.Close()
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Handover(t *testing.T) {
+	old := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer old.Stop()
+	old.SetBucketConfig("q", BucketConfig{MaxBytes: 1000})
+	old.Set("b", "first", "1")
+	if _, err := old.SetWithOptions("b", BulkItem{Key: "costly", Value: "2", Cost: 7, SoftTTL: time.Minute, MaxIdle: time.Hour, ExpiresAt: time.Now().Add(time.Hour)}, WriteOptions{Writer: "svc"}); err != nil {
+		t.Fatalf("SetWithOptions => %v", err)
+	}
+	old.Set("q", "forever", "3")
+	old.Persist("q", "forever")
+	old.OpenSession("s", time.Minute)
+	old.SetInSession("s", "b", "owned", "4", 0)
+	old.Get("b", "first") // most recently used
+	before, _, _ := old.Info("b", "costly")
+
+	var buf bytes.Buffer
+	n, err := old.WriteHandover(&buf)
+	if err != nil || n != 3 {
+		t.Fatalf("WriteHandover => %d, %v; want 3 entries", n, err)
+	}
+
+	fresh := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer fresh.Stop()
+	if n, err := fresh.ReadHandover(bytes.NewReader(buf.Bytes())); err != nil || n != 3 {
+		t.Fatalf("ReadHandover => %d, %v; want 3 entries", n, err)
+	}
+	if fresh.GetBucketConfig("q").MaxBytes != 1000 {
+		t.Fatalf("expected the bucket config to be handed over")
+	}
+	after, found, _ := fresh.Info("b", "costly")
+	if !found || after.Version != before.Version || after.Cost != 7 || after.WrittenBy != "svc" || after.TTL != before.TTL || after.MaxIdle != 3600 {
+		t.Fatalf("expected the entry to arrive unchanged, got %+v, want %+v", after, before)
+	}
+	if a, b := old.items[[2]string{"b", "costly"}], fresh.items[[2]string{"b", "costly"}]; !a.Value.(*CacheEntry).SoftExpiration.Equal(b.Value.(*CacheEntry).SoftExpiration) {
+		t.Fatalf("expected the soft expiry to be handed over")
+	}
+	if _, found, _ := fresh.Peek("b", "owned"); found {
+		t.Fatalf("expected session-owned entries to be left behind")
+	}
+	if ttl, _ := fresh.TTL("q", "forever"); ttl != 0 {
+		t.Fatalf("expected a persistent entry to stay persistent, got %s", ttl)
+	}
+	if front := fresh.entries.Front().Value.(*CacheEntry); front.Key != "first" {
+		t.Fatalf("expected LRU order to be kept, front is %q", front.Key)
+	}
+	if res, _ := fresh.SetWithOptions("b", BulkItem{Key: "new", Value: "v"}, WriteOptions{}); res.Version <= before.Version {
+		t.Fatalf("expected new versions to continue past handed-over ones, got %d", res.Version)
+	}
+
+	truncated := buf.Bytes()[:buf.Len()-10]
+	if _, err := NewCacheSystem(1024, 1_000_000, 60, 999999).ReadHandover(bytes.NewReader(truncated)); !errors.Is(err, ErrHandoverTruncated) {
+		t.Fatalf("expected ErrHandoverTruncated, got %v", err)
+	}
+}
+
+func TestHandoverSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "h.sock")
+	fresh := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer fresh.Stop()
+
+	// No previous process
+	if n, err := receiveHandover(path, fresh, nil); n != 0 || err != nil {
+		t.Fatalf("receiveHandover without a predecessor => %d, %v", n, err)
+	}
+
+	// A socket file left behind by a crashed process
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen => %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if n, err := receiveHandover(path, fresh, nil); n != 0 || err != nil {
+		t.Fatalf("receiveHandover with a stale socket => %d, %v", n, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale socket to be removed, got %v", err)
+	}
+
+	old := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer old.Stop()
+	old.Set("b", "k", "v")
+	if ln, err = net.Listen("unix", path); err != nil {
+		t.Fatalf("Listen => %v", err)
+	}
+	stopped := make(chan struct{})
+	done := make(chan int)
+	go func() {
+		n, err := serveHandover(ln, old, func() { close(stopped) })
+		if err != nil {
+			t.Errorf("serveHandover => %v", err)
+		}
+		done <- n
+	}()
+
+	// Something else connecting is ignored
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Write([]byte("GET / HTTP/1.1\n"))
+		conn.Close()
+	}
+	if n, err := receiveHandover(path, fresh, nil); n != 1 || err != nil {
+		t.Fatalf("receiveHandover => %d, %v; want 1 entry", n, err)
+	}
+	if n := <-done; n != 1 {
+		t.Fatalf("expected the old process to report 1 entry, got %d", n)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatalf("expected the old process to stop serving before handing over")
+	}
+	if got := fresh.Get("b", "k"); got != "v" {
+		t.Fatalf("expected the entry in the new cache, got %q", got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the old process to release the socket path, got %v", err)
+	}
+}
+
+func TestCacheSystem_HandoverWhileServing(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+	readyz := func() (int, map[string]interface{}) {
+		resp, err := http.Get(server.URL + "/readyz")
+		if err != nil {
+			t.Fatalf("GET /readyz => %v", err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+	if code, _ := readyz(); code != http.StatusOK {
+		t.Fatalf("expected a cache that isn't warming up to be ready, got %d", code)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan int)
+	go func() {
+		n, err := cache.ReadHandover(pr)
+		if err != nil {
+			t.Errorf("ReadHandover => %v", err)
+		}
+		done <- n
+	}()
+	enc := json.NewEncoder(pw)
+	total := 2
+	enc.Encode(handoverRecord{Total: &total, Version: 1000})
+	enc.Encode(handoverRecord{Bucket: "b", Entry: &handoverEntry{Key: "k1", Value: "old", Version: 999}})
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if st, _ := cache.Warmup(); st.Loaded == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the first entry to arrive")
+		}
+	}
+	code, body := readyz()
+	warmup, _ := body["warmup"].(map[string]interface{})
+	if code != http.StatusServiceUnavailable || warmup["loaded"] != 1.0 || warmup["total"] != 2.0 || warmup["percent"] != 50.0 {
+		t.Fatalf("expected 503 with half the entries loaded, got %d %v", code, body)
+	}
+	// Entries that have arrived are served, and clients can write
+	if got := cache.Get("b", "k1"); got != "old" {
+		t.Fatalf("expected the handed-over entry, got %q", got)
+	}
+	res, _ := cache.SetWithOptions("b", BulkItem{Key: "k2", Value: "new"}, WriteOptions{})
+	if res.Version <= 1000 {
+		t.Fatalf("expected new versions past the handed-over ones, got %d", res.Version)
+	}
+
+	enc.Encode(handoverRecord{Bucket: "b", Entry: &handoverEntry{Key: "k2", Value: "old", Version: 1000}})
+	n := 1
+	enc.Encode(handoverRecord{Done: &n})
+	if n := <-done; n != 1 {
+		t.Fatalf("expected 1 entry restored, got %d", n)
+	}
+	if got := cache.Get("b", "k2"); got != "new" {
+		t.Fatalf("expected the client's write to win over the handover, got %q", got)
+	}
+	if code, _ := readyz(); code != http.StatusOK {
+		t.Fatalf("expected ready once the handover is done, got %d", code)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNotHash is returned by the hash operations when the key holds
+// something other than a hash.
+var ErrNotHash = errors.New("value is not a hash")
+
+// HashOptions controls an update of a hash. Hashes are entries holding a
+// JSON object of string fields, so the entry's size is exactly what its
+// fields take encoded, and they are readable as ordinary keys.
+type HashOptions struct {
+	WriteOptions
+	// TTL, if set, restarts the hash's expiration. Otherwise a new hash gets
+	// the default TTL and an existing one keeps its own.
+	TTL time.Duration
+}
+
+// HashUpdate is the outcome of UpdateHash.
+type HashUpdate struct {
+	Added   int `json:"added"`   // fields that didn't exist before
+	Removed int `json:"removed"` // fields that existed and were removed
+	Length  int `json:"length"`  // fields left
+	Size    int `json:"size"`    // bytes the hash takes, 0 once it is gone
+}
+
+// UpdateHash sets the fields in set and removes those in remove, under one
+// lock acquisition, creating a missing hash. Removing the last field
+// deletes the hash.
+func (cs *CacheSystem) UpdateHash(bucket, key string, set map[string]string, remove []string, opts HashOptions) (HashUpdate, error) {
+	if err := cs.lock(); err != nil {
+		return HashUpdate{}, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return HashUpdate{}, err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return HashUpdate{}, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	hash, err := decodeHash(entry)
+	if err != nil {
+		return HashUpdate{}, err
+	}
+	var u HashUpdate
+	for _, f := range remove {
+		if _, ok := hash[f]; ok {
+			delete(hash, f)
+			u.Removed++
+		}
+	}
+	for f, v := range set {
+		if _, ok := hash[f]; !ok {
+			u.Added++
+		}
+		hash[f] = v
+	}
+	u.Length = len(hash)
+
+	switch {
+	case len(set) == 0 && u.Removed == 0:
+		// Nothing changed, so don't count a write.
+		if entry != nil {
+			u.Size = len(entry.Value)
+		}
+		return u, nil
+	case len(hash) == 0:
+		if entry != nil {
+			cs.emit(EventDelete, bucket, key, "")
+			cs.removeElement(cs.items[[2]string{bucket, key}])
+		}
+		return u, nil
+	}
+	value, _ := json.Marshal(hash)
+	if err := cs.rewriteLocked(bucket, key, entry, string(value), opts.TTL, opts.WriteOptions, s); err != nil {
+		return HashUpdate{}, err
+	}
+	u.Size = len(value)
+	return u, nil
+}
+
+// HashFields returns the named fields of the hash, or all of them if names
+// is empty, along with how many it has. Fields it lacks are left out. It
+// reads the hash like LookupValue but never from the loader.
+func (cs *CacheSystem) HashFields(bucket, key string, names []string) (map[string]string, int, bool, error) {
+	v, found, err := cs.lookupCachedValue(bucket, key)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	hash, err := decodeHash(&CacheEntry{Value: v.Value, Encoding: v.Encoding})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if len(names) == 0 {
+		return hash, len(hash), true, nil
+	}
+	fields := make(map[string]string, len(names))
+	for _, f := range names {
+		if v, ok := hash[f]; ok {
+			fields[f] = v
+		}
+	}
+	return fields, len(hash), true, nil
+}
+
+// decodeHash returns the hash entry holds, which is empty for a nil entry.
+func decodeHash(entry *CacheEntry) (map[string]string, error) {
+	hash := make(map[string]string)
+	if entry == nil {
+		return hash, nil
+	}
+	if entry.Encoding != "" || !strings.HasPrefix(entry.Value, "{") {
+		return nil, ErrNotHash
+	}
+	if err := json.Unmarshal([]byte(entry.Value), &hash); err != nil {
+		return nil, ErrNotHash
+	}
+	return hash, nil
+}
+
+// hashRequest is the body of PATCH /hashes/{bucket}/{key}: a JSON merge
+// patch of the fields, where null removes a field.
+type hashRequest struct {
+	Fields map[string]*string `json:"fields"`
+	TTL    jsonTTL            `json:"ttl"` // restarts the expiration if set
+}
+
+// serveHash handles the hash endpoints:
+//
+//	GET    /hashes/{bucket}/{key}[?field=f...] => {"fields": {...}, "length": n}
+//	PATCH  /hashes/{bucket}/{key}              => set and remove fields, {"fields": {...}, "ttl": ...}
+//	DELETE /hashes/{bucket}/{key}?field=f...   => remove fields
+//	DELETE /hashes/{bucket}/{key}              => remove the hash
+//
+// In buckets with HashKeys, the key is hashed like any other.
+func serveHash(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, key, _ := strings.Cut(r.URL.Path[len("/hashes/"):], "/")
+	if bucket == "" || key == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	key, _ = storedKey(cache.GetBucketConfig(bucket), key)
+	names := r.URL.Query()["field"]
+
+	switch r.Method {
+	case http.MethodGet:
+		fields, n, found, err := cache.HashFields(bucket, key, names)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"fields": fields, "length": n})
+		return
+	case http.MethodDelete:
+		if len(names) == 0 {
+			if _, err := cache.Delete(bucket, key); err != nil {
+				writeCacheError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		u, err := cache.UpdateHash(bucket, key, nil, names, HashOptions{WriteOptions: writeOptions(r)})
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(u)
+		return
+	case http.MethodPatch:
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+		return
+	}
+
+	var req hashRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	if len(req.Fields) == 0 {
+		writeError(w, http.StatusBadRequest, "fields must not be empty")
+		return
+	}
+	if req.TTL < 0 {
+		writeError(w, http.StatusBadRequest, "ttl must not be negative")
+		return
+	}
+	set := make(map[string]string, len(req.Fields))
+	var remove []string
+	for f, v := range req.Fields {
+		if v == nil {
+			remove = append(remove, f)
+		} else {
+			set[f] = *v
+		}
+	}
+	u, err := cache.UpdateHash(bucket, key, set, remove, HashOptions{WriteOptions: writeOptions(r), TTL: time.Duration(req.TTL)})
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(u)
+}
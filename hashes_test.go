@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Hash(t *testing.T) {
+	cache := NewCacheSystem(64, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	u, err := cache.UpdateHash("b", "user", map[string]string{"name": "Ada", "plan": "free"}, nil, HashOptions{TTL: time.Hour})
+	if err != nil || u != (HashUpdate{Added: 2, Length: 2, Size: len(`{"name":"Ada","plan":"free"}`)}) {
+		t.Fatalf("UpdateHash => %+v, %v", u, err)
+	}
+	overhead := int64(len("b") + len("user")) // an entry's size counts its bucket and key too
+	if _, size := cache.Usage(); size != int64(u.Size)+overhead {
+		t.Fatalf("expected the cache size to be the hash's %d bytes, got %d", u.Size, size)
+	}
+
+	// One field changes without resending the others
+	u, _ = cache.UpdateHash("b", "user", map[string]string{"plan": "pro"}, []string{"name", "missing"}, HashOptions{})
+	if u != (HashUpdate{Removed: 1, Length: 1, Size: len(`{"plan":"pro"}`)}) {
+		t.Fatalf("unexpected update %+v", u)
+	}
+	if _, size := cache.Usage(); size != int64(u.Size)+overhead {
+		t.Fatalf("expected the cache size to follow the hash to %d bytes, got %d", u.Size, size)
+	}
+	if ttl, _ := cache.TTL("b", "user"); ttl <= time.Minute {
+		t.Fatalf("expected the hash to keep its TTL, got %v", ttl)
+	}
+	if fields, n, found, err := cache.HashFields("b", "user", nil); err != nil || !found || n != 1 || fields["plan"] != "pro" {
+		t.Fatalf("HashFields => %v, %d, %v, %v", fields, n, found, err)
+	}
+	if fields, n, _, _ := cache.HashFields("b", "user", []string{"plan", "name"}); len(fields) != 1 || n != 1 {
+		t.Fatalf("expected only the fields asked for that exist, got %v, %d", fields, n)
+	}
+
+	if _, err := cache.UpdateHash("b", "user", map[string]string{"bio": strings.Repeat("x", 64)}, nil, HashOptions{}); !errors.Is(err, ErrEntryTooLarge) {
+		t.Fatalf("expected ErrEntryTooLarge, got %v", err)
+	}
+
+	// Removing the last field removes the hash
+	if u, _ := cache.UpdateHash("b", "user", nil, []string{"plan"}, HashOptions{}); u != (HashUpdate{Removed: 1}) {
+		t.Fatalf("unexpected update %+v", u)
+	}
+	if _, _, found, _ := cache.HashFields("b", "user", nil); found {
+		t.Fatalf("expected the hash to be gone")
+	}
+
+	cache.Set("b", "word", "hello")
+	if _, err := cache.UpdateHash("b", "word", map[string]string{"a": "1"}, nil, HashOptions{}); !errors.Is(err, ErrNotHash) {
+		t.Fatalf("expected ErrNotHash, got %v", err)
+	}
+	if _, _, _, err := cache.HashFields("b", "word", nil); !errors.Is(err, ErrNotHash) {
+		t.Fatalf("expected ErrNotHash, got %v", err)
+	}
+}
+
+func TestHTTP_Hashes(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	if resp, out := httpJSON(t, "PATCH", server.URL+"/hashes/b/u", `{"fields":{"name":"Ada","plan":"free"}}`); resp.StatusCode != http.StatusOK || out["added"] != 2.0 {
+		t.Fatalf("expected PATCH to create the hash, got %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "PATCH", server.URL+"/hashes/b/u", `{"fields":{"plan":"pro","name":null},"ttl":"1h"}`); resp.StatusCode != http.StatusOK || out["removed"] != 1.0 || out["length"] != 1.0 {
+		t.Fatalf("expected null to remove a field, got %d %v", resp.StatusCode, out)
+	}
+	if got := cache.Get("b", "u"); got != `{"plan":"pro"}` {
+		t.Fatalf("expected the hash to be readable as a key, got %s", got)
+	}
+	httpJSON(t, "PATCH", server.URL+"/hashes/b/u", `{"fields":{"seats":"5"}}`)
+	if resp, out := httpJSON(t, "GET", server.URL+"/hashes/b/u?field=seats&field=gone", ""); resp.StatusCode != http.StatusOK || out["length"] != 2.0 || len(out["fields"].(map[string]interface{})) != 1 {
+		t.Fatalf("unexpected fields %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "DELETE", server.URL+"/hashes/b/u?field=seats", ""); resp.StatusCode != http.StatusOK || out["removed"] != 1.0 {
+		t.Fatalf("expected DELETE ?field= to remove it, got %d %v", resp.StatusCode, out)
+	}
+
+	cache.Set("b", "word", "hello")
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"PATCH", "/hashes/b/word", `{"fields":{"a":"1"}}`, http.StatusConflict},
+		{"GET", "/hashes/b/word", "", http.StatusConflict},
+		{"PATCH", "/hashes/b/u", `{"fields":{}}`, http.StatusBadRequest},
+		{"PATCH", "/hashes/b/u", `{"fields":{"a":1}}`, http.StatusBadRequest},
+		{"PATCH", "/hashes/b/big", `{"fields":{"a":"` + strings.Repeat("x", 1024) + `"}}`, http.StatusRequestEntityTooLarge},
+		{"PUT", "/hashes/b/u", "", http.StatusMethodNotAllowed},
+		{"GET", "/hashes/b", "", http.StatusNotFound},
+		{"DELETE", "/hashes/b/u", "", http.StatusOK},
+		{"GET", "/hashes/b/u", "", http.StatusNotFound},
+	} {
+		if resp, _ := httpJSON(t, c.method, server.URL+c.path, c.body); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+}
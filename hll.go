@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrNotHLL is returned by the HyperLogLog operations when the key holds
+// something other than a HyperLogLog.
+var ErrNotHLL = errors.New("value is not a HyperLogLog")
+
+const (
+	// hllPrecision is the number of hash bits that pick a register. 2^12
+	// registers give a standard error of about 1.6%.
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+	// hllPrefix marks an entry as a HyperLogLog, ahead of its registers in
+	// base64, so the sketch is readable as an ordinary key.
+	hllPrefix = "hll:"
+)
+
+// HLLOptions controls a write of a HyperLogLog. HyperLogLogs are entries
+// holding a fixed-size sketch, about 5.5 KB, that estimates how many
+// distinct items were added to it however many there are.
+type HLLOptions struct {
+	WriteOptions
+	// TTL, if set, restarts the HyperLogLog's expiration. Otherwise a new
+	// one gets the default TTL and an existing one keeps its own.
+	TTL time.Duration
+}
+
+// HLLUpdate is the outcome of AddHLL.
+type HLLUpdate struct {
+	Changed bool   `json:"changed"` // whether the estimate may have moved
+	Count   uint64 `json:"count"`   // estimated distinct items after the add
+}
+
+// AddHLL adds items to the HyperLogLog at key, creating a missing one.
+func (cs *CacheSystem) AddHLL(bucket, key string, items []string, opts HLLOptions) (HLLUpdate, error) {
+	var u HLLUpdate
+	err := cs.updateHLL(bucket, key, opts, func(regs []byte) bool {
+		for _, item := range items {
+			i, rank := hllHash(item)
+			if rank > regs[i] {
+				regs[i] = rank
+				u.Changed = true
+			}
+		}
+		u.Count = hllEstimate(regs)
+		return u.Changed
+	})
+	if err != nil {
+		return HLLUpdate{}, err
+	}
+	return u, nil
+}
+
+// MergeHLL merges the HyperLogLogs at sources, in the same bucket, into the
+// one at key, creating it if missing, and returns the estimate of the
+// union. Missing sources count as empty.
+func (cs *CacheSystem) MergeHLL(bucket, key string, sources []string, opts HLLOptions) (uint64, error) {
+	var count uint64
+	var srcErr error
+	err := cs.updateHLL(bucket, key, opts, func(regs []byte) bool {
+		for _, src := range sources {
+			// updateHLL holds cs.mu, so sources are read as they stand.
+			other, err := decodeHLL(cs.liveEntryLocked(bucket, src))
+			if err != nil {
+				srcErr = err
+				return false
+			}
+			mergeHLL(regs, other)
+		}
+		count = hllEstimate(regs)
+		return true
+	})
+	if err == nil {
+		err = srcErr
+	}
+	return count, err
+}
+
+// updateHLL runs update on the registers of the HyperLogLog and, if it
+// reports a change, writes them back.
+func (cs *CacheSystem) updateHLL(bucket, key string, opts HLLOptions, update func(regs []byte) bool) error {
+	if err := cs.lock(); err != nil {
+		return err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	regs, err := decodeHLL(entry)
+	if err != nil {
+		return err
+	}
+	if !update(regs) {
+		return nil
+	}
+	return cs.rewriteLocked(bucket, key, entry, encodeHLL(regs), opts.TTL, opts.WriteOptions, s)
+}
+
+// CountHLL estimates the distinct items added to the HyperLogLogs at keys,
+// counted once across all of them. found is false if none of them exists.
+// It reads them like LookupValue but never from the loader.
+func (cs *CacheSystem) CountHLL(bucket string, keys []string) (count uint64, found bool, err error) {
+	union := make([]byte, hllRegisters)
+	for _, key := range keys {
+		v, ok, err := cs.lookupCachedValue(bucket, key)
+		if err != nil {
+			return 0, false, err
+		}
+		if !ok {
+			continue
+		}
+		regs, err := decodeHLL(&CacheEntry{Value: v.Value, Encoding: v.Encoding})
+		if err != nil {
+			return 0, false, err
+		}
+		mergeHLL(union, regs)
+		found = true
+	}
+	if !found {
+		return 0, false, nil
+	}
+	return hllEstimate(union), true, nil
+}
+
+// hllHash returns the register item falls in and the rank it gives it: one
+// more than the leading zeros of the rest of its hash.
+func hllHash(item string) (int, byte) {
+	x := itemHash(item)
+	rest := x<<hllPrecision | 1<<(hllPrecision-1)
+	return int(x >> (64 - hllPrecision)), byte(bits.LeadingZeros64(rest) + 1)
+}
+
+// itemHash hashes an item added to a HyperLogLog or Bloom filter. It must
+// not change, or sketches already stored would stop matching their items.
+func itemHash(item string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	// FNV spreads short, similar items poorly over the high bits, so mix
+	// them with the splitmix64 finalizer.
+	return mix64(h.Sum64())
+}
+
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// hllEstimate returns the cardinality estimate for regs, using linear
+// counting while many registers are still empty.
+func hllEstimate(regs []byte) uint64 {
+	m := float64(len(regs))
+	var sum float64
+	zeros := 0
+	for _, r := range regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// mergeHLL folds src into dst, which then estimates their union.
+func mergeHLL(dst, src []byte) {
+	for i, r := range src {
+		dst[i] = max(dst[i], r)
+	}
+}
+
+// decodeHLL returns the registers entry holds, which are all empty for a
+// nil entry.
+func decodeHLL(entry *CacheEntry) ([]byte, error) {
+	if entry == nil {
+		return make([]byte, hllRegisters), nil
+	}
+	s, ok := strings.CutPrefix(entry.Value, hllPrefix)
+	if entry.Encoding != "" || !ok {
+		return nil, ErrNotHLL
+	}
+	regs, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil || len(regs) != hllRegisters || slices.Max(regs) > 64-hllPrecision+1 {
+		return nil, ErrNotHLL
+	}
+	return regs, nil
+}
+
+func encodeHLL(regs []byte) string {
+	return hllPrefix + base64.RawStdEncoding.EncodeToString(regs)
+}
+
+// hllRequest is the body of POST /hlls/{bucket}/{key}/add and .../merge.
+type hllRequest struct {
+	Items []string `json:"items"` // add
+	From  []string `json:"from"`  // merge, keys in the same bucket
+	TTL   jsonTTL  `json:"ttl"`   // restarts the expiration if set
+}
+
+// serveHLL handles the HyperLogLog endpoints:
+//
+//	GET    /hlls/{bucket}/{key}[?key=k...]  => {"count": n}, of the union with any other keys
+//	DELETE /hlls/{bucket}/{key}             => remove
+//	POST   /hlls/{bucket}/{key}/add         => {"items": [...], "ttl": ...}
+//	POST   /hlls/{bucket}/{key}/merge       => {"from": [k...], "ttl": ...}
+//
+// In buckets with HashKeys, the keys are hashed like any other.
+func serveHLL(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, key, _ := strings.Cut(r.URL.Path[len("/hlls/"):], "/")
+	op := ""
+	for _, o := range []string{"add", "merge"} {
+		if k, ok := strings.CutSuffix(key, "/"+o); ok && k != "" {
+			key, op = k, o
+			break
+		}
+	}
+	if bucket == "" || key == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	cfg := cache.GetBucketConfig(bucket)
+	key, _ = storedKey(cfg, key)
+
+	allowed := []string{http.MethodGet, http.MethodDelete}
+	if op != "" {
+		allowed = []string{http.MethodPost}
+	}
+	if !slices.Contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, allowed...)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys := []string{key}
+		for _, k := range r.URL.Query()["key"] {
+			k, _ = storedKey(cfg, k)
+			keys = append(keys, k)
+		}
+		count, found, err := cache.CountHLL(bucket, keys)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]uint64{"count": count})
+		return
+	case http.MethodDelete:
+		if _, err := cache.Delete(bucket, key); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req hllRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TTL < 0 {
+		writeError(w, http.StatusBadRequest, "ttl must not be negative")
+		return
+	}
+	opts := HLLOptions{WriteOptions: writeOptions(r), TTL: time.Duration(req.TTL)}
+	w.Header().Set("Content-Type", "application/json")
+	if op == "merge" {
+		if len(req.From) == 0 {
+			writeError(w, http.StatusBadRequest, "from must not be empty")
+			return
+		}
+		for i, k := range req.From {
+			req.From[i], _ = storedKey(cfg, k)
+		}
+		count, err := cache.MergeHLL(bucket, key, req.From, opts)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]uint64{"count": count})
+		return
+	}
+	if len(req.Items) == 0 {
+		writeError(w, http.StatusBadRequest, "items must not be empty")
+		return
+	}
+	u, err := cache.AddHLL(bucket, key, req.Items, opts)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(u)
+}
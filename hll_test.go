@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_HLL(t *testing.T) {
+	cache := NewCacheSystem(8192, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	// Estimates stay within a few standard errors, small counts and large
+	for _, n := range []int{10, 1000, 50_000} {
+		key := "n" + strconv.Itoa(n)
+		items := make([]string, n)
+		for i := range items {
+			items[i] = key + "-" + strconv.Itoa(i)
+		}
+		if _, err := cache.AddHLL("b", key, items, HLLOptions{}); err != nil {
+			t.Fatalf("AddHLL => %v", err)
+		}
+		count, found, err := cache.CountHLL("b", []string{key})
+		if err != nil || !found || math.Abs(float64(count)-float64(n)) > 0.05*float64(n) {
+			t.Fatalf("CountHLL of %d items => %d, %v, %v", n, count, found, err)
+		}
+	}
+
+	u, err := cache.AddHLL("b", "mon", []string{"ada", "bob", "cy"}, HLLOptions{TTL: time.Hour})
+	if err != nil || u != (HLLUpdate{Changed: true, Count: 3}) {
+		t.Fatalf("AddHLL => %+v, %v", u, err)
+	}
+	if u, _ := cache.AddHLL("b", "mon", []string{"bob"}, HLLOptions{}); u.Changed {
+		t.Fatalf("expected re-adding an item to change nothing, got %+v", u)
+	}
+	cache.AddHLL("b", "tue", []string{"bob", "dee"}, HLLOptions{})
+
+	// Merges and counts across keys take the union
+	if count, _, _ := cache.CountHLL("b", []string{"mon", "tue", "none"}); count != 4 {
+		t.Fatalf("expected a count of the union of 4, got %d", count)
+	}
+	if count, err := cache.MergeHLL("b", "week", []string{"mon", "tue", "none"}, HLLOptions{}); err != nil || count != 4 {
+		t.Fatalf("MergeHLL => %d, %v", count, err)
+	}
+	if count, _, _ := cache.CountHLL("b", []string{"week"}); count != 4 {
+		t.Fatalf("expected the merged sketch to count 4, got %d", count)
+	}
+	if ttl, _ := cache.TTL("b", "mon"); ttl <= time.Minute {
+		t.Fatalf("expected the sketch to keep its TTL, got %v", ttl)
+	}
+	if _, found, _ := cache.CountHLL("b", []string{"none"}); found {
+		t.Fatalf("expected a missing sketch not to be found")
+	}
+
+	cache.Set("b", "word", "hello")
+	cache.Set("b", "fake", hllPrefix+"AAAA")
+	for _, key := range []string{"word", "fake"} {
+		if _, err := cache.AddHLL("b", key, []string{"a"}, HLLOptions{}); !errors.Is(err, ErrNotHLL) {
+			t.Fatalf("%s: expected ErrNotHLL, got %v", key, err)
+		}
+	}
+	if _, err := cache.MergeHLL("b", "week", []string{"word"}, HLLOptions{}); !errors.Is(err, ErrNotHLL) {
+		t.Fatalf("expected merging a non-sketch to fail, got %v", err)
+	}
+	small := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer small.Stop()
+	if _, err := small.AddHLL("b", "h", []string{"a"}, HLLOptions{}); !errors.Is(err, ErrEntryTooLarge) {
+		t.Fatalf("expected ErrEntryTooLarge, got %v", err)
+	}
+}
+
+func TestHTTP_HLLs(t *testing.T) {
+	cache := NewCacheSystem(8192, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	if resp, out := httpJSON(t, "POST", server.URL+"/hlls/b/mon/add", `{"items":["ada","bob"],"ttl":"1h"}`); resp.StatusCode != http.StatusOK || out["count"] != 2.0 || out["changed"] != true {
+		t.Fatalf("expected add to create the sketch, got %d %v", resp.StatusCode, out)
+	}
+	httpJSON(t, "POST", server.URL+"/hlls/b/tue/add", `{"items":["bob","cy"]}`)
+	if resp, out := httpJSON(t, "GET", server.URL+"/hlls/b/mon?key=tue&key=none", ""); resp.StatusCode != http.StatusOK || out["count"] != 3.0 {
+		t.Fatalf("unexpected count of the union %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "POST", server.URL+"/hlls/b/week/merge", `{"from":["mon","tue"]}`); resp.StatusCode != http.StatusOK || out["count"] != 3.0 {
+		t.Fatalf("expected merge to return the union, got %d %v", resp.StatusCode, out)
+	}
+
+	cache.Set("b", "word", "hello")
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/hlls/b/week", "", http.StatusOK},
+		{"POST", "/hlls/b/word/add", `{"items":["a"]}`, http.StatusConflict},
+		{"POST", "/hlls/b/week/merge", `{"from":["word"]}`, http.StatusConflict},
+		{"GET", "/hlls/b/word", "", http.StatusConflict},
+		{"POST", "/hlls/b/mon/add", `{"items":[]}`, http.StatusBadRequest},
+		{"POST", "/hlls/b/mon/merge", `{}`, http.StatusBadRequest},
+		{"POST", "/hlls/b/mon/add", `{"items":["a"],"ttl":-1}`, http.StatusBadRequest},
+		{"PUT", "/hlls/b/mon", "", http.StatusMethodNotAllowed},
+		{"GET", "/hlls/b/mon/add", "", http.StatusMethodNotAllowed},
+		{"GET", "/hlls/b", "", http.StatusNotFound},
+		{"DELETE", "/hlls/b/week", "", http.StatusOK},
+		{"GET", "/hlls/b/week", "", http.StatusNotFound},
+	} {
+		if resp, _ := httpJSON(t, c.method, server.URL+c.path, c.body); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+}
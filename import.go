@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidImport is returned when an import stops at an entry it can't
+// store as given, such as malformed JSON or a schema violation.
+var ErrInvalidImport = errors.New("invalid import entry")
+
+// throttle is a token bucket allowing rate units per second, with up to a
+// second's worth of burst. A zero rate never waits.
+type throttle struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (t *throttle) setRate(rate float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate, t.tokens, t.last = rate, rate, time.Now()
+}
+
+// wait takes n units, sleeping until they have accrued. n may exceed the
+// burst: the bucket goes into debt and the caller waits it off.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	t.mu.Lock()
+	if t.rate <= 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	t.tokens = min(t.rate, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	t.tokens -= float64(n)
+	delay := time.Duration(-t.tokens / t.rate * float64(time.Second))
+	t.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads through a byte throttle. Blocking in Read stops the
+// server draining the socket, which pushes back on a streaming client.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *throttle
+	n   int64 // bytes read so far
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.n += int64(n)
+	if werr := tr.t.wait(tr.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// SetImportLimits caps the rate at which imports and bulk writes (/mset and
+// PUT /buckets/{bucket}) are taken in, shared across all requests. Zero
+// leaves that dimension unlimited.
+func (cs *CacheSystem) SetImportLimits(bytesPerSec, opsPerSec int64) {
+	cs.importBytes.setRate(float64(bytesPerSec))
+	cs.importOps.setRate(float64(opsPerSec))
+}
+
+// throttleBulk waits until n more bulk writes are allowed.
+func (cs *CacheSystem) throttleBulk(ctx context.Context, n int) error {
+	return cs.importOps.wait(ctx, n)
+}
+
+// throttledBody wraps a bulk request body so it is read no faster than the
+// import byte limit allows.
+func (cs *CacheSystem) throttledBody(ctx context.Context, r io.Reader) *throttledReader {
+	return &throttledReader{ctx: ctx, r: r, t: &cs.importBytes}
+}
+
+// Import stores a stream of JSON entries (see msetItem), one after another,
+// as the job id; an empty id gets one assigned. Its progress counters are
+// "bytes" read, entries "stored" and entries "skipped" because they would
+// only fit by evicting others. Entries are paced by the import limits and
+// written with NoEvict, so they only fill free space. Unlike MSet an import
+// is not atomic: it stops at the first entry it can't store and keeps what
+// it wrote before. The job runs for as long as ctx and reading r do; the
+// returned Job is final.
+func (cs *CacheSystem) Import(ctx context.Context, id string, r io.Reader, defaultKeyspace string, opts WriteOptions) (Job, error) {
+	j, ctx, err := cs.startJob(ctx, "import", id)
+	if err != nil {
+		return Job{}, err
+	}
+	opts.NoEvict = true
+	body := cs.throttledBody(ctx, r)
+	err = cs.importEntries(ctx, j, body, defaultKeyspace, opts)
+	cs.updateJob(j, func(p map[string]int64) { p["bytes"] = body.n })
+	return cs.finishJob(j, err), err
+}
+
+func (cs *CacheSystem) importEntries(ctx context.Context, j *job, body *throttledReader, defaultKeyspace string, opts WriteOptions) error {
+	cs.updateJob(j, func(p map[string]int64) { p["bytes"], p["stored"], p["skipped"] = 0, 0, 0 })
+	dec := json.NewDecoder(body)
+	configs := make(map[string]BucketConfig)
+	for n := 1; ; n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var it msetItem
+		if err := dec.Decode(&it); err == io.EOF {
+			return nil
+		} else if err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("%w %d: %v", ErrInvalidImport, n, err)
+			}
+			return err
+		}
+		if it.Bucket == "" {
+			it.Bucket = defaultKeyspace
+		}
+		cfg, ok := configs[it.Bucket]
+		if !ok {
+			cfg = cs.GetBucketConfig(it.Bucket)
+			configs[it.Bucket] = cfg
+		}
+		bv := bulkValue{Value: it.Value, TTL: it.TTL, ExpiresAt: it.ExpiresAt, Version: it.Version, Cost: it.Cost, SoftTTL: it.SoftTTL, MaxIdle: it.MaxIdle}
+		// Warnings are logged by checkBulkValue; the entry is stored anyway.
+		if status, msg, violations, _ := checkBulkValue(cfg, it.Bucket, it.Key, bv); status != 0 || len(violations) > 0 {
+			if status == 0 {
+				msg = "schema violation: " + strings.Join(violations, "; ")
+			}
+			return fmt.Errorf("%w %d (%s): %s", ErrInvalidImport, n, it.Bucket, msg)
+		}
+
+		if err := cs.importOps.wait(ctx, 1); err != nil {
+			return err
+		}
+		stored, original := storedKey(cfg, it.Key)
+		res, err := cs.SetWithOptions(it.Bucket, BulkItem{
+			Key: stored, Value: it.Value, TTL: time.Duration(it.TTL), ExpiresAt: it.ExpiresAt, Version: it.Version, OriginalKey: original, Cost: it.Cost, SoftTTL: time.Duration(it.SoftTTL), MaxIdle: time.Duration(it.MaxIdle),
+		}, opts)
+		if err != nil {
+			return fmt.Errorf("entry %d (%s/%s): %w", n, it.Bucket, it.Key, err)
+		}
+		cs.updateJob(j, func(p map[string]int64) {
+			p["bytes"] = body.n
+			if res.Applied {
+				p["stored"]++
+			} else {
+				p["skipped"]++
+			}
+		})
+	}
+}
+
+// serveImports handles POST /imports?id=, running an import of the
+// newline-delimited msetItem JSON in the body. Progress is visible under
+// /admin/jobs while the upload runs.
+func serveImports(w http.ResponseWriter, r *http.Request, cache *CacheSystem, defaultKeyspace string) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	// The body is read as a stream, so only the body limit caps it.
+	reader, err := decodedBodyCapped(r, 0)
+	if err != nil {
+		writeEncodingError(w, err)
+		return
+	}
+	job, err := cache.Import(r.Context(), r.URL.Query().Get("id"), reader, defaultKeyspace, writeOptions(r))
+	if job.ID != "" {
+		w.Header().Set("Location", "/admin/jobs/"+job.ID)
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeBodyError(w, err)
+	case err != nil:
+		writeCacheError(w, err)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(job)
+	}
+}
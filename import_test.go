@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Import(t *testing.T) {
+	cache := NewCacheSystem(150, 200, 60, 999999)
+	defer cache.Stop()
+	cache.Set("live", "hot", strings.Repeat("x", 100))
+
+	body := `{"bucket":"b","key":"a","value":"1"}
+{"key":"c","value":"2","ttl":"1m"}
+{"bucket":"b","key":"big","value":"` + strings.Repeat("y", 100) + `"}
+`
+	job, err := cache.Import(context.Background(), "", strings.NewReader(body), "__root__", WriteOptions{})
+	if err != nil {
+		t.Fatalf("Import => %v", err)
+	}
+	if job.ID == "" || job.Kind != "import" || job.State != JobDone || job.Progress["stored"] != 2 || job.Progress["skipped"] != 1 || job.Progress["bytes"] != int64(len(body)) {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if got := cache.Get("live", "hot"); got == "" {
+		t.Fatalf("expected the import not to evict live entries")
+	}
+	if got := cache.Get("__root__", "c"); got != "2" {
+		t.Fatalf("expected c=2 in the default keyspace, got %q", got)
+	}
+
+	// A bad entry stops the import but keeps what came before it
+	job, err = cache.Import(context.Background(), "bad", strings.NewReader(`{"key":"d","value":"3"} {"key":""}`), "__root__", WriteOptions{})
+	if !errors.Is(err, ErrInvalidImport) || job.State != JobFailed || job.Progress["stored"] != 1 {
+		t.Fatalf("expected the import to fail at entry 2, got %+v, %v", job, err)
+	}
+	if status, err := cache.JobStatus("bad"); err != nil || status.Error == "" {
+		t.Fatalf("expected the failure to be recorded, got %+v, %v", status, err)
+	}
+}
+
+func TestCacheSystem_ImportThrottle(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.SetImportLimits(0, 20)
+
+	// The first second's worth goes through at once, the rest is paced
+	var body strings.Builder
+	for i := 0; i < 25; i++ {
+		body.WriteString(`{"key":"k","value":"v"}` + "\n")
+	}
+	start := time.Now()
+	if _, err := cache.Import(context.Background(), "", strings.NewReader(body.String()), "b", WriteOptions{}); err != nil {
+		t.Fatalf("Import => %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected 25 ops at 20/s to be throttled, took %s", elapsed)
+	}
+
+	// A cancelled request stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cache.throttleBulk(ctx, 1000); err == nil {
+		t.Fatalf("expected a cancelled context to end the wait")
+	}
+}
+
+func TestHTTP_Imports(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/imports?id=warmup", "application/x-ndjson", strings.NewReader(`{"bucket":"b","key":"a","value":"1"}`+"\n"))
+	if err != nil {
+		t.Fatalf("POST /imports => %v", err)
+	}
+	var job Job
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || job.Progress["stored"] != 1 || resp.Header.Get("Location") != "/admin/jobs/warmup" {
+		t.Fatalf("POST /imports => %d %+v, %v", resp.StatusCode, job, err)
+	}
+
+	resp, err = http.Post(server.URL+"/imports", "application/x-ndjson", strings.NewReader(`{"bucket":"b","key":"a"`))
+	if err != nil {
+		t.Fatalf("POST /imports => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Location") == "" {
+		t.Fatalf("expected 400 with the job's Location for a truncated entry, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/admin/jobs/warmup")
+	if err != nil {
+		t.Fatalf("GET /admin/jobs/warmup => %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), `"state":"done"`) {
+		t.Fatalf("GET /admin/jobs/warmup => %d %s", resp.StatusCode, b)
+	}
+}
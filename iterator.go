@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Iterator walks a point-in-time snapshot of a bucket's live entries, in key
+// order. It is the supported way for embedders to visit a whole bucket:
+//
+//   - The snapshot is taken once, under the read lock, by NewIterator. The
+//     iterator never takes the cache's lock again, so it can be advanced
+//     slowly, or interleaved with writes to the same bucket from this or
+//     other goroutines, without blocking them or being invalidated.
+//   - It sees exactly the entries that were live when it was created, with
+//     the values they had then. Later writes, deletes and expirations are not
+//     reflected.
+//   - Values are returned as stored; see EntryInfo.Encoding.
+//
+// An Iterator is not safe for concurrent use by several goroutines. Close
+// releases the snapshot; after it Next returns false. Callers should defer
+// Close as soon as NewIterator returns, since the snapshot holds on to every
+// value it references for as long as the iterator is reachable.
+//
+//	it, err := cache.NewIterator("users")
+//	if err != nil { ... }
+//	defer it.Close()
+//	for it.Next() {
+//		e := it.Entry()
+//		...
+//	}
+type Iterator struct {
+	entries []EntryInfo
+	pos     int
+	closed  bool
+}
+
+// NewIterator snapshots bucket's live entries and returns an iterator over
+// them. A bucket with no entries gives an iterator that is immediately done.
+func (cs *CacheSystem) NewIterator(bucket string) (*Iterator, error) {
+	if err := cs.rlock(); err != nil {
+		return nil, err
+	}
+	defer cs.mu.RUnlock()
+	return &Iterator{entries: cs.bucketSnapshotLocked(bucket, time.Now()), pos: -1}, nil
+}
+
+// Next advances to the following entry and reports whether there is one.
+func (it *Iterator) Next() bool {
+	if it.closed || it.pos+1 >= len(it.entries) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+// Entry returns the entry Next moved to. It panics if Next has not returned
+// true.
+func (it *Iterator) Entry() EntryInfo {
+	if it.closed || it.pos < 0 || it.pos >= len(it.entries) {
+		panic("kitsune: Iterator.Entry called without a successful Next")
+	}
+	return it.entries[it.pos]
+}
+
+// Len returns the number of entries in the snapshot.
+func (it *Iterator) Len() int {
+	return len(it.entries)
+}
+
+// Close releases the snapshot. It is safe to call more than once.
+func (it *Iterator) Close() error {
+	it.entries, it.closed = nil, true
+	return nil
+}
+
+// bucketSnapshotLocked copies bucket's live entries, sorted by key; cs.mu
+// must be held.
+func (cs *CacheSystem) bucketSnapshotLocked(bucket string, now time.Time) []EntryInfo {
+	var entries []EntryInfo
+	cs.buckets[bucket].each(func(k string) {
+		entry := cs.items[[2]string{bucket, k}].Value.(*CacheEntry)
+		if !entry.expiredAt(now) && !cs.sessionExpired(entry, now) {
+			entries = append(entries, entry.info(now))
+		}
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCacheSystem_Iterator(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	for i := 0; i < 100; i++ {
+		cache.Set("b", fmt.Sprintf("k%03d", i), "v")
+	}
+	cache.Set("other", "x", "v")
+
+	it, err := cache.NewIterator("b")
+	if err != nil {
+		t.Fatalf("NewIterator => %v", err)
+	}
+	defer it.Close()
+	if it.Len() != 100 {
+		t.Fatalf("expected 100 entries in the snapshot, got %d", it.Len())
+	}
+
+	// Writers run freely while the iterator is open; none of it shows up.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			cache.Set("b", fmt.Sprintf("k%03d", i), "changed")
+			cache.Set("b", fmt.Sprintf("new%03d", i), "v")
+		}
+		cache.Clear("b")
+	}()
+	var seen []string
+	for it.Next() {
+		e := it.Entry()
+		if e.Value != "v" {
+			t.Fatalf("expected the snapshot value for %s, got %q", e.Key, e.Value)
+		}
+		seen = append(seen, e.Key)
+	}
+	wg.Wait()
+	if len(seen) != 100 || seen[0] != "k000" || seen[99] != "k099" {
+		t.Fatalf("expected k000..k099 in order, got %d keys starting %v", len(seen), seen[:1])
+	}
+
+	it.Close()
+	if it.Next() || it.Close() != nil {
+		t.Fatalf("expected a closed iterator to be done and Close to be idempotent")
+	}
+
+	empty, _ := cache.NewIterator("missing")
+	if empty.Next() {
+		t.Fatalf("expected an iterator over a missing bucket to be done")
+	}
+}
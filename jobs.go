@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jobHistory is how many finished jobs are kept for GET /admin/jobs.
+const jobHistory = 50
+
+// Job states.
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// ErrJobNotFound is returned for a job ID that is not known.
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrJobRunning is returned when starting a job under the ID of one that has
+// not finished.
+var ErrJobRunning = errors.New("job already running")
+
+// ErrJobFinished is returned when cancelling a job that has already ended.
+var ErrJobFinished = errors.New("job already finished")
+
+// Job reports the progress, and once it ends the outcome, of a long-running
+// operation such as an import or a background clear.
+type Job struct {
+	ID         string           `json:"id"`
+	Kind       string           `json:"kind"`  // what the job does, e.g. "import" or "clear"
+	State      string           `json:"state"` // one of the Job state constants
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Progress   map[string]int64 `json:"progress"`        // kind-specific counters, final once the job ends
+	Error      string           `json:"error,omitempty"` // why a failed job stopped
+}
+
+// job is a Job tracked by the cache.
+type job struct {
+	Job
+	cancel context.CancelFunc
+}
+
+func (j *job) snapshot() Job {
+	s := j.Job
+	s.Progress = make(map[string]int64, len(j.Progress))
+	for k, v := range j.Progress {
+		s.Progress[k] = v
+	}
+	return s
+}
+
+// startJob registers a running job of kind under id, assigning one if empty.
+// The returned context is cancelled by CancelJob, Stop, or when ctx is.
+func (cs *CacheSystem) startJob(ctx context.Context, kind, id string) (*job, context.Context, error) {
+	cs.jobsMu.Lock()
+	defer cs.jobsMu.Unlock()
+	if id == "" {
+		cs.jobSeq++
+		id = kind + "-" + strconv.FormatUint(cs.jobSeq, 10)
+	}
+	if old, ok := cs.jobs[id]; ok {
+		if old.State == JobRunning {
+			return nil, nil, fmt.Errorf("%w: %q", ErrJobRunning, id)
+		}
+		cs.forgetJobLocked(id)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	j := &job{Job: Job{ID: id, Kind: kind, State: JobRunning, StartedAt: time.Now(), Progress: make(map[string]int64)}, cancel: cancel}
+	cs.jobs[id] = j
+	cs.jobIDs = append(cs.jobIDs, id)
+	return j, ctx, nil
+}
+
+// forgetJobLocked removes the job id. cs.jobsMu must be held.
+func (cs *CacheSystem) forgetJobLocked(id string) {
+	delete(cs.jobs, id)
+	for i, v := range cs.jobIDs {
+		if v == id {
+			cs.jobIDs = append(cs.jobIDs[:i], cs.jobIDs[i+1:]...)
+			break
+		}
+	}
+}
+
+// updateJob lets fn change j's progress counters.
+func (cs *CacheSystem) updateJob(j *job, fn func(progress map[string]int64)) {
+	cs.jobsMu.Lock()
+	defer cs.jobsMu.Unlock()
+	fn(j.Progress)
+}
+
+// finishJob records how j ended and returns its final state.
+func (cs *CacheSystem) finishJob(j *job, err error) Job {
+	j.cancel()
+	cs.jobsMu.Lock()
+	defer cs.jobsMu.Unlock()
+	now := time.Now()
+	j.FinishedAt = &now
+	switch {
+	case err == nil:
+		j.State = JobDone
+	case errors.Is(err, context.Canceled):
+		j.State = JobCancelled
+	default:
+		j.State = JobFailed
+		j.Error = err.Error()
+	}
+
+	// Drop the oldest finished jobs beyond the history limit.
+	finished := 0
+	for i := len(cs.jobIDs) - 1; i >= 0; i-- {
+		old := cs.jobIDs[i]
+		if cs.jobs[old].State == JobRunning {
+			continue
+		}
+		if finished++; finished > jobHistory {
+			cs.forgetJobLocked(old)
+		}
+	}
+	return j.snapshot()
+}
+
+// runJob starts fn as a background job of kind and returns its initial
+// state. Stop cancels the job and waits for fn to return.
+func (cs *CacheSystem) runJob(kind string, fn func(ctx context.Context, j *job) error) (Job, error) {
+	j, ctx, err := cs.startJob(context.Background(), kind, "")
+	if err != nil {
+		return Job{}, err
+	}
+	cs.wg.Add(1)
+	go func() {
+		defer cs.wg.Done()
+		cs.finishJob(j, fn(ctx, j))
+	}()
+	return cs.JobStatus(j.ID)
+}
+
+// cancelJobs cancels every running job, for Stop.
+func (cs *CacheSystem) cancelJobs() {
+	cs.jobsMu.Lock()
+	defer cs.jobsMu.Unlock()
+	for _, j := range cs.jobs {
+		j.cancel()
+	}
+}
+
+// JobStatus reports the progress of the job id.
+func (cs *CacheSystem) JobStatus(id string) (Job, error) {
+	cs.jobsMu.Lock()
+	defer cs.jobsMu.Unlock()
+	j, ok := cs.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %q", ErrJobNotFound, id)
+	}
+	return j.snapshot(), nil
+}
+
+// Jobs reports every running job and the most recent finished ones, oldest
+// first.
+func (cs *CacheSystem) Jobs() []Job {
+	cs.jobsMu.Lock()
+	defer cs.jobsMu.Unlock()
+	jobs := make([]Job, len(cs.jobIDs))
+	for i, id := range cs.jobIDs {
+		jobs[i] = cs.jobs[id].snapshot()
+	}
+	return jobs
+}
+
+// CancelJob asks the running job id to stop. Jobs stop between steps, so it
+// may still be running when CancelJob returns; poll JobStatus to see it end.
+func (cs *CacheSystem) CancelJob(id string) error {
+	cs.jobsMu.Lock()
+	defer cs.jobsMu.Unlock()
+	j, ok := cs.jobs[id]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrJobNotFound, id)
+	}
+	if j.State != JobRunning {
+		return fmt.Errorf("%w: %q is %s", ErrJobFinished, id, j.State)
+	}
+	j.cancel()
+	return nil
+}
+
+// ClearAsync clears bucket like Clear, but hands the removal of its entries
+// to a background job. The bucket reads as empty as soon as this returns.
+func (cs *CacheSystem) ClearAsync(bucket string) (Job, error) {
+	keys, gen, err := cs.detachBucket(bucket)
+	if err != nil {
+		return Job{}, err
+	}
+	return cs.runJob("clear", func(ctx context.Context, j *job) error {
+		// The entries are already logically gone, so the purge runs to the
+		// end even if the job is cancelled.
+		cs.updateJob(j, func(p map[string]int64) { p["total"] = int64(keys.len()) })
+		if keys != nil {
+			cs.purgeDetached(bucket, keys, gen)
+		}
+		cs.updateJob(j, func(p map[string]int64) { p["removed"] = int64(keys.len()) })
+		return nil
+	})
+}
+
+// DeletePrefixAsync runs DeletePrefix as a background job, which can be
+// cancelled between batches. Its progress counts the entries "removed".
+func (cs *CacheSystem) DeletePrefixAsync(bucket, prefix string) (Job, error) {
+	return cs.runJob("delete", func(ctx context.Context, j *job) error {
+		cs.updateJob(j, func(p map[string]int64) { p["removed"] = 0 })
+		_, err := cs.deletePrefix(ctx, bucket, prefix, func(removed int) {
+			cs.updateJob(j, func(p map[string]int64) { p["removed"] = int64(removed) })
+		})
+		return err
+	})
+}
+
+// writeJobAccepted answers a request that started job with 202 Accepted and
+// the job's status URL.
+func writeJobAccepted(w http.ResponseWriter, job Job) {
+	w.Header().Set("Location", "/admin/jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// serveAdminJobs handles the job endpoints:
+//
+//	GET    /admin/jobs      => every tracked job
+//	GET    /admin/jobs/{id} => one job's progress or outcome
+//	DELETE /admin/jobs/{id} => cancel it
+func serveAdminJobs(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/jobs"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string][]Job{"jobs": cache.Jobs()})
+		return
+	case id == "":
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	case r.Method == http.MethodGet:
+	case r.Method == http.MethodDelete:
+		if err := cache.CancelJob(id); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		return
+	}
+	job, err := cache.JobStatus(id)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
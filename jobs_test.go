@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// waitJob polls until the job id has finished.
+func waitJob(t *testing.T, cache *CacheSystem, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := cache.JobStatus(id)
+		if err != nil {
+			t.Fatalf("JobStatus(%q) => %v", id, err)
+		}
+		if info.State != JobRunning {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %q still running", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheSystem_Jobs(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	for i := 0; i < 2*clearBatchSize; i++ {
+		cache.Set("big", "k"+strconv.Itoa(i), "v")
+	}
+	info, err := cache.ClearAsync("big")
+	if err != nil {
+		t.Fatalf("ClearAsync => %v", err)
+	}
+	if size, _ := cache.GetBucketSize("big"); size != 0 {
+		t.Fatalf("expected the bucket to read as empty at once, got %d", size)
+	}
+	if info = waitJob(t, cache, info.ID); info.State != JobDone || info.Progress["removed"] != 2*clearBatchSize {
+		t.Fatalf("unexpected clear job %+v", info)
+	}
+	if entries, _ := cache.Usage(); entries != 0 {
+		t.Fatalf("expected the purge to remove every entry, got %d", entries)
+	}
+
+	cache.Set("p", "t1:a", "v")
+	cache.Set("p", "t2:a", "v")
+	info, err = cache.DeletePrefixAsync("p", "t1:")
+	if err != nil {
+		t.Fatalf("DeletePrefixAsync => %v", err)
+	}
+	if info = waitJob(t, cache, info.ID); info.Kind != "delete" || info.State != JobDone || info.Progress["removed"] != 1 {
+		t.Fatalf("unexpected delete job %+v", info)
+	}
+
+	// Cancellation is cooperative: the job sees its context end
+	started := make(chan struct{})
+	info, _ = cache.runJob("wait", func(ctx context.Context, j *job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	<-started
+	if err := cache.CancelJob(info.ID); err != nil {
+		t.Fatalf("CancelJob => %v", err)
+	}
+	if info = waitJob(t, cache, info.ID); info.State != JobCancelled {
+		t.Fatalf("expected the job to be cancelled, got %s", info.State)
+	}
+	if err := cache.CancelJob(info.ID); !errors.Is(err, ErrJobFinished) {
+		t.Fatalf("expected ErrJobFinished, got %v", err)
+	}
+	if err := cache.CancelJob("missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("expected ErrJobNotFound, got %v", err)
+	}
+
+	for i := 0; i < jobHistory+5; i++ {
+		info, _ := cache.runJob("noop", func(context.Context, *job) error { return nil })
+		waitJob(t, cache, info.ID)
+	}
+	if jobs := cache.Jobs(); len(jobs) != jobHistory {
+		t.Fatalf("expected history capped at %d, got %d", jobHistory, len(jobs))
+	}
+
+	// Stop cancels jobs still running and waits for them
+	other := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	done := make(chan struct{})
+	other.runJob("wait", func(ctx context.Context, j *job) error {
+		<-ctx.Done()
+		close(done)
+		return ctx.Err()
+	})
+	other.Stop()
+	select {
+	case <-done:
+	default:
+		t.Fatalf("expected Stop to wait for running jobs")
+	}
+}
+
+func TestHTTP_AdminJobs(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+	cache.Set("b", "k", "v")
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/buckets/b?async=true", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE ?async => %v", err)
+	}
+	var info Job
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") != "/admin/jobs/"+info.ID {
+		t.Fatalf("DELETE ?async => %d %+v, %v", resp.StatusCode, info, err)
+	}
+	waitJob(t, cache, info.ID)
+
+	resp, err = http.Get(server.URL + "/admin/jobs")
+	if err != nil {
+		t.Fatalf("GET /admin/jobs => %v", err)
+	}
+	var list struct {
+		Jobs []Job `json:"jobs"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || len(list.Jobs) != 1 || list.Jobs[0].Kind != "clear" || list.Jobs[0].Progress["removed"] != 1 {
+		t.Fatalf("GET /admin/jobs => %+v, %v", list, err)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, server.URL+"/admin/jobs/"+info.ID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE job => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 cancelling a finished job, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotJSON is returned by the document operations when the key holds
+// something other than a JSON document.
+var ErrNotJSON = errors.New("value is not a JSON document")
+
+// ErrJSONPath is returned when a JSON pointer names nothing in the
+// document, or, for a write, a member whose parent doesn't exist.
+var ErrJSONPath = errors.New("path not found in document")
+
+// ErrBadPointer is returned for a path that isn't a JSON pointer.
+var ErrBadPointer = errors.New("invalid JSON pointer")
+
+// ErrInvalidJSON is returned by SetJSON for a value that isn't JSON.
+var ErrInvalidJSON = errors.New("value is not valid JSON")
+
+// JSONOptions controls a write to a JSON document. Documents are entries
+// holding compact JSON, so they count towards the cache size like any other
+// value and are readable as ordinary keys. A write at a path rewrites the
+// whole document, so the saving is in what travels over the wire.
+type JSONOptions struct {
+	WriteOptions
+	// TTL, if set, restarts the document's expiration. Otherwise a new
+	// document gets the default TTL, an existing one written at a path keeps
+	// its own, and one replaced whole gets the default again, like a PUT.
+	TTL time.Duration
+	// Validate, if set, is given the whole document as it would be stored
+	// and may refuse the write by returning an error.
+	Validate func(doc string) error
+}
+
+// SetJSON stores value, which must be valid JSON, at path in the document,
+// a JSON pointer (RFC 6901). An empty path replaces the whole document,
+// creating it if missing; any other path needs the document and the
+// member's parent to exist. In an array, an index replaces the element and
+// "-", or the length, appends. It returns the document's new size.
+func (cs *CacheSystem) SetJSON(bucket, key, path string, value []byte, opts JSONOptions) (int, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := decodeJSON(string(value))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	if err := cs.lock(); err != nil {
+		return 0, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return 0, err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	var doc string
+	if len(tokens) == 0 {
+		// Replaced whole: written afresh like a PUT, whatever was there.
+		var buf bytes.Buffer
+		_ = json.Compact(&buf, value)
+		doc, entry = buf.String(), nil
+	} else {
+		if entry == nil {
+			return 0, ErrJSONPath
+		}
+		root, err := entryJSON(entry)
+		if err != nil {
+			return 0, err
+		}
+		if root, err = setPointer(root, tokens, v); err != nil {
+			return 0, err
+		}
+		doc = encodeJSON(root)
+	}
+	if opts.Validate != nil {
+		if err := opts.Validate(doc); err != nil {
+			return 0, err
+		}
+	}
+	if err := cs.rewriteLocked(bucket, key, entry, doc, opts.TTL, opts.WriteOptions, s); err != nil {
+		return 0, err
+	}
+	return len(doc), nil
+}
+
+// DeleteJSON removes the member at path from the document; an empty path
+// removes the document. It reports whether the document existed.
+func (cs *CacheSystem) DeleteJSON(bucket, key, path string, opts JSONOptions) (bool, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return false, err
+	}
+	if err := cs.lock(); err != nil {
+		return false, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return false, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	if entry == nil {
+		return false, nil
+	}
+	elem := cs.items[[2]string{bucket, key}]
+	if len(tokens) == 0 {
+		cs.emit(EventDelete, bucket, key, "")
+		cs.removeElement(elem)
+		return true, nil
+	}
+	root, err := entryJSON(entry)
+	if err != nil {
+		return false, err
+	}
+	if root, err = removePointer(root, tokens); err != nil {
+		return false, err
+	}
+	doc := encodeJSON(root)
+	if opts.Validate != nil {
+		if err := opts.Validate(doc); err != nil {
+			return false, err
+		}
+	}
+	cs.replaceValueLocked(elem, doc, opts.Writer)
+	return true, nil
+}
+
+// GetJSON returns the compact JSON at path in the document, or the whole
+// document for an empty path. It reads the document like LookupValue but
+// never from the loader.
+func (cs *CacheSystem) GetJSON(bucket, key, path string) (string, bool, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return "", false, err
+	}
+	v, found, err := cs.lookupCachedValue(bucket, key)
+	if err != nil || !found {
+		return "", false, err
+	}
+	root, err := entryJSON(&CacheEntry{Value: v.Value, Encoding: v.Encoding})
+	if err != nil {
+		return "", false, err
+	}
+	if len(tokens) == 0 {
+		return v.Value, true, nil
+	}
+	sub, err := lookupPointer(root, tokens)
+	if err != nil {
+		return "", false, err
+	}
+	return encodeJSON(sub), true, nil
+}
+
+// parsePointer splits a JSON pointer into its unescaped reference tokens.
+func parsePointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path[0] != '/' {
+		return nil, fmt.Errorf("%w %q: must be empty or start with /", ErrBadPointer, path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, tok := range tokens {
+		for j := 0; j < len(tok); j++ {
+			if tok[j] == '~' && (j+1 == len(tok) || (tok[j+1] != '0' && tok[j+1] != '1')) {
+				return nil, fmt.Errorf("%w %q: ~ must be followed by 0 or 1", ErrBadPointer, path)
+			}
+		}
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex resolves tok against an array of length n. With appending,
+// "-" and n itself name the slot past the end.
+func arrayIndex(tok string, n int, appending bool) (int, error) {
+	if tok == "-" && appending {
+		return n, nil
+	}
+	// Only plain decimal digits, without leading zeros, index an array.
+	if tok == "" || (len(tok) > 1 && tok[0] == '0') || strings.TrimLeft(tok, "0123456789") != "" {
+		return 0, ErrJSONPath
+	}
+	i, err := strconv.Atoi(tok)
+	if err != nil {
+		return 0, ErrJSONPath
+	}
+	if i > n || (i == n && !appending) {
+		return 0, ErrJSONPath
+	}
+	return i, nil
+}
+
+func lookupPointer(node interface{}, tokens []string) (interface{}, error) {
+	for _, tok := range tokens {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[tok]
+			if !ok {
+				return nil, ErrJSONPath
+			}
+			node = v
+		case []interface{}:
+			i, err := arrayIndex(tok, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, ErrJSONPath
+		}
+	}
+	return node, nil
+}
+
+// setPointer stores value at tokens under node and returns the new node,
+// which differs from node only when an array grew or tokens is empty.
+func setPointer(node interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	tok, rest := tokens[0], tokens[1:]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[tok]
+		if !ok && len(rest) > 0 {
+			return nil, ErrJSONPath
+		}
+		v, err := setPointer(child, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		n[tok] = v
+		return n, nil
+	case []interface{}:
+		i, err := arrayIndex(tok, len(n), len(rest) == 0)
+		if err != nil {
+			return nil, err
+		}
+		if i == len(n) {
+			return append(n, value), nil
+		}
+		v, err := setPointer(n[i], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = v
+		return n, nil
+	}
+	return nil, ErrJSONPath
+}
+
+// removePointer removes the member at tokens, which must not be empty, from
+// under node and returns the new node.
+func removePointer(node interface{}, tokens []string) (interface{}, error) {
+	tok, rest := tokens[0], tokens[1:]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[tok]
+		if !ok {
+			return nil, ErrJSONPath
+		}
+		if len(rest) == 0 {
+			delete(n, tok)
+			return n, nil
+		}
+		v, err := removePointer(child, rest)
+		if err != nil {
+			return nil, err
+		}
+		n[tok] = v
+		return n, nil
+	case []interface{}:
+		i, err := arrayIndex(tok, len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return append(n[:i], n[i+1:]...), nil
+		}
+		v, err := removePointer(n[i], rest)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = v
+		return n, nil
+	}
+	return nil, ErrJSONPath
+}
+
+// entryJSON decodes the document entry holds.
+func entryJSON(entry *CacheEntry) (interface{}, error) {
+	if entry.Encoding != "" {
+		return nil, ErrEncodedValue
+	}
+	v, err := decodeJSON(entry.Value)
+	if err != nil {
+		return nil, ErrNotJSON
+	}
+	return v, nil
+}
+
+// decodeJSON parses one JSON value, keeping numbers exactly as written.
+func decodeJSON(s string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+// encodeJSON returns v as compact JSON, leaving <, > and & unescaped.
+func encodeJSON(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// errSchemaRefused is what a JSONOptions.Validate built by serveJSON returns
+// for a document the bucket's schema refuses.
+var errSchemaRefused = errors.New("document does not match the bucket's JSON schema")
+
+// serveJSON handles the document endpoints:
+//
+//	GET    /json/{bucket}/{key}[?path=/p]      => the document, or the JSON at /p
+//	PUT    /json/{bucket}/{key}[?path=/p&ttl=] => store the body, which must be JSON, there
+//	DELETE /json/{bucket}/{key}[?path=/p]      => remove the document, or the member at /p
+//
+// Every write is validated against the bucket's JSON schema, if it has one,
+// as the whole document it produces. In buckets with HashKeys, the key is
+// hashed like any other.
+func serveJSON(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, key, _ := strings.Cut(r.URL.Path[len("/json/"):], "/")
+	if bucket == "" || key == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	cfg := cache.GetBucketConfig(bucket)
+	key, _ = storedKey(cfg, key)
+	path := r.URL.Query().Get("path")
+
+	opts := JSONOptions{WriteOptions: writeOptions(r)}
+	var violations []string
+	if cfg.jsonSchema != nil {
+		opts.Validate = func(doc string) error {
+			violations = schemaViolations(cfg, bucket, key, doc)
+			if len(violations) > 0 && cfg.SchemaMode != "warn" {
+				return errSchemaRefused
+			}
+			return nil
+		}
+	}
+	writeJSONError := func(err error) {
+		if errors.Is(err, errSchemaRefused) {
+			writeSchemaError(w, violations)
+			return
+		}
+		writeCacheError(w, err)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		doc, found, err := cache.GetJSON(bucket, key, path)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, doc+"\n")
+	case http.MethodPut:
+		if s := r.URL.Query().Get("ttl"); s != "" {
+			ttl, err := parseTTL(s)
+			if err != nil || ttl < 0 {
+				writeError(w, http.StatusBadRequest, "invalid ttl: "+s)
+				return
+			}
+			opts.TTL = ttl
+		}
+		body, err := decodedBody(r)
+		if err != nil {
+			writeEncodingError(w, err)
+			return
+		}
+		value, err := io.ReadAll(body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		size, err := cache.SetJSON(bucket, key, path, value, opts)
+		if err != nil {
+			writeJSONError(err)
+			return
+		}
+		if len(violations) > 0 {
+			w.Header().Set("X-Kitsune-Schema-Warning", strings.Join(violations, "; "))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int{"size": size})
+	case http.MethodDelete:
+		found, err := cache.DeleteJSON(bucket, key, path, opts)
+		if err != nil {
+			writeJSONError(err)
+			return
+		}
+		if !found && path != "" {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
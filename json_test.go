@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_JSON(t *testing.T) {
+	cache := NewCacheSystem(128, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	if _, err := cache.SetJSON("b", "doc", "", []byte(`{"user": {"name": "Ada", "a/b": 1}, "tags": ["x"]}`), JSONOptions{TTL: time.Hour}); err != nil {
+		t.Fatalf("SetJSON => %v", err)
+	}
+	if got := cache.Get("b", "doc"); got != `{"user":{"name":"Ada","a/b":1},"tags":["x"]}` {
+		t.Fatalf("expected the document to be stored compact and in order, got %s", got)
+	}
+	for path, want := range map[string]string{
+		"":            `{"user":{"name":"Ada","a/b":1},"tags":["x"]}`,
+		"/user/name":  `"Ada"`,
+		"/user/a~1b":  `1`,
+		"/tags/0":     `"x"`,
+		"/tags":       `["x"]`,
+		"/user/name/": "",
+		"/tags/1":     "",
+		"/tags/01":    "",
+		"/nothing":    "",
+	} {
+		got, _, err := cache.GetJSON("b", "doc", path)
+		if want == "" {
+			if !errors.Is(err, ErrJSONPath) {
+				t.Fatalf("GetJSON %q: expected ErrJSONPath, got %q, %v", path, got, err)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Fatalf("GetJSON %q => %q, %v, want %q", path, got, err, want)
+		}
+	}
+
+	// Writes at a path keep the TTL
+	for path, value := range map[string]string{"/user/name": `"Grace"`, "/user/plan": `{"seats": 5}`, "/tags/-": `"y"`} {
+		if _, err := cache.SetJSON("b", "doc", path, []byte(value), JSONOptions{}); err != nil {
+			t.Fatalf("SetJSON %q => %v", path, err)
+		}
+	}
+	if _, err := cache.DeleteJSON("b", "doc", "/tags/0", JSONOptions{}); err != nil {
+		t.Fatalf("DeleteJSON => %v", err)
+	}
+	if got, _, _ := cache.GetJSON("b", "doc", ""); got != `{"tags":["y"],"user":{"a/b":1,"name":"Grace","plan":{"seats":5}}}` {
+		t.Fatalf("unexpected document %s", got)
+	}
+	if ttl, _ := cache.TTL("b", "doc"); ttl <= time.Minute {
+		t.Fatalf("expected the document to keep its TTL, got %v", ttl)
+	}
+
+	for _, c := range []struct {
+		path, value string
+		err         error
+	}{
+		{"/missing/name", `1`, ErrJSONPath},
+		{"/tags/5", `1`, ErrJSONPath},
+		{"user", `1`, ErrBadPointer},
+		{"/user/~2", `1`, ErrBadPointer},
+		{"/user/name", `{"a":`, ErrInvalidJSON},
+		{"/user/bio", `"` + strings.Repeat("x", 128) + `"`, ErrEntryTooLarge},
+	} {
+		if _, err := cache.SetJSON("b", "doc", c.path, []byte(c.value), JSONOptions{}); !errors.Is(err, c.err) {
+			t.Fatalf("SetJSON %q: expected %v, got %v", c.path, c.err, err)
+		}
+	}
+	if _, err := cache.SetJSON("b", "none", "/a", []byte(`1`), JSONOptions{}); !errors.Is(err, ErrJSONPath) {
+		t.Fatalf("expected a path in a missing document to fail, got %v", err)
+	}
+
+	cache.Set("b", "word", "hello")
+	if _, _, err := cache.GetJSON("b", "word", "/a"); !errors.Is(err, ErrNotJSON) {
+		t.Fatalf("expected ErrNotJSON, got %v", err)
+	}
+	if _, err := cache.SetJSON("b", "word", "", []byte(`[1]`), JSONOptions{}); err != nil {
+		t.Fatalf("expected a whole document to replace any value, got %v", err)
+	}
+
+	refuse := errors.New("refused")
+	if _, err := cache.SetJSON("b", "doc", "/user/name", []byte(`2`), JSONOptions{Validate: func(doc string) error { return refuse }}); err != refuse {
+		t.Fatalf("expected Validate to refuse the write, got %v", err)
+	}
+	if got, _, _ := cache.GetJSON("b", "doc", "/user/name"); got != `"Grace"` {
+		t.Fatalf("expected a refused write to leave the document alone, got %s", got)
+	}
+}
+
+func TestHTTP_JSON(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	if resp, out := httpDo(t, "PUT", server.URL+"/json/b/u?ttl=1h", `{"name": "Ada", "tags": []}`); resp.StatusCode != http.StatusOK || out != `{"size":24}` {
+		t.Fatalf("expected PUT to store the document, got %d %s", resp.StatusCode, out)
+	}
+	httpDo(t, "PUT", server.URL+"/json/b/u?path=/tags/-", `"<admin>"`)
+	if resp, out := httpDo(t, "GET", server.URL+"/json/b/u?path=/tags", ""); resp.StatusCode != http.StatusOK || out != `["<admin>"]` {
+		t.Fatalf("unexpected GET ?path= %d %s", resp.StatusCode, out)
+	}
+
+	// Writes are validated as the whole document
+	schema := `{"json_schema": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}}`
+	if resp, out := httpDo(t, "PUT", server.URL+"/buckets/strict/config", schema); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT config => %d %s", resp.StatusCode, out)
+	}
+	httpDo(t, "PUT", server.URL+"/json/strict/u", `{"name": "Ada"}`)
+
+	cache.Set("b", "word", "hello")
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"PUT", "/json/strict/u?path=/name", `5`, http.StatusBadRequest},
+		{"DELETE", "/json/strict/u?path=/name", "", http.StatusBadRequest},
+		{"PUT", "/json/strict/u?path=/age", `5`, http.StatusOK},
+		{"PUT", "/json/b/u", `{"name":`, http.StatusBadRequest},
+		{"PUT", "/json/b/u?ttl=soon", `1`, http.StatusBadRequest},
+		{"GET", "/json/b/u?path=name", "", http.StatusBadRequest},
+		{"GET", "/json/b/u?path=/age", "", http.StatusNotFound},
+		{"PUT", "/json/b/u?path=/a/b", `1`, http.StatusNotFound},
+		{"GET", "/json/b/word", "", http.StatusConflict},
+		{"PUT", "/json/b/big", `"` + strings.Repeat("x", 1024) + `"`, http.StatusRequestEntityTooLarge},
+		{"PATCH", "/json/b/u", `{}`, http.StatusMethodNotAllowed},
+		{"GET", "/json/b", "", http.StatusNotFound},
+		{"DELETE", "/json/b/u?path=/tags/0", "", http.StatusOK},
+		{"DELETE", "/json/b/u", "", http.StatusOK},
+		{"GET", "/json/b/u", "", http.StatusNotFound},
+	} {
+		if resp, out := httpDo(t, c.method, server.URL+c.path, c.body); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d %s", c.method, c.path, c.code, resp.StatusCode, out)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// hashedKeyPrefix marks a key as the output of HashKey. The "1" versions the
+// scheme so it can change without confusing stored keys.
+const hashedKeyPrefix = "h1:"
+
+// hashedKeyLen is the length of every HashKey result.
+var hashedKeyLen = len(hashedKeyPrefix) + base64.RawURLEncoding.EncodedLen(16)
+
+// ErrKeyCollision is returned when a write to a bucket with HashKeys would
+// overwrite the entry of a different key that hashes the same.
+var ErrKeyCollision = errors.New("key hash collides with a different stored key")
+
+// HashKey returns the key stored for key in buckets with HashKeys: "h1:"
+// followed by the first 16 bytes of the key's SHA-256 digest in unpadded
+// base64url. Clients can compute it themselves and send it in place of key.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashedKeyPrefix + base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// isHashedKey reports whether key already has the form of a HashKey result.
+func isHashedKey(key string) bool {
+	return len(key) == hashedKeyLen && strings.HasPrefix(key, hashedKeyPrefix)
+}
+
+// storedKey maps a client key to the key stored in a bucket with cfg, and
+// returns the original to check for collisions: "" unless the key was hashed
+// here, since a precomputed hash carries nothing to compare against.
+func storedKey(cfg BucketConfig, key string) (stored, original string) {
+	if !cfg.HashKeys || isHashedKey(key) {
+		return key, ""
+	}
+	return HashKey(key), key
+}
+
+// keyCollides reports whether an entry stored for the original key stored
+// is being addressed by a different original key. Either side being unknown
+// ("") counts as a match.
+func keyCollides(stored, original string) bool {
+	return stored != "" && original != "" && stored != original
+}
+
+// storedForOther reports whether key's entry was stored for an original key
+// other than original, for routes that act on a key without reading its
+// value first. Like the plain key routes, they treat such an entry as
+// missing when reading it and answer ErrKeyCollision when changing it.
+func storedForOther(cache *CacheSystem, bucket, key, original string) bool {
+	if original == "" {
+		return false
+	}
+	meta, found, err := cache.Info(bucket, key)
+	return err == nil && found && keyCollides(meta.OriginalKey, original)
+}
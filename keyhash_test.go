@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHashKey(t *testing.T) {
+	// SDKs precompute this, so the scheme must never change silently.
+	if got := HashKey("users:42:profile"); got != "h1:EOkGk4mfHDFf7AYsZaslvw" {
+		t.Fatalf("HashKey changed: got %q", got)
+	}
+	if !isHashedKey(HashKey(strings.Repeat("k", 2048))) {
+		t.Fatalf("expected HashKey output to be recognized as hashed")
+	}
+
+	cfg := BucketConfig{HashKeys: true}
+	if stored, original := storedKey(cfg, "long key"); stored != HashKey("long key") || original != "long key" {
+		t.Fatalf("expected the key to be hashed, got %q, %q", stored, original)
+	}
+	if stored, original := storedKey(cfg, HashKey("long key")); stored != HashKey("long key") || original != "" {
+		t.Fatalf("expected a precomputed hash to pass through, got %q, %q", stored, original)
+	}
+	if stored, _ := storedKey(BucketConfig{}, "long key"); stored != "long key" {
+		t.Fatalf("expected keys to be stored as is without HashKeys, got %q", stored)
+	}
+}
+
+func TestHTTP_HashedKeys(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+	cache.SetBucketConfig("h", BucketConfig{HashKeys: true})
+
+	get := func(key string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/buckets/h/" + key)
+		if err != nil {
+			t.Fatalf("GET %s => %v", key, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	long := "report/" + strings.Repeat("x", 2000)
+	resp, err := httpPut(server.URL+"/buckets/h/"+long, "application/json", strings.NewReader(`{"value":"v"}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT long key => %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	if _, found, _ := cache.Lookup("h", HashKey(long)); !found {
+		t.Fatalf("expected the entry to be stored under the key's hash")
+	}
+	if _, body := get(long); !strings.Contains(body, `"v"`) {
+		t.Fatalf("expected to read back by the original key, got %s", body)
+	}
+	if _, body := get(HashKey(long)); !strings.Contains(body, `"v"`) {
+		t.Fatalf("expected to read back by the precomputed hash, got %s", body)
+	}
+
+	_, body := get(HashKey(long) + "?info")
+	var meta EntryMeta
+	if err := json.Unmarshal([]byte(body), &meta); err != nil || meta.OriginalKey != long {
+		t.Fatalf("expected ?info to report the original key, got %s", body)
+	}
+
+	// Simulate a collision: an entry under a's hash that belongs to another key
+	cache.SetWithOptions("h", BulkItem{Key: HashKey("a"), Value: "theirs", OriginalKey: "b"}, WriteOptions{})
+	if _, body := get("a"); strings.Contains(body, "theirs") {
+		t.Fatalf("expected a colliding entry not to be served, got %s", body)
+	}
+	resp, err = httpPut(server.URL+"/buckets/h/a", "application/json", strings.NewReader(`{"value":"mine"}`))
+	if err != nil {
+		t.Fatalf("PUT a => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for a colliding write, got %d", resp.StatusCode)
+	}
+
+	// Key actions check the original key too: reads miss, writes conflict
+	for _, c := range []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"GET", "a?info", http.StatusNotFound, ""},
+		{"GET", "a/ttl", http.StatusOK, `{"ttl":-1,"ttl_ms":-1}`},
+		{"POST", "a/getdel", http.StatusNotFound, ""},
+		{"DELETE", "a?return=true", http.StatusNotFound, ""},
+		{"POST", "a/touch", http.StatusConflict, ""},
+		{"POST", "a/persist", http.StatusConflict, ""},
+		{"POST", "a/incr", http.StatusConflict, ""},
+		{"POST", "a/decr", http.StatusConflict, ""},
+		{"POST", "a/lease", http.StatusConflict, ""},
+	} {
+		resp, body := httpDo(t, c.method, server.URL+"/buckets/h/"+c.path, "")
+		if resp.StatusCode != c.code || strings.Contains(body, "theirs") || (c.body != "" && body != c.body) {
+			t.Fatalf("%s %s: expected %d %s, got %d %s", c.method, c.path, c.code, c.body, resp.StatusCode, body)
+		}
+	}
+	if v, found, _ := cache.Lookup("h", HashKey("a")); !found || v != "theirs" {
+		t.Fatalf("expected the colliding entry to be left alone, got %q, %v", v, found)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "hash/fnv"
+
+// keySetSlots is how many hash slots a bucket's key set is split into. SCAN
+// walks one slot per lock acquisition, so a big bucket is never traversed
+// while the lock is held.
+const keySetSlots = 64
+
+// keySet is the set of keys in one bucket, sharded by key hash. Slots are
+// allocated on first use, so small buckets stay small.
+type keySet struct {
+	slots [keySetSlots]map[string]struct{}
+	n     int
+}
+
+// keySlot returns the slot key belongs to.
+func keySlot(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % keySetSlots)
+}
+
+func (s *keySet) add(key string) {
+	i := keySlot(key)
+	if s.slots[i] == nil {
+		s.slots[i] = make(map[string]struct{})
+	}
+	if _, ok := s.slots[i][key]; !ok {
+		s.slots[i][key] = struct{}{}
+		s.n++
+	}
+}
+
+func (s *keySet) remove(key string) {
+	i := keySlot(key)
+	if _, ok := s.slots[i][key]; ok {
+		delete(s.slots[i], key)
+		s.n--
+		if len(s.slots[i]) == 0 {
+			s.slots[i] = nil
+		}
+	}
+}
+
+// has reports whether key is in the set; a nil set is empty.
+func (s *keySet) has(key string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.slots[keySlot(key)][key]
+	return ok
+}
+
+// len returns the number of keys; a nil set is empty.
+func (s *keySet) len() int {
+	if s == nil {
+		return 0
+	}
+	return s.n
+}
+
+// each calls fn for every key, in no particular order. A nil set is empty.
+func (s *keySet) each(fn func(key string)) {
+	if s == nil {
+		return
+	}
+	for _, slot := range s.slots {
+		for k := range slot {
+			fn(k)
+		}
+	}
+}
+
+// eachIn calls fn for every key in slot i, in no particular order. A nil set
+// is empty.
+func (s *keySet) eachIn(i int, fn func(key string)) {
+	if s == nil {
+		return
+	}
+	for k := range s.slots[i] {
+		fn(k)
+	}
+}
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"container/heap"
 	"container/list"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -18,6 +31,12 @@ const (
 	DEFAULT_MAX_SIZE         = math.MaxInt64
 	DEFAULT_CLEANUP_INTERVAL = 300
 	DEFAULT_KEYSPACE         = "__root__"
+
+	// clearBatchSize is how many entries Clear removes per lock acquisition.
+	clearBatchSize = 1024
+
+	// defaultMinCleanupInterval is the floor of an adaptive cleanup interval.
+	defaultMinCleanupInterval = 100 * time.Millisecond
 )
 
 var cacheEntryPool = sync.Pool{
@@ -28,16 +47,63 @@ var cacheEntryPool = sync.Pool{
 
 // CacheEntry holds an individual item in the cache.
 type CacheEntry struct {
-	Bucket     string
-	Key        string
-	Value      string
-	Expiration time.Time
-	Size       int
+	Bucket      string
+	Key         string
+	Value       string
+	Expiration  time.Time
+	Size        int
+	Session     string    // owning session, if written with SetInSession
+	WrittenBy   string    // identity of the last writer, if known
+	WrittenAt   time.Time // time of the last write
+	Encoding    string    // content encoding Value is stored in, "" or encodingGzip
+	Version     uint64    // assigned by every write; increases across the whole cache
+	OriginalKey string    // client key that Key is the hash of, in buckets with HashKeys
+	Cost        float64   // writer's estimate of what rebuilding the value costs, see victimLocked
+	// SoftExpiration is when the value goes stale: reads still return it but
+	// flag it so callers refresh it. Zero for never; see BulkItem.SoftTTL.
+	SoftExpiration time.Time
+	// IdleExpiration is when the entry expires unless it is read first; every
+	// read pushes it out by maxIdle. Zero for never; see BulkItem.MaxIdle.
+	IdleExpiration time.Time
+
+	ttl     time.Duration // lifetime granted by the last write or touch, renewed by sliding expiration; 0 for none
+	maxIdle time.Duration // longest the entry may go unread; 0 for no limit
+	hits    int64         // reads served since the last write
+	gen     uint64        // CacheSystem.gen at insertion, used to detect logically cleared entries
+	sum     uint32        // CRC-32C of Value, if summed; see SetChecksums
+	summed  bool
+
+	bucketElem *list.Element // place in CacheSystem.bucketLRU
 }
 
 // IsExpired returns true if the entry is beyond its Expiration.
+// A zero Expiration never expires.
 func (ce *CacheEntry) IsExpired() bool {
-	return time.Now().After(ce.Expiration)
+	return ce.expiredAt(time.Now())
+}
+
+func (ce *CacheEntry) expiredAt(now time.Time) bool {
+	at := ce.expiresAt()
+	return !at.IsZero() && now.After(at)
+}
+
+// expiresAt returns when the entry expires if nothing renews it, the earlier
+// of its Expiration and IdleExpiration, or zero for never.
+func (ce *CacheEntry) expiresAt() time.Time {
+	if ce.IdleExpiration.IsZero() || (!ce.Expiration.IsZero() && ce.Expiration.Before(ce.IdleExpiration)) {
+		return ce.Expiration
+	}
+	return ce.IdleExpiration
+}
+
+// staleAt reports whether the entry is past its soft TTL at now.
+func (ce *CacheEntry) staleAt(now time.Time) bool {
+	return !ce.SoftExpiration.IsZero() && now.After(ce.SoftExpiration)
+}
+
+// storedValue returns the entry as a read sees it at now.
+func (ce *CacheEntry) storedValue(now time.Time) StoredValue {
+	return StoredValue{Value: ce.Value, Encoding: ce.Encoding, Version: ce.Version, OriginalKey: ce.OriginalKey, Stale: ce.staleAt(now)}
 }
 
 // reset clears the CacheEntry fields so they can be reused safely.
@@ -47,20 +113,143 @@ func (ce *CacheEntry) reset() {
 	ce.Value = ""
 	ce.Size = 0
 	ce.Expiration = time.Time{}
+	ce.Session = ""
+	ce.WrittenBy = ""
+	ce.WrittenAt = time.Time{}
+	ce.Encoding = ""
+	ce.Version = 0
+	ce.OriginalKey = ""
+	ce.Cost = 0
+	ce.SoftExpiration = time.Time{}
+	ce.IdleExpiration = time.Time{}
+	ce.maxIdle = 0
+	ce.ttl = 0
+	ce.hits = 0
+	ce.gen = 0
+	ce.sum = 0
+	ce.summed = false
+	ce.bucketElem = nil
+}
+
+// BucketConfig holds per-bucket settings that override cache-wide behavior.
+type BucketConfig struct {
+	// Codec names the wire encoding for values in the bucket (see Codec).
+	// An empty Codec keeps the default JSON envelope for requests and responses.
+	Codec string `json:"codec,omitempty"`
+	// Schema optionally names the protobuf message type stored in the bucket.
+	Schema string `json:"schema,omitempty"`
+	// JSONSchema, if set, is checked against every value written to the bucket.
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+	// SchemaMode is "enforce" (the default) to reject invalid values with 400,
+	// or "warn" to store them anyway and only log the violations.
+	SchemaMode string `json:"schema_mode,omitempty"`
+	// SlidingExpiration, if set, overrides the cache-wide sliding expiration
+	// setting for the bucket (see CacheSystem.SetSlidingExpiration).
+	SlidingExpiration *bool `json:"sliding_expiration,omitempty"`
+	// TTL, if set, replaces the cache-wide default TTL for entries written
+	// to the bucket without one of their own.
+	TTL jsonTTL `json:"ttl,omitempty"`
+	// HashKeys indexes every key by its fixed-size HashKey. The client's key
+	// is kept on the entry only to detect collisions, and clients may send
+	// the hash itself to keep long keys off the wire.
+	HashKeys bool `json:"hash_keys,omitempty"`
+	// MaxBytes caps the bytes the bucket holds, counted like the cache size;
+	// zero for no quota beyond the cache's own.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// OnFull is what a write past MaxBytes does: "evict" (the default) makes
+	// room by evicting the bucket's own least recently used entries, "reject"
+	// fails it with a *QuotaError (507 over HTTP) and keeps what is stored.
+	OnFull string `json:"on_full,omitempty"`
+
+	jsonSchema *jsonSchema // compiled JSONSchema, set by Validate
 }
 
 // CacheSystem manages all in-memory buckets and entries.
 type CacheSystem struct {
 	mu              sync.RWMutex
-	entries         *list.List                     // Doubly linked list for LRU ordering: front=MRU, back=LRU
-	items           map[[2]string]*list.Element    // (bucket,key) => list element
-	buckets         map[string]map[string]struct{} // bucket => set of keys
+	entries         *list.List                  // Doubly linked list for LRU ordering: front=MRU, back=LRU
+	items           map[[2]string]*list.Element // (bucket,key) => list element
+	buckets         map[string]*keySet          // bucket => set of keys
 	maxEntrySize    int64
 	maxSize         int64
 	ttl             time.Duration
-	cleanupInterval time.Duration
+	cleanupInterval time.Duration // the sweep interval, or its ceiling if it adapts
+	cleanupMin      time.Duration // floor of an adaptive interval; 0 if it is fixed
+	cleanupCurrent  int64         // atomic; sweep interval in use, in nanoseconds
+	expiredBacklog  int64         // atomic; expired entries found by the last sweep
 
 	currentSize int64
+	bucketSize  map[string]int64 // bucket => bytes of its live entries, for quotas
+	// bucketLRU orders each bucket's elements of entries the same way, so
+	// a bucket's least recently used entries are found without walking
+	// everyone else's.
+	bucketLRU map[string]*list.List
+
+	// Clear detaches a bucket immediately and removes its entries in batches.
+	// Entries inserted before clearedAt[bucket] are logically gone and must be
+	// treated as missing until the batches get to them.
+	gen       uint64
+	clearedAt map[string]uint64
+
+	version uint64 // last CacheEntry.Version handed out
+
+	events *eventLog // change feed, nil until enableEvents
+
+	sessions map[string]*session // session ID => lease and tagged entries
+
+	frozen map[string]time.Time // read-only buckets => automatic thaw time, zero for none
+
+	stats   *statsRegistry // per-bucket counters, under their own lock
+	churn   churnCounters  // cache-wide write amplification, atomic
+	started time.Time      // when the cache was created, for uptime
+
+	// Bucket settings live under their own lock so they stay readable while
+	// a long operation holds mu.
+	cfgMu         sync.RWMutex
+	bucketConfigs map[string]BucketConfig // bucket => settings, kept across Clear
+
+	lockTimeout  int64 // atomic; max wait for mu in nanoseconds, 0 = wait forever
+	lockTimeouts int64 // atomic; number of operations that gave up waiting
+
+	sliding int32 // atomic; 1 if reads extend expiration by default
+
+	strictStatus atomic.Bool // GET of a missing key answers 404, see SetStrictStatus
+
+	admission atomic.Pointer[frequencySketch] // nil unless TinyLFU admission is on
+
+	checksums        string // see SetChecksums; guarded by mu
+	checksumFailures atomic.Int64
+
+	maintenance atomic.Pointer[MaintenanceWindow] // nil to run heavy work at any time
+	warming     atomic.Pointer[warmup]            // startup fill in progress, see Warmup
+
+	store atomic.Pointer[storeWriter] // nil without a backing store, see SetStore
+
+	// Leases on missing keys, see Lease. leased counts them so that writes
+	// skip leaseMu while there are none.
+	leaseMu sync.Mutex
+	leases  map[[2]string]*lease
+	leased  atomic.Int64
+
+	// Read-through: misses are filled by the loader, see SetLoader.
+	loadMu      sync.Mutex
+	loader      Loader
+	loads       map[[2]string]*loadCall // (bucket,key) => load in progress
+	loadResults [3]int64                // atomic; ok, not found, failed
+
+	// Scheduled clears live under their own lock, since running one takes mu.
+	schedMu          sync.Mutex
+	schedules        map[string]*schedule // name => schedule
+	scheduleFailures int64                // atomic; runs that failed
+
+	// Imports and bulk writes share these limits.
+	importBytes, importOps throttle
+
+	// Long-running operations are tracked as jobs, see runJob.
+	jobsMu sync.Mutex
+	jobs   map[string]*job
+	jobIDs []string // in start order
+	jobSeq uint64
 
 	// For background cleanup
 	stopCh chan struct{}
@@ -68,7 +257,34 @@ type CacheSystem struct {
 }
 
 // NewCacheSystem creates a new CacheSystem with the given parameters.
+// ttl and cleanupInterval are in seconds; use NewCache for finer control.
 func NewCacheSystem(maxEntrySize, maxSize, ttl, cleanupInterval int64) *CacheSystem {
+	return NewCache(CacheConfig{
+		MaxEntrySize:    maxEntrySize,
+		MaxSize:         maxSize,
+		TTL:             time.Duration(ttl) * time.Second,
+		CleanupInterval: time.Duration(cleanupInterval) * time.Second,
+	})
+}
+
+// CacheConfig holds the settings of a CacheSystem.
+type CacheConfig struct {
+	MaxEntrySize    int64         // max value size in bytes; <= 0 for no limit
+	MaxSize         int64         // max total size in bytes; <= 0 for no limit
+	TTL             time.Duration // default TTL; 0 means entries never expire
+	CleanupInterval time.Duration // how often expired entries are swept; <= 0 for 1s
+
+	// AdaptiveCleanup lets the sweep interval float between
+	// MinCleanupInterval and CleanupInterval: it halves while each sweep
+	// finds more expired entries than the one before, and doubles while
+	// sweeps find none.
+	AdaptiveCleanup    bool
+	MinCleanupInterval time.Duration // floor for AdaptiveCleanup; <= 0 for 100ms
+}
+
+// NewCache creates a new CacheSystem from cfg.
+func NewCache(cfg CacheConfig) *CacheSystem {
+	maxEntrySize, maxSize := cfg.MaxEntrySize, cfg.MaxSize
 	if maxEntrySize <= 0 {
 		maxEntrySize = DEFAULT_MAX_ENTRY_SIZE
 	}
@@ -78,21 +294,44 @@ func NewCacheSystem(maxEntrySize, maxSize, ttl, cleanupInterval int64) *CacheSys
 	if maxSize < maxEntrySize {
 		maxSize = maxEntrySize
 	}
+	ttl := cfg.TTL
 	if ttl < 0 {
-		ttl = 0
+		ttl = 0 // no expiry
 	}
+	cleanupInterval := cfg.CleanupInterval
 	if cleanupInterval <= 0 {
-		cleanupInterval = 1
+		cleanupInterval = time.Second
+	}
+	var cleanupMin time.Duration
+	if cfg.AdaptiveCleanup {
+		if cleanupMin = cfg.MinCleanupInterval; cleanupMin <= 0 {
+			cleanupMin = defaultMinCleanupInterval
+		}
+		if cleanupMin > cleanupInterval {
+			cleanupMin = cleanupInterval
+		}
 	}
 
 	cs := &CacheSystem{
 		entries:         list.New(),
 		items:           make(map[[2]string]*list.Element),
-		buckets:         make(map[string]map[string]struct{}),
+		buckets:         make(map[string]*keySet),
+		bucketSize:      make(map[string]int64),
+		bucketLRU:       make(map[string]*list.List),
+		clearedAt:       make(map[string]uint64),
+		sessions:        make(map[string]*session),
+		frozen:          make(map[string]time.Time),
+		stats:           newStatsRegistry(),
+		started:         time.Now(),
+		bucketConfigs:   make(map[string]BucketConfig),
+		schedules:       make(map[string]*schedule),
+		jobs:            make(map[string]*job),
 		maxEntrySize:    maxEntrySize,
 		maxSize:         maxSize,
-		ttl:             time.Duration(ttl) * time.Second,
-		cleanupInterval: time.Duration(cleanupInterval) * time.Second,
+		ttl:             ttl,
+		cleanupInterval: cleanupInterval,
+		cleanupMin:      cleanupMin,
+		cleanupCurrent:  int64(cleanupInterval),
 		stopCh:          make(chan struct{}),
 	}
 
@@ -102,66 +341,307 @@ func NewCacheSystem(maxEntrySize, maxSize, ttl, cleanupInterval int64) *CacheSys
 	return cs
 }
 
-// Stop signals the background cleanup goroutine to exit.
+// ErrLockTimeout is returned when an operation could not acquire the cache
+// lock within the configured lock timeout.
+var ErrLockTimeout = errors.New("timed out waiting for cache lock")
+
+// ErrVersionMismatch is returned by a compare-and-swap write whose expected
+// version (BulkItem.Version) is not the stored entry's.
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// SetLockTimeout bounds how long operations wait for the cache lock before
+// failing with ErrLockTimeout. Zero (the default) waits indefinitely.
+func (cs *CacheSystem) SetLockTimeout(d time.Duration) {
+	atomic.StoreInt64(&cs.lockTimeout, int64(d))
+}
+
+// SetSlidingExpiration turns on time-to-idle semantics: every successful Get
+// pushes the entry's expiration out by the TTL it was written with. Buckets
+// can override this with BucketConfig.SlidingExpiration.
+func (cs *CacheSystem) SetSlidingExpiration(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&cs.sliding, v)
+}
+
+// SetStrictStatus makes a GET of a missing key over HTTP answer 404, as it
+// does in codec buckets, rather than 200 with an empty value, which can't be
+// told apart from an empty one.
+func (cs *CacheSystem) SetStrictStatus(on bool) {
+	cs.strictStatus.Store(on)
+}
+
+// slidingFor reports whether reads extend expiration in bucket.
+func (cs *CacheSystem) slidingFor(bucket string) bool {
+	if cfg := cs.GetBucketConfig(bucket); cfg.SlidingExpiration != nil {
+		return *cfg.SlidingExpiration
+	}
+	return atomic.LoadInt32(&cs.sliding) == 1
+}
+
+// LockTimeouts returns how many operations failed with ErrLockTimeout.
+func (cs *CacheSystem) LockTimeouts() int64 {
+	return atomic.LoadInt64(&cs.lockTimeouts)
+}
+
+// lock acquires the write lock, honoring the lock timeout.
+func (cs *CacheSystem) lock() error {
+	return cs.acquire(cs.mu.Lock, cs.mu.TryLock)
+}
+
+// rlock acquires the read lock, honoring the lock timeout.
+func (cs *CacheSystem) rlock() error {
+	return cs.acquire(cs.mu.RLock, cs.mu.TryRLock)
+}
+
+// acquire blocks on lockFn when no timeout is set; otherwise it polls tryFn
+// with a short exponential backoff until the deadline passes.
+func (cs *CacheSystem) acquire(lockFn func(), tryFn func() bool) error {
+	timeout := time.Duration(atomic.LoadInt64(&cs.lockTimeout))
+	if timeout <= 0 {
+		lockFn()
+		return nil
+	}
+	if tryFn() {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := 10 * time.Microsecond
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			atomic.AddInt64(&cs.lockTimeouts, 1)
+			return ErrLockTimeout
+		}
+		time.Sleep(min(backoff, wait))
+		if tryFn() {
+			return nil
+		}
+		if backoff < time.Millisecond {
+			backoff *= 2
+		}
+	}
+}
+
+// Stop signals the background cleanup goroutine and any background jobs to
+// exit, and waits for them. Writes still queued for the store are flushed.
 func (cs *CacheSystem) Stop() {
+	cs.cancelJobs()
 	close(cs.stopCh)
 	cs.wg.Wait()
+	if store := cs.store.Load(); store != nil {
+		store.close()
+	}
 }
 
 // expirationLoop periodically evicts expired entries.
 func (cs *CacheSystem) expirationLoop() {
 	defer cs.wg.Done()
-	ticker := time.NewTicker(cs.cleanupInterval)
+	interval, backlog := cs.cleanupInterval, 0
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
+	sessionTicker := time.NewTicker(sessionSweepInterval)
+	defer sessionTicker.Stop()
+	scheduleTicker := time.NewTicker(scheduleTickInterval)
+	defer scheduleTicker.Stop()
 
 	for {
 		select {
 		case <-cs.stopCh:
 			return
-		case <-ticker.C:
-			cs.cleanupExpired()
+		case now := <-ticker.C:
+			if !cs.maintenanceAllows(taskSweep, now) {
+				continue
+			}
+			prev := backlog
+			backlog = cs.cleanupExpired()
+			atomic.StoreInt64(&cs.expiredBacklog, int64(backlog))
+			if next := cs.adaptCleanupInterval(interval, backlog, prev); next != interval {
+				interval = next
+				ticker.Reset(interval)
+				atomic.StoreInt64(&cs.cleanupCurrent, int64(interval))
+			}
+		case now := <-sessionTicker.C:
+			cs.expireSessions()
+			cs.pruneLeases(now)
+		case now := <-scheduleTicker.C:
+			cs.runDueSchedules(now)
 		}
 	}
 }
 
-// cleanupExpired removes entries whose TTL has expired.
-func (cs *CacheSystem) cleanupExpired() {
+// adaptCleanupInterval returns the sweep interval to use after a sweep that
+// found backlog expired entries, where the one before found prev. A fixed
+// interval is returned unchanged.
+func (cs *CacheSystem) adaptCleanupInterval(interval time.Duration, backlog, prev int) time.Duration {
+	switch {
+	case cs.cleanupMin <= 0:
+		return interval
+	case backlog > prev:
+		interval /= 2 // falling behind
+	case backlog == 0:
+		interval *= 2 // idle
+	}
+	if interval < cs.cleanupMin {
+		interval = cs.cleanupMin
+	}
+	if interval > cs.cleanupInterval {
+		interval = cs.cleanupInterval
+	}
+	return interval
+}
+
+// CleanupInterval returns how often expired entries are currently swept.
+func (cs *CacheSystem) CleanupInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&cs.cleanupCurrent))
+}
+
+// ExpiredBacklog returns the number of expired entries the last sweep found,
+// i.e. how many had piled up since the one before.
+func (cs *CacheSystem) ExpiredBacklog() int64 {
+	return atomic.LoadInt64(&cs.expiredBacklog)
+}
+
+// cleanupExpired removes entries whose TTL has expired and returns how many
+// there were.
+func (cs *CacheSystem) cleanupExpired() int {
 	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	defer cs.unlock()
 
+	removed := 0
 	for e := cs.entries.Back(); e != nil; {
 		entry := e.Value.(*CacheEntry)
 		if entry.IsExpired() {
 			prev := e.Prev()
+			if !cs.isStale(entry) {
+				cs.emit(EventExpire, entry.Bucket, entry.Key, "")
+				removed++
+			}
 			cs.removeElement(e)
 			e = prev
 		} else {
 			e = e.Prev()
 		}
 	}
+	return removed
 }
 
 // enforceSizeLimit evicts from the LRU side until currentSize <= maxSize.
 func (cs *CacheSystem) enforceSizeLimit() {
 	for cs.currentSize > cs.maxSize && cs.entries.Len() > 0 {
-		evictElem := cs.entries.Back()
+		evictElem := cs.victimLocked("")
+		if entry := evictElem.Value.(*CacheEntry); !cs.isStale(entry) {
+			cs.emit(EventEvict, entry.Bucket, entry.Key, "")
+		}
 		cs.removeElement(evictElem)
 	}
 }
 
+// evictionSample is how many of the least recently used entries are weighed
+// against each other by cost when one has to be evicted.
+const evictionSample = 8
+
+// victimLocked picks the entry to evict next, from bucket or from the whole
+// cache if bucket is empty. Among the evictionSample least recently used
+// entries it takes the one with the lowest Cost, the least recently used of
+// equals, so with no costs set eviction is plain LRU. Entries of cleared
+// buckets go first. The most recently used entry, normally the one just
+// written, is only picked when there is no other. A bucket's entries are
+// taken from bucketLRU, so picking one costs the same however many other
+// entries the cache holds. cs.mu must be held; it returns nil if there is
+// nothing to evict.
+func (cs *CacheSystem) victimLocked(bucket string) *list.Element {
+	lru := cs.entries
+	if bucket != "" {
+		if lru = cs.bucketLRU[bucket]; lru == nil {
+			return nil
+		}
+	}
+	// elemOf returns the element of entries that e of lru stands for.
+	elemOf := func(e *list.Element) *list.Element {
+		if bucket == "" {
+			return e
+		}
+		return e.Value.(*list.Element)
+	}
+	front := lru.Front()
+	var victim *list.Element
+	for e, seen := lru.Back(), 0; e != front && seen < evictionSample; e = e.Prev() {
+		elem := elemOf(e)
+		entry := elem.Value.(*CacheEntry)
+		if cs.isStale(entry) {
+			return elem
+		}
+		if victim == nil || entry.Cost < victim.Value.(*CacheEntry).Cost {
+			victim = elem
+			if entry.Cost == 0 {
+				break // nothing is cheaper
+			}
+		}
+		seen++
+	}
+	if victim == nil && front != nil {
+		return elemOf(front)
+	}
+	return victim
+}
+
+// pushLocked inserts entry as the most recently used, both in the cache and
+// in its bucket. cs.mu must be held for writing.
+func (cs *CacheSystem) pushLocked(entry *CacheEntry) *list.Element {
+	elem := cs.entries.PushFront(entry)
+	lru := cs.bucketLRU[entry.Bucket]
+	if lru == nil {
+		lru = list.New()
+		cs.bucketLRU[entry.Bucket] = lru
+	}
+	entry.bucketElem = lru.PushFront(elem)
+	return elem
+}
+
+// moveToFrontLocked marks elem as the most recently used, both in the
+// cache and in its bucket. cs.mu must be held for writing.
+func (cs *CacheSystem) moveToFrontLocked(elem *list.Element) {
+	entry := elem.Value.(*CacheEntry)
+	cs.entries.MoveToFront(elem)
+	cs.bucketLRU[entry.Bucket].MoveToFront(entry.bucketElem)
+}
+
+// isStale reports whether entry belongs to a bucket cleared after it was written.
+func (cs *CacheSystem) isStale(entry *CacheEntry) bool {
+	cleared, ok := cs.clearedAt[entry.Bucket]
+	return ok && entry.gen < cleared
+}
+
 // removeElement is an internal helper to remove a *list.Element (CacheEntry) from the list.
 func (cs *CacheSystem) removeElement(elem *list.Element) {
 	entry := elem.Value.(*CacheEntry)
 	cs.entries.Remove(elem)
+	if lru := cs.bucketLRU[entry.Bucket]; lru != nil {
+		if lru.Remove(entry.bucketElem); lru.Len() == 0 {
+			delete(cs.bucketLRU, entry.Bucket)
+		}
+	}
 	delete(cs.items, [2]string{entry.Bucket, entry.Key})
 	cs.currentSize -= int64(entry.Size)
+	// A cleared bucket's usage was dropped with it.
+	if !cs.isStale(entry) {
+		if cs.bucketSize[entry.Bucket] -= int64(entry.Size); cs.bucketSize[entry.Bucket] == 0 {
+			delete(cs.bucketSize, entry.Bucket)
+		}
+	}
 
 	if setOfKeys, ok := cs.buckets[entry.Bucket]; ok {
-		delete(setOfKeys, entry.Key)
-		if len(setOfKeys) == 0 {
+		setOfKeys.remove(entry.Key)
+		if setOfKeys.len() == 0 {
 			delete(cs.buckets, entry.Bucket)
 		}
 	}
+	if s, ok := cs.sessions[entry.Session]; ok {
+		delete(s.keys, [2]string{entry.Bucket, entry.Key})
+	}
 
 	// Wipe fields, then return the entry to the pool.
 	entry.reset()
@@ -170,42 +650,498 @@ func (cs *CacheSystem) removeElement(elem *list.Element) {
 
 // Get returns the value from the cache if present and not expired.
 // Moves the entry to the front (MRU) if found and valid.
+// A missing key, or a lock timeout, yields an empty string.
 func (cs *CacheSystem) Get(bucket, key string) string {
-	cs.mu.RLock()
+	val, _, _ := cs.Lookup(bucket, key)
+	return val
+}
+
+// Lookup is like Get but also reports whether the entry was found,
+// so an empty value can be told apart from a missing key.
+func (cs *CacheSystem) Lookup(bucket, key string) (string, bool, error) {
+	val, _, found, err := cs.LookupEncoded(bucket, key)
+	return val, found, err
+}
+
+// LookupEncoded is like Lookup but also returns the content encoding the value
+// was stored in; an encoded value is returned as stored.
+func (cs *CacheSystem) LookupEncoded(bucket, key string) (value, encoding string, found bool, err error) {
+	v, found, err := cs.LookupValue(bucket, key)
+	return v.Value, v.Encoding, found, err
+}
+
+// StoredValue is an entry's value as returned by LookupValue.
+type StoredValue struct {
+	Value       string
+	Encoding    string // content encoding Value is stored in, "" or encodingGzip
+	Version     uint64
+	OriginalKey string // see CacheEntry.OriginalKey
+	Stale       bool   // past its soft TTL, see CacheEntry.SoftExpiration
+}
+
+// LookupValue is like Lookup but returns the value together with its encoding
+// and version, for callers that go on to make a compare-and-swap write. A
+// miss is filled by the loader, if one is set.
+func (cs *CacheSystem) LookupValue(bucket, key string) (StoredValue, bool, error) {
+	v, found, err := cs.lookupCachedValue(bucket, key)
+	if found || err != nil {
+		return v, found, err
+	}
+	return cs.loadMissing(bucket, key)
+}
+
+// lookupCachedValue is LookupValue without the loader.
+func (cs *CacheSystem) lookupCachedValue(bucket, key string) (StoredValue, bool, error) {
+	cs.recordAccess(bucket, key)
+	if err := cs.rlock(); err != nil {
+		return StoredValue{}, false, err
+	}
 	elem, found := cs.items[[2]string{bucket, key}]
+	stale := found && cs.isStale(elem.Value.(*CacheEntry))
 	cs.mu.RUnlock()
 
-	if !found {
-		return ""
+	if !found || stale {
+		cs.stats.record(bucket, statMiss)
+		return StoredValue{}, false, nil
 	}
 
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	if err := cs.lock(); err != nil {
+		return StoredValue{}, false, err
+	}
+	defer cs.unlock()
 
 	// double-check existence & expiration
 	if elem2, stillFound := cs.items[[2]string{bucket, key}]; !stillFound || elem2 != elem {
 		// it was removed between RUnlock and Lock
-		return ""
+		cs.stats.record(bucket, statMiss)
+		return StoredValue{}, false, nil
 	}
+	return cs.readLocked(bucket, key, elem)
+}
+
+// readLocked reads the entry at elem for a lookup of bucket/key: an expired
+// entry is removed and misses, a live one is promoted and hits, and one that
+// fails its checksum under ChecksumsFail is removed and fails the read. cs.mu
+// must be held for writing.
+func (cs *CacheSystem) readLocked(bucket, key string, elem *list.Element) (StoredValue, bool, error) {
 	entry := elem.Value.(*CacheEntry)
+	if cs.isStale(entry) {
+		cs.removeElement(elem)
+		cs.stats.record(bucket, statMiss)
+		return StoredValue{}, false, nil
+	}
 	if entry.IsExpired() {
+		cs.emit(EventExpire, bucket, key, "")
 		cs.removeElement(elem)
-		return ""
+		cs.stats.record(bucket, statMiss)
+		return StoredValue{}, false, nil
+	}
+	if entry.Session != "" && cs.liveSessionLocked(entry.Session, time.Now()) == nil {
+		// The owning session lapsed and took the entry with it.
+		cs.stats.record(bucket, statMiss)
+		return StoredValue{}, false, nil
+	}
+	if err := cs.verifyLocked(entry); err != nil {
+		// Only the cached copy is bad; the store's was written before it went
+		// bad, so it is kept.
+		cs.emit(EventEvict, bucket, key, "")
+		cs.removeElement(elem)
+		return StoredValue{}, false, err
+	}
+
+	if entry.ttl > 0 && cs.slidingFor(bucket) {
+		entry.Expiration = time.Now().Add(entry.ttl)
+	}
+	if entry.maxIdle > 0 {
+		entry.IdleExpiration = time.Now().Add(entry.maxIdle)
 	}
 
 	// Move to the front (MRU)
-	cs.entries.MoveToFront(elem)
-	return entry.Value
+	cs.moveToFrontLocked(elem)
+	entry.hits++
+	cs.stats.record(bucket, statHit)
+	cs.churn.served(len(entry.Value))
+	return entry.storedValue(time.Now()), true, nil
+}
+
+// MGetResult is the outcome of one key of MGet.
+type MGetResult struct {
+	StoredValue
+	Found bool
+	Err   error // the loader failed to fill the miss, see LoadError, or the value failed its checksum
+}
+
+// MGet looks up keys that may span buckets under one lock acquisition,
+// returning a result per key in order. Each counts as a read just as with
+// LookupValue, and misses are then filled by the loader, if one is set; a
+// failed load fails only its own key.
+func (cs *CacheSystem) MGet(keys []KeyRef) ([]MGetResult, error) {
+	for _, k := range keys {
+		cs.recordAccess(k.Bucket, k.Key)
+	}
+	if err := cs.lock(); err != nil {
+		return nil, err
+	}
+	results := make([]MGetResult, len(keys))
+	for i, k := range keys {
+		elem, ok := cs.items[[2]string{k.Bucket, k.Key}]
+		if !ok {
+			cs.stats.record(k.Bucket, statMiss)
+			continue
+		}
+		results[i].StoredValue, results[i].Found, results[i].Err = cs.readLocked(k.Bucket, k.Key, elem)
+	}
+	cs.unlock()
+
+	for i, k := range keys {
+		if !results[i].Found && results[i].Err == nil {
+			results[i].StoredValue, results[i].Found, results[i].Err = cs.loadMissing(k.Bucket, k.Key)
+		}
+	}
+	return results, nil
+}
+
+// Peek is like Lookup but leaves the entry where it is in the LRU order, and
+// its expiration, hit count and the bucket's stats untouched, so monitoring
+// and debugging reads don't change what gets evicted.
+func (cs *CacheSystem) Peek(bucket, key string) (string, bool, error) {
+	v, found, err := cs.PeekValue(bucket, key)
+	return v.Value, found, err
+}
+
+// PeekValue is like LookupValue but, like Peek, has no effect on the entry.
+func (cs *CacheSystem) PeekValue(bucket, key string) (StoredValue, bool, error) {
+	if err := cs.rlock(); err != nil {
+		return StoredValue{}, false, err
+	}
+	defer cs.mu.RUnlock()
+
+	entry := cs.liveEntryLocked(bucket, key)
+	if entry == nil {
+		return StoredValue{}, false, nil
+	}
+	if err := cs.verifyLocked(entry); err != nil {
+		return StoredValue{}, false, err
+	}
+	return entry.storedValue(time.Now()), true, nil
 }
 
 // Set inserts or updates an entry, respecting the maxEntrySize, maxSize, and TTL.
-func (cs *CacheSystem) Set(bucket, key, value string) {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+func (cs *CacheSystem) Set(bucket, key, value string) error {
+	return cs.SetWithTTL(bucket, key, value, 0)
+}
+
+// SetWithTTL is like Set but overrides the default TTL when ttl > 0.
+func (cs *CacheSystem) SetWithTTL(bucket, key, value string, ttl time.Duration) error {
+	return cs.SetInSession("", bucket, key, value, ttl)
+}
+
+// SetWithExpiry is like Set but expires the entry at an absolute time.
+func (cs *CacheSystem) SetWithExpiry(bucket, key, value string, expiresAt time.Time) error {
+	return cs.SetMany(bucket, []BulkItem{{Key: key, Value: value, ExpiresAt: expiresAt}})
+}
+
+// BulkItem is one key/value pair written by SetMany.
+type BulkItem struct {
+	Key       string
+	Value     string
+	TTL       time.Duration // zero uses the default TTL
+	ExpiresAt time.Time     // if set, the exact expiration; overrides TTL
+	Encoding  string        // content encoding Value is already in, "" or encodingGzip
+	Version   uint64        // if non-zero, write only over an entry with this version
+	// OriginalKey is the client key that Key hashes, for buckets with
+	// HashKeys; the write fails with ErrKeyCollision over another key's entry.
+	OriginalKey string
+	Cost        float64 // see CacheEntry.Cost; zero for none
+	// SoftTTL, if positive, is how long until the value goes stale; reads
+	// keep returning it until it expires, flagged for a refresh.
+	SoftTTL time.Duration
+	// MaxIdle, if positive, also expires the entry once it has gone that
+	// long without a read, whichever of that and its TTL comes first.
+	MaxIdle time.Duration
+}
+
+// SetMany writes all items into bucket under a single lock acquisition.
+func (cs *CacheSystem) SetMany(bucket string, items []BulkItem) error {
+	return cs.SetManyWithOptions(bucket, items, WriteOptions{})
+}
+
+// Write modes make a write conditional on whether the key is already present.
+const (
+	ModeAlways      = ""   // write unconditionally
+	ModeIfNotExists = "nx" // write only if the key is missing, like SETNX
+	ModeIfExists    = "xx" // write only if the key is present
+)
+
+// WriteOptions carries attributes of a write beyond the values themselves.
+type WriteOptions struct {
+	Session string // owning session, see SetInSession; empty for none
+	Writer  string // identity recorded as the entries' last writer
+	Mode    string // one of the Mode constants; items it rules out are skipped
+	// NoEvict skips items that would only fit by evicting other entries,
+	// so background loads can't push out the live working set.
+	NoEvict bool
+}
+
+// SetNX stores the value only if the key is missing and reports whether it did.
+func (cs *CacheSystem) SetNX(bucket, key, value string) (bool, error) {
+	res, err := cs.SetWithOptions(bucket, BulkItem{Key: key, Value: value}, WriteOptions{Mode: ModeIfNotExists})
+	return res.Applied, err
+}
+
+// SetXX stores the value only if the key is present and reports whether it did.
+func (cs *CacheSystem) SetXX(bucket, key, value string) (bool, error) {
+	res, err := cs.SetWithOptions(bucket, BulkItem{Key: key, Value: value}, WriteOptions{Mode: ModeIfExists})
+	return res.Applied, err
+}
+
+// CompareAndSwap stores the value only if the entry's current version is
+// version, failing with ErrVersionMismatch otherwise. It returns the new version.
+func (cs *CacheSystem) CompareAndSwap(bucket, key, value string, version uint64) (uint64, error) {
+	res, err := cs.SetWithOptions(bucket, BulkItem{Key: key, Value: value, Version: version}, WriteOptions{})
+	return res.Version, err
+}
+
+// WriteResult describes the outcome of SetWithOptions.
+type WriteResult struct {
+	Applied bool   // false if WriteOptions.Mode ruled the write out
+	Version uint64 // version of the stored entry, 0 if nothing was stored
+}
+
+// SetWithOptions writes a single item. The write is skipped if opts.Mode rules
+// it out, and fails with ErrVersionMismatch if item.Version is set but stale.
+func (cs *CacheSystem) SetWithOptions(bucket string, item BulkItem, opts WriteOptions) (WriteResult, error) {
+	if err := cs.lock(); err != nil {
+		return WriteResult{}, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return WriteResult{}, err
+	}
+
+	s, err := cs.writeSessionLocked(opts)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	if err := cs.checkWriteLocked(bucket, item); err != nil {
+		return WriteResult{}, err
+	}
+	if err := cs.checkQuotaLocked(bucket, item, opts, nil); err != nil {
+		return WriteResult{}, err
+	}
+	return cs.writeLocked(bucket, item, opts, s), nil
+}
+
+// SetManyWithOptions is like SetMany but applies opts to every entry written.
+// If any item's Version does not match, nothing is written.
+func (cs *CacheSystem) SetManyWithOptions(bucket string, items []BulkItem, opts WriteOptions) error {
+	if err := cs.lock(); err != nil {
+		return err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return err
+	}
+
+	s, err := cs.writeSessionLocked(opts)
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]int64)
+	for _, item := range items {
+		if err := cs.checkWriteLocked(bucket, item); err != nil {
+			return fmt.Errorf("key %q: %w", item.Key, err)
+		}
+		if err := cs.checkQuotaLocked(bucket, item, opts, pending); err != nil {
+			return fmt.Errorf("key %q: %w", item.Key, err)
+		}
+	}
+	for _, item := range items {
+		cs.writeLocked(bucket, item, opts, s)
+	}
+	return nil
+}
+
+// MultiItem is one write of MSet, which unlike SetMany may span buckets.
+type MultiItem struct {
+	Bucket string
+	BulkItem
+}
+
+// MSet writes items across any number of buckets under a single lock
+// acquisition, applying opts to each. If any item's Version does not match,
+// nothing is written.
+func (cs *CacheSystem) MSet(items []MultiItem, opts WriteOptions) error {
+	if err := cs.lock(); err != nil {
+		return err
+	}
+	defer cs.unlock()
+
+	s, err := cs.writeSessionLocked(opts)
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]int64)
+	for _, item := range items {
+		if err := cs.writableLocked(item.Bucket); err != nil {
+			return err
+		}
+		if err := cs.checkWriteLocked(item.Bucket, item.BulkItem); err != nil {
+			return fmt.Errorf("bucket %q key %q: %w", item.Bucket, item.Key, err)
+		}
+		if err := cs.checkQuotaLocked(item.Bucket, item.BulkItem, opts, pending); err != nil {
+			return fmt.Errorf("bucket %q key %q: %w", item.Bucket, item.Key, err)
+		}
+	}
+	for _, item := range items {
+		cs.writeLocked(item.Bucket, item.BulkItem, opts, s)
+	}
+	return nil
+}
+
+// writeSessionLocked returns the session a write is tagged with, nil for none.
+// cs.mu must be held for writing.
+func (cs *CacheSystem) writeSessionLocked(opts WriteOptions) (*session, error) {
+	if opts.Session == "" {
+		return nil, nil
+	}
+	s := cs.liveSessionLocked(opts.Session, time.Now())
+	if s == nil {
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+// liveEntryLocked returns the entry under key if it is readable, nil if it is
+// missing, expired, cleared or its session lapsed. cs.mu must be held.
+func (cs *CacheSystem) liveEntryLocked(bucket, key string) *CacheEntry {
+	elem, ok := cs.items[[2]string{bucket, key}]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*CacheEntry)
+	now := time.Now()
+	if cs.isStale(entry) || entry.expiredAt(now) || cs.sessionExpired(entry, now) {
+		return nil
+	}
+	return entry
+}
+
+// checkWriteLocked returns ErrVersionMismatch if item expects a version the
+// entry does not have, or ErrKeyCollision if item would overwrite an entry
+// stored for a different original key. cs.mu must be held.
+func (cs *CacheSystem) checkWriteLocked(bucket string, item BulkItem) error {
+	if item.Version == 0 && item.OriginalKey == "" {
+		return nil
+	}
+	entry := cs.liveEntryLocked(bucket, item.Key)
+	if item.Version != 0 && (entry == nil || entry.Version != item.Version) {
+		return ErrVersionMismatch
+	}
+	if entry != nil && keyCollides(entry.OriginalKey, item.OriginalKey) {
+		return ErrKeyCollision
+	}
+	return nil
+}
+
+// writeLocked stores one item as described by opts, tagging it with session s
+// if non-nil, unless opts.Mode rules it out. cs.mu must be held for writing.
+func (cs *CacheSystem) writeLocked(bucket string, item BulkItem, opts WriteOptions, s *session) WriteResult {
+	if !cs.modeAllowsLocked(bucket, item.Key, opts.Mode) {
+		return WriteResult{}
+	}
+	if opts.NoEvict && !cs.fitsLocked(bucket, item) {
+		return WriteResult{}
+	}
+	cs.recordAccess(bucket, item.Key)
+	if cs.leased.Load() > 0 {
+		// Waiters wake once cs.mu is released, and find the value.
+		cs.endLease(bucket, item.Key)
+	}
+	stored := storeOp{bucket: bucket, key: item.Key, value: StoredValue{Value: item.Value, Encoding: item.Encoding, OriginalKey: item.OriginalKey}}
+	if !cs.admitLocked(bucket, item) {
+		// Like an oversized value, the write succeeds without being kept.
+		cs.storeLocked(stored)
+		return WriteResult{Applied: true}
+	}
+
+	cs.setLocked(bucket, item.Key, item.Value, item.TTL)
+	compositeKey := [2]string{bucket, item.Key}
+	elem, ok := cs.items[compositeKey]
+	if !ok {
+		cs.storeLocked(stored)
+		return WriteResult{Applied: true}
+	}
+	entry := elem.Value.(*CacheEntry)
+	entry.WrittenBy = opts.Writer
+	entry.Encoding = item.Encoding
+	entry.OriginalKey = item.OriginalKey
+	entry.Cost = item.Cost
+	if item.SoftTTL > 0 {
+		entry.SoftExpiration = entry.WrittenAt.Add(item.SoftTTL)
+	}
+	if item.MaxIdle > 0 {
+		entry.maxIdle = item.MaxIdle
+		entry.IdleExpiration = entry.WrittenAt.Add(item.MaxIdle)
+	}
+	if !item.ExpiresAt.IsZero() {
+		// Absolute expiry is kept as given and never slides.
+		entry.Expiration = item.ExpiresAt
+		entry.ttl = 0
+	}
+	if s != nil {
+		entry.Session = opts.Session
+		s.keys[compositeKey] = struct{}{}
+	}
+	stored.value.Version = entry.Version
+	cs.storeLocked(stored)
+	return WriteResult{Applied: true, Version: entry.Version}
+}
+
+// modeAllowsLocked reports whether write mode lets a write to key through.
+// cs.mu must be held.
+func (cs *CacheSystem) modeAllowsLocked(bucket, key, mode string) bool {
+	if mode == ModeAlways {
+		return true
+	}
+	exists := cs.liveEntryLocked(bucket, key) != nil
+	return exists == (mode == ModeIfExists)
+}
+
+// fitsLocked reports whether item can be stored without evicting anything
+// else, from the cache or from its bucket's quota. cs.mu must be held.
+func (cs *CacheSystem) fitsLocked(bucket string, item BulkItem) bool {
+	if cfg := cs.GetBucketConfig(bucket); cfg.MaxBytes > 0 {
+		if cs.bucketSize[bucket]+cs.growthLocked(bucket, item.Key, item.Value) > cfg.MaxBytes {
+			return false
+		}
+	}
+	if cs.maxSize <= 0 {
+		return true
+	}
+	size := int64(len(bucket) + len(item.Key) + len(item.Value))
+	if elem, ok := cs.items[[2]string{bucket, item.Key}]; ok {
+		size -= int64(elem.Value.(*CacheEntry).Size)
+	}
+	return cs.currentSize+size <= cs.maxSize
+}
+
+// setLocked inserts or replaces an entry; cs.mu must be held for writing.
+// A replaced entry leaves its session, so the new one is untagged.
+func (cs *CacheSystem) setLocked(bucket, key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = cs.ttlFor(bucket)
+	}
 
 	compositeKey := [2]string{bucket, key}
 	// If it already exists, remove it first so we can reinsert a fresh one.
+	existed := false
 	if elem, found := cs.items[compositeKey]; found {
+		old := elem.Value.(*CacheEntry)
+		existed = !cs.isStale(old)
+		if existed && !old.IsExpired() {
+			cs.churn.overwrote(time.Since(old.WrittenAt))
+		}
 		cs.removeElement(elem)
 	}
 
@@ -215,249 +1151,2372 @@ func (cs *CacheSystem) Set(bucket, key, value string) {
 	entry.Bucket = bucket
 	entry.Key = key
 	entry.Value = value
-	entry.Expiration = time.Now().Add(cs.ttl)
+	cs.sumLocked(entry)
+	if ttl > 0 {
+		entry.Expiration = time.Now().Add(ttl)
+		entry.ttl = ttl
+	}
 	entry.Size = len(bucket) + len(key) + len(value)
+	entry.WrittenAt = time.Now()
+	entry.gen = cs.gen
+	cs.version++
+	entry.Version = cs.version
 
 	// Compare just the value size to maxEntrySize
 	if int64(len(value)) > cs.maxEntrySize {
 		// Return entry to pool and exit (too large)
 		entry.reset()
 		cacheEntryPool.Put(entry)
+		if existed {
+			cs.emit(EventDelete, bucket, key, "")
+		}
 		return
 	}
 
-	elem := cs.entries.PushFront(entry)
+	elem := cs.pushLocked(entry)
 	cs.items[compositeKey] = elem
 	cs.currentSize += int64(entry.Size)
+	cs.churn.wrote(len(value))
+	cs.bucketSize[bucket] += int64(entry.Size)
 
 	// Bucket set
 	if _, ok := cs.buckets[bucket]; !ok {
-		cs.buckets[bucket] = make(map[string]struct{})
+		cs.buckets[bucket] = &keySet{}
 	}
-	cs.buckets[bucket][key] = struct{}{}
+	cs.buckets[bucket].add(key)
+	cs.emit(EventSet, bucket, key, value)
 
-	// Evict if over max size
+	// Evict if over the bucket's quota or max size
+	cs.enforceQuotaLocked(bucket)
 	cs.enforceSizeLimit()
 }
 
 // Delete removes the entry with the given bucket/key, returning its value.
-func (cs *CacheSystem) Delete(bucket, key string) string {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+func (cs *CacheSystem) Delete(bucket, key string) (string, error) {
+	if err := cs.lock(); err != nil {
+		return "", err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return "", err
+	}
 
 	compositeKey := [2]string{bucket, key}
 	elem, found := cs.items[compositeKey]
 	if !found {
-		return ""
+		// The store may still hold a value the cache evicted or never kept.
+		cs.storeLocked(storeOp{bucket: bucket, key: key, delete: true})
+		return "", nil
 	}
 	entry := elem.Value.(*CacheEntry)
 	val := entry.Value
+	if cs.isStale(entry) {
+		val = ""
+		cs.storeLocked(storeOp{bucket: bucket, key: key, delete: true})
+	} else {
+		cs.emit(EventDelete, bucket, key, "")
+	}
 	cs.removeElement(elem)
-	return val
+	return val, nil
 }
 
-// Clear removes all entries in a particular bucket.
-func (cs *CacheSystem) Clear(bucket string) {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+// KeyRef names an entry by bucket and key.
+type KeyRef struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
 
-	keysSet, ok := cs.buckets[bucket]
-	if !ok {
-		return
+// DeletePrefix removes every entry of bucket whose key starts with prefix and
+// returns how many it removed. It works through the bucket in batches like
+// Scan, so entries written meanwhile may or may not be removed.
+func (cs *CacheSystem) DeletePrefix(bucket, prefix string) (int, error) {
+	return cs.deletePrefix(context.Background(), bucket, prefix, nil)
+}
+
+// deletePrefix is DeletePrefix, stopping between batches once ctx is done.
+// progress, if set, is called with the running count after each batch.
+func (cs *CacheSystem) deletePrefix(ctx context.Context, bucket, prefix string, progress func(removed int)) (int, error) {
+	// The store may hold keys the cache no longer does, so it is handed the
+	// prefix up front, before the batches below delete the cached keys.
+	if err := cs.lock(); err != nil {
+		return 0, err
+	}
+	err := cs.writableLocked(bucket)
+	if err == nil {
+		cs.storeLocked(storeOp{bucket: bucket, key: prefix, delete: true, prefix: true})
+	}
+	cs.unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	removed, cursor := 0, ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		keys, next, err := cs.Scan(bucket, cursor, prefix, "", clearBatchSize)
+		if err != nil {
+			return removed, err
+		}
+		if len(keys) > 0 {
+			refs := make([]KeyRef, len(keys))
+			for i, k := range keys {
+				refs[i] = KeyRef{Bucket: bucket, Key: k}
+			}
+			deleted, err := cs.DeleteMany(refs)
+			if err != nil {
+				return removed, err
+			}
+			for _, d := range deleted {
+				if d {
+					removed++
+				}
+			}
+			if progress != nil {
+				progress(removed)
+			}
+		}
+		if next == "" {
+			return removed, nil
+		}
+		cursor = next
+	}
+}
+
+// DeleteMany removes every listed entry under a single lock acquisition and
+// reports, per key, whether a live entry was deleted.
+func (cs *CacheSystem) DeleteMany(keys []KeyRef) ([]bool, error) {
+	if err := cs.lock(); err != nil {
+		return nil, err
+	}
+	defer cs.unlock()
+	for _, k := range keys {
+		if err := cs.writableLocked(k.Bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	deleted := make([]bool, len(keys))
+	for i, k := range keys {
+		elem, ok := cs.items[[2]string{k.Bucket, k.Key}]
+		if ok && cs.liveEntryLocked(k.Bucket, k.Key) != nil {
+			cs.emit(EventDelete, k.Bucket, k.Key, "")
+			deleted[i] = true
+		} else {
+			// Not cached, but the store may still hold it.
+			cs.storeLocked(storeOp{bucket: k.Bucket, key: k.Key, delete: true})
+		}
+		if ok {
+			cs.removeElement(elem)
+		}
+	}
+	return deleted, nil
+}
+
+// GetDel returns an entry's value and removes it under one lock acquisition,
+// so of several concurrent callers exactly one sees the value. The value is
+// returned in the encoding it was stored in, as with LookupEncoded.
+func (cs *CacheSystem) GetDel(bucket, key string) (value, encoding string, found bool, err error) {
+	if err := cs.lock(); err != nil {
+		return "", "", false, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return "", "", false, err
 	}
-	for k := range keysSet {
-		if elem, found := cs.items[[2]string{bucket, k}]; found {
+
+	// A miss still deletes whatever the store holds for key.
+	elem, found := cs.items[[2]string{bucket, key}]
+	if !found {
+		cs.storeLocked(storeOp{bucket: bucket, key: key, delete: true})
+		cs.stats.record(bucket, statMiss)
+		return "", "", false, nil
+	}
+	entry := elem.Value.(*CacheEntry)
+	switch {
+	case cs.isStale(entry):
+		cs.removeElement(elem)
+	case entry.IsExpired():
+		cs.emit(EventExpire, bucket, key, "")
+		cs.removeElement(elem)
+	case entry.Session != "" && cs.liveSessionLocked(entry.Session, time.Now()) == nil:
+		// Left for the session sweep, which reports it as expired.
+	default:
+		if err := cs.verifyLocked(entry); err != nil {
+			cs.emit(EventEvict, bucket, key, "")
 			cs.removeElement(elem)
+			return "", "", false, err
 		}
+		value, encoding = entry.Value, entry.Encoding
+		cs.stats.record(bucket, statHit)
+		cs.churn.served(len(value))
+		cs.emit(EventDelete, bucket, key, "")
+		cs.removeElement(elem)
+		return value, encoding, true, nil
 	}
+	cs.storeLocked(storeOp{bucket: bucket, key: key, delete: true})
+	cs.stats.record(bucket, statMiss)
+	return "", "", false, nil
+}
+
+// Clear removes all entries in a particular bucket. The bucket is emptied
+// logically right away, so reads miss immediately; the entries themselves are
+// then removed in batches that release the lock in between, so clearing a huge
+// bucket never blocks other requests for long.
+func (cs *CacheSystem) Clear(bucket string) error {
+	keys, gen, err := cs.detachBucket(bucket)
+	if err != nil || keys == nil {
+		return err
+	}
+	cs.purgeDetached(bucket, keys, gen)
+	return nil
+}
+
+// detachBucket marks every current entry in bucket as cleared and hands back
+// its key set for purgeDetached. It returns a nil set if the bucket is empty.
+func (cs *CacheSystem) detachBucket(bucket string) (*keySet, uint64, error) {
+	if err := cs.lock(); err != nil {
+		return nil, 0, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return nil, 0, err
+	}
+
+	keysSet, ok := cs.buckets[bucket]
+	if !ok {
+		return nil, 0, nil
+	}
+	cs.gen++
+	cs.clearedAt[bucket] = cs.gen
 	delete(cs.buckets, bucket)
+	delete(cs.bucketSize, bucket)
+	cs.emit(EventClear, bucket, "", "")
+	return keysSet, cs.gen, nil
 }
 
-// ClearAll removes every entry in the cache.
-func (cs *CacheSystem) ClearAll() {
+// purgeDetached removes the stale entries left behind by detachBucket,
+// clearBatchSize keys per lock acquisition.
+func (cs *CacheSystem) purgeDetached(bucket string, keys *keySet, gen uint64) {
+	batch := make([]string, 0, clearBatchSize)
+	flush := func() {
+		cs.mu.Lock()
+		for _, k := range batch {
+			// The key may since have been rewritten (fresh entry) or removed.
+			if elem, found := cs.items[[2]string{bucket, k}]; found && cs.isStale(elem.Value.(*CacheEntry)) {
+				cs.removeElement(elem)
+			}
+		}
+		cs.unlock()
+		batch = batch[:0]
+	}
+
+	keys.each(func(k string) {
+		batch = append(batch, k)
+		if len(batch) == clearBatchSize {
+			flush()
+		}
+	})
+	flush()
+
 	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	// A newer Clear of the same bucket owns the marker if it moved on.
+	if cs.clearedAt[bucket] == gen {
+		delete(cs.clearedAt, bucket)
+	}
+	cs.unlock()
+}
+
+// ClearAll removes every entry in the cache. The index is swapped out for an
+// empty one under the lock; the old entries are recycled afterwards without it.
+func (cs *CacheSystem) ClearAll() error {
+	if err := cs.lock(); err != nil {
+		return err
+	}
+	if err := cs.anyFrozenLocked(); err != nil {
+		cs.unlock()
+		return err
+	}
+	old := cs.entries
+	cs.entries = list.New()
+	cs.bucketLRU = make(map[string]*list.List)
+	cs.items = make(map[[2]string]*list.Element)
+	cs.buckets = make(map[string]*keySet)
+	cs.clearedAt = make(map[string]uint64)
+	cs.currentSize = 0
+	cs.bucketSize = make(map[string]int64)
+	for _, s := range cs.sessions {
+		s.keys = make(map[[2]string]struct{})
+	}
+	cs.emit(EventClear, "", "", "")
+	cs.unlock()
 
-	// We need to move through the list and return each entry to the pool
-	for e := cs.entries.Front(); e != nil; {
-		next := e.Next()
+	// The detached list is unreachable from the cache, so return each entry
+	// to the pool at leisure.
+	for e := old.Front(); e != nil; e = e.Next() {
 		entry := e.Value.(*CacheEntry)
-		cs.entries.Remove(e)
-		delete(cs.items, [2]string{entry.Bucket, entry.Key})
 		entry.reset()
 		cacheEntryPool.Put(entry)
-		e = next
 	}
-
-	cs.items = make(map[[2]string]*list.Element)
-	cs.buckets = make(map[string]map[string]struct{})
-	cs.currentSize = 0
+	return nil
 }
 
 // GetBucketSize returns how many keys a given bucket has.
-func (cs *CacheSystem) GetBucketSize(bucket string) int {
-	cs.mu.RLock()
+func (cs *CacheSystem) GetBucketSize(bucket string) (int, error) {
+	if err := cs.rlock(); err != nil {
+		return 0, err
+	}
+	defer cs.mu.RUnlock()
+
+	return cs.buckets[bucket].len(), nil
+}
+
+// EntryInfo describes a live entry as returned by listing operations.
+type EntryInfo struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	TTL       int64     `json:"ttl"` // remaining lifetime in seconds, rounded up
+	WrittenBy string    `json:"written_by,omitempty"`
+	WrittenAt time.Time `json:"written_at"`
+	Encoding  string    `json:"encoding,omitempty"` // Value is stored compressed
+	// OriginalKey is the client key behind a hashed Key, see BucketConfig.HashKeys.
+	OriginalKey string `json:"original_key,omitempty"`
+}
+
+// EntryMeta describes a live entry without its value.
+type EntryMeta struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Size      int       `json:"size"`
+	TTL       int64     `json:"ttl"` // remaining lifetime in seconds, rounded up
+	Session   string    `json:"session,omitempty"`
+	WrittenBy string    `json:"written_by,omitempty"`
+	WrittenAt time.Time `json:"written_at"`
+	Encoding  string    `json:"encoding,omitempty"`
+	Version   uint64    `json:"version"`
+	Cost      float64   `json:"cost,omitempty"`
+	Stale     bool      `json:"stale,omitempty"`    // past its soft TTL
+	MaxIdle   int64     `json:"max_idle,omitempty"` // seconds the entry may go unread, see BulkItem.MaxIdle
+	// OriginalKey is the client key behind a hashed Key, see BucketConfig.HashKeys.
+	OriginalKey string `json:"original_key,omitempty"`
+}
+
+// info returns the listing view of the entry.
+func (ce *CacheEntry) info(now time.Time) EntryInfo {
+	return EntryInfo{Key: ce.Key, Value: ce.Value, TTL: ce.remainingTTL(now), WrittenBy: ce.WrittenBy, WrittenAt: ce.WrittenAt, Encoding: ce.Encoding, OriginalKey: ce.OriginalKey}
+}
+
+// Info returns an entry's metadata without affecting LRU order.
+func (cs *CacheSystem) Info(bucket, key string) (EntryMeta, bool, error) {
+	if err := cs.rlock(); err != nil {
+		return EntryMeta{}, false, err
+	}
 	defer cs.mu.RUnlock()
 
-	if keysSet, ok := cs.buckets[bucket]; ok {
-		return len(keysSet)
+	now := time.Now()
+	elem, ok := cs.items[[2]string{bucket, key}]
+	if !ok {
+		return EntryMeta{}, false, nil
+	}
+	entry := elem.Value.(*CacheEntry)
+	if cs.isStale(entry) || entry.expiredAt(now) || cs.sessionExpired(entry, now) {
+		return EntryMeta{}, false, nil
 	}
-	return 0
+	return EntryMeta{
+		Bucket:      bucket,
+		Key:         key,
+		Size:        entry.Size,
+		TTL:         entry.remainingTTL(now),
+		Session:     entry.Session,
+		WrittenBy:   entry.WrittenBy,
+		WrittenAt:   entry.WrittenAt,
+		Encoding:    entry.Encoding,
+		Version:     entry.Version,
+		Cost:        entry.Cost,
+		Stale:       entry.staleAt(now),
+		MaxIdle:     int64((entry.maxIdle + time.Second - 1) / time.Second),
+		OriginalKey: entry.OriginalKey,
+	}, true, nil
 }
 
-type putBucketKeyRequest struct {
-	Value string `json:"value"`
+// Exists reports whether bucket holds a live entry under key. Like Info it
+// leaves LRU order, sliding expiration and hit counts alone.
+func (cs *CacheSystem) Exists(bucket, key string) (bool, error) {
+	_, found, err := cs.Info(bucket, key)
+	return found, err
 }
 
-func createHandler(cache *CacheSystem, defaultKeyspace string) http.Handler {
-	mux := http.NewServeMux()
+// remainingTTL returns the entry's remaining lifetime in whole seconds,
+// rounded up, or 0 if it never expires.
+func (ce *CacheEntry) remainingTTL(now time.Time) int64 {
+	at := ce.expiresAt()
+	if at.IsZero() {
+		return 0
+	}
+	return int64((at.Sub(now) + time.Second - 1) / time.Second)
+}
 
-	// Health check: GET /
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet && r.URL.Path == "/" {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
-		} else {
-			http.NotFound(w, r)
+// Touch resets the entry's expiration to ttl from now (the default TTL when
+// ttl <= 0) without rewriting its value, and marks it recently used. It
+// reports whether the entry existed.
+func (cs *CacheSystem) Touch(bucket, key string, ttl time.Duration) (bool, error) {
+	if err := cs.lock(); err != nil {
+		return false, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return false, err
+	}
+
+	elem, ok := cs.items[[2]string{bucket, key}]
+	if !ok {
+		return false, nil
+	}
+	entry := elem.Value.(*CacheEntry)
+	now := time.Now()
+	if cs.isStale(entry) || entry.expiredAt(now) || cs.sessionExpired(entry, now) {
+		return false, nil
+	}
+	if ttl <= 0 {
+		ttl = cs.ttlFor(bucket)
+	}
+	entry.Expiration = time.Time{}
+	entry.ttl = 0
+	if ttl > 0 {
+		entry.Expiration = now.Add(ttl)
+		entry.ttl = ttl
+	}
+	if entry.maxIdle > 0 {
+		entry.IdleExpiration = now.Add(entry.maxIdle)
+	}
+	cs.moveToFrontLocked(elem)
+	return true, nil
+}
+
+// ErrNotInteger is returned by IncrBy when the stored value is not a base-10
+// 64-bit integer, or when the result would overflow one.
+var ErrNotInteger = errors.New("value is not an integer or out of range")
+
+// IncrBy atomically adds delta to the integer stored under key and returns the
+// result. A missing key starts from 0 and is created with the default TTL; an
+// existing entry keeps its expiration.
+func (cs *CacheSystem) IncrBy(bucket, key string, delta int64) (int64, error) {
+	return cs.IncrByWithOptions(bucket, key, delta, WriteOptions{})
+}
+
+// IncrByWithOptions is like IncrBy but records opts like SetManyWithOptions.
+// opts.Mode is ignored.
+func (cs *CacheSystem) IncrByWithOptions(bucket, key string, delta int64, opts WriteOptions) (int64, error) {
+	if err := cs.lock(); err != nil {
+		return 0, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return 0, err
+	}
+
+	s, err := cs.writeSessionLocked(opts)
+	if err != nil {
+		return 0, err
+	}
+	entry := cs.liveEntryLocked(bucket, key)
+	if entry == nil {
+		item := BulkItem{Key: key, Value: strconv.FormatInt(delta, 10)}
+		if err := cs.checkQuotaLocked(bucket, item, WriteOptions{}, nil); err != nil {
+			return 0, err
 		}
-	})
+		cs.writeLocked(bucket, item, WriteOptions{Session: opts.Session, Writer: opts.Writer}, s)
+		return delta, nil
+	}
+	if entry.Encoding != "" {
+		return 0, ErrNotInteger
+	}
+	n, err := strconv.ParseInt(entry.Value, 10, 64)
+	if err != nil || (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrNotInteger
+	}
+	n += delta
+	if err := cs.checkQuotaLocked(bucket, BulkItem{Key: key, Value: strconv.FormatInt(n, 10)}, WriteOptions{}, nil); err != nil {
+		return 0, err
+	}
+	cs.replaceValueLocked(cs.items[[2]string{bucket, key}], strconv.FormatInt(n, 10), opts.Writer)
+	return n, nil
+}
 
-	// Keys in the default keyspace: GET/PUT/DELETE /keys/{key}
-	mux.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
-		if len(r.URL.Path) <= len("/keys/") {
-			http.NotFound(w, r)
-			return
+// ErrEntryTooLarge is returned when an in-place update would grow a value
+// past the cache's maximum entry size.
+var ErrEntryTooLarge = errors.New("value would exceed the maximum entry size")
+
+// ErrEncodedValue is returned when an in-place update meets a value stored
+// compressed, which cannot be extended without inflating it.
+var ErrEncodedValue = errors.New("value is stored with a content encoding")
+
+// Append adds text to the end of the value under key and returns the new
+// length. A missing key is created with the default TTL; an existing entry
+// keeps its expiration.
+func (cs *CacheSystem) Append(bucket, key, text string) (int, error) {
+	return cs.Extend(bucket, key, text, false, WriteOptions{})
+}
+
+// Prepend is like Append but adds text to the start of the value.
+func (cs *CacheSystem) Prepend(bucket, key, text string) (int, error) {
+	return cs.Extend(bucket, key, text, true, WriteOptions{})
+}
+
+// Extend implements Append and Prepend, recording opts like
+// SetManyWithOptions. opts.Mode is ignored.
+func (cs *CacheSystem) Extend(bucket, key, text string, prepend bool, opts WriteOptions) (int, error) {
+	if err := cs.lock(); err != nil {
+		return 0, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return 0, err
+	}
+
+	s, err := cs.writeSessionLocked(opts)
+	if err != nil {
+		return 0, err
+	}
+	entry := cs.liveEntryLocked(bucket, key)
+	value := text
+	if entry != nil {
+		if entry.Encoding != "" {
+			return 0, ErrEncodedValue
 		}
-		key := r.URL.Path[len("/keys/"):]
-		switch r.Method {
-		case http.MethodGet:
-			w.Header().Set("Content-Type", "application/json")
-			val := cache.Get(defaultKeyspace, key)
-			_ = json.NewEncoder(w).Encode(map[string]string{"value": val})
-		case http.MethodPut:
-			var req putBucketKeyRequest
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			cache.Set(defaultKeyspace, key, req.Value)
-			w.WriteHeader(http.StatusOK)
-		case http.MethodDelete:
-			cache.Delete(defaultKeyspace, key)
-			w.WriteHeader(http.StatusOK)
-		default:
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		if prepend {
+			value = text + entry.Value
+		} else {
+			value = entry.Value + text
 		}
-	})
+	}
+	if int64(len(value)) > cs.maxEntrySize {
+		return 0, ErrEntryTooLarge
+	}
+	if err := cs.checkQuotaLocked(bucket, BulkItem{Key: key, Value: value}, WriteOptions{}, nil); err != nil {
+		return 0, err
+	}
+	if entry == nil {
+		cs.writeLocked(bucket, BulkItem{Key: key, Value: value}, WriteOptions{Session: opts.Session, Writer: opts.Writer}, s)
+	} else {
+		cs.replaceValueLocked(cs.items[[2]string{bucket, key}], value, opts.Writer)
+	}
+	return len(value), nil
+}
 
-	// Buckets:
-	//   GET /buckets/{bucket} => {"count": n}
-	//   DELETE /buckets/{bucket} => clear the bucket
-	//   GET /buckets/{bucket}/{key}
-	//   PUT /buckets/{bucket}/{key}
-	//   DELETE /buckets/{bucket}/{key}
-	//   DELETE /buckets => clear all buckets
-	mux.HandleFunc("/buckets", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/buckets" {
-			if r.Method == http.MethodDelete {
-				cache.ClearAll()
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-			return
+// replaceValueLocked rewrites a live entry's value in place, keeping its
+// expiration and session, and accounts for it like a fresh write: new version,
+// MRU position, size limit enforced. cs.mu must be held for writing.
+func (cs *CacheSystem) replaceValueLocked(elem *list.Element, value, writer string) {
+	entry := elem.Value.(*CacheEntry)
+	cs.churn.overwrote(time.Since(entry.WrittenAt))
+	cs.churn.wrote(len(value))
+	cs.currentSize += int64(len(value) - len(entry.Value))
+	cs.bucketSize[entry.Bucket] += int64(len(value) - len(entry.Value))
+	entry.Size += len(value) - len(entry.Value)
+	entry.Value = value
+	cs.sumLocked(entry)
+	entry.WrittenBy = writer
+	entry.WrittenAt = time.Now()
+	entry.hits = 0
+	cs.version++
+	entry.Version = cs.version
+	cs.moveToFrontLocked(elem)
+	cs.emit(EventSet, entry.Bucket, entry.Key, value)
+	cs.storeLocked(storeOp{bucket: entry.Bucket, key: entry.Key, value: StoredValue{Value: value, Encoding: entry.Encoding, Version: entry.Version, OriginalKey: entry.OriginalKey}})
+	cs.enforceQuotaLocked(entry.Bucket)
+	cs.enforceSizeLimit()
+}
+
+// rewriteLocked finishes a read-modify-write of a counter, list or hash:
+// entry, the live entry value was computed from, is rewritten in place, or
+// the key is created if it was nil. A positive ttl restarts the expiration;
+// otherwise a new entry gets the default TTL and an existing one keeps its
+// own. cs.mu must be held for writing.
+func (cs *CacheSystem) rewriteLocked(bucket, key string, entry *CacheEntry, value string, ttl time.Duration, opts WriteOptions, s *session) error {
+	if int64(len(value)) > cs.maxEntrySize {
+		return ErrEntryTooLarge
+	}
+	item := BulkItem{Key: key, Value: value, TTL: ttl}
+	if err := cs.checkQuotaLocked(bucket, item, WriteOptions{}, nil); err != nil {
+		return err
+	}
+	if entry == nil {
+		cs.writeLocked(bucket, item, WriteOptions{Session: opts.Session, Writer: opts.Writer}, s)
+		return nil
+	}
+	if ttl > 0 {
+		entry.Expiration = time.Now().Add(ttl)
+		entry.ttl = ttl
+	}
+	cs.replaceValueLocked(cs.items[[2]string{bucket, key}], value, opts.Writer)
+	return nil
+}
+
+// Persist removes the entry's expiration, and any max idle time, so it
+// lives until deleted or evicted. It reports whether the entry existed.
+func (cs *CacheSystem) Persist(bucket, key string) (bool, error) {
+	if err := cs.lock(); err != nil {
+		return false, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return false, err
+	}
+
+	elem, ok := cs.items[[2]string{bucket, key}]
+	if !ok {
+		return false, nil
+	}
+	entry := elem.Value.(*CacheEntry)
+	now := time.Now()
+	if cs.isStale(entry) || entry.expiredAt(now) || cs.sessionExpired(entry, now) {
+		return false, nil
+	}
+	entry.Expiration = time.Time{}
+	entry.ttl = 0
+	entry.IdleExpiration = time.Time{}
+	entry.maxIdle = 0
+	return true, nil
+}
+
+// TTL returns how long the entry has left to live: -1 if there is no such
+// entry, and 0 if it never expires. It does not affect LRU order.
+func (cs *CacheSystem) TTL(bucket, key string) (time.Duration, error) {
+	if err := cs.rlock(); err != nil {
+		return 0, err
+	}
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	elem, ok := cs.items[[2]string{bucket, key}]
+	if !ok {
+		return -1, nil
+	}
+	entry := elem.Value.(*CacheEntry)
+	if cs.isStale(entry) || entry.expiredAt(now) || cs.sessionExpired(entry, now) {
+		return -1, nil
+	}
+	at := entry.expiresAt()
+	if at.IsZero() {
+		return 0, nil
+	}
+	return at.Sub(now), nil
+}
+
+// Page returns up to limit live entries of bucket in key order, starting
+// after the key `after` (empty for the first page). more reports whether
+// further entries remain. Listing does not affect LRU order.
+func (cs *CacheSystem) Page(bucket, after string, limit int) (items []EntryInfo, more bool, err error) {
+	if err := cs.rlock(); err != nil {
+		return nil, false, err
+	}
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	keys := smallestKeysAfter(cs.buckets[bucket], after, limit+1, func(k string) bool {
+		elem, ok := cs.items[[2]string{bucket, k}]
+		if !ok {
+			return false
 		}
+		entry := elem.Value.(*CacheEntry)
+		return !entry.expiredAt(now) && !cs.sessionExpired(entry, now)
 	})
+	if len(keys) > limit {
+		keys, more = keys[:limit], true
+	}
+	items = make([]EntryInfo, len(keys))
+	for i, k := range keys {
+		items[i] = cs.items[[2]string{bucket, k}].Value.(*CacheEntry).info(now)
+	}
+	return items, more, nil
+}
 
-	mux.HandleFunc("/buckets/", func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path[len("/buckets/"):]
+// Keys returns the names of bucket's live entries in sorted order. It holds
+// the read lock while it walks the bucket, so prefer Scan for big buckets.
+func (cs *CacheSystem) Keys(bucket string) ([]string, error) {
+	return cs.Match(bucket, "*")
+}
 
-		// If path is empty => "/buckets/"
-		if path == "" {
-			http.NotFound(w, r)
+// Match returns the names of bucket's live entries that match the glob
+// pattern (see globMatch), in sorted order. Like Keys it walks the whole
+// bucket under the read lock.
+func (cs *CacheSystem) Match(bucket, pattern string) ([]string, error) {
+	if err := validGlob(pattern); err != nil {
+		return nil, err
+	}
+	if err := cs.rlock(); err != nil {
+		return nil, err
+	}
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]string, 0)
+	cs.buckets[bucket].each(func(k string) {
+		if pattern != "*" && !globMatch(pattern, k) {
 			return
 		}
-
-		// If there's no slash, it's "/buckets/{bucket}"
-		var bucket, key string
-		slashIndex := -1
-		for i := 0; i < len(path); i++ {
-			if path[i] == '/' {
-				slashIndex = i
-				break
-			}
+		entry := cs.items[[2]string{bucket, k}].Value.(*CacheEntry)
+		if !entry.expiredAt(now) && !cs.sessionExpired(entry, now) {
+			keys = append(keys, k)
 		}
+	})
+	sort.Strings(keys)
+	return keys, nil
+}
 
-		if slashIndex < 0 {
-			bucket = path
-			switch r.Method {
-			case http.MethodGet:
-				w.Header().Set("Content-Type", "application/json")
-				count := cache.GetBucketSize(bucket)
-				_ = json.NewEncoder(w).Encode(map[string]int{"count": count})
-			case http.MethodDelete:
-				cache.Clear(bucket)
-				w.WriteHeader(http.StatusOK)
-			default:
-				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-			}
+// smallestKeysAfter returns, in order, the n smallest keys of set that sort
+// after `after` and pass keep. A bounded max-heap keeps this O(len(set) log n).
+func smallestKeysAfter(set *keySet, after string, n int, keep func(string) bool) []string {
+	if n <= 0 {
+		return nil
+	}
+	h := make(keyMaxHeap, 0, n)
+	set.each(func(k string) {
+		if k <= after || (len(h) == n && k >= h[0]) || !keep(k) {
 			return
 		}
-
-		bucket = path[:slashIndex]
-		key = path[slashIndex+1:]
-
-		switch r.Method {
-		case http.MethodGet:
-			w.Header().Set("Content-Type", "application/json")
-			val := cache.Get(bucket, key)
-			_ = json.NewEncoder(w).Encode(map[string]string{"value": val})
-		case http.MethodPut:
-			var req putBucketKeyRequest
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			cache.Set(bucket, key, req.Value)
-			w.WriteHeader(http.StatusOK)
-		case http.MethodDelete:
-			cache.Delete(bucket, key)
-			w.WriteHeader(http.StatusOK)
-		default:
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		if len(h) == n {
+			heap.Pop(&h)
 		}
+		heap.Push(&h, k)
 	})
+	sort.Strings(h)
+	return h
+}
 
-	return mux
+// keyMaxHeap is a container/heap of strings with the largest at the root.
+type keyMaxHeap []string
+
+func (h keyMaxHeap) Len() int            { return len(h) }
+func (h keyMaxHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h keyMaxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyMaxHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *keyMaxHeap) Pop() interface{} {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
 }
 
-func main() {
-	// Remove environment variable defaults and simplify to just flags
-	hostFlag := flag.String("host", "0.0.0.0", "Host to bind")
-	portFlag := flag.Int64("port", 42069, "Port to bind")
-	maxEntrySizeFlag := flag.Int64("max-entry-size", DEFAULT_MAX_ENTRY_SIZE, "Max entry size (bytes)")
-	maxSizeFlag := flag.Int64("max-size", DEFAULT_MAX_SIZE, "Max total cache size (bytes)")
-	ttlFlag := flag.Int64("ttl", DEFAULT_TTL, "Default TTL in seconds")
-	cleanupFlag := flag.Int64("cleanup-interval", DEFAULT_CLEANUP_INTERVAL, "Cleanup interval in seconds")
-	defaultKeyspaceFlag := flag.String("default-keyspace", DEFAULT_KEYSPACE, "Default keyspace")
-	flag.Parse()
+// SetBucketConfig replaces the configuration of a bucket.
+func (cs *CacheSystem) SetBucketConfig(bucket string, cfg BucketConfig) {
+	cs.cfgMu.Lock()
+	defer cs.cfgMu.Unlock()
+	cs.bucketConfigs[bucket] = cfg
+}
 
-	cache := NewCacheSystem(*maxEntrySizeFlag, *maxSizeFlag, *ttlFlag, *cleanupFlag)
-	defer cache.Stop() // Cleanly stop background goroutine when the server exits
+// GetBucketConfig returns the configuration of a bucket (zero value if unset).
+func (cs *CacheSystem) GetBucketConfig(bucket string) BucketConfig {
+	cs.cfgMu.RLock()
+	defer cs.cfgMu.RUnlock()
+	return cs.bucketConfigs[bucket]
+}
 
-	// Log configuration information
-	log.Printf("Configuration:")
-	log.Printf("  Host: %s", *hostFlag)
-	log.Printf("  Port: %d", *portFlag)
-	log.Printf("  Max Entry Size: %d bytes", *maxEntrySizeFlag)
-	log.Printf("  Max Total Cache Size: %d bytes", *maxSizeFlag)
-	log.Printf("  TTL: %d seconds", *ttlFlag)
-	log.Printf("  Cleanup Interval: %d seconds", *cleanupFlag)
-	log.Printf("  Default Keyspace: %s", *defaultKeyspaceFlag)
-
-	handler := createHandler(cache, *defaultKeyspaceFlag)
-
-	addr := fmt.Sprintf("%s:%d", *hostFlag, *portFlag)
-	log.Printf("Starting server on %s ...\n", addr)
-	log.Fatal(http.ListenAndServe(addr, handler))
+// ttlFor returns the default TTL of entries written to bucket: the bucket's
+// own, or else the cache-wide one.
+func (cs *CacheSystem) ttlFor(bucket string) time.Duration {
+	if cfg := cs.GetBucketConfig(bucket); cfg.TTL > 0 {
+		return time.Duration(cfg.TTL)
+	}
+	return cs.ttl
+}
+
+// DeleteBucketConfig resets a bucket back to the cache-wide defaults.
+func (cs *CacheSystem) DeleteBucketConfig(bucket string) {
+	cs.cfgMu.Lock()
+	defer cs.cfgMu.Unlock()
+	delete(cs.bucketConfigs, bucket)
+}
+
+// Validate checks that the config names a known codec and compiles its JSON schema.
+func (cfg *BucketConfig) Validate() error {
+	if cfg.Codec != "" {
+		if _, ok := lookupCodec(cfg.Codec); !ok {
+			return fmt.Errorf("unknown codec %q", cfg.Codec)
+		}
+	}
+	if cfg.Schema != "" && cfg.Codec != "protobuf" {
+		return fmt.Errorf("schema requires the protobuf codec")
+	}
+	switch cfg.SchemaMode {
+	case "", "enforce", "warn":
+	default:
+		return fmt.Errorf("unknown schema_mode %q", cfg.SchemaMode)
+	}
+	if cfg.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+	if cfg.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes must not be negative")
+	}
+	switch cfg.OnFull {
+	case "", OnFullEvict, OnFullReject:
+	default:
+		return fmt.Errorf("unknown on_full %q", cfg.OnFull)
+	}
+	if cfg.OnFull != "" && cfg.MaxBytes == 0 {
+		return fmt.Errorf("on_full requires max_bytes")
+	}
+	cfg.jsonSchema = nil
+	if len(cfg.JSONSchema) > 0 {
+		if cfg.Codec != "" && cfg.Codec != "json" {
+			return fmt.Errorf("json_schema requires the json codec")
+		}
+		compiled, err := compileJSONSchema(cfg.JSONSchema)
+		if err != nil {
+			return err
+		}
+		cfg.jsonSchema = compiled
+	}
+	return nil
+}
+
+// checkSchema validates value against the bucket's JSON schema. It returns false
+// (after writing a 400 response) only when the value is invalid and the schema
+// is enforced; in warn mode violations are logged and reported in a header.
+func checkSchema(w http.ResponseWriter, cfg BucketConfig, bucket, key, value string) bool {
+	violations := schemaViolations(cfg, bucket, key, value)
+	if len(violations) == 0 {
+		return true
+	}
+	if cfg.SchemaMode == "warn" {
+		w.Header().Set("X-Kitsune-Schema-Warning", strings.Join(violations, "; "))
+		return true
+	}
+	writeSchemaError(w, violations)
+	return false
+}
+
+// setSchemaWarning reports the violations a bulk write stored anyway, in
+// warn mode, in the header checkSchema uses for a single value.
+func setSchemaWarning(w http.ResponseWriter, warnings []string) {
+	if len(warnings) > 0 {
+		sort.Strings(warnings)
+		w.Header().Set("X-Kitsune-Schema-Warning", strings.Join(warnings, "; "))
+	}
+}
+
+// schemaViolations returns the JSON schema violations for value. In warn mode
+// they are logged here, and the caller is expected to store the value anyway.
+func schemaViolations(cfg BucketConfig, bucket, key, value string) []string {
+	if cfg.jsonSchema == nil {
+		return nil
+	}
+	violations := cfg.jsonSchema.ValidateValue(value)
+	if len(violations) > 0 && cfg.SchemaMode == "warn" {
+		log.Printf("schema warning for %s/%s: %s", bucket, key, strings.Join(violations, "; "))
+	}
+	return violations
+}
+
+func writeSchemaError(w http.ResponseWriter, violations []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "value does not match the bucket's JSON schema",
+		"details": violations,
+	})
+}
+
+// writeError sends a JSON error envelope: {"error": msg}.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// writeMethodNotAllowed answers a request to a known path with a method the
+// path doesn't support, listing the ones it does in the Allow header.
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// writeBodyError reports a failure to read or decode a request body,
+// mapping bodies cut off by RequestLimits to 413.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+		return
+	}
+	writeError(w, http.StatusBadRequest, err.Error())
+}
+
+// writeEncodingError reports a request body that decodedBody couldn't unwrap:
+// an unknown Content-Encoding is 415, a corrupt gzip stream 400.
+func writeEncodingError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedEncoding) {
+		writeError(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	writeBodyError(w, err)
+}
+
+// writeCacheError reports a failed cache operation. Lock timeouts become 503
+// so clients back off instead of piling up behind a long-running operation,
+// and quota rejections 507 with the bucket's quota and usage.
+func writeCacheError(w http.ResponseWriter, err error) {
+	var quota *QuotaError
+	if errors.As(err, &quota) {
+		writeQuotaError(w, quota)
+		return
+	}
+	if errors.Is(err, ErrLockTimeout) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	var load *LoadError
+	if errors.As(err, &load) {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrScheduleNotFound) || errors.Is(err, ErrJobNotFound) ||
+		errors.Is(err, ErrJSONPath) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, ErrVersionMismatch) || errors.Is(err, ErrNotInteger) || errors.Is(err, ErrEncodedValue) ||
+		errors.Is(err, ErrKeyCollision) || errors.Is(err, ErrBucketFrozen) || errors.Is(err, ErrLeaseNotHeld) ||
+		errors.Is(err, ErrJobRunning) || errors.Is(err, ErrJobFinished) || errors.Is(err, ErrCounterOverflow) || errors.Is(err, ErrNotList) ||
+		errors.Is(err, ErrNotHash) || errors.Is(err, ErrNotJSON) || errors.Is(err, ErrNotZSet) || errors.Is(err, ErrNotHLL) ||
+		errors.Is(err, ErrNotBloom) || errors.Is(err, ErrNotBitmap) || errors.Is(err, ErrNotRateLimit) ||
+		errors.Is(err, ErrNotSemaphore) || errors.Is(err, ErrSemaphoreNotHeld) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, ErrBadPattern) || errors.Is(err, ErrInvalidImport) || errors.Is(err, ErrBadPointer) ||
+		errors.Is(err, ErrInvalidJSON) || errors.Is(err, ErrInvalidScore) || errors.Is(err, ErrInvalidBloom) ||
+		errors.Is(err, ErrBitOffset) || errors.Is(err, ErrInvalidBitOp) || errors.Is(err, ErrInvalidRateLimit) ||
+		errors.Is(err, ErrInvalidSemaphore) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, ErrEntryTooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+type putBucketKeyRequest struct {
+	Value     string    `json:"value"`
+	TTL       jsonTTL   `json:"ttl"`        // optional; 0 or absent uses the default TTL
+	ExpiresAt time.Time `json:"expires_at"` // optional RFC 3339 time, instead of ttl
+	Mode      string    `json:"mode"`       // optional "nx" or "xx", see WriteOptions
+	Version   uint64    `json:"version"`    // optional expected version, like If-Match
+	Cost      float64   `json:"cost"`       // optional rebuild cost, see CacheEntry.Cost
+	SoftTTL   jsonTTL   `json:"soft_ttl"`   // optional time until reads flag the value stale
+	MaxIdle   jsonTTL   `json:"max_idle"`   // optional time the entry may go unread before it expires
+}
+
+// validMode reports whether mode is one of the write modes.
+func validMode(mode string) bool {
+	switch mode {
+	case ModeAlways, ModeIfNotExists, ModeIfExists:
+		return true
+	}
+	return false
+}
+
+// writeSet stores a single item and responds to the PUT. Conditional writes
+// answer {"applied": bool} so the client learns whether the mode let it through.
+func writeSet(w http.ResponseWriter, cache *CacheSystem, bucket string, item BulkItem, opts WriteOptions) {
+	res, err := cache.SetWithOptions(bucket, item, opts)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	if res.Version != 0 {
+		w.Header().Set("ETag", etag(res.Version))
+	}
+	if opts.Mode == ModeAlways {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"applied": res.Applied})
+}
+
+// etag renders an entry version as an ETag header value.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// ifMatchVersion parses an If-Match header carrying a version previously
+// returned as an ETag. It returns 0 if the header is absent.
+func ifMatchVersion(r *http.Request) (uint64, error) {
+	h := r.Header.Get("If-Match")
+	if h == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(h, "W/"), `"`), 10, 64)
+	if err != nil || v == 0 {
+		return 0, fmt.Errorf("If-Match must be a version as returned in ETag, got %q", h)
+	}
+	return v, nil
+}
+
+// expiryError checks a requested TTL / absolute expiry pair, returning a
+// message for the client or "" if it is acceptable.
+func expiryError(ttl time.Duration, expiresAt time.Time) string {
+	switch {
+	case ttl < 0:
+		return "ttl must not be negative"
+	case ttl > 0 && !expiresAt.IsZero():
+		return "set either ttl or expires_at, not both"
+	}
+	return ""
+}
+
+func createHandler(cache *CacheSystem, defaultKeyspace string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveReadyz(w, r, cache)
+	})
+
+	// Health check: GET /. Every path nothing else handles ends up here too.
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path != "/":
+			writeError(w, http.StatusNotFound, "not found")
+		case r.Method != http.MethodGet:
+			writeMethodNotAllowed(w, http.MethodGet)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+		}
+	})
+
+	// Cache-wide size and counters: GET /stats
+	mux.Handle("/stats", statsHandler(cache, nil))
+
+	// Upcoming expirations per time slot: GET /admin/expiry-histogram
+	mux.HandleFunc("/admin/expiry-histogram", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminExpiryHistogram(w, r, cache)
+	})
+
+	// Memory by bucket and key prefix: GET /admin/usage
+	mux.HandleFunc("/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminUsage(w, r, cache)
+	})
+
+	// Runtime inspection and GC tuning: GET/PATCH /admin/runtime
+	mux.HandleFunc("/admin/runtime", serveAdminRuntime)
+
+	// Anonymized size/TTL/hit distributions: GET /admin/distributions
+	mux.HandleFunc("/admin/distributions", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminDistributions(w, r, cache)
+	})
+
+	// Background jobs: GET /admin/jobs, GET/DELETE /admin/jobs/{id}
+	mux.HandleFunc("/admin/jobs", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminJobs(w, r, cache)
+	})
+	mux.HandleFunc("/admin/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminJobs(w, r, cache)
+	})
+
+	// Multi-bucket reads, writes and deletes: POST /mget, POST /mset, POST /mdelete
+	mux.HandleFunc("/mget", func(w http.ResponseWriter, r *http.Request) {
+		serveMGet(w, r, cache, defaultKeyspace)
+	})
+	mux.HandleFunc("/mset", func(w http.ResponseWriter, r *http.Request) {
+		serveMSet(w, r, cache, defaultKeyspace)
+	})
+	mux.HandleFunc("/mdelete", func(w http.ResponseWriter, r *http.Request) {
+		serveMDelete(w, r, cache, defaultKeyspace)
+	})
+
+	// Session leases: PUT/GET/DELETE /sessions/{id}, POST /sessions/{id}/heartbeat
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		serveSession(w, r, cache)
+	})
+
+	// Scheduled clears: GET /schedules, PUT/GET/DELETE /schedules/{name},
+	// POST /schedules/{name}/run
+	mux.HandleFunc("/schedules", func(w http.ResponseWriter, r *http.Request) {
+		serveSchedules(w, r, cache)
+	})
+	mux.HandleFunc("/schedules/", func(w http.ResponseWriter, r *http.Request) {
+		serveSchedules(w, r, cache)
+	})
+
+	// Bulk loads: POST /imports, tracked as jobs
+	mux.HandleFunc("/imports", func(w http.ResponseWriter, r *http.Request) {
+		serveImports(w, r, cache, defaultKeyspace)
+	})
+
+	// Counters: GET/PUT/DELETE /counters/{bucket}/{name},
+	// POST /counters/{bucket}/{name}/incr, /decr and /reset
+	mux.HandleFunc("/counters/", func(w http.ResponseWriter, r *http.Request) {
+		serveCounter(w, r, cache)
+	})
+
+	// Lists: GET/DELETE /lists/{bucket}/{key},
+	// POST /lists/{bucket}/{key}/lpush, /rpush, /lpop and /rpop
+	mux.HandleFunc("/lists/", func(w http.ResponseWriter, r *http.Request) {
+		serveList(w, r, cache)
+	})
+
+	// Hashes: GET/PATCH/DELETE /hashes/{bucket}/{key}
+	mux.HandleFunc("/hashes/", func(w http.ResponseWriter, r *http.Request) {
+		serveHash(w, r, cache)
+	})
+
+	// Sorted sets: GET/PATCH/DELETE /zsets/{bucket}/{key},
+	// POST /zsets/{bucket}/{key}/incr
+	mux.HandleFunc("/zsets/", func(w http.ResponseWriter, r *http.Request) {
+		serveZSet(w, r, cache)
+	})
+
+	// JSON documents: GET/PUT/DELETE /json/{bucket}/{key}[?path=]
+	mux.HandleFunc("/json/", func(w http.ResponseWriter, r *http.Request) {
+		serveJSON(w, r, cache)
+	})
+
+	// HyperLogLogs: GET/DELETE /hlls/{bucket}/{key},
+	// POST /hlls/{bucket}/{key}/add and /merge
+	mux.HandleFunc("/hlls/", func(w http.ResponseWriter, r *http.Request) {
+		serveHLL(w, r, cache)
+	})
+
+	// Bloom filters: GET/PUT/DELETE /blooms/{bucket}/{key},
+	// POST /blooms/{bucket}/{key}/add
+	mux.HandleFunc("/blooms/", func(w http.ResponseWriter, r *http.Request) {
+		serveBloom(w, r, cache)
+	})
+
+	// Bitmaps: GET/DELETE /bitmaps/{bucket}/{key},
+	// POST /bitmaps/{bucket}/{key}/setbit and /op
+	mux.HandleFunc("/bitmaps/", func(w http.ResponseWriter, r *http.Request) {
+		serveBitmap(w, r, cache)
+	})
+
+	// Rate limiters: POST/DELETE /ratelimit/{bucket}/{key}
+	mux.HandleFunc("/ratelimit/", func(w http.ResponseWriter, r *http.Request) {
+		serveRateLimit(w, r, cache)
+	})
+
+	// Semaphores: GET/POST/DELETE /semaphores/{bucket}/{key}
+	mux.HandleFunc("/semaphores/", func(w http.ResponseWriter, r *http.Request) {
+		serveSemaphore(w, r, cache)
+	})
+
+	// Keys in the default keyspace: GET/PUT/DELETE /keys/{key}
+	mux.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) <= len("/keys/") {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		key := r.URL.Path[len("/keys/"):]
+		serveKey(w, r, cache, defaultKeyspace, key)
+	})
+
+	// Buckets:
+	//   GET /buckets/{bucket} => {"count": n}
+	//   PUT /buckets/{bucket} => store many keys at once
+	//   DELETE /buckets/{bucket} => clear the bucket; ?async=true in a background job
+	//   DELETE /buckets/{bucket}?prefix= => delete the keys starting with prefix
+	//   GET /buckets/{bucket}/{key}
+	//   HEAD /buckets/{bucket}/{key} => 200 or 404, without the value
+	//   PUT /buckets/{bucket}/{key}
+	//   PATCH /buckets/{bucket}/{key} => append or prepend
+	//   DELETE /buckets/{bucket}/{key}
+	//   GET /buckets/{bucket}/{key}/ttl => {"ttl": seconds}
+	//   POST /buckets/{bucket}/{key}/touch => reset expiration
+	//   POST /buckets/{bucket}/{key}/persist => remove expiration
+	//   POST /buckets/{bucket}/{key}/getdel => remove and return the value
+	//   POST /buckets/{bucket}/{key}/incr, /decr => atomic counter
+	//   GET/PUT/DELETE /buckets/{bucket}/config
+	//   GET /buckets/{bucket}/all?limit=&cursor= => paginated entries
+	//   GET /buckets/{bucket}/keys?match= => every key name, or those matching a glob
+	//   GET /buckets/{bucket}/scan?cursor=&prefix=&match=&limit= => incremental key scan
+	//   GET /buckets/{bucket}/watch => snapshot, then live changes (SSE)
+	//   GET/DELETE /buckets/{bucket}/stats => counters and windowed rates; DELETE resets
+	//   POST /buckets/{bucket}/freeze, /thaw => make read-only, writable again
+	//   DELETE /buckets => clear all buckets
+	mux.HandleFunc("/buckets", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/buckets" {
+			if r.Method == http.MethodDelete {
+				if err := cache.ClearAll(); err != nil {
+					writeCacheError(w, err)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+	})
+
+	mux.HandleFunc("/buckets/", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path[len("/buckets/"):]
+
+		// If path is empty => "/buckets/"
+		if path == "" {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		// If there's no slash, it's "/buckets/{bucket}"
+		var bucket, key string
+		slashIndex := -1
+		for i := 0; i < len(path); i++ {
+			if path[i] == '/' {
+				slashIndex = i
+				break
+			}
+		}
+
+		if slashIndex < 0 {
+			bucket = path
+			switch r.Method {
+			case http.MethodGet:
+				count, err := cache.GetBucketSize(bucket)
+				if err != nil {
+					writeCacheError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]int{"count": count})
+			case http.MethodPut:
+				serveBucketPut(w, r, cache, bucket)
+			case http.MethodDelete:
+				if r.URL.Query().Has("prefix") {
+					serveBucketDeletePrefix(w, r, cache, bucket)
+					return
+				}
+				if r.URL.Query().Get("async") == "true" {
+					job, err := cache.ClearAsync(bucket)
+					if err != nil {
+						writeCacheError(w, err)
+						return
+					}
+					writeJobAccepted(w, job)
+					return
+				}
+				if err := cache.Clear(bucket); err != nil {
+					writeCacheError(w, err)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			default:
+				writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+			}
+			return
+		}
+
+		bucket = path[:slashIndex]
+		key = path[slashIndex+1:]
+		if bucket == "" || key == "" {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		switch key {
+		case "config":
+			serveBucketConfig(w, r, cache, bucket)
+			return
+		case "all":
+			serveBucketAll(w, r, cache, bucket)
+			return
+		case "watch":
+			serveBucketWatch(w, r, cache, bucket)
+			return
+		case "stats":
+			serveBucketStats(w, r, cache, bucket)
+			return
+		case "keys":
+			serveBucketKeys(w, r, cache, bucket)
+			return
+		case "scan":
+			serveBucketScan(w, r, cache, bucket)
+			return
+		case "freeze", "thaw":
+			serveBucketFreeze(w, r, cache, bucket, key == "freeze")
+			return
+		}
+		serveKey(w, r, cache, bucket, key)
+	})
+
+	return mux
+}
+
+// writerHeader names the caller on writes. An authenticating proxy in front
+// of the cache is expected to set it; without it the client address is used.
+const writerHeader = "X-Kitsune-Writer"
+
+// staleHeader marks a read of a value past its soft TTL: it is still served,
+// but the caller should refresh it.
+const staleHeader = "X-Kitsune-Stale"
+
+// writeOptions collects the attributes a request applies to the entries it writes.
+func writeOptions(r *http.Request) WriteOptions {
+	return WriteOptions{Session: r.Header.Get(sessionHeader), Writer: writerIdentity(r)}
+}
+
+// writerIdentity returns who is making the request, for last-writer metadata.
+func writerIdentity(r *http.Request) string {
+	if id := r.Header.Get(writerHeader); id != "" {
+		return id
+	}
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// serveKeyInfo handles GET with ?info on a key, returning its metadata.
+func serveKeyInfo(w http.ResponseWriter, cache *CacheSystem, bucket, key, original string) {
+	meta, found, err := cache.Info(bucket, key)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	if !found || keyCollides(meta.OriginalKey, original) {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(meta)
+}
+
+// serveKeyHead handles HEAD on a key: 200 with the entry's ETag if it
+// exists, 404 if not, and never the value.
+func serveKeyHead(w http.ResponseWriter, cache *CacheSystem, bucket, key, original string, cfg BucketConfig) {
+	meta, found, err := cache.Info(bucket, key)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	if !found || keyCollides(meta.OriginalKey, original) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	contentType := "application/json"
+	if cfg.Codec != "" {
+		contentType = codecContentType(cfg)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag(meta.Version))
+	if meta.Stale {
+		w.Header().Set(staleHeader, "true")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveKeyTTL handles GET {key}/ttl, returning the remaining lifetime in
+// seconds (rounded up), -1 for a missing key, or 0 for one that never expires.
+func serveKeyTTL(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if storedForOther(cache, bucket, key, original) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int64{"ttl": -1, "ttl_ms": -1})
+		return
+	}
+	writeTTL(w, cache, bucket, key)
+}
+
+// writeTTL responds with {"ttl": seconds} for the key, as described on serveKeyTTL.
+func writeTTL(w http.ResponseWriter, cache *CacheSystem, bucket, key string) {
+	ttl, err := cache.TTL(bucket, key)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	secs, ms := int64(ttl), int64(ttl)
+	if ttl > 0 {
+		secs = int64((ttl + time.Second - 1) / time.Second)
+		ms = int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"ttl": secs, "ttl_ms": ms})
+}
+
+// touchRequest is the optional body of POST {key}/touch.
+type touchRequest struct {
+	TTL jsonTTL `json:"ttl"` // 0 or absent uses the default TTL
+}
+
+// serveKeyTouch handles POST {key}/touch, resetting the key's expiration.
+func serveKeyTouch(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if storedForOther(cache, bucket, key, original) {
+		writeCacheError(w, ErrKeyCollision)
+		return
+	}
+	var req touchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TTL < 0 {
+		writeError(w, http.StatusBadRequest, "ttl must not be negative")
+		return
+	}
+	found, err := cache.Touch(bucket, key, time.Duration(req.TTL))
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeTTL(w, cache, bucket, key)
+}
+
+// serveKeyPersist handles POST {key}/persist, removing the key's expiration.
+func serveKeyPersist(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if storedForOther(cache, bucket, key, original) {
+		writeCacheError(w, ErrKeyCollision)
+		return
+	}
+	found, err := cache.Persist(bucket, key)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeTTL(w, cache, bucket, key)
+}
+
+// serveKeyGetDel handles POST {key}/getdel and DELETE {key}?return=true,
+// removing the key and responding with the value it held, or 404 if there was
+// none. The value is formatted as a GET on the key would format it.
+func serveKeyGetDel(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, http.MethodPost, http.MethodDelete)
+		return
+	}
+	if storedForOther(cache, bucket, key, original) {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	val, enc, found, err := cache.GetDel(bucket, key)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	cfg := cache.GetBucketConfig(bucket)
+	if enc != "" && (cfg.Codec == "" || !acceptsEncoding(r.Header.Get("Accept-Encoding"), enc)) {
+		if val, err = gunzip(val); err != nil {
+			writeError(w, http.StatusInternalServerError, "stored value does not decompress: "+err.Error())
+			return
+		}
+		enc = ""
+	}
+	if cfg.Codec == "" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"value": val})
+		return
+	}
+	if enc != "" {
+		w.Header().Set("Content-Encoding", enc)
+	}
+	w.Header().Set("Content-Type", codecContentType(cfg))
+	_, _ = io.WriteString(w, val)
+}
+
+// patchKeyRequest is the body of PATCH on a key: exactly one of Append and
+// Prepend, the text to add to that end of the value.
+type patchKeyRequest struct {
+	Append  *string `json:"append"`
+	Prepend *string `json:"prepend"`
+}
+
+// patchKey handles PATCH on a key, extending its value in place and
+// responding with the new {"length": n}.
+func patchKey(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key string) {
+	body, err := decodedBody(r)
+	if err != nil {
+		writeEncodingError(w, err)
+		return
+	}
+	var req patchKeyRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if (req.Append == nil) == (req.Prepend == nil) {
+		writeError(w, http.StatusBadRequest, "set exactly one of append or prepend")
+		return
+	}
+	text, prepend := req.Append, false
+	if req.Prepend != nil {
+		text, prepend = req.Prepend, true
+	}
+	n, err := cache.Extend(bucket, key, *text, prepend, writeOptions(r))
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"length": n})
+}
+
+// incrRequest is the optional body of POST {key}/incr and {key}/decr.
+type incrRequest struct {
+	By *int64 `json:"by"` // absent means 1
+}
+
+// serveKeyIncr handles POST {key}/incr, atomically adding to an integer value.
+func serveKeyIncr(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string) {
+	serveKeyAdd(w, r, cache, bucket, key, original, 1)
+}
+
+// serveKeyDecr handles POST {key}/decr, atomically subtracting from an integer value.
+func serveKeyDecr(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string) {
+	serveKeyAdd(w, r, cache, bucket, key, original, -1)
+}
+
+// serveKeyAdd applies sign * by to the key and responds with {"value": n}.
+func serveKeyAdd(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string, sign int64) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if storedForOther(cache, bucket, key, original) {
+		writeCacheError(w, ErrKeyCollision)
+		return
+	}
+	var req incrRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	delta := int64(1)
+	if req.By != nil {
+		if *req.By == math.MinInt64 {
+			writeError(w, http.StatusBadRequest, "by is out of range")
+			return
+		}
+		delta = *req.By
+	}
+	n, err := cache.IncrByWithOptions(bucket, key, sign*delta, writeOptions(r))
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"value": n})
+}
+
+// keyActions are the operations addressed by a suffix on a key's path,
+// e.g. /buckets/{bucket}/{key}/ttl. They are passed the key as stored and
+// the original key, as returned by storedKey.
+var keyActions = map[string]func(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string){
+	"ttl":     serveKeyTTL,
+	"touch":   serveKeyTouch,
+	"persist": serveKeyPersist,
+	"getdel":  serveKeyGetDel,
+	"incr":    serveKeyIncr,
+	"decr":    serveKeyDecr,
+	"lease":   serveKeyLease,
+}
+
+// lookupForGet reads key for a GET, with PeekValue if ?peek=true asks for
+// the read to leave the entry's LRU position alone.
+func lookupForGet(r *http.Request, cache *CacheSystem, bucket, key string) (StoredValue, bool, error) {
+	if r.URL.Query().Get("peek") == "true" {
+		return cache.PeekValue(bucket, key)
+	}
+	return cache.LookupValue(bucket, key)
+}
+
+// serveKey handles GET/PUT/PATCH/DELETE for a single key in a bucket.
+// In buckets with HashKeys, the key is hashed before anything else.
+// Buckets with a codec exchange raw values; all others use the JSON envelope.
+// GET with ?info returns the entry's metadata instead of its value, GET with
+// ?peek=true reads it without promoting it in the LRU order, DELETE with
+// ?return=true responds with the value it removed, and a trailing action name
+// (see keyActions) addresses that action instead.
+func serveKey(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key string) {
+	var action func(http.ResponseWriter, *http.Request, *CacheSystem, string, string, string)
+	if i := strings.LastIndexByte(key, '/'); i > 0 {
+		if a, ok := keyActions[key[i+1:]]; ok {
+			action, key = a, key[:i]
+		}
+	}
+	cfg := cache.GetBucketConfig(bucket)
+	key, original := storedKey(cfg, key)
+	if action != nil {
+		action(w, r, cache, bucket, key, original)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Query().Has("info") {
+		serveKeyInfo(w, cache, bucket, key, original)
+		return
+	}
+	if r.Method == http.MethodDelete && r.URL.Query().Get("return") == "true" {
+		serveKeyGetDel(w, r, cache, bucket, key, original)
+		return
+	}
+	if r.Method == http.MethodHead {
+		serveKeyHead(w, cache, bucket, key, original, cfg)
+		return
+	}
+	if cfg.Codec != "" {
+		serveCodecKey(w, r, cache, bucket, key, original, cfg)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		v, found, err := lookupForGet(r, cache, bucket, key)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if found && keyCollides(v.OriginalKey, original) {
+			v, found = StoredValue{}, false
+		}
+		if !found && cache.strictStatus.Load() {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		val := v.Value
+		if v.Encoding == encodingGzip {
+			// Stored compressed while the bucket had a codec.
+			if val, err = gunzip(val); err != nil {
+				writeError(w, http.StatusInternalServerError, "stored value does not decompress: "+err.Error())
+				return
+			}
+		}
+		if found {
+			w.Header().Set("ETag", etag(v.Version))
+		}
+		if found && v.Stale {
+			w.Header().Set(staleHeader, "true")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"value": val})
+	case http.MethodPut:
+		body, err := decodedBody(r)
+		if err != nil {
+			writeEncodingError(w, err)
+			return
+		}
+		var req putBucketKeyRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if !checkSchema(w, cfg, bucket, key, req.Value) {
+			return
+		}
+		if msg := expiryError(time.Duration(req.TTL), req.ExpiresAt); msg != "" {
+			writeError(w, http.StatusBadRequest, msg)
+			return
+		}
+		if req.Cost < 0 {
+			writeError(w, http.StatusBadRequest, "cost must not be negative")
+			return
+		}
+		if req.SoftTTL < 0 {
+			writeError(w, http.StatusBadRequest, "soft_ttl must not be negative")
+			return
+		}
+		if req.MaxIdle < 0 {
+			writeError(w, http.StatusBadRequest, "max_idle must not be negative")
+			return
+		}
+		if !validMode(req.Mode) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown mode %q, expected nx or xx", req.Mode))
+			return
+		}
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if version != 0 && req.Version != 0 && version != req.Version {
+			writeError(w, http.StatusBadRequest, "If-Match and version disagree")
+			return
+		}
+		if version == 0 {
+			version = req.Version
+		}
+		opts := writeOptions(r)
+		opts.Mode = req.Mode
+		writeSet(w, cache, bucket, BulkItem{Key: key, Value: req.Value, TTL: time.Duration(req.TTL), ExpiresAt: req.ExpiresAt, Version: version, OriginalKey: original, Cost: req.Cost, SoftTTL: time.Duration(req.SoftTTL), MaxIdle: time.Duration(req.MaxIdle)}, opts)
+	case http.MethodPatch:
+		if cfg.jsonSchema != nil {
+			writeError(w, http.StatusConflict, fmt.Sprintf("bucket %q validates values against a schema, PUT the whole value instead", bucket))
+			return
+		}
+		patchKey(w, r, cache, bucket, key)
+	case http.MethodDelete:
+		if _, err := cache.Delete(bucket, key); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// codecContentType is the Content-Type values of a codec bucket are served with.
+func codecContentType(cfg BucketConfig) string {
+	c, _ := lookupCodec(cfg.Codec)
+	if cfg.Schema != "" {
+		return c.ContentType() + "; messageType=" + cfg.Schema
+	}
+	return c.ContentType()
+}
+
+// serveCodecKey handles a key in a bucket that declares a codec. The request
+// and response bodies carry the raw value typed with the codec's Content-Type.
+func serveCodecKey(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string, cfg BucketConfig) {
+	c, _ := lookupCodec(cfg.Codec)
+	contentType := codecContentType(cfg)
+
+	switch r.Method {
+	case http.MethodGet:
+		v, found, err := lookupForGet(r, cache, bucket, key)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if !found || keyCollides(v.OriginalKey, original) {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		val, enc := v.Value, v.Encoding
+		w.Header().Set("ETag", etag(v.Version))
+		if v.Stale {
+			w.Header().Set(staleHeader, "true")
+		}
+		if enc != "" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if acceptsEncoding(r.Header.Get("Accept-Encoding"), enc) {
+				w.Header().Set("Content-Encoding", enc)
+			} else if val, err = gunzip(val); err != nil {
+				writeError(w, http.StatusInternalServerError, "stored value does not decompress: "+err.Error())
+				return
+			}
+		}
+		w.Header().Set("Content-Type", contentType)
+		_, _ = io.WriteString(w, val)
+	case http.MethodPut:
+		if got := mediaType(r.Header.Get("Content-Type")); got != mediaType(c.ContentType()) {
+			writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("bucket %q expects %s, got %q", bucket, c.ContentType(), got))
+			return
+		}
+		enc, err := requestEncoding(r)
+		if err != nil {
+			writeError(w, http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+		var ttl time.Duration
+		var expiresAt time.Time
+		if s := r.URL.Query().Get("ttl"); s != "" {
+			if ttl, err = parseTTL(s); err != nil || ttl < 0 {
+				writeError(w, http.StatusBadRequest, "ttl must be a non-negative number of seconds or a duration like 250ms")
+				return
+			}
+		}
+		if s := r.URL.Query().Get("expires_at"); s != "" {
+			if expiresAt, err = time.Parse(time.RFC3339Nano, s); err != nil {
+				writeError(w, http.StatusBadRequest, "expires_at must be an RFC 3339 time")
+				return
+			}
+		}
+		if msg := expiryError(ttl, expiresAt); msg != "" {
+			writeError(w, http.StatusBadRequest, msg)
+			return
+		}
+		var cost float64
+		if s := r.URL.Query().Get("cost"); s != "" {
+			if cost, err = strconv.ParseFloat(s, 64); err != nil || cost < 0 || math.IsInf(cost, 0) || math.IsNaN(cost) {
+				writeError(w, http.StatusBadRequest, "cost must be a non-negative number")
+				return
+			}
+		}
+		var softTTL time.Duration
+		if s := r.URL.Query().Get("soft_ttl"); s != "" {
+			if softTTL, err = parseTTL(s); err != nil || softTTL < 0 {
+				writeError(w, http.StatusBadRequest, "soft_ttl must be a non-negative number of seconds or a duration like 250ms")
+				return
+			}
+		}
+		var maxIdle time.Duration
+		if s := r.URL.Query().Get("max_idle"); s != "" {
+			if maxIdle, err = parseTTL(s); err != nil || maxIdle < 0 {
+				writeError(w, http.StatusBadRequest, "max_idle must be a non-negative number of seconds or a duration like 250ms")
+				return
+			}
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		// A compressed value is stored as sent. It is only inflated here when
+		// it has to be checked against the codec or a schema.
+		plain := string(body)
+		if enc != "" && (validates(c) || cfg.jsonSchema != nil) {
+			if plain, err = gunzip(plain); err != nil {
+				writeError(w, http.StatusBadRequest, badGzip(err).Error())
+				return
+			}
+		}
+		if err := c.Validate(plain); err != nil {
+			writeError(w, http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+		if !checkSchema(w, cfg, bucket, key, plain) {
+			return
+		}
+		opts := writeOptions(r)
+		if opts.Mode = r.URL.Query().Get("mode"); !validMode(opts.Mode) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown mode %q, expected nx or xx", opts.Mode))
+			return
+		}
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeSet(w, cache, bucket, BulkItem{Key: key, Value: string(body), TTL: ttl, ExpiresAt: expiresAt, Encoding: enc, Version: version, OriginalKey: original, Cost: cost, SoftTTL: softTTL, MaxIdle: maxIdle}, opts)
+	case http.MethodDelete:
+		if _, err := cache.Delete(bucket, key); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// bulkValue is one value in a PUT /buckets/{bucket} body: either a bare
+// string or an object carrying a value and an optional TTL in seconds.
+type bulkValue struct {
+	Value     string    `json:"value"`
+	TTL       jsonTTL   `json:"ttl"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Version   uint64    `json:"version"`
+	Cost      float64   `json:"cost"`
+	SoftTTL   jsonTTL   `json:"soft_ttl"`
+	MaxIdle   jsonTTL   `json:"max_idle"`
+}
+
+func (bv *bulkValue) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &bv.Value)
+	}
+	type plain bulkValue
+	return json.Unmarshal(data, (*plain)(bv))
+}
+
+// serveBucketPut handles PUT /buckets/{bucket}, storing every key in the
+// body object in one cache operation.
+func serveBucketPut(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket string) {
+	reader, err := decodedBody(r)
+	if err != nil {
+		writeEncodingError(w, err)
+		return
+	}
+	var body map[string]bulkValue
+	if err := json.NewDecoder(cache.throttledBody(r.Context(), reader)).Decode(&body); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			err = errors.New(`body must be a JSON object of key to value or {"value": ..., "ttl": seconds or duration}`)
+		}
+		writeBodyError(w, err)
+		return
+	}
+
+	cfg := cache.GetBucketConfig(bucket)
+	items := make([]BulkItem, 0, len(body))
+	var violations, warnings []string
+	for key, bv := range body {
+		status, msg, v, warn := checkBulkValue(cfg, bucket, key, bv)
+		if status != 0 {
+			writeError(w, status, msg)
+			return
+		}
+		violations = append(violations, v...)
+		warnings = append(warnings, warn...)
+		stored, original := storedKey(cfg, key)
+		items = append(items, BulkItem{Key: stored, Value: bv.Value, TTL: time.Duration(bv.TTL), ExpiresAt: bv.ExpiresAt, Version: bv.Version, OriginalKey: original, Cost: bv.Cost, SoftTTL: time.Duration(bv.SoftTTL), MaxIdle: time.Duration(bv.MaxIdle)})
+	}
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		writeSchemaError(w, violations)
+		return
+	}
+
+	if err := cache.throttleBulk(r.Context(), len(items)); err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	if err := cache.SetManyWithOptions(bucket, items, writeOptions(r)); err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	setSchemaWarning(w, warnings)
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveBucketDeletePrefix handles DELETE /buckets/{bucket}?prefix=, removing
+// every key that starts with prefix and responding with {"deleted": n}, or
+// with a background job given ?async=true.
+func serveBucketDeletePrefix(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket string) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		writeError(w, http.StatusBadRequest, "prefix must not be empty")
+		return
+	}
+	if cache.GetBucketConfig(bucket).HashKeys {
+		writeError(w, http.StatusBadRequest, "hash_keys buckets do not store keys by name, so they can't be deleted by prefix")
+		return
+	}
+	if r.URL.Query().Get("async") == "true" {
+		job, err := cache.DeletePrefixAsync(bucket, prefix)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		writeJobAccepted(w, job)
+		return
+	}
+	n, err := cache.DeletePrefix(bucket, prefix)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"deleted": n})
+}
+
+// checkBulkValue validates one value of a bulk write against its bucket's
+// config. A non-zero status rejects the whole write with msg; schema
+// violations are returned for the caller to report together, as violations
+// that refuse the write or, in warn mode, as warnings, which are logged.
+func checkBulkValue(cfg BucketConfig, bucket, key string, bv bulkValue) (status int, msg string, violations, warnings []string) {
+	if key == "" {
+		return http.StatusBadRequest, "keys must not be empty", nil, nil
+	}
+	if msg := expiryError(time.Duration(bv.TTL), bv.ExpiresAt); msg != "" {
+		return http.StatusBadRequest, fmt.Sprintf("key %q: %s", key, msg), nil, nil
+	}
+	if bv.Cost < 0 {
+		return http.StatusBadRequest, fmt.Sprintf("key %q: cost must not be negative", key), nil, nil
+	}
+	if bv.SoftTTL < 0 {
+		return http.StatusBadRequest, fmt.Sprintf("key %q: soft_ttl must not be negative", key), nil, nil
+	}
+	if bv.MaxIdle < 0 {
+		return http.StatusBadRequest, fmt.Sprintf("key %q: max_idle must not be negative", key), nil, nil
+	}
+	if c, ok := lookupCodec(cfg.Codec); ok {
+		if err := c.Validate(bv.Value); err != nil {
+			return http.StatusUnsupportedMediaType, fmt.Sprintf("key %q: %v", key, err), nil, nil
+		}
+	}
+	for _, msg := range schemaViolations(cfg, bucket, key, bv.Value) {
+		if cfg.SchemaMode == "warn" {
+			warnings = append(warnings, key+": "+msg)
+		} else {
+			violations = append(violations, key+": "+msg)
+		}
+	}
+	return 0, "", violations, warnings
+}
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// serveBucketAll handles GET /buckets/{bucket}/all?limit=&cursor=.
+// The cursor is opaque to clients: it encodes the last key of the previous page.
+func serveBucketAll(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	limit, after, ok := parsePageParams(w, r)
+	if !ok {
+		return
+	}
+
+	items, more, err := cache.Page(bucket, after, limit)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	resp := struct {
+		Items      []EntryInfo `json:"items"`
+		NextCursor string      `json:"next_cursor,omitempty"`
+	}{Items: items}
+	if more {
+		resp.NextCursor = encodeCursor(items[len(items)-1].Key)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// serveBucketKeys handles GET /buckets/{bucket}/keys?match=, listing every
+// key name, or those matching a glob pattern.
+func serveBucketKeys(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	pattern := r.URL.Query().Get("match")
+	if pattern == "" {
+		pattern = "*"
+	}
+	keys, err := cache.Match(bucket, pattern)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]string{"keys": keys})
+}
+
+// parsePageParams reads ?limit= and ?cursor=, writing a 400 and returning
+// ok=false if either is malformed.
+func parsePageParams(w http.ResponseWriter, r *http.Request) (limit int, after string, ok bool) {
+	q := r.URL.Query()
+	limit = defaultPageLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageLimit {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+			return 0, "", false
+		}
+		limit = n
+	}
+	if c := q.Get("cursor"); c != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return 0, "", false
+		}
+		after = string(decoded)
+	}
+	return limit, after, true
+}
+
+func encodeCursor(lastKey string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+}
+
+// serveBucketConfig handles GET/PUT/DELETE /buckets/{bucket}/config.
+func serveBucketConfig(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(cache.GetBucketConfig(bucket))
+	case http.MethodPut:
+		var cfg BucketConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		cache.SetBucketConfig(bucket, cfg)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		cache.DeleteBucketConfig(bucket)
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:], os.Stdout))
+		case "soak":
+			os.Exit(runSoak(os.Args[2:], os.Stdout))
+		case "verify-backup":
+			os.Exit(runVerifyBackup(os.Args[2:], os.Stdout))
+		}
+	}
+
+	var cfg serverConfig
+	cfg.registerFlags(flag.CommandLine)
+	flag.Parse()
+	preset, err := cfg.applyPreset(flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	limits, err := cfg.requestLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.validateTimeouts(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.validateSLO(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.validateChecksums(); err != nil {
+		log.Fatal(err)
+	}
+	proxies, err := cfg.trustedProxies()
+	if err != nil {
+		log.Fatal(err)
+	}
+	disabled, err := cfg.disabledEndpoints()
+	if err != nil {
+		log.Fatal(err)
+	}
+	concurrency, err := cfg.concurrencyLimit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	conns, err := cfg.connectionTracker()
+	if err != nil {
+		log.Fatal(err)
+	}
+	shedding, err := cfg.loadShedding(concurrency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loader, err := cfg.loader()
+	if err != nil {
+		log.Fatal(err)
+	}
+	maintenance, err := cfg.maintenanceWindow()
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, storeOpts, err := cfg.store()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.DistributionExport != "" && cfg.DistributionInterval <= 0 {
+		log.Fatalf("-distribution-interval %s must be positive", cfg.DistributionInterval)
+	}
+
+	cache := NewCache(CacheConfig{
+		MaxEntrySize:    cfg.MaxEntrySize,
+		MaxSize:         cfg.MaxSize,
+		TTL:             cfg.TTL,
+		CleanupInterval: cfg.CleanupInterval,
+
+		AdaptiveCleanup:    cfg.CleanupAdaptive,
+		MinCleanupInterval: cfg.CleanupMinInterval,
+	})
+	defer cache.Stop() // Cleanly stop background goroutine when the server exits
+	cache.SetLockTimeout(cfg.LockTimeout)
+	cache.SetSlidingExpiration(cfg.SlidingExpiration)
+	cache.SetTinyLFU(cfg.TinyLFU)
+	cache.SetStrictStatus(cfg.StrictStatus)
+	if err := cache.SetChecksums(cfg.Checksums); err != nil {
+		log.Fatal(err)
+	}
+	cache.SetImportLimits(cfg.ImportBytesPerSec, cfg.ImportOpsPerSec)
+	if loader != nil {
+		cache.SetLoader(loader)
+	}
+	cache.SetMaintenanceWindow(maintenance)
+	if store != nil {
+		if err := cache.SetStore(store, storeOpts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.HandoverSocket != "" {
+		tookOver := func(n int, err error) {
+			if err != nil {
+				log.Printf("Cache handover from %s failed: %v (starting with %d entries)", cfg.HandoverSocket, err, n)
+			} else if n > 0 {
+				log.Printf("Took over %d entries from the previous process", n)
+			}
+		}
+		if cfg.HandoverPartial {
+			// Serve as soon as the port is free, while entries keep arriving.
+			serving := make(chan struct{})
+			go func() { tookOver(receiveHandover(cfg.HandoverSocket, cache, func() { close(serving) })) }()
+			<-serving
+		} else {
+			tookOver(receiveHandover(cfg.HandoverSocket, cache, nil))
+		}
+	}
+
+	// Log configuration information
+	log.Printf("Configuration:")
+	log.Printf("  Preset: %s", describePreset(cfg.Preset, preset))
+	log.Printf("  Host: %s", cfg.Host)
+	log.Printf("  Port: %d", cfg.Port)
+	if tlsConfig != nil {
+		cert := tlsConfig.Certificates[0]
+		log.Printf("  TLS: self-signed for %s (SHA-256 %s)", strings.Join(cfg.certHosts(), ", "), certFingerprint(cert))
+	}
+	log.Printf("  Max Entry Size: %d bytes", cfg.MaxEntrySize)
+	log.Printf("  Max Total Cache Size: %d bytes", cfg.MaxSize)
+	log.Printf("  TTL: %s", cfg.TTL)
+	if cfg.CleanupAdaptive {
+		log.Printf("  Cleanup Interval: adaptive, %s to %s", cfg.CleanupMinInterval, cfg.CleanupInterval)
+	} else {
+		log.Printf("  Cleanup Interval: %s", cfg.CleanupInterval)
+	}
+	log.Printf("  Default Keyspace: %s", cfg.DefaultKeyspace)
+	log.Printf("  Max Body Size: %d bytes (per endpoint: %v)", cfg.MaxBodySize, limits.EndpointBodySize)
+	log.Printf("  Max Header Size: %d bytes", cfg.MaxHeaderSize)
+	log.Printf("  Max URL Length: %d bytes", cfg.MaxURLLength)
+	log.Printf("  Lock Timeout: %s", cfg.LockTimeout)
+	log.Printf("  Server Timeouts: read header %s, read %s, idle %s, shutdown %s", cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.IdleTimeout, cfg.ShutdownTimeout)
+	log.Printf("  Strict Status: %t", cfg.StrictStatus)
+	log.Printf("  Sliding Expiration: %t", cfg.SlidingExpiration)
+	log.Printf("  TinyLFU Admission: %t", cfg.TinyLFU)
+	log.Printf("  Checksums: %s", cfg.Checksums)
+	log.Printf("  Trusted Proxies: %q (honoring %s)", cfg.TrustedProxies, cfg.ForwardedHeaders)
+	log.Printf("  Disabled Endpoints: %q", cfg.DisableEndpoints)
+	log.Printf("  Max Concurrent Requests: %d (%d reserved for admin)", cfg.MaxConcurrentRequests, cfg.AdminReservedRequests)
+	log.Printf("  Max Connections Per Client: %d", cfg.MaxConnsPerClient)
+	log.Printf("  Load Shedding: %s", shedding)
+	if maintenance != nil {
+		log.Printf("  Maintenance Window: %s", maintenance)
+	}
+	if loader != nil {
+		log.Printf("  Read-Through Loader: %s (timeout %s)", cfg.LoaderURL, cfg.LoaderTimeout)
+	}
+	if store != nil {
+		log.Printf("  Backing Store: %s (%s, queue %d)", cfg.StoreDir, cfg.StoreMode, cfg.StoreQueue)
+	}
+	log.Printf("  SLOs: availability %g, latency %s at %g, burn alert %g, webhook %q",
+		cfg.SLO.AvailabilityTarget, cfg.SLO.Latency, cfg.SLO.LatencyTarget, cfg.SLO.BurnAlert, cfg.SLO.Webhook)
+
+	if cfg.DistributionExport != "" {
+		stopExport := make(chan struct{})
+		defer close(stopExport)
+		go exportDistributions(cache, cfg.DistributionExport, cfg.DistributionInterval, stopExport)
+		log.Printf("  Distribution Export: %s every %s", cfg.DistributionExport, cfg.DistributionInterval)
+	}
+
+	slo := newSLOTracker(cfg.SLO)
+	slo.Start()
+	defer slo.Stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(cache, limits, concurrency, shedding, slo, conns))
+	mux.Handle("/stats", limits.Middleware(statsHandler(cache, conns)))
+	mux.Handle("/", limits.Middleware(createHandler(cache, cfg.DefaultKeyspace)))
+	handler := proxies.Middleware(slo.Middleware(shedding.Middleware(concurrency.Middleware(disabled.Middleware(mux)))))
+
+	addrs, err := cfg.listenAddrs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	listeners, err := listenAll(addrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, ln := range listeners {
+		listeners[i] = conns.Listener(ln)
+	}
+	server := &http.Server{
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	if limits.MaxHeaderSize > 0 {
+		// Leave headroom so the middleware, not net/http, answers with the JSON envelope.
+		server.MaxHeaderBytes = limits.MaxHeaderSize*2 + 4096
+	}
+	log.Printf("Starting server on %s ...\n", strings.Join(addrs, ", "))
+	errc := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if tlsConfig != nil {
+				errc <- server.ServeTLS(ln, "", "")
+				return
+			}
+			errc <- server.Serve(ln)
+		}(ln)
+	}
+
+	handedOver := make(chan int)
+	if cfg.HandoverSocket != "" {
+		hln, err := net.Listen("unix", cfg.HandoverSocket)
+		if err != nil {
+			log.Fatalf("-handover-socket: %v", err)
+		}
+		go func() {
+			stopped := false
+			n, err := serveHandover(hln, cache, func() {
+				stopped = true
+				shutdownForHandover(server)
+				// Queued writes must reach the store before the new process writes.
+				cache.FlushStore()
+			})
+			if !stopped {
+				log.Printf("-handover-socket stopped listening: %v", err)
+				return
+			}
+			if err != nil {
+				log.Printf("Cache handover failed after %d entries: %v", n, err)
+			}
+			handedOver <- n
+		}()
+	}
+	// Return on SIGINT and SIGTERM rather than dying, so that deferred
+	// cleanup, such as flushing write-behind store writes, runs.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s; shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			_ = server.Shutdown(ctx)
+			cancel()
+			return
+		case err := <-errc:
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		case n := <-handedOver:
+			log.Printf("Handed %d entries over to the new process; exiting", n)
+			return
+		}
+	}
 }
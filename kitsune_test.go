@@ -3,11 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -43,7 +46,7 @@ func TestCacheSystem_BasicOperations(t *testing.T) {
 	}
 
 	// Delete the key, ensure it's gone
-	deletedVal := cache.Delete("default", "foo")
+	deletedVal, _ := cache.Delete("default", "foo")
 	if deletedVal != "baz" {
 		t.Fatalf("expected 'baz' from Delete, got %q", deletedVal)
 	}
@@ -72,6 +75,49 @@ func TestCacheSystem_TTLExpiration(t *testing.T) {
 	}
 }
 
+func TestCacheSystem_AdaptiveCleanup(t *testing.T) {
+	cache := NewCache(CacheConfig{
+		TTL:                time.Millisecond,
+		CleanupInterval:    time.Second,
+		AdaptiveCleanup:    true,
+		MinCleanupInterval: 100 * time.Millisecond,
+	})
+	defer cache.Stop()
+
+	steps := []struct {
+		backlog, prev int
+		from, want    time.Duration
+	}{
+		{10, 0, time.Second, 500 * time.Millisecond},             // growing: halve
+		{20, 10, 150 * time.Millisecond, 100 * time.Millisecond}, // but not below the floor
+		{5, 20, 250 * time.Millisecond, 250 * time.Millisecond},  // shrinking: hold
+		{0, 5, 250 * time.Millisecond, 500 * time.Millisecond},   // idle: double
+		{0, 0, 800 * time.Millisecond, time.Second},              // up to -cleanup-interval
+	}
+	for _, s := range steps {
+		if got := cache.adaptCleanupInterval(s.from, s.backlog, s.prev); got != s.want {
+			t.Fatalf("adaptCleanupInterval(%s, %d, %d) = %s, want %s", s.from, s.backlog, s.prev, got, s.want)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		cache.Set("b", strconv.Itoa(i), "v")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if got := cache.ExpiredBacklog(); got != 50 {
+		t.Fatalf("expected the first sweep to find 50 expired entries, got %d", got)
+	}
+	if got := cache.CleanupInterval(); got != 500*time.Millisecond {
+		t.Fatalf("expected the interval to halve after a growing backlog, got %s", got)
+	}
+
+	fixed := NewCacheSystem(1024, 10_000, 60, 2)
+	defer fixed.Stop()
+	if got := fixed.adaptCleanupInterval(2*time.Second, 100, 0); got != 2*time.Second {
+		t.Fatalf("expected a fixed interval not to adapt, got %s", got)
+	}
+}
+
 func TestCacheSystem_MaxEntrySize(t *testing.T) {
 	// Each entry can only be up to 10 bytes
 	cache := NewCacheSystem(10, 1000, 60, 999999)
@@ -142,6 +188,43 @@ func TestCacheSystem_MaxTotalSize(t *testing.T) {
 	}
 }
 
+func TestCacheSystem_CostWeightedEviction(t *testing.T) {
+	// Room for four 14-byte entries
+	cache := NewCacheSystem(10, 56, 60, 999999)
+	defer cache.Stop()
+	set := func(key string, cost float64) {
+		if _, err := cache.SetWithOptions("b", BulkItem{Key: key, Value: "0123456789", Cost: cost}, WriteOptions{}); err != nil {
+			t.Fatalf("SetWithOptions(%s) => %v", key, err)
+		}
+	}
+	set("k1", 100)
+	set("k2", 5)
+	set("k3", 100)
+	set("k4", 100)
+
+	// k1 is least recently used, but k2 is cheaper to rebuild
+	set("k5", 100)
+	if _, found, _ := cache.Peek("b", "k2"); found {
+		t.Fatalf("expected the cheap k2 to be evicted")
+	}
+	if _, found, _ := cache.Peek("b", "k1"); !found {
+		t.Fatalf("expected the expensive k1 to survive")
+	}
+	if meta, _, _ := cache.Info("b", "k1"); meta.Cost != 100 {
+		t.Fatalf("expected Info to report the cost, got %v", meta.Cost)
+	}
+
+	// Equal costs fall back to LRU, and an uncosted write never displaces
+	// itself just because it is the cheapest
+	set("k6", 0)
+	if _, found, _ := cache.Peek("b", "k1"); found {
+		t.Fatalf("expected k1 to go first among equal costs")
+	}
+	if _, found, _ := cache.Peek("b", "k6"); !found {
+		t.Fatalf("expected the new entry to be kept")
+	}
+}
+
 func TestCacheSystem_ClearBucket(t *testing.T) {
 	cache := NewCacheSystem(1024, 999999, 60, 999999)
 	defer cache.Stop()
@@ -180,6 +263,613 @@ func TestCacheSystem_ClearAll(t *testing.T) {
 	}
 }
 
+func TestCacheSystem_ClearIsIncremental(t *testing.T) {
+	cache := NewCacheSystem(1024, 999999999, 60, 999999)
+	defer cache.Stop()
+
+	const n = 3*clearBatchSize + 7
+	for i := 0; i < n; i++ {
+		cache.Set("big", "k"+strconv.Itoa(i), "v")
+	}
+	cache.Set("other", "k", "v")
+
+	// Detach without purging: the bucket must already look empty
+	keys, gen, err := cache.detachBucket("big")
+	if err != nil || keys.len() != n {
+		t.Fatalf("detachBucket => %d keys, err %v", keys.len(), err)
+	}
+	if got := cache.Get("big", "k1"); got != "" {
+		t.Fatalf("expected cleared key to miss before purge, got %q", got)
+	}
+	if size, _ := cache.GetBucketSize("big"); size != 0 {
+		t.Fatalf("expected bucket size 0 after detach, got %d", size)
+	}
+
+	// Writes that land between detach and purge must survive the purge
+	cache.Set("big", "k2", "fresh")
+
+	cache.purgeDetached("big", keys, gen)
+
+	if got := cache.Get("big", "k2"); got != "fresh" {
+		t.Fatalf("expected rewritten key to survive purge, got %q", got)
+	}
+	if got := cache.Get("other", "k"); got != "v" {
+		t.Fatalf("expected other bucket untouched, got %q", got)
+	}
+	if cache.entries.Len() != 2 || len(cache.items) != 2 {
+		t.Fatalf("expected 2 live entries after purge, got list=%d items=%d", cache.entries.Len(), len(cache.items))
+	}
+	wantSize := int64(len("big") + len("k2") + len("fresh") + len("other") + len("k") + len("v"))
+	if cache.currentSize != wantSize {
+		t.Fatalf("expected currentSize %d after purge, got %d", wantSize, cache.currentSize)
+	}
+	if _, ok := cache.clearedAt["big"]; ok {
+		t.Fatalf("expected clear marker to be dropped after purge")
+	}
+}
+
+func TestCacheSystem_SetMany(t *testing.T) {
+	cache := NewCacheSystem(1024, 999999, 60, 999999)
+	defer cache.Stop()
+
+	err := cache.SetMany("b", []BulkItem{
+		{Key: "k1", Value: "v1"},
+		{Key: "k2", Value: "v2", TTL: time.Second},
+	})
+	if err != nil {
+		t.Fatalf("SetMany => %v", err)
+	}
+	if got := cache.Get("b", "k1"); got != "v1" {
+		t.Fatalf("expected 'v1', got %q", got)
+	}
+	if size, _ := cache.GetBucketSize("b"); size != 2 {
+		t.Fatalf("expected 2 keys, got %d", size)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if got := cache.Get("b", "k2"); got != "" {
+		t.Fatalf("expected k2 to expire with its own 1s TTL, got %q", got)
+	}
+	if got := cache.Get("b", "k1"); got != "v1" {
+		t.Fatalf("expected k1 to keep the default TTL, got %q", got)
+	}
+}
+
+func TestCacheSystem_Page(t *testing.T) {
+	cache := NewCacheSystem(1024, 999999, 60, 999999)
+	defer cache.Stop()
+
+	for i := 0; i < 25; i++ {
+		cache.Set("cfg", fmt.Sprintf("key-%02d", i), strconv.Itoa(i))
+	}
+	cache.Set("other", "key-00", "x")
+
+	var seen []string
+	after := ""
+	for pages := 0; ; pages++ {
+		items, more, err := cache.Page("cfg", after, 10)
+		if err != nil {
+			t.Fatalf("Page => %v", err)
+		}
+		for _, it := range items {
+			if it.TTL < 59 || it.TTL > 60 {
+				t.Fatalf("expected ~60s TTL for %s, got %d", it.Key, it.TTL)
+			}
+			seen = append(seen, it.Key)
+		}
+		if !more {
+			if pages != 2 {
+				t.Fatalf("expected 3 pages, got %d", pages+1)
+			}
+			break
+		}
+		after = items[len(items)-1].Key
+	}
+	if len(seen) != 25 || seen[0] != "key-00" || seen[24] != "key-24" {
+		t.Fatalf("expected all 25 keys in order, got %v", seen)
+	}
+}
+
+func TestCacheSystem_BucketTTL(t *testing.T) {
+	cache := NewCacheSystem(1024, 10_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.SetBucketConfig("sessions", BucketConfig{TTL: jsonTTL(30 * time.Minute)})
+	cache.Set("sessions", "k", "v")
+	cache.Set("static", "k", "v")
+	if ttl := cache.items[[2]string{"sessions", "k"}].Value.(*CacheEntry).Expiration.Sub(time.Now()); ttl <= 29*time.Minute || ttl > 30*time.Minute {
+		t.Fatalf("expected the bucket's TTL, got %v", ttl)
+	}
+	if ttl := cache.items[[2]string{"static", "k"}].Value.(*CacheEntry).Expiration.Sub(time.Now()); ttl <= 59*time.Second || ttl > time.Minute {
+		t.Fatalf("expected the cache-wide TTL elsewhere, got %v", ttl)
+	}
+
+	// A TTL given with the write still wins
+	cache.SetWithTTL("sessions", "short", "v", time.Second)
+	if ttl := cache.items[[2]string{"sessions", "short"}].Value.(*CacheEntry).Expiration.Sub(time.Now()); ttl > time.Second {
+		t.Fatalf("expected the write's own TTL, got %v", ttl)
+	}
+
+	cfg := BucketConfig{TTL: jsonTTL(-time.Second)}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected a negative ttl to be rejected")
+	}
+}
+
+func TestCacheSystem_TTL(t *testing.T) {
+	cache := NewCacheSystem(1024, 10_000, 60, 999999)
+	defer cache.Stop()
+
+	if ttl, _ := cache.TTL("b", "missing"); ttl != -1 {
+		t.Fatalf("expected -1 for a missing key, got %v", ttl)
+	}
+	cache.Set("b", "default", "v")
+	if ttl, _ := cache.TTL("b", "default"); ttl <= 59*time.Second || ttl > 60*time.Second {
+		t.Fatalf("expected about 60s left, got %v", ttl)
+	}
+	cache.SetWithTTL("b", "short", "v", 50*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	if ttl, _ := cache.TTL("b", "short"); ttl != -1 {
+		t.Fatalf("expected -1 for an expired key, got %v", ttl)
+	}
+
+	// A zero default TTL means entries never expire
+	forever := NewCacheSystem(1024, 10_000, 0, 999999)
+	defer forever.Stop()
+	forever.Set("b", "k", "v")
+	if ttl, _ := forever.TTL("b", "k"); ttl != 0 {
+		t.Fatalf("expected 0 for an entry without expiry, got %v", ttl)
+	}
+	if got := forever.Get("b", "k"); got != "v" {
+		t.Fatalf("expected entry without expiry to be readable, got %q", got)
+	}
+}
+
+func TestCacheSystem_SubSecondTTL(t *testing.T) {
+	cache := NewCache(CacheConfig{MaxEntrySize: 1024, MaxSize: 10_000, TTL: 80 * time.Millisecond, CleanupInterval: 20 * time.Millisecond})
+	defer cache.Stop()
+
+	cache.Set("b", "default", "v")
+	cache.SetWithTTL("b", "short", "v", 30*time.Millisecond)
+	if ttl, _ := cache.TTL("b", "default"); ttl <= 0 || ttl > 80*time.Millisecond {
+		t.Fatalf("expected a sub-second default TTL, got %v", ttl)
+	}
+
+	// The background sweep removes entries without any reads
+	time.Sleep(60 * time.Millisecond)
+	if size, _ := cache.GetBucketSize("b"); size != 1 {
+		t.Fatalf("expected only the 80ms entry after 60ms, got %d entries", size)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if size, _ := cache.GetBucketSize("b"); size != 0 {
+		t.Fatalf("expected the sweep to remove every entry, got %d entries", size)
+	}
+}
+
+func TestCacheSystem_SetWithExpiry(t *testing.T) {
+	cache := NewCacheSystem(1024, 10_000, 60, 999999)
+	defer cache.Stop()
+	cache.SetSlidingExpiration(true)
+
+	at := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	cache.SetWithExpiry("b", "k", "v", at)
+	if meta, _, _ := cache.Info("b", "k"); meta.TTL <= 3600 {
+		t.Fatalf("expected the absolute expiry to override the default TTL, got %ds", meta.TTL)
+	}
+
+	// Reads must not slide an absolute expiry
+	cache.Get("b", "k")
+	cache.mu.RLock()
+	exp := cache.items[[2]string{"b", "k"}].Value.(*CacheEntry).Expiration
+	cache.mu.RUnlock()
+	if !exp.Equal(at) {
+		t.Fatalf("expected expiration %v to be stored exactly, got %v", at, exp)
+	}
+
+	cache.SetWithExpiry("b", "past", "v", time.Now().Add(-time.Second))
+	if _, found, _ := cache.Lookup("b", "past"); found {
+		t.Fatalf("expected an entry expiring in the past to be a miss")
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	cases := map[string]time.Duration{
+		"120":   120 * time.Second,
+		"0":     0,
+		"250ms": 250 * time.Millisecond,
+		"1m30s": 90 * time.Second,
+	}
+	for in, want := range cases {
+		if got, err := parseTTL(in); err != nil || got != want {
+			t.Fatalf("parseTTL(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseTTL("soon"); err == nil {
+		t.Fatalf("expected an error for a bad duration")
+	}
+
+	var v struct{ TTL jsonTTL }
+	for body, want := range map[string]time.Duration{
+		`{"TTL": 2}`:       2 * time.Second,
+		`{"TTL": 0.25}`:    250 * time.Millisecond,
+		`{"TTL": "100ms"}`: 100 * time.Millisecond,
+	} {
+		if err := json.Unmarshal([]byte(body), &v); err != nil || time.Duration(v.TTL) != want {
+			t.Fatalf("decode %s = %v, %v; want %v", body, time.Duration(v.TTL), err, want)
+		}
+	}
+}
+
+func TestCacheSystem_Touch(t *testing.T) {
+	cache := NewCacheSystem(1024, 10_000, 60, 999999)
+	defer cache.Stop()
+
+	if found, _ := cache.Touch("b", "missing", time.Minute); found {
+		t.Fatalf("expected Touch of a missing key to report false")
+	}
+
+	cache.SetWithTTL("b", "k", "v", 50*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if found, _ := cache.Touch("b", "k", 100*time.Millisecond); !found {
+		t.Fatalf("expected Touch to find the key")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if got := cache.Get("b", "k"); got != "v" {
+		t.Fatalf("expected touched key to outlive its original TTL, got %q", got)
+	}
+
+	// ttl <= 0 falls back to the default TTL
+	cache.Touch("b", "k", 0)
+	if ttl, _ := cache.TTL("b", "k"); ttl <= 59*time.Second {
+		t.Fatalf("expected default TTL after Touch, got %v", ttl)
+	}
+}
+
+func TestCacheSystem_GetDel(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	// Racing claimers: exactly one may see each token.
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("token%d", i)
+		cache.Set("claims", key, "secret")
+		var wg sync.WaitGroup
+		var winners int32
+		for c := 0; c < 8; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if val, _, found, _ := cache.GetDel("claims", key); found && val == "secret" {
+					atomic.AddInt32(&winners, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if winners != 1 {
+			t.Fatalf("expected exactly one claimer of %s, got %d", key, winners)
+		}
+	}
+	if size, _ := cache.GetBucketSize("claims"); size != 0 {
+		t.Fatalf("expected every token to be removed, got %d left", size)
+	}
+
+	cache.SetWithTTL("claims", "expired", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, _, found, _ := cache.GetDel("claims", "expired"); found {
+		t.Fatalf("expected GetDel to miss an expired entry")
+	}
+}
+
+func TestCacheSystem_ConditionalSet(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	if ok, _ := cache.SetXX("b", "k", "v1"); ok {
+		t.Fatalf("expected SetXX on a missing key not to apply")
+	}
+	if ok, _ := cache.SetNX("b", "k", "v1"); !ok {
+		t.Fatalf("expected SetNX on a missing key to apply")
+	}
+	if ok, _ := cache.SetNX("b", "k", "v2"); ok {
+		t.Fatalf("expected SetNX on an existing key not to apply")
+	}
+	if ok, _ := cache.SetXX("b", "k", "v3"); !ok {
+		t.Fatalf("expected SetXX on an existing key to apply")
+	}
+	if val := cache.Get("b", "k"); val != "v3" {
+		t.Fatalf("expected v3, got %q", val)
+	}
+
+	// An expired entry counts as missing
+	cache.SetWithTTL("b", "old", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := cache.SetNX("b", "old", "fresh"); !ok {
+		t.Fatalf("expected SetNX to replace an expired entry")
+	}
+
+	// Racing SetNX: exactly one wins
+	var wg sync.WaitGroup
+	var winners int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := cache.SetNX("b", "lock", "held"); ok {
+				atomic.AddInt32(&winners, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Fatalf("expected exactly one SetNX to win, got %d", winners)
+	}
+}
+
+func TestCacheSystem_CompareAndSwap(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	if _, err := cache.CompareAndSwap("b", "k", "v", 1); err != ErrVersionMismatch {
+		t.Fatalf("expected CAS on a missing key to fail, got %v", err)
+	}
+	cache.Set("b", "k", "v1")
+	v1, _, _ := cache.LookupValue("b", "k")
+	v2, err := cache.CompareAndSwap("b", "k", "v2", v1.Version)
+	if err != nil || v2 <= v1.Version {
+		t.Fatalf("expected CAS to succeed with a newer version, got %d, %v", v2, err)
+	}
+	if _, err := cache.CompareAndSwap("b", "k", "v3", v1.Version); err != ErrVersionMismatch {
+		t.Fatalf("expected CAS with a stale version to fail, got %v", err)
+	}
+
+	// A bulk write with one stale version stores nothing
+	err = cache.SetMany("b", []BulkItem{{Key: "x", Value: "1"}, {Key: "k", Value: "v4", Version: v1.Version}})
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expected a version mismatch, got %v", err)
+	}
+	if _, found, _ := cache.Lookup("b", "x"); found {
+		t.Fatalf("expected nothing to be written by a failed bulk CAS")
+	}
+
+	// Concurrent writers racing from the same version: exactly one wins
+	var wg sync.WaitGroup
+	var winners int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := cache.CompareAndSwap("b", "k", strconv.Itoa(i), v2); err == nil {
+				atomic.AddInt32(&winners, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Fatalf("expected exactly one CAS to win, got %d", winners)
+	}
+}
+
+func TestCacheSystem_IncrBy(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	if n, err := cache.IncrBy("b", "n", 5); err != nil || n != 5 {
+		t.Fatalf("expected a missing key to start from 0, got %d, %v", n, err)
+	}
+	if n, _ := cache.IncrBy("b", "n", -7); n != -2 {
+		t.Fatalf("expected -2, got %d", n)
+	}
+	cache.Persist("b", "n")
+	cache.IncrBy("b", "n", 1)
+	if ttl, _ := cache.TTL("b", "n"); ttl != 0 {
+		t.Fatalf("expected IncrBy to keep the entry's expiration, got %v", ttl)
+	}
+
+	cache.Set("b", "text", "abc")
+	if _, err := cache.IncrBy("b", "text", 1); err != ErrNotInteger {
+		t.Fatalf("expected ErrNotInteger, got %v", err)
+	}
+	cache.Set("b", "max", strconv.FormatInt(math.MaxInt64, 10))
+	if _, err := cache.IncrBy("b", "max", 1); err != ErrNotInteger {
+		t.Fatalf("expected overflow to fail, got %v", err)
+	}
+
+	// Concurrent increments are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.IncrBy("b", "counter", 2)
+		}()
+	}
+	wg.Wait()
+	if val := cache.Get("b", "counter"); val != "100" {
+		t.Fatalf("expected 100, got %q", val)
+	}
+	if meta, _, _ := cache.Info("b", "counter"); meta.Size != len("b")+len("counter")+len("100") {
+		t.Fatalf("expected the entry size to follow the value, got %d", meta.Size)
+	}
+}
+
+func TestCacheSystem_AppendPrepend(t *testing.T) {
+	cache := NewCacheSystem(10, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.Append("b", "csv", "2,")
+	cache.Append("b", "csv", "3,")
+	if n, err := cache.Prepend("b", "csv", "1,"); err != nil || n != 6 {
+		t.Fatalf("expected length 6, got %d, %v", n, err)
+	}
+	if val := cache.Get("b", "csv"); val != "1,2,3," {
+		t.Fatalf("expected 1,2,3, got %q", val)
+	}
+	if _, err := cache.Append("b", "csv", "45678"); err != ErrEntryTooLarge {
+		t.Fatalf("expected appending past the entry size limit to fail, got %v", err)
+	}
+	if val := cache.Get("b", "csv"); val != "1,2,3," {
+		t.Fatalf("expected a rejected append to leave the value alone, got %q", val)
+	}
+	if meta, _, _ := cache.Info("b", "csv"); meta.Size != len("b")+len("csv")+len("1,2,3,") {
+		t.Fatalf("expected the entry size to follow the value, got %d", meta.Size)
+	}
+}
+
+func TestCacheSystem_Keys(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.Set("b", "c", "3")
+	cache.Set("b", "a", "1")
+	cache.Set("b", "b", "2")
+	cache.SetWithTTL("b", "expired", "x", time.Millisecond)
+	cache.Set("other", "z", "9")
+	time.Sleep(5 * time.Millisecond)
+
+	keys, err := cache.Keys("b")
+	if err != nil || strings.Join(keys, ",") != "a,b,c" {
+		t.Fatalf("expected a,b,c, got %v, %v", keys, err)
+	}
+	if keys, _ := cache.Keys("missing"); len(keys) != 0 {
+		t.Fatalf("expected no keys for a missing bucket, got %v", keys)
+	}
+}
+
+func TestCacheSystem_DeletePrefix(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	for i := 0; i < clearBatchSize+10; i++ {
+		cache.Set("s", "session:tenant42:"+strconv.Itoa(i), "v")
+	}
+	cache.Set("s", "session:tenant7:1", "v")
+	cache.Set("other", "session:tenant42:1", "v")
+
+	n, err := cache.DeletePrefix("s", "session:tenant42:")
+	if err != nil || n != clearBatchSize+10 {
+		t.Fatalf("DeletePrefix => %d, %v", n, err)
+	}
+	if keys, _ := cache.Keys("s"); len(keys) != 1 || keys[0] != "session:tenant7:1" {
+		t.Fatalf("expected only the other tenant's key to remain, got %v", keys)
+	}
+	if got := cache.Get("other", "session:tenant42:1"); got != "v" {
+		t.Fatalf("expected other buckets to be untouched, got %q", got)
+	}
+
+	cache.Freeze("s", 0)
+	if _, err := cache.DeletePrefix("s", "session:"); !errors.Is(err, ErrBucketFrozen) {
+		t.Fatalf("expected ErrBucketFrozen, got %v", err)
+	}
+}
+
+func TestCacheSystem_Exists(t *testing.T) {
+	cache := NewCacheSystem(1024, 10_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.Set("b", "k", "v")
+	cache.SetWithTTL("b", "old", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	for key, want := range map[string]bool{"k": true, "old": false, "missing": false} {
+		if found, err := cache.Exists("b", key); err != nil || found != want {
+			t.Fatalf("Exists(%q) => %v, %v; want %v", key, found, err, want)
+		}
+	}
+	if hits := cache.items[[2]string{"b", "k"}].Value.(*CacheEntry).hits; hits != 0 {
+		t.Fatalf("expected Exists not to count as a read, got %d hits", hits)
+	}
+}
+
+func TestCacheSystem_Peek(t *testing.T) {
+	// Room for two 4-byte entries
+	cache := NewCacheSystem(1, 8, 60, 999999)
+	defer cache.Stop()
+
+	cache.Set("b", "k1", "v")
+	cache.Set("b", "k2", "v")
+	if val, found, err := cache.Peek("b", "k1"); err != nil || !found || val != "v" {
+		t.Fatalf("Peek => %q, %v, %v", val, found, err)
+	}
+	if _, found, _ := cache.Peek("b", "missing"); found {
+		t.Fatalf("expected Peek of a missing key to miss")
+	}
+	cache.Set("b", "k3", "v")
+	if _, found, _ := cache.Peek("b", "k1"); found {
+		t.Fatalf("expected the peeked entry to stay least recently used and be evicted")
+	}
+	if _, found, _ := cache.Peek("b", "k2"); !found {
+		t.Fatalf("expected k2 to be kept")
+	}
+	if stats := cache.Stats("b"); stats.Totals.Hits != 0 || stats.Totals.Misses != 0 {
+		t.Fatalf("expected peeks not to count as reads, got %+v", stats.Totals)
+	}
+}
+
+func TestCacheSystem_Persist(t *testing.T) {
+	cache := NewCacheSystem(1024, 10_000, 60, 999999)
+	defer cache.Stop()
+
+	if found, _ := cache.Persist("b", "missing"); found {
+		t.Fatalf("expected Persist of a missing key to report false")
+	}
+	cache.SetWithTTL("b", "k", "v", 50*time.Millisecond)
+	if found, _ := cache.Persist("b", "k"); !found {
+		t.Fatalf("expected Persist to find the key")
+	}
+	time.Sleep(70 * time.Millisecond)
+	if got := cache.Get("b", "k"); got != "v" {
+		t.Fatalf("expected persisted key to outlive its TTL, got %q", got)
+	}
+	if ttl, _ := cache.TTL("b", "k"); ttl != 0 {
+		t.Fatalf("expected no expiry after Persist, got %v", ttl)
+	}
+
+	// Touch gives it an expiration again
+	cache.Touch("b", "k", time.Minute)
+	if ttl, _ := cache.TTL("b", "k"); ttl <= 0 {
+		t.Fatalf("expected Touch to restore an expiration, got %v", ttl)
+	}
+}
+
+func TestCacheSystem_SlidingExpiration(t *testing.T) {
+	cache := NewCacheSystem(1024, 10_000, 60, 999999)
+	defer cache.Stop()
+
+	// Off by default: reads don't keep an entry alive
+	cache.SetWithTTL("fixed", "k", "v", 60*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	cache.Get("fixed", "k")
+	time.Sleep(40 * time.Millisecond)
+	if got := cache.Get("fixed", "k"); got != "" {
+		t.Fatalf("expected entry to expire despite reads, got %q", got)
+	}
+
+	// Cache-wide: each read pushes expiration out by the original TTL
+	cache.SetSlidingExpiration(true)
+	cache.SetWithTTL("idle", "k", "v", 60*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if got := cache.Get("idle", "k"); got != "v" {
+			t.Fatalf("read %d: expected entry to stay alive while read, got %q", i, got)
+		}
+	}
+	time.Sleep(80 * time.Millisecond)
+	if got := cache.Get("idle", "k"); got != "" {
+		t.Fatalf("expected idle entry to expire, got %q", got)
+	}
+
+	// A bucket can opt out
+	off := false
+	cache.SetBucketConfig("fixed", BucketConfig{SlidingExpiration: &off})
+	cache.SetWithTTL("fixed", "k", "v", 60*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	cache.Get("fixed", "k")
+	time.Sleep(40 * time.Millisecond)
+	if got := cache.Get("fixed", "k"); got != "" {
+		t.Fatalf("expected bucket override to disable sliding, got %q", got)
+	}
+}
+
 func TestCacheSystem_ConcurrentAccess(t *testing.T) {
 	cache := NewCacheSystem(1024, 999999, 60, 999999)
 	defer cache.Stop()
@@ -236,6 +926,52 @@ func TestCacheSystem_LazyExpirationOnGet(t *testing.T) {
 	}
 }
 
+func TestCacheSystem_LockTimeout(t *testing.T) {
+	cache := NewCacheSystem(1024, 999999, 60, 999999)
+	defer cache.Stop()
+	cache.SetLockTimeout(20 * time.Millisecond)
+
+	// Simulate a long-running operation holding the write lock
+	cache.mu.Lock()
+	start := time.Now()
+	err := cache.Set("b", "k", "v")
+	waited := time.Since(start)
+	if err != ErrLockTimeout {
+		t.Fatalf("expected ErrLockTimeout, got %v", err)
+	}
+	if waited < 20*time.Millisecond || waited > time.Second {
+		t.Fatalf("expected to give up after ~20ms, waited %v", waited)
+	}
+	if _, _, err = cache.Lookup("b", "k"); err != ErrLockTimeout {
+		t.Fatalf("expected ErrLockTimeout from Lookup, got %v", err)
+	}
+
+	// HTTP requests fail fast with 503
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/keys/k")
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the lock is held, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected a Retry-After header on 503")
+	}
+	cache.mu.Unlock()
+
+	if got := cache.LockTimeouts(); got != 3 {
+		t.Fatalf("expected 3 lock timeouts, got %d", got)
+	}
+
+	// Once the lock is free, operations succeed again
+	if err = cache.Set("b", "k", "v"); err != nil {
+		t.Fatalf("expected Set to succeed, got %v", err)
+	}
+}
+
 // ---------------------------------------------------------------
 // Integration Tests for the HTTP Endpoints
 // ---------------------------------------------------------------
@@ -490,6 +1226,150 @@ func TestHTTP_Integration_Buckets(t *testing.T) {
 	}
 }
 
+func TestHTTP_Integration_BucketMultiPut(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	body := []byte(`{"a":"1","b":{"value":"2","ttl":30},"c":{"value":"3"}}`)
+	resp, err := httpPut(server.URL+"/buckets/warm", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("PUT /buckets/warm => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT /buckets/warm => expected 200, got %d", resp.StatusCode)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if got := cache.Get("warm", key); got != want {
+			t.Fatalf("expected %s=%q, got %q", key, want, got)
+		}
+	}
+
+	// Negative TTLs reject the whole request
+	body = []byte(`{"d":"4","e":{"value":"5","ttl":-1}}`)
+	resp, err = httpPut(server.URL+"/buckets/warm", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("PUT /buckets/warm => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT with negative ttl => expected 400, got %d", resp.StatusCode)
+	}
+	if got := cache.Get("warm", "d"); got != "" {
+		t.Fatalf("expected nothing stored from a rejected request, got %q", got)
+	}
+}
+
+func TestHTTP_Integration_BucketAll(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	cache.Set("settings", "a", "1")
+	cache.Set("settings", "b", "2")
+	cache.Set("settings", "c", "3")
+
+	type page struct {
+		Items      []EntryInfo `json:"items"`
+		NextCursor string      `json:"next_cursor"`
+	}
+	fetch := func(query string) page {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/buckets/settings/all" + query)
+		if err != nil {
+			t.Fatalf("GET all => %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET all%s => expected 200, got %d", query, resp.StatusCode)
+		}
+		var p page
+		if err = json.NewDecoder(resp.Body).Decode(&p); err != nil {
+			t.Fatalf("decode => %v", err)
+		}
+		return p
+	}
+
+	first := fetch("?limit=2")
+	if len(first.Items) != 2 || first.Items[0].Key != "a" || first.Items[1].Value != "2" || first.NextCursor == "" {
+		t.Fatalf("unexpected first page: %+v", first)
+	}
+	second := fetch("?limit=2&cursor=" + first.NextCursor)
+	if len(second.Items) != 1 || second.Items[0].Key != "c" || second.NextCursor != "" {
+		t.Fatalf("unexpected second page: %+v", second)
+	}
+
+	resp, err := http.Get(server.URL + "/buckets/settings/all?limit=0")
+	if err != nil {
+		t.Fatalf("GET all => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("GET all?limit=0 => expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTP_Integration_LastWriter(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	info := func(path string) EntryMeta {
+		t.Helper()
+		resp, err := http.Get(server.URL + path + "?info")
+		if err != nil {
+			t.Fatalf("GET info => %v", err)
+		}
+		defer resp.Body.Close()
+		var meta EntryMeta
+		if err = json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+			t.Fatalf("decode => %v", err)
+		}
+		return meta
+	}
+
+	before := time.Now()
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/buckets/prices/sku1", strings.NewReader(`{"value":"9.99"}`))
+	req.Header.Set(writerHeader, "pricing-svc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+
+	meta := info("/buckets/prices/sku1")
+	if meta.WrittenBy != "pricing-svc" || meta.WrittenAt.Before(before) || meta.Size != len("prices")+len("sku1")+len("9.99") {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+
+	// Without the header, the client address is recorded; basic auth wins over it
+	resp, _ = httpPut(server.URL+"/keys/k", "application/json", strings.NewReader(`{"value":"v"}`))
+	resp.Body.Close()
+	if got := info("/keys/k").WrittenBy; got != "127.0.0.1" {
+		t.Fatalf("expected client address as writer, got %q", got)
+	}
+	req, _ = http.NewRequest(http.MethodPut, server.URL+"/keys/k", strings.NewReader(`{"value":"v"}`))
+	req.SetBasicAuth("alice", "secret")
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if got := info("/keys/k").WrittenBy; got != "alice" {
+		t.Fatalf("expected basic auth user as writer, got %q", got)
+	}
+
+	// Exported through listings too
+	items, _, _ := cache.Page("prices", "", 10)
+	if len(items) != 1 || items[0].WrittenBy != "pricing-svc" || items[0].WrittenAt.IsZero() {
+		t.Fatalf("unexpected listing: %+v", items)
+	}
+}
+
 func TestHTTP_Integration_Expiration(t *testing.T) {
 	// Very short TTL => 1s
 	cache := NewCacheSystem(1_000_000, 10_000_000, 1, 999999)
@@ -547,6 +1427,145 @@ func TestHTTP_Integration_Expiration(t *testing.T) {
 	}
 }
 
+func TestHTTP_Integration_SoftTTL(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	resp, err := httpPut(server.URL+"/keys/foo", "application/json", strings.NewReader(`{"value":"bar","soft_ttl":"50ms"}`))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT => expected 200, got %d", resp.StatusCode)
+	}
+	resp, err = httpPut(server.URL+"/keys/bad", "application/json", strings.NewReader(`{"value":"bar","soft_ttl":-1}`))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT with a negative soft_ttl => expected 400, got %d", resp.StatusCode)
+	}
+
+	get := func() (string, string) {
+		resp, err := http.Get(server.URL + "/keys/foo")
+		if err != nil {
+			t.Fatalf("GET => %v", err)
+		}
+		defer resp.Body.Close()
+		var getRes map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&getRes); err != nil {
+			t.Fatalf("decode => %v", err)
+		}
+		return getRes["value"], resp.Header.Get(staleHeader)
+	}
+	if value, stale := get(); value != "bar" || stale != "" {
+		t.Fatalf("expected a fresh 'bar', got %q stale=%q", value, stale)
+	}
+
+	// Past the soft TTL the value is still served, flagged stale
+	time.Sleep(100 * time.Millisecond)
+	if value, stale := get(); value != "bar" || stale != "true" {
+		t.Fatalf("expected a stale 'bar', got %q stale=%q", value, stale)
+	}
+	if meta, _, _ := cache.Info("__root__", "foo"); !meta.Stale {
+		t.Fatalf("expected Info to report the entry stale")
+	}
+
+	// until a refresh makes it fresh again
+	cache.Set("__root__", "foo", "baz")
+	if value, stale := get(); value != "baz" || stale != "" {
+		t.Fatalf("expected a fresh 'baz' after the refresh, got %q stale=%q", value, stale)
+	}
+}
+
+func TestCacheSystem_MaxIdle(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.SetWithOptions("b", BulkItem{Key: "read", Value: "1", TTL: time.Hour, MaxIdle: 80 * time.Millisecond}, WriteOptions{})
+	cache.SetWithOptions("b", BulkItem{Key: "unread", Value: "2", TTL: time.Hour, MaxIdle: 80 * time.Millisecond}, WriteOptions{})
+	cache.SetWithOptions("b", BulkItem{Key: "short", Value: "3", TTL: 40 * time.Millisecond, MaxIdle: time.Hour}, WriteOptions{})
+	if ttl, _ := cache.TTL("b", "unread"); ttl <= 0 || ttl > 80*time.Millisecond {
+		t.Fatalf("expected TTL to report the max idle time, got %v", ttl)
+	}
+	if meta, _, _ := cache.Info("b", "read"); meta.MaxIdle != 1 {
+		t.Fatalf("expected Info to report max_idle rounded up, got %d", meta.MaxIdle)
+	}
+
+	// Reads keep an entry alive past its max idle time
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if got := cache.Get("b", "read"); got != "1" {
+			t.Fatalf("expected reads to keep the entry alive, got %q", got)
+		}
+	}
+	if got := cache.Get("b", "unread"); got != "" {
+		t.Fatalf("expected the unread entry to expire, got %q", got)
+	}
+	// but not past its TTL
+	if got := cache.Get("b", "short"); got != "" {
+		t.Fatalf("expected the TTL to still apply, got %q", got)
+	}
+
+	// A write without max_idle clears it, as does Persist
+	cache.SetWithOptions("b", BulkItem{Key: "read", Value: "4"}, WriteOptions{})
+	if meta, _, _ := cache.Info("b", "read"); meta.MaxIdle != 0 {
+		t.Fatalf("expected a plain write to clear max_idle, got %d", meta.MaxIdle)
+	}
+	cache.SetWithOptions("b", BulkItem{Key: "kept", Value: "5", MaxIdle: 40 * time.Millisecond}, WriteOptions{})
+	cache.Persist("b", "kept")
+	time.Sleep(60 * time.Millisecond)
+	if got := cache.Get("b", "kept"); got != "5" {
+		t.Fatalf("expected Persist to clear max_idle, got %q", got)
+	}
+}
+
+func TestHTTP_Integration_MaxIdle(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	for _, c := range []struct {
+		path, body string
+		code       int
+	}{
+		{"/keys/foo", `{"value":"bar","max_idle":"1h"}`, http.StatusOK},
+		{"/keys/bad", `{"value":"bar","max_idle":-1}`, http.StatusBadRequest},
+		{"/buckets/b", `{"k":{"value":"v","max_idle":"1m"}}`, http.StatusOK},
+		{"/buckets/b", `{"k":{"value":"v","max_idle":"-1s"}}`, http.StatusBadRequest},
+	} {
+		resp, err := httpPut(server.URL+c.path, "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("PUT %s => %v", c.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Fatalf("PUT %s %s => expected %d, got %d", c.path, c.body, c.code, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/keys/foo?info")
+	if err != nil {
+		t.Fatalf("GET ?info => %v", err)
+	}
+	defer resp.Body.Close()
+	var meta EntryMeta
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		t.Fatalf("decode => %v", err)
+	}
+	if meta.MaxIdle != 3600 || meta.TTL != 60 {
+		t.Fatalf("expected max_idle 3600 and the default TTL, got %+v", meta)
+	}
+	if meta, _, _ := cache.Info("b", "k"); meta.MaxIdle != 60 {
+		t.Fatalf("expected the bucket write to set max_idle, got %+v", meta)
+	}
+}
+
 // ---------------------------------------------------------------
 // Helpers
 // ---------------------------------------------------------------
@@ -561,6 +1580,36 @@ func httpPut(url, contentType string, body io.Reader) (*http.Response, error) {
 	return http.DefaultClient.Do(req)
 }
 
+// httpDo sends a method request with body to url and returns the response
+// and its body, trimmed. It fails t if the request can't be made.
+func httpDo(t *testing.T, method, url, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%s %s => %v", method, url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s => %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading the response => %v", method, url, err)
+	}
+	return resp, strings.TrimSpace(string(data))
+}
+
+// httpJSON is httpDo for endpoints that answer with a JSON object, which
+// it decodes; the object is nil if the response isn't one.
+func httpJSON(t *testing.T, method, url, body string) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	resp, data := httpDo(t, method, url, body)
+	var out map[string]interface{}
+	json.Unmarshal([]byte(data), &out)
+	return resp, out
+}
+
 // BenchmarkSet measures the time it takes to perform a cache Set operation repeatedly.
 func BenchmarkSet(b *testing.B) {
 	cache := NewCacheSystem(1024*1024, 10*1024*1024, 60, 10)
@@ -696,3 +1745,110 @@ func BenchmarkHighContentionSetGet(b *testing.B) {
 		}
 	})
 }
+
+func TestHTTP_Routing(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.SetBucketConfig("codec", BucketConfig{Codec: "json"})
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	tests := []struct {
+		method, path string
+		status       int    // 404, or 405 with allow
+		allow        string // the expected Allow header
+	}{
+		{"GET", "/nope", 404, ""},
+		{"GET", "/bucketsx", 404, ""},
+		{"GET", "/buckets/", 404, ""},
+		{"GET", "/buckets/b/", 404, ""},
+		{"GET", "/keys/", 404, ""},
+		{"GET", "/admin/nope", 404, ""},
+		{"GET", "/sessions/", 404, ""},
+		{"GET", "/sessions/s/nope", 404, ""},
+		{"GET", "/schedules/s/nope", 404, ""},
+		{"GET", "/counters/b", 404, ""},
+		{"GET", "/lists/", 404, ""},
+		{"GET", "/hashes/b", 404, ""},
+		{"GET", "/zsets/b/", 404, ""},
+		{"GET", "/json/", 404, ""},
+		{"GET", "/hlls/b", 404, ""},
+		{"GET", "/blooms/b", 404, ""},
+		{"GET", "/bitmaps/", 404, ""},
+		{"POST", "/ratelimit/b", 404, ""},
+		{"GET", "/semaphores/b", 404, ""},
+
+		{"POST", "/", 405, "GET"},
+		{"POST", "/readyz", 405, "GET"},
+		{"POST", "/stats", 405, "GET"},
+		{"GET", "/buckets", 405, "DELETE"},
+		{"POST", "/buckets/b", 405, "GET, PUT, DELETE"},
+		{"POST", "/buckets/b/k", 405, "GET, HEAD, PUT, PATCH, DELETE"},
+		{"POST", "/keys/k", 405, "GET, HEAD, PUT, PATCH, DELETE"},
+		{"PATCH", "/buckets/codec/k", 405, "GET, HEAD, PUT, DELETE"},
+		{"POST", "/buckets/b/k/ttl", 405, "GET"},
+		{"GET", "/buckets/b/k/touch", 405, "POST"},
+		{"GET", "/buckets/b/k/persist", 405, "POST"},
+		{"GET", "/buckets/b/k/getdel", 405, "POST, DELETE"},
+		{"GET", "/buckets/b/k/incr", 405, "POST"},
+		{"GET", "/keys/k/decr", 405, "POST"},
+		{"GET", "/buckets/b/k/lease", 405, "POST, DELETE"},
+		{"POST", "/buckets/b/config", 405, "GET, PUT, DELETE"},
+		{"POST", "/buckets/b/all", 405, "GET"},
+		{"POST", "/buckets/b/keys", 405, "GET"},
+		{"POST", "/buckets/b/scan", 405, "GET"},
+		{"POST", "/buckets/b/watch", 405, "GET"},
+		{"POST", "/buckets/b/stats", 405, "GET, DELETE"},
+		{"DELETE", "/buckets/b/freeze", 405, "GET, POST"},
+		{"PUT", "/buckets/b/thaw", 405, "GET, POST"},
+		{"GET", "/mget", 405, "POST"},
+		{"GET", "/mset", 405, "POST"},
+		{"GET", "/mdelete", 405, "POST"},
+		{"GET", "/imports", 405, "POST"},
+		{"POST", "/sessions/s", 405, "GET, PUT, DELETE"},
+		{"GET", "/sessions/s/heartbeat", 405, "POST"},
+		{"POST", "/schedules", 405, "GET"},
+		{"POST", "/schedules/s", 405, "GET, PUT, DELETE"},
+		{"GET", "/schedules/s/run", 405, "POST"},
+		{"POST", "/admin/jobs", 405, "GET"},
+		{"POST", "/admin/jobs/j", 405, "GET, DELETE"},
+		{"POST", "/admin/runtime", 405, "GET, PATCH"},
+		{"POST", "/admin/usage", 405, "GET"},
+		{"POST", "/admin/distributions", 405, "GET"},
+		{"POST", "/admin/expiry-histogram", 405, "GET"},
+		{"POST", "/counters/b/k", 405, "GET, PUT, DELETE"},
+		{"GET", "/counters/b/k/incr", 405, "POST"},
+		{"GET", "/counters/b/k/reset", 405, "POST"},
+		{"POST", "/lists/b/k", 405, "GET, DELETE"},
+		{"GET", "/lists/b/k/lpop", 405, "POST"},
+		{"POST", "/hashes/b/k", 405, "GET, PATCH, DELETE"},
+		{"POST", "/zsets/b/k", 405, "GET, PATCH, DELETE"},
+		{"GET", "/zsets/b/k/incr", 405, "POST"},
+		{"POST", "/json/b/k", 405, "GET, PUT, DELETE"},
+		{"POST", "/hlls/b/k", 405, "GET, DELETE"},
+		{"GET", "/hlls/b/k/merge", 405, "POST"},
+		{"POST", "/blooms/b/k", 405, "GET, PUT, DELETE"},
+		{"GET", "/blooms/b/k/add", 405, "POST"},
+		{"POST", "/bitmaps/b/k", 405, "GET, DELETE"},
+		{"GET", "/bitmaps/b/k/setbit", 405, "POST"},
+		{"GET", "/ratelimit/b/k", 405, "POST, DELETE"},
+		{"PUT", "/semaphores/b/k", 405, "GET, POST, DELETE"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s => %v", tt.method, tt.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || resp.Header.Get("Allow") != tt.allow {
+			t.Errorf("%s %s => %d, Allow %q; want %d, Allow %q", tt.method, tt.path, resp.StatusCode, resp.Header.Get("Allow"), tt.status, tt.allow)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(cache, nil, nil, nil, nil, nil).ServeHTTP(rec, httptest.NewRequest("POST", "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET" {
+		t.Errorf("POST /metrics => %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets is the number of finite histogram buckets. Bucket i counts
+// durations up to 2^i microseconds, so they run from 1µs to about 16.8s, each
+// twice as wide as the one before; slower requests land in the +Inf bucket.
+const latencyBuckets = 25
+
+// latencyHistogram is an exponential histogram of durations. Recording is a
+// couple of atomic adds: no locks and no allocation, so it can sit on every
+// request without a measurable cost.
+type latencyHistogram struct {
+	counts [latencyBuckets + 1]atomic.Int64 // the last counts overflows
+	sum    atomic.Int64                     // nanoseconds
+}
+
+// latencyBucket returns the index of the bucket that counts d.
+func latencyBucket(d time.Duration) int {
+	us := d.Microseconds()
+	if us <= 1 {
+		return 0
+	}
+	// The smallest i with 2^i >= us
+	if i := bits.Len64(uint64(us - 1)); i < latencyBuckets {
+		return i
+	}
+	return latencyBuckets
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.counts[latencyBucket(d)].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// requestMethods are the methods request latency is broken down by; anything
+// else is counted as "other" to keep the label set fixed.
+var requestMethods = [...]string{
+	http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost,
+	http.MethodPatch, http.MethodDelete, "other",
+}
+
+// requestLatency tracks how long requests take, per method. The zero value is
+// ready to use.
+type requestLatency struct {
+	byMethod [len(requestMethods)]latencyHistogram
+}
+
+func (l *requestLatency) observe(method string, d time.Duration) {
+	i := len(requestMethods) - 1
+	for j, m := range requestMethods[:i] {
+		if m == method {
+			i = j
+			break
+		}
+	}
+	l.byMethod[i].observe(d)
+}
+
+// writeMetrics writes the histograms as kitsune_request_duration_seconds.
+// Counts are read bucket by bucket while requests keep landing, so a scrape
+// can be off by the requests that finished during it.
+func (l *requestLatency) writeMetrics(w io.Writer) {
+	const name = "kitsune_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken to serve requests, by method.\n# TYPE %s histogram\n", name, name)
+	for i, method := range requestMethods {
+		h := &l.byMethod[i]
+		var cumulative int64
+		for b := 0; b < latencyBuckets; b++ {
+			cumulative += h.counts[b].Load()
+			le := float64(int64(1)<<b) / 1e6
+			fmt.Fprintf(w, "%s_bucket{method=%q,le=\"%g\"} %d\n", name, method, le, cumulative)
+		}
+		cumulative += h.counts[latencyBuckets].Load()
+		fmt.Fprintf(w, "%s_bucket{method=%q,le=\"+Inf\"} %d\n", name, method, cumulative)
+		fmt.Fprintf(w, "%s_sum{method=%q} %g\n", name, method, time.Duration(h.sum.Load()).Seconds())
+		fmt.Fprintf(w, "%s_count{method=%q} %d\n", name, method, cumulative)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	cases := map[time.Duration]int{
+		0:                       0,
+		time.Microsecond:        0,
+		2 * time.Microsecond:    1,
+		3 * time.Microsecond:    2,
+		1024 * time.Microsecond: 10,
+		1025 * time.Microsecond: 11,
+		time.Second:             20,
+		time.Minute:             latencyBuckets,
+	}
+	for d, want := range cases {
+		if got := latencyBucket(d); got != want {
+			t.Fatalf("latencyBucket(%s) = %d, want %d", d, got, want)
+		}
+	}
+}
+
+func TestRequestLatency(t *testing.T) {
+	var l requestLatency
+	l.observe("GET", 3*time.Microsecond)
+	l.observe("GET", time.Second)
+	l.observe("PROPFIND", time.Millisecond)
+	if allocs := testing.AllocsPerRun(100, func() { l.observe("PUT", time.Millisecond) }); allocs != 0 {
+		t.Fatalf("expected observe not to allocate, got %v allocs", allocs)
+	}
+
+	var b strings.Builder
+	l.writeMetrics(&b)
+	for _, want := range []string{
+		`kitsune_request_duration_seconds_bucket{method="GET",le="2e-06"} 0` + "\n",
+		`kitsune_request_duration_seconds_bucket{method="GET",le="4e-06"} 1` + "\n",
+		`kitsune_request_duration_seconds_bucket{method="GET",le="0.524288"} 1` + "\n",
+		`kitsune_request_duration_seconds_bucket{method="GET",le="1.048576"} 2` + "\n",
+		`kitsune_request_duration_seconds_sum{method="GET"} 1.000003` + "\n",
+		`kitsune_request_duration_seconds_count{method="other"} 1` + "\n",
+		`kitsune_request_duration_seconds_count{method="PUT"} 101` + "\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Fatalf("metrics missing %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func BenchmarkRequestLatency(b *testing.B) {
+	var l requestLatency
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.observe("GET", 150*time.Microsecond)
+		}
+	})
+}
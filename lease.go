@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrLeaseNotHeld is returned when releasing a lease with a token that
+// doesn't hold it, e.g. because it expired and passed to another client.
+var ErrLeaseNotHeld = errors.New("lease not held")
+
+const (
+	// defaultLeaseTTL is how long a lease lasts if the request doesn't say.
+	defaultLeaseTTL = 30 * time.Second
+	// maxLeaseWait bounds how long a request may block on another client's
+	// lease before it is told to poll again.
+	maxLeaseWait = time.Minute
+)
+
+// lease is one client's claim to compute the value of a missing key. Other
+// clients asking for the key wait on done, which is closed once the key is
+// written or the lease is released.
+type lease struct {
+	token   string
+	expires time.Time
+	done    chan struct{}
+}
+
+// LeaseResult is the outcome of Lease. Exactly one of these holds: Found is
+// set and Value is the key's value; Token is set and the caller holds the
+// lease until Expires; or neither is, and another client holds it until
+// Expires.
+type LeaseResult struct {
+	Value   StoredValue
+	Found   bool
+	Token   string
+	Expires time.Time
+}
+
+// Lease protects an expensive value from a stampede of clients recomputing
+// it. If bucket/key has a value, it is returned. Otherwise the first caller
+// gets a lease for ttl and is expected to compute the value and write it,
+// while later callers wait up to wait for that write. If the lease expires
+// or is released first, one of them gets it instead.
+func (cs *CacheSystem) Lease(ctx context.Context, bucket, key string, ttl, wait time.Duration) (LeaseResult, error) {
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	deadline := time.Now().Add(wait)
+	k := [2]string{bucket, key}
+	for {
+		v, found, err := cs.LookupValue(bucket, key)
+		if err != nil || found {
+			return LeaseResult{Value: v, Found: found}, err
+		}
+
+		now := time.Now()
+		cs.leaseMu.Lock()
+		l := cs.leases[k]
+		if l == nil || !now.Before(l.expires) {
+			token, err := leaseToken()
+			if err != nil {
+				cs.leaseMu.Unlock()
+				return LeaseResult{}, err
+			}
+			if l != nil {
+				close(l.done)
+			} else {
+				cs.leased.Add(1)
+			}
+			l = &lease{token: token, expires: now.Add(ttl), done: make(chan struct{})}
+			if cs.leases == nil {
+				cs.leases = make(map[[2]string]*lease)
+			}
+			cs.leases[k] = l
+			cs.leaseMu.Unlock()
+			return LeaseResult{Token: token, Expires: l.expires}, nil
+		}
+		cs.leaseMu.Unlock()
+
+		if !now.Before(deadline) {
+			return LeaseResult{Expires: l.expires}, nil
+		}
+		timer := time.NewTimer(min(l.expires.Sub(now), deadline.Sub(now)))
+		select {
+		case <-l.done:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return LeaseResult{}, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// ReleaseLease gives up a lease without writing the key, e.g. because
+// computing the value failed, so that a waiting client can take over.
+func (cs *CacheSystem) ReleaseLease(bucket, key, token string) error {
+	cs.leaseMu.Lock()
+	defer cs.leaseMu.Unlock()
+	k := [2]string{bucket, key}
+	l := cs.leases[k]
+	if l == nil || l.token != token || !time.Now().Before(l.expires) {
+		return ErrLeaseNotHeld
+	}
+	delete(cs.leases, k)
+	cs.leased.Add(-1)
+	close(l.done)
+	return nil
+}
+
+// endLease ends any lease on bucket/key, waking the clients waiting on it,
+// once the key has been written.
+func (cs *CacheSystem) endLease(bucket, key string) {
+	cs.leaseMu.Lock()
+	defer cs.leaseMu.Unlock()
+	k := [2]string{bucket, key}
+	if l := cs.leases[k]; l != nil {
+		delete(cs.leases, k)
+		cs.leased.Add(-1)
+		close(l.done)
+	}
+}
+
+// pruneLeases forgets leases that expired without anyone asking again.
+func (cs *CacheSystem) pruneLeases(now time.Time) {
+	cs.leaseMu.Lock()
+	defer cs.leaseMu.Unlock()
+	for k, l := range cs.leases {
+		if !now.Before(l.expires) {
+			delete(cs.leases, k)
+			cs.leased.Add(-1)
+			close(l.done)
+		}
+	}
+}
+
+func leaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// leaseRequest is the optional body of POST {key}/lease.
+type leaseRequest struct {
+	TTL  jsonTTL `json:"ttl"`  // how long a granted lease lasts; 0 or absent for defaultLeaseTTL
+	Wait jsonTTL `json:"wait"` // how long to wait for another client's lease; 0 to poll
+}
+
+// serveKeyLease handles POST {key}/lease, which returns the key's value or a
+// lease to compute it, and DELETE {key}/lease?token=, which releases one.
+func serveKeyLease(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket, key, original string) {
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodDelete:
+		if err := cache.ReleaseLease(bucket, key, r.URL.Query().Get("token")); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeMethodNotAllowed(w, http.MethodPost, http.MethodDelete)
+		return
+	}
+
+	var req leaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TTL < 0 || req.Wait < 0 {
+		writeError(w, http.StatusBadRequest, "ttl and wait must not be negative")
+		return
+	}
+	if storedForOther(cache, bucket, key, original) {
+		writeCacheError(w, ErrKeyCollision)
+		return
+	}
+	res, err := cache.Lease(r.Context(), bucket, key, time.Duration(req.TTL), min(time.Duration(req.Wait), maxLeaseWait))
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case res.Found:
+		val := res.Value.Value
+		if res.Value.Encoding == encodingGzip {
+			if val, err = gunzip(val); err != nil {
+				writeError(w, http.StatusInternalServerError, "stored value does not decompress: "+err.Error())
+				return
+			}
+		}
+		w.Header().Set("ETag", etag(res.Value.Version))
+		_ = json.NewEncoder(w).Encode(map[string]string{"value": val})
+	case res.Token != "":
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"lease": res.Token, "expires_at": res.Expires})
+	default:
+		// Another client is computing the value; ask again shortly.
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"leased": true, "expires_at": res.Expires})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTP_Lease(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	lease := func(key, body string) (int, map[string]interface{}) {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/buckets/b/"+key+"/lease", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Errorf("POST lease => %v", err)
+			return 0, nil
+		}
+		defer resp.Body.Close()
+		var out map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	code, first := lease("report", "")
+	token, _ := first["lease"].(string)
+	if code != http.StatusCreated || token == "" {
+		t.Fatalf("expected the first client to get a lease, got %d %v", code, first)
+	}
+	if code, _ := lease("report", ""); code != http.StatusAccepted {
+		t.Fatalf("expected a polling client to be told to come back, got %d", code)
+	}
+
+	// A waiting client gets the value as soon as the lease holder writes it
+	got := make(chan map[string]interface{})
+	go func() {
+		code, body := lease("report", `{"wait":"5s"}`)
+		if code != http.StatusOK {
+			t.Errorf("expected the waiter to get the value, got %d %v", code, body)
+		}
+		got <- body
+	}()
+	time.Sleep(20 * time.Millisecond)
+	resp, err := httpPut(server.URL+"/buckets/b/report", "application/json", strings.NewReader(`{"value":"computed"}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT => %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	select {
+	case body := <-got:
+		if body["value"] != "computed" {
+			t.Fatalf("expected the computed value, got %v", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the waiter to wake up on the write")
+	}
+
+	// Releasing a lease hands it to a waiting client
+	_, first = lease("other", "")
+	token, _ = first["lease"].(string)
+	go func() {
+		code, body := lease("other", `{"wait":"5s"}`)
+		if code != http.StatusCreated || body["lease"] == token {
+			t.Errorf("expected the waiter to get a new lease, got %d %v", code, body)
+		}
+		got <- body
+	}()
+	time.Sleep(20 * time.Millisecond)
+	release := func(token string) int {
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+"/buckets/b/other/lease?token="+token, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("DELETE lease => %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := release("wrong"); code != http.StatusConflict {
+		t.Fatalf("expected a wrong token to be refused, got %d", code)
+	}
+	if code := release(token); code != http.StatusNoContent {
+		t.Fatalf("expected the lease to be released, got %d", code)
+	}
+	select {
+	case <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the waiter to wake up on the release")
+	}
+
+	if code, _ := lease("report", `{"wait":-1}`); code != http.StatusBadRequest {
+		t.Fatalf("expected a negative wait to be refused, got %d", code)
+	}
+}
+
+func TestCacheSystem_LeaseExpires(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	ctx := context.Background()
+
+	first, err := cache.Lease(ctx, "b", "k", 20*time.Millisecond, 0)
+	if err != nil || first.Token == "" {
+		t.Fatalf("Lease => %+v, %v", first, err)
+	}
+	// The holder never writes, so a waiter takes over once the lease lapses
+	start := time.Now()
+	second, err := cache.Lease(ctx, "b", "k", time.Second, time.Second)
+	if err != nil || second.Token == "" || second.Token == first.Token {
+		t.Fatalf("expected a new lease after expiry, got %+v, %v", second, err)
+	}
+	if waited := time.Since(start); waited < 10*time.Millisecond || waited > 500*time.Millisecond {
+		t.Fatalf("expected to wait for the first lease to expire, waited %s", waited)
+	}
+	if err := cache.ReleaseLease("b", "k", first.Token); err != ErrLeaseNotHeld {
+		t.Fatalf("expected the expired lease to be gone, got %v", err)
+	}
+
+	// A canceled wait returns early
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := cache.Lease(ctx, "b", "k", 0, time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to end with the context, got %v", err)
+	}
+
+	cache.pruneLeases(time.Now().Add(2 * time.Second))
+	if n := cache.leased.Load(); n != 0 {
+		t.Fatalf("expected expired leases to be pruned, %d left", n)
+	}
+}
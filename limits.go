@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Reasons a request can be rejected by RequestLimits.
+const (
+	rejectBody   = "body"
+	rejectHeader = "header"
+	rejectURL    = "url"
+)
+
+// RequestLimits caps the size of incoming requests before any handler reads them.
+// A zero limit means unlimited.
+type RequestLimits struct {
+	MaxBodySize      int64            // default cap on request bodies (bytes)
+	EndpointBodySize map[string]int64 // per endpoint class overrides, see endpointClass
+	MaxHeaderSize    int              // cap on the summed size of header names and values
+	MaxURLLength     int              // cap on the length of the request URI
+
+	bodyRejects   int64
+	headerRejects int64
+	urlRejects    int64
+}
+
+// endpointClass groups request paths for per-endpoint body limits.
+func endpointClass(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/buckets/") && strings.HasSuffix(path, "/config"):
+		return "config"
+	case strings.HasPrefix(path, "/buckets/") && !strings.Contains(path[len("/buckets/"):], "/"), path == "/mset", path == "/mget", path == "/mdelete", path == "/imports":
+		return "bulk"
+	case strings.HasPrefix(path, "/keys/"), strings.HasPrefix(path, "/buckets/"), strings.HasPrefix(path, "/counters/"), strings.HasPrefix(path, "/lists/"), strings.HasPrefix(path, "/hashes/"), strings.HasPrefix(path, "/zsets/"),
+		strings.HasPrefix(path, "/json/"), strings.HasPrefix(path, "/hlls/"), strings.HasPrefix(path, "/blooms/"),
+		strings.HasPrefix(path, "/bitmaps/"), strings.HasPrefix(path, "/ratelimit/"),
+		strings.HasPrefix(path, "/semaphores/"):
+		return "keys"
+	default:
+		return "other"
+	}
+}
+
+// bodyLimit returns the body cap that applies to path.
+func (l *RequestLimits) bodyLimit(path string) int64 {
+	if n, ok := l.EndpointBodySize[endpointClass(path)]; ok {
+		return n
+	}
+	return l.MaxBodySize
+}
+
+// Rejects returns how many requests were refused for each reason.
+func (l *RequestLimits) Rejects() map[string]int64 {
+	return map[string]int64{
+		rejectBody:   atomic.LoadInt64(&l.bodyRejects),
+		rejectHeader: atomic.LoadInt64(&l.headerRejects),
+		rejectURL:    atomic.LoadInt64(&l.urlRejects),
+	}
+}
+
+func (l *RequestLimits) reject(w http.ResponseWriter, r *http.Request, counter *int64, status int, msg string) {
+	atomic.AddInt64(counter, 1)
+	log.Printf("rejected %s %.64s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, msg)
+	writeError(w, status, msg)
+}
+
+// Middleware enforces the limits in front of next.
+func (l *RequestLimits) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.MaxURLLength > 0 && len(r.RequestURI) > l.MaxURLLength {
+			l.reject(w, r, &l.urlRejects, http.StatusRequestURITooLong,
+				fmt.Sprintf("request URI exceeds %d bytes", l.MaxURLLength))
+			return
+		}
+
+		if l.MaxHeaderSize > 0 {
+			size := 0
+			for name, values := range r.Header {
+				for _, v := range values {
+					size += len(name) + len(v)
+				}
+			}
+			if size > l.MaxHeaderSize {
+				l.reject(w, r, &l.headerRejects, http.StatusRequestHeaderFieldsTooLarge,
+					fmt.Sprintf("request headers exceed %d bytes", l.MaxHeaderSize))
+				return
+			}
+		}
+
+		if limit := l.bodyLimit(r.URL.Path); limit > 0 {
+			// Refuse up front when the client announces an oversized body,
+			// otherwise stop reading as soon as the cap is crossed.
+			if r.ContentLength > limit {
+				l.reject(w, r, &l.bodyRejects, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("request body exceeds %d bytes", limit))
+				return
+			}
+			r.Body = &limitedBody{
+				ReadCloser: http.MaxBytesReader(w, r.Body, limit),
+				limit:      limit,
+				onLimit:    func() { atomic.AddInt64(&l.bodyRejects, 1) },
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody counts a reject the first time the wrapped MaxBytesReader trips.
+type limitedBody struct {
+	io.ReadCloser
+	limit   int64 // the MaxBytesReader's limit
+	onLimit func()
+	tripped bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if err != nil && errors.As(err, &tooLarge) {
+		b.trip()
+	}
+	return n, err
+}
+
+// trip counts the reject, unless it already has been.
+func (b *limitedBody) trip() {
+	if !b.tripped {
+		b.tripped = true
+		b.onLimit()
+	}
+}
+
+// parseEndpointLimits parses "class=bytes,class=bytes" into a map.
+func parseEndpointLimits(s string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	if s == "" {
+		return limits, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		class, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid endpoint limit %q, expected class=bytes", pair)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid byte count in endpoint limit %q", pair)
+		}
+		limits[class] = n
+	}
+	return limits, nil
+}
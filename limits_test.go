@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLimits(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	limits := &RequestLimits{
+		MaxBodySize:      64,
+		EndpointBodySize: map[string]int64{"config": 16},
+		MaxHeaderSize:    512,
+		MaxURLLength:     128,
+	}
+	server := httptest.NewServer(limits.Middleware(createHandler(cache, "__root__")))
+	defer server.Close()
+
+	expectError := func(resp *http.Response, status int) {
+		t.Helper()
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("expected %d, got %d", status, resp.StatusCode)
+		}
+		var envelope map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil || envelope["error"] == "" {
+			t.Fatalf("expected JSON error envelope, got err=%v body=%v", err, envelope)
+		}
+	}
+
+	// Within limits => OK
+	resp, err := httpPut(server.URL+"/keys/small", "application/json", strings.NewReader(`{"value":"ok"}`))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT small => expected 200, got %d", resp.StatusCode)
+	}
+
+	// Oversized body with Content-Length => 413
+	big := `{"value":"` + strings.Repeat("x", 100) + `"}`
+	resp, err = httpPut(server.URL+"/keys/big", "application/json", strings.NewReader(big))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	expectError(resp, http.StatusRequestEntityTooLarge)
+
+	// Oversized chunked body (no Content-Length) => 413
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/keys/big", io.MultiReader(strings.NewReader(big)))
+	req.ContentLength = -1
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT chunked => %v", err)
+	}
+	expectError(resp, http.StatusRequestEntityTooLarge)
+
+	// Per-endpoint override applies to config
+	resp, err = httpPut(server.URL+"/buckets/b/config", "application/json", bytes.NewReader([]byte(`{"codec":"json","schema_mode":"warn"}`)))
+	if err != nil {
+		t.Fatalf("PUT config => %v", err)
+	}
+	expectError(resp, http.StatusRequestEntityTooLarge)
+
+	// A small gzip body that inflates past the limit => 413
+	bomb := gzipBytes(t, `{"value":"`+strings.Repeat("x", 10_000)+`"}`)
+	if len(bomb) > 64 {
+		t.Fatalf("expected the compressed body to fit the limit, got %d bytes", len(bomb))
+	}
+	req, _ = http.NewRequest(http.MethodPut, server.URL+"/keys/bomb", bytes.NewReader(bomb))
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT gzip => %v", err)
+	}
+	expectError(resp, http.StatusRequestEntityTooLarge)
+	if cache.Get("__root__", "bomb") != "" {
+		t.Fatalf("expected nothing stored from an oversized gzip body")
+	}
+
+	// Oversized headers => 431
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/keys/small", nil)
+	req.Header.Set("X-Padding", strings.Repeat("p", 600))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	expectError(resp, http.StatusRequestHeaderFieldsTooLarge)
+
+	// Overlong URL => 414
+	resp, err = http.Get(server.URL + "/keys/" + strings.Repeat("k", 200))
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	expectError(resp, http.StatusRequestURITooLong)
+
+	rejects := limits.Rejects()
+	if rejects[rejectBody] != 4 || rejects[rejectHeader] != 1 || rejects[rejectURL] != 1 {
+		t.Fatalf("unexpected reject counts: %v", rejects)
+	}
+}
+
+func TestParseEndpointLimits(t *testing.T) {
+	limits, err := parseEndpointLimits("keys=1024, config=64")
+	if err != nil {
+		t.Fatalf("parse => %v", err)
+	}
+	if limits["keys"] != 1024 || limits["config"] != 64 {
+		t.Fatalf("unexpected limits: %v", limits)
+	}
+	if _, err := parseEndpointLimits("keys"); err == nil {
+		t.Fatalf("expected error for missing '='")
+	}
+	if _, err := parseEndpointLimits("keys=-1"); err == nil {
+		t.Fatalf("expected error for negative limit")
+	}
+}
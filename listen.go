@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// listenAddrs resolves -host and -port into the addresses to listen on. -host
+// is a comma-separated list of IP addresses (IPv6 with or without brackets,
+// with a zone if link-local), host names and network interface names. An
+// interface contributes every address it has, so "eth0" covers both stacks.
+func (cfg *serverConfig) listenAddrs() ([]string, error) {
+	port := strconv.FormatInt(cfg.Port, 10)
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, h := range strings.Split(cfg.Host, ",") {
+		h = strings.TrimSpace(h)
+		hosts, err := resolveHost(h)
+		if err != nil {
+			return nil, fmt.Errorf("-host %q: %v", h, err)
+		}
+		for _, host := range hosts {
+			if addr := net.JoinHostPort(host, port); !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// resolveHost returns the hosts one -host entry stands for. Names that are
+// neither an interface nor resolvable are rejected here, so a typo fails at
+// startup with a clear error instead of as a DNS failure from the listener.
+func resolveHost(h string) ([]string, error) {
+	if h == "" {
+		return nil, errors.New("empty address")
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")); err == nil {
+		return []string{addr.String()}, nil
+	}
+	if ifi, err := net.InterfaceByName(h); err == nil {
+		return interfaceHosts(ifi)
+	}
+	if _, err := net.LookupHost(h); err != nil {
+		return nil, errors.New("not an IP address, network interface or resolvable host name")
+	}
+	return []string{h}, nil
+}
+
+// interfaceHosts returns the IP addresses of ifi, which must be up.
+func interfaceHosts(ifi *net.Interface) ([]string, error) {
+	if ifi.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", ifi.Name)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %v", ifi.Name, err)
+	}
+	var hosts []string
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		host := ipnet.IP.String()
+		if ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+			host += "%" + ifi.Name // link-local addresses only bind with their zone
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("interface %s has no IP addresses", ifi.Name)
+	}
+	return hosts, nil
+}
+
+// listenAll opens a TCP listener on each of addrs. If any fails, those
+// already open are closed, so a partial bind never goes unnoticed.
+func listenAll(addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListenAddrs(t *testing.T) {
+	cfg := serverConfig{Host: "127.0.0.1, [::1],::1,localhost", Port: 8080}
+	addrs, err := cfg.listenAddrs()
+	if err != nil {
+		t.Fatalf("listenAddrs => %v", err)
+	}
+	if want := []string{"127.0.0.1:8080", "[::1]:8080", "localhost:8080"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("listenAddrs => %v, want %v", addrs, want)
+	}
+
+	// An interface stands for each of its addresses
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback == 0 || ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		cfg.Host = ifi.Name
+		addrs, err := cfg.listenAddrs()
+		if err != nil || len(addrs) == 0 {
+			t.Fatalf("listenAddrs(%s) => %v, %v", ifi.Name, addrs, err)
+		}
+		for _, addr := range addrs {
+			host, _, _ := net.SplitHostPort(addr)
+			if ip := net.ParseIP(strings.Split(host, "%")[0]); ip == nil || !ip.IsLoopback() {
+				t.Fatalf("expected loopback addresses for %s, got %v", ifi.Name, addrs)
+			}
+		}
+		break
+	}
+
+	for _, host := range []string{"127.0.0.1,", "not a host!", "[localhost]"} {
+		cfg.Host = host
+		if _, err := cfg.listenAddrs(); err == nil || !strings.Contains(err.Error(), "-host") {
+			t.Fatalf("expected an error naming -host for %q, got %v", host, err)
+		}
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen => %v", err)
+	}
+	defer held.Close()
+
+	if _, err := listenAll([]string{"127.0.0.1:0", held.Addr().String()}); err == nil {
+		t.Fatalf("expected binding a held port to fail")
+	}
+	listeners, err := listenAll([]string{"127.0.0.1:0", "127.0.0.1:0"})
+	if err != nil || len(listeners) != 2 {
+		t.Fatalf("listenAll => %v, %v", listeners, err)
+	}
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
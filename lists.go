@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotList is returned by the list operations when the key holds
+// something other than a list.
+var ErrNotList = errors.New("value is not a list")
+
+// maxListPop bounds how many values one pop may take.
+const maxListPop = 1000
+
+// ListOptions controls a push onto a list. Lists are entries holding a JSON
+// array of strings, so they count towards the cache size, bucket quotas and
+// -max-entry-size, are evicted like any other entry, and are readable as
+// ordinary keys. Each operation rewrites the whole array, so lists suit
+// queues of modest length rather than millions of items.
+type ListOptions struct {
+	WriteOptions
+	// TTL, if set, restarts the list's expiration. Otherwise a new list gets
+	// the default TTL and an existing one keeps its own.
+	TTL time.Duration
+	// MaxLen, if positive, caps the list's length: after the push, values
+	// are dropped from the other end until it fits.
+	MaxLen int
+}
+
+// PushList adds values to the front of the list, in the order given, so the
+// last one ends up first, or to its back. A missing list is created. It
+// returns the new length.
+func (cs *CacheSystem) PushList(bucket, key string, values []string, front bool, opts ListOptions) (int, error) {
+	if err := cs.lock(); err != nil {
+		return 0, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return 0, err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	list, err := decodeList(entry)
+	if err != nil {
+		return 0, err
+	}
+	if front {
+		pushed := slices.Clone(values)
+		slices.Reverse(pushed)
+		list = append(pushed, list...)
+	} else {
+		list = append(list, values...)
+	}
+	if opts.MaxLen > 0 && len(list) > opts.MaxLen {
+		if front {
+			list = list[:opts.MaxLen]
+		} else {
+			list = list[len(list)-opts.MaxLen:]
+		}
+	}
+
+	value, _ := json.Marshal(list)
+	if err := cs.rewriteLocked(bucket, key, entry, string(value), opts.TTL, opts.WriteOptions, s); err != nil {
+		return 0, err
+	}
+	return len(list), nil
+}
+
+// PopList removes and returns up to n values from the front or back of the
+// list, nearest the end first. Popping the last value deletes the list; a
+// missing list pops nothing. Like GetDel, exactly one of several racing
+// clients gets each value.
+func (cs *CacheSystem) PopList(bucket, key string, n int, front bool, opts WriteOptions) ([]string, error) {
+	if err := cs.lock(); err != nil {
+		return nil, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return nil, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	list, err := decodeList(entry)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	n = min(n, len(list))
+	var popped []string
+	if front {
+		popped, list = list[:n], list[n:]
+	} else {
+		popped, list = slices.Clone(list[len(list)-n:]), list[:len(list)-n]
+		slices.Reverse(popped)
+	}
+
+	elem := cs.items[[2]string{bucket, key}]
+	if len(list) == 0 {
+		cs.emit(EventDelete, bucket, key, "")
+		cs.removeElement(elem)
+		return popped, nil
+	}
+	value, _ := json.Marshal(list)
+	cs.replaceValueLocked(elem, string(value), opts.Writer)
+	return popped, nil
+}
+
+// ListRange returns the values of the list from index start to stop,
+// inclusive, along with its length. Negative indexes count from the end, so
+// 0 and -1 return the whole list. It reads the list like LookupValue but
+// never from the loader.
+func (cs *CacheSystem) ListRange(bucket, key string, start, stop int) ([]string, int, bool, error) {
+	v, found, err := cs.lookupCachedValue(bucket, key)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	list, err := decodeList(&CacheEntry{Value: v.Value, Encoding: v.Encoding})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	lo, hi := indexRange(len(list), start, stop)
+	return list[lo:hi], len(list), true, nil
+}
+
+// indexRange resolves the inclusive range of indexes start to stop, where
+// negative ones count from the end, against a sequence of length n, as the
+// half-open range lo to hi, which is empty if nothing falls within it.
+func indexRange(n, start, stop int) (lo, hi int) {
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+// decodeList returns the list entry holds, which is empty for a nil entry.
+func decodeList(entry *CacheEntry) ([]string, error) {
+	if entry == nil {
+		return nil, nil
+	}
+	if entry.Encoding != "" || !strings.HasPrefix(entry.Value, "[") {
+		return nil, ErrNotList
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(entry.Value), &list); err != nil {
+		return nil, ErrNotList
+	}
+	return list, nil
+}
+
+// listRequest is the optional body of the list endpoints.
+type listRequest struct {
+	Values []string `json:"values"`  // push: the values to add
+	TTL    jsonTTL  `json:"ttl"`     // push: restarts the expiration if set
+	MaxLen int      `json:"max_len"` // push: caps the length, trimming the other end
+	Count  int      `json:"count"`   // pop: how many values to take, 1 if absent
+}
+
+// serveList handles the list endpoints:
+//
+//	GET    /lists/{bucket}/{key}?start=&stop= => {"values": [...], "length": n}
+//	DELETE /lists/{bucket}/{key}              => remove
+//	POST   /lists/{bucket}/{key}/lpush        => {"values": [...], "ttl": ..., "max_len": n}
+//	POST   /lists/{bucket}/{key}/rpush        => likewise, at the back
+//	POST   /lists/{bucket}/{key}/lpop         => {"count": n}
+//	POST   /lists/{bucket}/{key}/rpop         => likewise, from the back
+//
+// In buckets with HashKeys, the key is hashed like any other.
+func serveList(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, key, _ := strings.Cut(r.URL.Path[len("/lists/"):], "/")
+	action := ""
+	if i := strings.LastIndexByte(key, '/'); i > 0 {
+		switch key[i+1:] {
+		case "lpush", "rpush", "lpop", "rpop":
+			key, action = key[:i], key[i+1:]
+		}
+	}
+	if bucket == "" || key == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	key, _ = storedKey(cache.GetBucketConfig(bucket), key)
+
+	allowed := []string{http.MethodGet, http.MethodDelete}
+	if action != "" {
+		allowed = []string{http.MethodPost}
+	}
+	if !slices.Contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, allowed...)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		start, stop := 0, -1
+		var err error
+		if s := r.URL.Query().Get("start"); s != "" {
+			if start, err = strconv.Atoi(s); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid start: "+s)
+				return
+			}
+		}
+		if s := r.URL.Query().Get("stop"); s != "" {
+			if stop, err = strconv.Atoi(s); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid stop: "+s)
+				return
+			}
+		}
+		values, n, found, err := cache.ListRange(bucket, key, start, stop)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"values": values, "length": n})
+		return
+	case http.MethodDelete:
+		if _, err := cache.Delete(bucket, key); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req listRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	front := action[0] == 'l'
+	w.Header().Set("Content-Type", "application/json")
+	switch action {
+	case "lpush", "rpush":
+		if len(req.Values) == 0 {
+			writeError(w, http.StatusBadRequest, "values must not be empty")
+			return
+		}
+		if req.TTL < 0 || req.MaxLen < 0 {
+			writeError(w, http.StatusBadRequest, "ttl and max_len must not be negative")
+			return
+		}
+		opts := ListOptions{WriteOptions: writeOptions(r), TTL: time.Duration(req.TTL), MaxLen: req.MaxLen}
+		n, err := cache.PushList(bucket, key, req.Values, front, opts)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]int{"length": n})
+	default:
+		if req.Count == 0 {
+			req.Count = 1
+		}
+		if req.Count < 0 || req.Count > maxListPop {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("count must be between 1 and %d", maxListPop))
+			return
+		}
+		values, err := cache.PopList(bucket, key, req.Count, front, writeOptions(r))
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		if len(values) == 0 {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]string{"values": values})
+	}
+}
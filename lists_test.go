@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_List(t *testing.T) {
+	cache := NewCacheSystem(64, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	if n, err := cache.PushList("b", "q", []string{"a", "b"}, false, ListOptions{}); err != nil || n != 2 {
+		t.Fatalf("PushList => %d, %v", n, err)
+	}
+	if n, _ := cache.PushList("b", "q", []string{"y", "z"}, true, ListOptions{}); n != 4 {
+		t.Fatalf("expected 4, got %d", n)
+	}
+	for _, c := range []struct {
+		start, stop int
+		want        string
+	}{{0, -1, "z,y,a,b"}, {1, 2, "y,a"}, {-2, -1, "a,b"}, {-10, 0, "z"}, {3, 10, "b"}, {2, 1, ""}} {
+		values, n, found, err := cache.ListRange("b", "q", c.start, c.stop)
+		if err != nil || !found || n != 4 || strings.Join(values, ",") != c.want {
+			t.Fatalf("ListRange(%d, %d) => %v, %d, %v, %v; want %s", c.start, c.stop, values, n, found, err, c.want)
+		}
+	}
+
+	if values, _ := cache.PopList("b", "q", 1, true, WriteOptions{}); strings.Join(values, ",") != "z" {
+		t.Fatalf("expected to pop z, got %v", values)
+	}
+	if values, _ := cache.PopList("b", "q", 2, false, WriteOptions{}); strings.Join(values, ",") != "b,a" {
+		t.Fatalf("expected to pop b,a, got %v", values)
+	}
+	if values, _ := cache.PopList("b", "q", 5, false, WriteOptions{}); strings.Join(values, ",") != "y" {
+		t.Fatalf("expected to pop y, got %v", values)
+	}
+	if _, _, found, _ := cache.ListRange("b", "q", 0, -1); found {
+		t.Fatalf("expected popping the last value to delete the list")
+	}
+	if values, err := cache.PopList("b", "q", 1, true, WriteOptions{}); err != nil || len(values) != 0 {
+		t.Fatalf("expected popping a missing list to pop nothing, got %v, %v", values, err)
+	}
+
+	// Capped lists drop from the other end
+	cache.PushList("b", "log", []string{"1", "2", "3"}, false, ListOptions{MaxLen: 2, TTL: time.Hour})
+	if values, _, _, _ := cache.ListRange("b", "log", 0, -1); strings.Join(values, ",") != "2,3" {
+		t.Fatalf("expected the front to be trimmed, got %v", values)
+	}
+	cache.PushList("b", "log", []string{"0"}, true, ListOptions{MaxLen: 2})
+	if values, _, _, _ := cache.ListRange("b", "log", 0, -1); strings.Join(values, ",") != "0,2" {
+		t.Fatalf("expected the back to be trimmed, got %v", values)
+	}
+	if ttl, _ := cache.TTL("b", "log"); ttl <= time.Minute {
+		t.Fatalf("expected the list to keep its TTL, got %v", ttl)
+	}
+
+	// Lists are sized like any other entry
+	if _, err := cache.PushList("b", "log", []string{strings.Repeat("x", 64)}, false, ListOptions{}); !errors.Is(err, ErrEntryTooLarge) {
+		t.Fatalf("expected ErrEntryTooLarge, got %v", err)
+	}
+	if got := cache.Get("b", "log"); got != `["0","2"]` {
+		t.Fatalf("expected a failed push to leave the list alone, got %s", got)
+	}
+
+	cache.Set("b", "word", "hello")
+	if _, err := cache.PushList("b", "word", []string{"a"}, false, ListOptions{}); !errors.Is(err, ErrNotList) {
+		t.Fatalf("expected ErrNotList, got %v", err)
+	}
+	if _, err := cache.PopList("b", "word", 1, false, WriteOptions{}); !errors.Is(err, ErrNotList) {
+		t.Fatalf("expected ErrNotList, got %v", err)
+	}
+}
+
+func TestCacheSystem_ListQueue(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		cache.PushList("b", "jobs", []string{strings.Repeat("j", i%7+1)}, false, ListOptions{})
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	taken := 0
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				values, _ := cache.PopList("b", "jobs", 3, true, WriteOptions{})
+				if len(values) == 0 {
+					return
+				}
+				mu.Lock()
+				taken += len(values)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != n {
+		t.Fatalf("expected every value to be popped exactly once, got %d of %d", taken, n)
+	}
+}
+
+func TestHTTP_Lists(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	if resp, out := httpJSON(t, "POST", server.URL+"/lists/b/q/rpush", `{"values":["a","b","c"]}`); resp.StatusCode != http.StatusOK || out["length"] != 3.0 {
+		t.Fatalf("expected rpush to create the list, got %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "POST", server.URL+"/lists/b/q/lpush", `{"values":["x"],"max_len":3}`); resp.StatusCode != http.StatusOK || out["length"] != 3.0 {
+		t.Fatalf("expected lpush to cap the list, got %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "GET", server.URL+"/lists/b/q", ""); resp.StatusCode != http.StatusOK || out["length"] != 3.0 || len(out["values"].([]interface{})) != 3 {
+		t.Fatalf("unexpected list %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "GET", server.URL+"/lists/b/q?start=1&stop=1", ""); resp.StatusCode != http.StatusOK || out["values"].([]interface{})[0] != "a" {
+		t.Fatalf("unexpected range %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "POST", server.URL+"/lists/b/q/rpop", `{"count":2}`); resp.StatusCode != http.StatusOK || len(out["values"].([]interface{})) != 2 || out["values"].([]interface{})[0] != "b" {
+		t.Fatalf("unexpected rpop %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "POST", server.URL+"/lists/b/q/lpop", ""); resp.StatusCode != http.StatusOK || out["values"].([]interface{})[0] != "x" {
+		t.Fatalf("unexpected lpop %d %v", resp.StatusCode, out)
+	}
+	if resp, _ := httpJSON(t, "POST", server.URL+"/lists/b/q/lpop", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an empty list, got %d", resp.StatusCode)
+	}
+
+	cache.Set("b", "word", "hello")
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/lists/b/word/rpush", `{"values":["a"]}`, http.StatusConflict},
+		{"POST", "/lists/b/q/rpush", `{"values":[]}`, http.StatusBadRequest},
+		{"POST", "/lists/b/q/rpush", `{"values":["a"],"max_len":-1}`, http.StatusBadRequest},
+		{"POST", "/lists/b/q/rpop", `{"count":1001}`, http.StatusBadRequest},
+		{"GET", "/lists/b/q?start=x", "", http.StatusBadRequest},
+		{"POST", "/lists/b/big/rpush", `{"values":["` + strings.Repeat("x", 1024) + `"]}`, http.StatusRequestEntityTooLarge},
+		{"PUT", "/lists/b/q", "", http.StatusMethodNotAllowed},
+		{"GET", "/lists/b/q/rpush", "", http.StatusMethodNotAllowed},
+		{"GET", "/lists/b", "", http.StatusNotFound},
+		{"DELETE", "/lists/b/q", "", http.StatusOK},
+		{"GET", "/lists/b/q", "", http.StatusNotFound},
+	} {
+		if resp, _ := httpJSON(t, c.method, server.URL+c.path, c.body); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Loader fills the cache on a miss. Once one is set with SetLoader, a read
+// that misses calls Load, stores what it returns and returns it as a hit. In
+// buckets with HashKeys, Load is given the stored hash rather than the
+// client's key.
+type Loader interface {
+	// Load returns the value for key, and how long to cache it (0 for the
+	// default TTL). It returns ErrNotFound if there is no value, and the
+	// read then misses as usual.
+	Load(bucket, key string) (value string, ttl time.Duration, err error)
+}
+
+// LoaderFunc adapts an ordinary function to a Loader.
+type LoaderFunc func(bucket, key string) (string, time.Duration, error)
+
+func (f LoaderFunc) Load(bucket, key string) (string, time.Duration, error) {
+	return f(bucket, key)
+}
+
+// ErrNotFound is returned by a Loader for a key that has no value.
+var ErrNotFound = errors.New("not found")
+
+// LoadError reports that a Loader failed to fill a miss.
+type LoadError struct {
+	Bucket, Key string
+	Err         error
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("loading %s/%s: %v", e.Bucket, e.Key, e.Err)
+}
+
+func (e *LoadError) Unwrap() error { return e.Err }
+
+// Outcomes of a load, as counted by LoadCounts.
+const (
+	loadOK       = "ok"
+	loadNotFound = "not_found"
+	loadFailed   = "error"
+)
+
+// loadCall is a load in progress. Reads that miss the same key while it runs
+// wait for its result instead of loading again.
+type loadCall struct {
+	done  chan struct{}
+	value StoredValue
+	found bool
+	err   error
+}
+
+// SetLoader makes reads that miss fill the cache from l, or stops them from
+// doing so if l is nil.
+func (cs *CacheSystem) SetLoader(l Loader) {
+	cs.loadMu.Lock()
+	defer cs.loadMu.Unlock()
+	cs.loader = l
+	if cs.loads == nil {
+		cs.loads = make(map[[2]string]*loadCall)
+	}
+}
+
+// LoadCounts returns how many loads ended in each outcome, or nil if no
+// loader is set.
+func (cs *CacheSystem) LoadCounts() map[string]int64 {
+	cs.loadMu.Lock()
+	defer cs.loadMu.Unlock()
+	if cs.loader == nil {
+		return nil
+	}
+	return map[string]int64{
+		loadOK:       atomic.LoadInt64(&cs.loadResults[0]),
+		loadNotFound: atomic.LoadInt64(&cs.loadResults[1]),
+		loadFailed:   atomic.LoadInt64(&cs.loadResults[2]),
+	}
+}
+
+// loadMissing fills a miss of bucket/key from the loader, if there is one.
+// Concurrent misses of the same key share a single call to Load.
+func (cs *CacheSystem) loadMissing(bucket, key string) (StoredValue, bool, error) {
+	k := [2]string{bucket, key}
+	cs.loadMu.Lock()
+	l := cs.loader
+	if l == nil {
+		cs.loadMu.Unlock()
+		return StoredValue{}, false, nil
+	}
+	if c, ok := cs.loads[k]; ok {
+		cs.loadMu.Unlock()
+		<-c.done
+		return c.value, c.found, c.err
+	}
+	c := &loadCall{done: make(chan struct{})}
+	cs.loads[k] = c
+	cs.loadMu.Unlock()
+
+	defer func() {
+		cs.loadMu.Lock()
+		delete(cs.loads, k)
+		cs.loadMu.Unlock()
+		close(c.done)
+	}()
+	c.value, c.found, c.err = cs.fill(l, bucket, key)
+	return c.value, c.found, c.err
+}
+
+// fill calls l for bucket/key and stores the result.
+func (cs *CacheSystem) fill(l Loader, bucket, key string) (StoredValue, bool, error) {
+	value, ttl, err := l.Load(bucket, key)
+	if errors.Is(err, ErrNotFound) {
+		atomic.AddInt64(&cs.loadResults[1], 1)
+		return StoredValue{}, false, nil
+	}
+	if err != nil {
+		atomic.AddInt64(&cs.loadResults[2], 1)
+		return StoredValue{}, false, &LoadError{Bucket: bucket, Key: key, Err: err}
+	}
+	atomic.AddInt64(&cs.loadResults[0], 1)
+
+	// A write that landed while the load ran is newer than what was loaded.
+	res, err := cs.SetWithOptions(bucket, BulkItem{Key: key, Value: value, TTL: ttl}, WriteOptions{Mode: ModeIfNotExists, Writer: "loader"})
+	if err == nil && !res.Applied {
+		if v, found, err := cs.lookupCachedValue(bucket, key); found || err != nil {
+			return v, found, err
+		}
+	}
+	// A value that can't be kept, e.g. in a frozen bucket, is still served.
+	return StoredValue{Value: value, Version: res.Version}, true, nil
+}
+
+// httpLoader loads values from an upstream HTTP server with
+// GET {base}/{bucket}/{key}. A 200 response body is the value, cached for
+// its Cache-Control max-age if it has one; a 404 is ErrNotFound.
+type httpLoader struct {
+	base   string
+	client *http.Client
+}
+
+// newHTTPLoader checks base, a -loader-url, and returns a loader for it.
+func newHTTPLoader(base string, timeout time.Duration) (*httpLoader, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", base)
+	}
+	return &httpLoader{base: strings.TrimSuffix(base, "/"), client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (l *httpLoader) Load(bucket, key string) (string, time.Duration, error) {
+	resp, err := l.client.Get(l.base + "/" + url.PathEscape(bucket) + "/" + url.PathEscape(key))
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", 0, err
+		}
+		return string(body), maxAge(resp.Header.Get("Cache-Control")), nil
+	case http.StatusNotFound:
+		return "", 0, ErrNotFound
+	}
+	return "", 0, fmt.Errorf("upstream answered %s", resp.Status)
+}
+
+// maxAge returns the max-age directive of a Cache-Control header, or 0.
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return 0
+}
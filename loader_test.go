@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_LoaderSingleflight(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	var calls int64
+	release := make(chan struct{})
+	cache.SetLoader(LoaderFunc(func(bucket, key string) (string, time.Duration, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return bucket + "/" + key, 0, nil
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := cache.Get("b", "k"); got != "b/k" {
+				t.Errorf("expected the loaded value, got %q", got)
+			}
+		}()
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&calls) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a load to start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // let the other readers pile up
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Fatalf("expected concurrent misses to share one load, got %d", n)
+	}
+	if meta, found, _ := cache.Info("b", "k"); !found || meta.WrittenBy != "loader" {
+		t.Fatalf("expected the loaded value to be cached, got %+v", meta)
+	}
+	cache.Get("b", "k")
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Fatalf("expected a hit not to load, got %d loads", n)
+	}
+	if counts := cache.LoadCounts(); counts[loadOK] != 1 {
+		t.Fatalf("unexpected load counts %v", counts)
+	}
+}
+
+func TestCacheSystem_LoaderOutcomes(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	if cache.LoadCounts() != nil {
+		t.Fatalf("expected no load counts without a loader")
+	}
+	broken := errors.New("upstream down")
+	cache.SetLoader(LoaderFunc(func(bucket, key string) (string, time.Duration, error) {
+		switch key {
+		case "missing":
+			return "", 0, ErrNotFound
+		case "broken":
+			return "", 0, broken
+		case "raced":
+			cache.Set(bucket, key, "newer")
+		}
+		return "loaded", time.Second, nil
+	}))
+
+	if _, found, err := cache.Lookup("b", "missing"); found || err != nil {
+		t.Fatalf("expected ErrNotFound to be a plain miss, got %v, %v", found, err)
+	}
+	var loadErr *LoadError
+	if _, _, err := cache.Lookup("b", "broken"); !errors.As(err, &loadErr) || !errors.Is(err, broken) {
+		t.Fatalf("expected a LoadError wrapping the loader's, got %v", err)
+	}
+	if got := cache.Get("b", "raced"); got != "newer" {
+		t.Fatalf("expected a write made during the load to win, got %q", got)
+	}
+	cache.Get("b", "fresh")
+	if ttl, _ := cache.TTL("b", "fresh"); ttl <= 0 || ttl > time.Second {
+		t.Fatalf("expected the loader's TTL, got %s", ttl)
+	}
+	if _, found, _ := cache.Peek("b", "other"); found {
+		t.Fatalf("expected Peek not to load")
+	}
+
+	counts := cache.LoadCounts()
+	if counts[loadOK] != 2 || counts[loadNotFound] != 1 || counts[loadFailed] != 1 {
+		t.Fatalf("unexpected load counts %v", counts)
+	}
+	cache.SetLoader(nil)
+	if _, found, _ := cache.Lookup("b", "unloaded"); found {
+		t.Fatalf("expected no load once the loader is removed")
+	}
+}
+
+func TestHTTPLoader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/users/42":
+			w.Header().Set("Cache-Control", "public, max-age=30")
+			w.Write([]byte(`{"name":"ada"}`))
+		case "/users/a%2Fb":
+			w.Write([]byte("slashed"))
+		case "/users/gone":
+			http.NotFound(w, r)
+		default:
+			http.Error(w, "boom", http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	if _, err := newHTTPLoader("ftp://example.com", time.Second); err == nil {
+		t.Fatalf("expected a non-HTTP URL to be rejected")
+	}
+	l, err := newHTTPLoader(upstream.URL+"/", time.Second)
+	if err != nil {
+		t.Fatalf("newHTTPLoader => %v", err)
+	}
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.SetLoader(l)
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	for path, want := range map[string]int{
+		"/buckets/users/42":    http.StatusOK,
+		"/buckets/users/a%2Fb": http.StatusOK,
+		"/buckets/users/gone":  http.StatusOK, // a miss, as without a loader
+		"/buckets/users/error": http.StatusBadGateway,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET => %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("GET %s => expected %d, got %d", path, want, resp.StatusCode)
+		}
+	}
+	if got := cache.Get("users", "42"); got != `{"name":"ada"}` {
+		t.Fatalf("expected the upstream body to be cached, got %q", got)
+	}
+	if ttl, _ := cache.TTL("users", "42"); ttl <= 29*time.Second || ttl > 30*time.Second {
+		t.Fatalf("expected the max-age as TTL, got %s", ttl)
+	}
+	if got := cache.Get("users", "a/b"); got != "slashed" {
+		t.Fatalf("expected keys to be escaped in the upstream path, got %q", got)
+	}
+}
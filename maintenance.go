@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Heavy background tasks that a maintenance window holds back.
+const (
+	taskSweep  = "sweep"  // periodic sweeps for expired entries
+	taskExport = "export" // -distribution-export writes
+)
+
+var maintenanceTasks = []string{taskSweep, taskExport}
+
+// MaintenanceWindow is a daily span of wall-clock time to which heavy
+// background work is confined, so that full-cache sweeps and exports, which
+// hold the cache lock or walk every entry, happen off-peak. Outside the
+// window that work is skipped, unless memory pressure (Go memory in use over
+// GOMEMLIMIT) has reached ForcePressure. Reads still expire entries lazily
+// in the meantime, and work started by an operator, such as scheduled or
+// asynchronous clears, is never held back.
+type MaintenanceWindow struct {
+	Start, End    time.Duration // since midnight; an End before Start wraps past midnight
+	Location      *time.Location
+	ForcePressure float64 // 0 to never force
+
+	pressure func() float64  // runtimeMemoryPressure, replaced by tests
+	deferred [2]atomic.Int64 // by maintenanceTasks index
+}
+
+// parseMaintenanceWindow parses a -maintenance-window like "02:00-04:30",
+// in local time.
+func parseMaintenanceWindow(s string, forcePressure float64) (*MaintenanceWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("%q is not a range like 02:00-04:30", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("%q is empty", s)
+	}
+	if forcePressure < 0 || forcePressure > 1 {
+		return nil, fmt.Errorf("force pressure %g must be between 0 and 1", forcePressure)
+	}
+	return &MaintenanceWindow{Start: start, End: end, Location: time.Local, ForcePressure: forcePressure, pressure: runtimeMemoryPressure}, nil
+}
+
+// parseClock parses an HH:MM time of day into the offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day like 02:00", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Open reports whether now falls inside the window.
+func (w *MaintenanceWindow) Open(now time.Time) bool {
+	now = now.In(w.Location)
+	since := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	if w.Start < w.End {
+		return since >= w.Start && since < w.End
+	}
+	return since >= w.Start || since < w.End
+}
+
+// String describes the window for the startup log.
+func (w *MaintenanceWindow) String() string {
+	clock := func(d time.Duration) string { return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60) }
+	return fmt.Sprintf("%s-%s %s, forced at memory pressure %g", clock(w.Start), clock(w.End), w.Location, w.ForcePressure)
+}
+
+// SetMaintenanceWindow confines heavy background work to w, or lets it run
+// at any time if w is nil.
+func (cs *CacheSystem) SetMaintenanceWindow(w *MaintenanceWindow) {
+	cs.maintenance.Store(w)
+}
+
+// maintenanceAllows reports whether heavy background task may run at now,
+// and counts it as deferred if not.
+func (cs *CacheSystem) maintenanceAllows(task string, now time.Time) bool {
+	w := cs.maintenance.Load()
+	if w == nil || w.Open(now) {
+		return true
+	}
+	if w.ForcePressure > 0 && w.pressure() >= w.ForcePressure {
+		return true
+	}
+	for i, t := range maintenanceTasks {
+		if t == task {
+			w.deferred[i].Add(1)
+		}
+	}
+	return false
+}
+
+// MaintenanceDeferred returns how many runs of each heavy task were skipped
+// for falling outside the maintenance window, or nil if there is no window.
+func (cs *CacheSystem) MaintenanceDeferred() map[string]int64 {
+	w := cs.maintenance.Load()
+	if w == nil {
+		return nil
+	}
+	deferred := make(map[string]int64, len(maintenanceTasks))
+	for i, task := range maintenanceTasks {
+		deferred[task] = w.deferred[i].Load()
+	}
+	return deferred
+}
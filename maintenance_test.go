@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	for _, s := range []string{"02:00", "2am-4am", "02:00-02:00", "25:00-01:00"} {
+		if _, err := parseMaintenanceWindow(s, 0.9); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+	if _, err := parseMaintenanceWindow("02:00-04:00", 1.5); err == nil {
+		t.Fatalf("expected an error for a force pressure above 1")
+	}
+
+	w, err := parseMaintenanceWindow("22:30-02:00", 0.9)
+	if err != nil {
+		t.Fatalf("parseMaintenanceWindow => %v", err)
+	}
+	w.Location = time.UTC
+	if got := w.String(); got != "22:30-02:00 UTC, forced at memory pressure 0.9" {
+		t.Fatalf("String() = %q", got)
+	}
+	at := func(hour, min int) time.Time { return time.Date(2024, 5, 1, hour, min, 0, 0, time.UTC) }
+	for _, tc := range []struct {
+		at   time.Time
+		open bool
+	}{
+		{at(22, 29), false},
+		{at(22, 30), true},
+		{at(23, 59), true},
+		{at(1, 59), true},
+		{at(2, 0), false},
+		{at(12, 0), false},
+	} {
+		if got := w.Open(tc.at); got != tc.open {
+			t.Fatalf("Open(%s) = %v, want %v", tc.at.Format("15:04"), got, tc.open)
+		}
+	}
+}
+
+func TestCacheSystem_MaintenanceWindow(t *testing.T) {
+	cache := NewCache(CacheConfig{TTL: time.Millisecond, CleanupInterval: 10 * time.Millisecond})
+	defer cache.Stop()
+	if cache.MaintenanceDeferred() != nil {
+		t.Fatalf("expected no deferral counts without a window")
+	}
+
+	// A window that is never open now
+	now := time.Now()
+	start := time.Duration((now.Hour()+12)%24) * time.Hour
+	var pressured atomic.Bool
+	cache.SetMaintenanceWindow(&MaintenanceWindow{
+		Start: start, End: start + time.Hour, Location: time.Local, ForcePressure: 0.9,
+		pressure: func() float64 {
+			if pressured.Load() {
+				return 0.95
+			}
+			return 0
+		},
+	})
+	cache.Set("b", "k", "v")
+	time.Sleep(50 * time.Millisecond)
+	if entries, _ := cache.Usage(); entries != 1 {
+		t.Fatalf("expected the sweep to be deferred outside the window, got %d entries", entries)
+	}
+	if n := cache.MaintenanceDeferred()[taskSweep]; n == 0 {
+		t.Fatalf("expected deferred sweeps to be counted")
+	}
+	if _, found, _ := cache.Peek("b", "k"); found {
+		t.Fatalf("expected reads to keep expiring entries lazily")
+	}
+
+	// Memory pressure forces the sweep
+	cache.Set("b", "k2", "v")
+	pressured.Store(true)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if entries, _ := cache.Usage(); entries == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected memory pressure to force the sweep")
+		}
+	}
+	if !cache.maintenanceAllows(taskExport, now) {
+		t.Fatalf("expected memory pressure to let exports run too")
+	}
+}
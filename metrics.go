@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Usage returns the number of entries and their total size in bytes.
+func (cs *CacheSystem) Usage() (entries int, size int64) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.entries.Len(), cs.currentSize
+}
+
+// metricsHandler serves GET /metrics in the Prometheus text format.
+// limits, concurrency, shedding and slo may be nil when those features are
+// not in use.
+func metricsHandler(cache *CacheSystem, limits *RequestLimits, concurrency *ConcurrencyLimit, shedding *LoadShedding, slo *sloTracker, conns *ConnectionTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		entries, size := cache.Usage()
+		writeMetric(w, "kitsune_entries", "gauge", "Entries in the cache.", float64(entries))
+		writeMetric(w, "kitsune_size_bytes", "gauge", "Total size of cached entries.", float64(size))
+		writeMetric(w, "kitsune_expired_backlog", "gauge", "Expired entries found by the last cleanup sweep.", float64(cache.ExpiredBacklog()))
+		writeMetric(w, "kitsune_cleanup_interval_seconds", "gauge", "Current interval between cleanup sweeps.", cache.CleanupInterval().Seconds())
+		writeMetric(w, "kitsune_lock_timeouts_total", "counter", "Operations that gave up waiting for the cache lock.", float64(cache.LockTimeouts()))
+		writeMetric(w, "kitsune_admission_rejects_total", "counter", "New keys turned away by TinyLFU admission.", float64(cache.AdmissionRejects()))
+		writeMetric(w, "kitsune_checksum_failures_total", "counter", "Reads of values that didn't match their checksum.", float64(cache.ChecksumFailures()))
+		writeMetric(w, "kitsune_schedule_failures_total", "counter", "Scheduled clears that failed.", float64(cache.ScheduleFailures()))
+
+		if deferred := cache.MaintenanceDeferred(); deferred != nil {
+			fmt.Fprintf(w, "# HELP kitsune_maintenance_deferred_total Heavy background task runs skipped outside the maintenance window.\n# TYPE kitsune_maintenance_deferred_total counter\n")
+			for _, task := range maintenanceTasks {
+				fmt.Fprintf(w, "kitsune_maintenance_deferred_total{task=%q} %d\n", task, deferred[task])
+			}
+		}
+
+		if counts := cache.LoadCounts(); counts != nil {
+			fmt.Fprintf(w, "# HELP kitsune_loads_total Misses filled from the read-through loader, by outcome.\n# TYPE kitsune_loads_total counter\n")
+			for _, result := range []string{loadOK, loadNotFound, loadFailed} {
+				fmt.Fprintf(w, "kitsune_loads_total{result=%q} %d\n", result, counts[result])
+			}
+		}
+
+		if st, ok := cache.StoreStats(); ok {
+			fmt.Fprintf(w, "# HELP kitsune_store_writes_total Writes and deletes propagated to the backing store, by outcome.\n# TYPE kitsune_store_writes_total counter\n")
+			fmt.Fprintf(w, "kitsune_store_writes_total{result=\"ok\"} %d\n", st.Stored)
+			fmt.Fprintf(w, "kitsune_store_writes_total{result=\"error\"} %d\n", st.Failed)
+			writeMetric(w, "kitsune_store_queue_length", "gauge", "Write-behind writes not yet stored.", float64(st.Queued))
+			writeMetric(w, "kitsune_store_queue_stalls_total", "counter", "Writes that waited for room in the full write-behind queue.", float64(st.Stalls))
+		}
+
+		if limits != nil {
+			fmt.Fprintf(w, "# HELP kitsune_rejected_requests_total Requests refused by request limits.\n# TYPE kitsune_rejected_requests_total counter\n")
+			rejects := limits.Rejects()
+			reasons := make([]string, 0, len(rejects))
+			for reason := range rejects {
+				reasons = append(reasons, reason)
+			}
+			sort.Strings(reasons)
+			for _, reason := range reasons {
+				fmt.Fprintf(w, "kitsune_rejected_requests_total{reason=%q} %d\n", reason, rejects[reason])
+			}
+		}
+
+		if concurrency != nil && concurrency.Max > 0 {
+			writeMetric(w, "kitsune_inflight_requests", "gauge", "Requests being served that count against -max-concurrent-requests.", float64(concurrency.InFlight()))
+			writeMetric(w, "kitsune_overload_rejects_total", "counter", "Requests refused with 503 for lack of a concurrency slot.", float64(concurrency.Rejects()))
+		}
+
+		if shedding != nil && len(shedding.Thresholds) > 0 {
+			writeMetric(w, "kitsune_pressure", "gauge", "Pressure load shedding acts on, from 0 to 1.", shedding.Pressure())
+			fmt.Fprintf(w, "# HELP kitsune_shed_requests_total Requests turned away by load shedding.\n# TYPE kitsune_shed_requests_total counter\n")
+			shed := shedding.Shed()
+			for _, class := range shedClasses {
+				fmt.Fprintf(w, "kitsune_shed_requests_total{class=%q} %d\n", class, shed[class])
+			}
+		}
+
+		if conns != nil {
+			st := conns.Stats()
+			writeMetric(w, "kitsune_connections_open", "gauge", "Client connections open.", float64(st.Open))
+			writeMetric(w, "kitsune_connections_accepted_total", "counter", "Client connections accepted.", float64(st.Accepted))
+			writeMetric(w, "kitsune_connections_rejected_total", "counter", "Client connections closed on accept for exceeding -max-conns-per-client.", float64(st.Rejected))
+			writeMetric(w, "kitsune_connection_lifetime_seconds_mean", "gauge", "Mean lifetime of closed client connections.", st.MeanLifetime)
+		}
+
+		if slo != nil {
+			slo.writeMetrics(w, time.Now())
+			slo.latency.writeMetrics(w)
+		}
+	})
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, typ, name, value)
+}
+
+// writeMetrics writes the SLO counters, targets, burn rates and alert states.
+func (t *sloTracker) writeMetrics(w io.Writer, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	writeMetric(w, "kitsune_slo_requests_total", "counter", "Requests measured against the SLOs.", float64(t.total.total))
+	writeMetric(w, "kitsune_slo_errors_total", "counter", "Requests that failed with a 5xx status.", float64(t.total.errors))
+	writeMetric(w, "kitsune_slo_slow_requests_total", "counter", "Requests slower than the latency objective.", float64(t.total.slow))
+
+	targets := t.targets()
+	slos := make([]string, 0, len(targets))
+	for slo := range targets {
+		slos = append(slos, slo)
+	}
+	sort.Strings(slos)
+
+	fmt.Fprintf(w, "# HELP kitsune_slo_target Objective as a fraction of good requests.\n# TYPE kitsune_slo_target gauge\n")
+	for _, slo := range slos {
+		fmt.Fprintf(w, "kitsune_slo_target{slo=%q} %g\n", slo, targets[slo])
+	}
+	fmt.Fprintf(w, "# HELP kitsune_slo_burn_rate Error budget burn rate over the window (1 = on budget).\n# TYPE kitsune_slo_burn_rate gauge\n")
+	for _, slo := range slos {
+		for _, win := range sloWindows {
+			fmt.Fprintf(w, "kitsune_slo_burn_rate{slo=%q,window=%q} %g\n", slo, win.name, t.burnRateLocked(slo, targets[slo], win.minutes, now))
+		}
+	}
+	fmt.Fprintf(w, "# HELP kitsune_slo_alert_firing Whether the burn-rate alert is firing.\n# TYPE kitsune_slo_alert_firing gauge\n")
+	for _, slo := range slos {
+		firing := 0
+		if t.firing[slo] {
+			firing = 1
+		}
+		fmt.Fprintf(w, "kitsune_slo_alert_firing{slo=%q} %d\n", slo, firing)
+	}
+}
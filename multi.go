@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// msetItem is one element of a POST /mset body.
+type msetItem struct {
+	Bucket    string    `json:"bucket"` // empty means the default keyspace
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	TTL       jsonTTL   `json:"ttl"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Version   uint64    `json:"version"`
+	Cost      float64   `json:"cost"`
+	SoftTTL   jsonTTL   `json:"soft_ttl"`
+	MaxIdle   jsonTTL   `json:"max_idle"`
+}
+
+// serveMSet handles POST /mset, writing an array of entries that may span
+// buckets in one cache operation: either every entry is stored or none is.
+func serveMSet(w http.ResponseWriter, r *http.Request, cache *CacheSystem, defaultKeyspace string) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	reader, err := decodedBody(r)
+	if err != nil {
+		writeEncodingError(w, err)
+		return
+	}
+	var body []msetItem
+	if err := json.NewDecoder(cache.throttledBody(r.Context(), reader)).Decode(&body); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			err = errors.New(`body must be a JSON array of {"bucket", "key", "value", "ttl"} objects`)
+		}
+		writeBodyError(w, err)
+		return
+	}
+
+	items := make([]MultiItem, 0, len(body))
+	configs := make(map[string]BucketConfig)
+	var violations, warnings []string
+	for _, it := range body {
+		if it.Bucket == "" {
+			it.Bucket = defaultKeyspace
+		}
+		cfg, ok := configs[it.Bucket]
+		if !ok {
+			cfg = cache.GetBucketConfig(it.Bucket)
+			configs[it.Bucket] = cfg
+		}
+		bv := bulkValue{Value: it.Value, TTL: it.TTL, ExpiresAt: it.ExpiresAt, Version: it.Version, Cost: it.Cost, SoftTTL: it.SoftTTL, MaxIdle: it.MaxIdle}
+		status, msg, v, warn := checkBulkValue(cfg, it.Bucket, it.Key, bv)
+		if status != 0 {
+			writeError(w, status, it.Bucket+": "+msg)
+			return
+		}
+		for _, msg := range v {
+			violations = append(violations, it.Bucket+"/"+msg)
+		}
+		for _, msg := range warn {
+			warnings = append(warnings, it.Bucket+"/"+msg)
+		}
+		stored, original := storedKey(cfg, it.Key)
+		items = append(items, MultiItem{Bucket: it.Bucket, BulkItem: BulkItem{
+			Key: stored, Value: it.Value, TTL: time.Duration(it.TTL), ExpiresAt: it.ExpiresAt, Version: it.Version, OriginalKey: original, Cost: it.Cost, SoftTTL: time.Duration(it.SoftTTL), MaxIdle: time.Duration(it.MaxIdle),
+		}})
+	}
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		writeSchemaError(w, violations)
+		return
+	}
+
+	if err := cache.throttleBulk(r.Context(), len(items)); err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	if err := cache.MSet(items, writeOptions(r)); err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	setSchemaWarning(w, warnings)
+	w.WriteHeader(http.StatusOK)
+}
+
+// mgetResult reports one key of POST /mget.
+type mgetResult struct {
+	KeyRef
+	Found   bool   `json:"found"`
+	Value   string `json:"value,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	Stale   bool   `json:"stale,omitempty"` // past its soft TTL
+	Error   string `json:"error,omitempty"` // the miss could not be loaded, or the value failed its checksum
+}
+
+// serveMGet handles POST /mget, reading an array of {bucket, key} entries
+// that may span buckets in one cache operation, so that a caller needing
+// several buckets makes one round trip.
+func serveMGet(w http.ResponseWriter, r *http.Request, cache *CacheSystem, defaultKeyspace string) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	keys, ok := decodeKeyRefs(w, r, defaultKeyspace)
+	if !ok {
+		return
+	}
+
+	stored := make([]KeyRef, len(keys))
+	for i, k := range keys {
+		stored[i] = k
+		stored[i].Key, _ = storedKey(cache.GetBucketConfig(k.Bucket), k.Key)
+	}
+	values, err := cache.MGet(stored)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	results := make([]mgetResult, len(keys))
+	count := 0
+	for i, k := range keys {
+		v := values[i]
+		results[i] = mgetResult{KeyRef: k}
+		if v.Err != nil {
+			results[i].Error = v.Err.Error()
+			continue
+		}
+		if !v.Found || keyCollides(v.OriginalKey, k.Key) {
+			continue
+		}
+		value := v.Value
+		if v.Encoding == encodingGzip {
+			if value, err = gunzip(value); err != nil {
+				results[i].Error = "stored value does not decompress: " + err.Error()
+				continue
+			}
+		}
+		results[i].Found, results[i].Value, results[i].Version, results[i].Stale = true, value, v.Version, v.Stale
+		count++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"found": count, "results": results})
+}
+
+// decodeKeyRefs reads a JSON array of {bucket, key} objects, filling in the
+// default keyspace, and answers the request itself if the body is invalid.
+func decodeKeyRefs(w http.ResponseWriter, r *http.Request, defaultKeyspace string) ([]KeyRef, bool) {
+	var keys []KeyRef
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			err = errors.New(`body must be a JSON array of {"bucket", "key"} objects`)
+		}
+		writeBodyError(w, err)
+		return nil, false
+	}
+	for i := range keys {
+		if keys[i].Bucket == "" {
+			keys[i].Bucket = defaultKeyspace
+		}
+		if keys[i].Key == "" {
+			writeError(w, http.StatusBadRequest, keys[i].Bucket+": keys must not be empty")
+			return nil, false
+		}
+	}
+	return keys, true
+}
+
+// mdeleteResult reports the outcome for one key of POST /mdelete.
+type mdeleteResult struct {
+	KeyRef
+	Deleted bool `json:"deleted"` // false if the key was not found
+}
+
+// serveMDelete handles POST /mdelete, removing an array of {bucket, key}
+// entries in one cache operation and reporting which of them existed.
+func serveMDelete(w http.ResponseWriter, r *http.Request, cache *CacheSystem, defaultKeyspace string) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	keys, ok := decodeKeyRefs(w, r, defaultKeyspace)
+	if !ok {
+		return
+	}
+
+	// Hashed buckets are addressed by the stored key; results echo the request.
+	stored := make([]KeyRef, len(keys))
+	for i, k := range keys {
+		stored[i] = k
+		stored[i].Key, _ = storedKey(cache.GetBucketConfig(k.Bucket), k.Key)
+	}
+	deleted, err := cache.DeleteMany(stored)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	results := make([]mdeleteResult, len(keys))
+	count := 0
+	for i, k := range keys {
+		results[i] = mdeleteResult{KeyRef: k, Deleted: deleted[i]}
+		if deleted[i] {
+			count++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"deleted": count, "results": results})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTP_MSet(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	post := func(body string) int {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/mset", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST /mset => %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(`[{"bucket":"a","key":"x","value":"1"},{"bucket":"b","key":"y","value":"2","ttl":"250ms"},{"key":"z","value":"3"}]`); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	for _, c := range []struct{ bucket, key, want string }{{"a", "x", "1"}, {"b", "y", "2"}, {"__root__", "z", "3"}} {
+		if got := cache.Get(c.bucket, c.key); got != c.want {
+			t.Fatalf("expected %s/%s=%q, got %q", c.bucket, c.key, c.want, got)
+		}
+	}
+
+	// A schema violation in one bucket rejects the writes to every bucket
+	cfg := BucketConfig{Codec: "json", JSONSchema: []byte(`{"type":"object","required":["id"]}`)}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate => %v", err)
+	}
+	cache.SetBucketConfig("docs", cfg)
+	if code := post(`[{"bucket":"a","key":"new","value":"1"},{"bucket":"docs","key":"d","value":"{}"}]`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a schema violation, got %d", code)
+	}
+	if _, found, _ := cache.Lookup("a", "new"); found {
+		t.Fatalf("expected nothing stored from a rejected request")
+	}
+
+	// So does a stale version
+	if code := post(`[{"bucket":"a","key":"new","value":"1"},{"bucket":"a","key":"x","value":"9","version":12345}]`); code != http.StatusConflict {
+		t.Fatalf("expected 409 for a stale version, got %d", code)
+	}
+	if _, found, _ := cache.Lookup("a", "new"); found {
+		t.Fatalf("expected nothing stored from a conflicting request")
+	}
+}
+
+func TestCacheSystem_DeleteMany(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.Set("a", "x", "1")
+	cache.Set("b", "y", "2")
+	cache.SetWithTTL("b", "old", "3", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	deleted, err := cache.DeleteMany([]KeyRef{{"a", "x"}, {"b", "y"}, {"b", "old"}, {"b", "missing"}})
+	if err != nil {
+		t.Fatalf("DeleteMany => %v", err)
+	}
+	if want := []bool{true, true, false, false}; fmt.Sprint(deleted) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, deleted)
+	}
+	if entries, _ := cache.Usage(); entries != 0 {
+		t.Fatalf("expected every listed entry to be removed, got %d left", entries)
+	}
+}
+
+func TestHTTP_MGet(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	cache.Set("users", "42", "ada")
+	cache.Set("flags", "beta", "on")
+	cache.SetWithTTL("flags", "gone", "x", time.Millisecond)
+	cache.Set("__root__", "z", "")
+	cache.SetBucketConfig("h", BucketConfig{HashKeys: true})
+	stored, original := storedKey(cache.GetBucketConfig("h"), "long key")
+	cache.SetWithOptions("h", BulkItem{Key: stored, Value: "hashed", OriginalKey: original}, WriteOptions{})
+	time.Sleep(5 * time.Millisecond)
+
+	resp, err := http.Post(server.URL+"/mget", "application/json", strings.NewReader(
+		`[{"bucket":"users","key":"42"},{"bucket":"flags","key":"beta"},{"bucket":"flags","key":"gone"},{"key":"z"},{"bucket":"h","key":"long key"},{"bucket":"users","key":"43"}]`))
+	if err != nil {
+		t.Fatalf("POST /mget => %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Found   int          `json:"found"`
+		Results []mgetResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /mget => %d, %v", resp.StatusCode, err)
+	}
+	var got []string
+	for _, r := range body.Results {
+		got = append(got, fmt.Sprintf("%s/%s=%t:%q", r.Bucket, r.Key, r.Found, r.Value))
+	}
+	want := `users/42=true:"ada" flags/beta=true:"on" flags/gone=false:"" __root__/z=true:"" h/long key=true:"hashed" users/43=false:""`
+	if strings.Join(got, " ") != want || body.Found != 4 {
+		t.Fatalf("expected %s (4 found), got %s (%d found)", want, strings.Join(got, " "), body.Found)
+	}
+
+	// Each key counts as a read of its bucket
+	if st := cache.Stats("users"); st.Totals.Hits != 1 || st.Totals.Misses != 1 {
+		t.Fatalf("expected a hit and a miss on users, got %+v", st.Totals)
+	}
+	if st := cache.Stats("flags"); st.Totals.Expirations != 1 {
+		t.Fatalf("expected the expired key to be removed, got %+v", st.Totals)
+	}
+}
+
+func TestCacheSystem_MGetLoader(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.Set("b", "cached", "1")
+	cache.SetLoader(LoaderFunc(func(bucket, key string) (string, time.Duration, error) {
+		if key == "broken" {
+			return "", 0, errors.New("upstream down")
+		}
+		return "loaded " + key, 0, nil
+	}))
+
+	results, err := cache.MGet([]KeyRef{{Bucket: "b", Key: "cached"}, {Bucket: "b", Key: "new"}, {Bucket: "b", Key: "broken"}})
+	if err != nil {
+		t.Fatalf("MGet => %v", err)
+	}
+	if r := results[0]; !r.Found || r.Value != "1" {
+		t.Fatalf("expected the cached value, got %+v", r)
+	}
+	if r := results[1]; !r.Found || r.Value != "loaded new" {
+		t.Fatalf("expected the miss to be loaded, got %+v", r)
+	}
+	var loadErr *LoadError
+	if r := results[2]; r.Found || !errors.As(r.Err, &loadErr) {
+		t.Fatalf("expected a failed load for that key only, got %+v", r)
+	}
+}
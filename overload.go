@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Request lanes under a concurrency limit.
+const (
+	laneHealth   = "health"   // never limited
+	lanePriority = "priority" // may use the reserved slots
+	laneNormal   = "normal"
+)
+
+// ConcurrencyLimit caps how many requests are served at once, answering the
+// excess with 503 so an overloaded instance sheds load instead of queueing
+// it. Health checks are never limited, and Reserved of the Max slots are kept
+// for admin, stats and metrics requests, so operators can still inspect and
+// fix an instance that ordinary traffic has saturated. A zero Max means
+// unlimited.
+type ConcurrencyLimit struct {
+	Max      int64
+	Reserved int64
+
+	inflight int64 // atomic
+	rejects  int64 // atomic
+}
+
+// parseConcurrencyLimit checks a -max-concurrent-requests and
+// -admin-reserved-requests pair.
+func parseConcurrencyLimit(max, reserved int64) (*ConcurrencyLimit, error) {
+	switch {
+	case max < 0 || reserved < 0:
+		return nil, fmt.Errorf("limits must not be negative")
+	case max > 0 && reserved >= max:
+		return nil, fmt.Errorf("%d reserved slots leave none of %d for ordinary requests", reserved, max)
+	}
+	return &ConcurrencyLimit{Max: max, Reserved: reserved}, nil
+}
+
+// requestLane classifies r for the concurrency limit. Watch streams are
+// long-lived by design and, like health and readiness checks, are not counted.
+func requestLane(r *http.Request) string {
+	if r.URL.Path == "/" || r.URL.Path == "/readyz" || strings.HasSuffix(r.URL.Path, "/watch") {
+		return laneHealth
+	}
+	switch requestSurface(r) {
+	case "admin", "stats", "metrics":
+		return lanePriority
+	}
+	return laneNormal
+}
+
+// InFlight returns the number of requests being served that count against
+// the limit.
+func (c *ConcurrencyLimit) InFlight() int64 {
+	return atomic.LoadInt64(&c.inflight)
+}
+
+// Rejects returns how many requests were refused for lack of a slot.
+func (c *ConcurrencyLimit) Rejects() int64 {
+	return atomic.LoadInt64(&c.rejects)
+}
+
+// Middleware enforces the limit.
+func (c *ConcurrencyLimit) Middleware(next http.Handler) http.Handler {
+	if c.Max <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := c.Max - c.Reserved
+		switch requestLane(r) {
+		case laneHealth:
+			next.ServeHTTP(w, r)
+			return
+		case lanePriority:
+			limit = c.Max
+		}
+		if atomic.AddInt64(&c.inflight, 1) > limit {
+			atomic.AddInt64(&c.inflight, -1)
+			atomic.AddInt64(&c.rejects, 1)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "server overloaded, retry later")
+			return
+		}
+		defer atomic.AddInt64(&c.inflight, -1)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	c, err := parseConcurrencyLimit(3, 1)
+	if err != nil {
+		t.Fatalf("parseConcurrencyLimit => %v", err)
+	}
+	release := make(chan struct{})
+	handler := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("block") {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+	var wg sync.WaitGroup
+	hold := func(path string, want int64) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(http.MethodGet, path)
+		}()
+		for deadline := time.Now().Add(time.Second); c.InFlight() != want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d requests in flight, got %d", want, c.InFlight())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Ordinary traffic fills its two slots
+	hold("/buckets/b/k?block", 1)
+	hold("/keys/k?block", 2)
+	rec := serve(http.MethodPut, "/buckets/b/k")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After once ordinary slots are used up, got %d", rec.Code)
+	}
+	// but health checks and admin requests still get through
+	if rec := serve(http.MethodGet, "/"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the health check to pass, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/admin/jobs"); rec.Code != http.StatusOK {
+		t.Fatalf("expected an admin request to use the reserved slot, got %d", rec.Code)
+	}
+	// up to the reserved budget
+	hold("/admin/runtime?block", 3)
+	if rec := serve(http.MethodGet, "/stats"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the reserved slot is taken too, got %d", rec.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	if c.InFlight() != 0 || c.Rejects() != 2 {
+		t.Fatalf("expected no requests in flight and 2 rejects, got %d and %d", c.InFlight(), c.Rejects())
+	}
+
+	for _, bad := range [][2]int64{{2, 2}, {-1, 0}, {4, -1}} {
+		if _, err := parseConcurrencyLimit(bad[0], bad[1]); err == nil {
+			t.Fatalf("expected parseConcurrencyLimit(%d, %d) to fail", bad[0], bad[1])
+		}
+	}
+	if _, err := parseConcurrencyLimit(0, 2); err != nil {
+		t.Fatalf("expected a zero limit to be accepted, got %v", err)
+	}
+}
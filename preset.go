@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presets for -preset.
+const (
+	PresetProduction = "production"
+	PresetDev        = "dev"
+)
+
+// presetMemoryShare is the part of the memory available to the process that
+// the production preset gives -max-size. Entry bookkeeping roughly doubles
+// the footprint of the raw data (see checkMemory), so this leaves a fifth
+// for the rest of the process.
+const presetMemoryShare = 0.4
+
+// presetFlags returns the flag values preset stands for. The production
+// preset bounds -max-size by avail, the bytes the process may use, if it is
+// known.
+func presetFlags(preset string, avail int64) (map[string]string, error) {
+	switch preset {
+	case "":
+		return nil, nil
+	case PresetProduction:
+		flags := map[string]string{
+			"ttl":                 (15 * time.Minute).String(),
+			"strict-status":       "true",
+			"read-header-timeout": (5 * time.Second).String(),
+			"read-timeout":        (30 * time.Second).String(),
+			"idle-timeout":        (2 * time.Minute).String(),
+			"shutdown-timeout":    (30 * time.Second).String(),
+		}
+		if avail > 0 {
+			flags["max-size"] = strconv.FormatInt(int64(float64(avail)*presetMemoryShare), 10)
+		}
+		return flags, nil
+	case PresetDev:
+		return map[string]string{
+			"ttl":                 (15 * time.Minute).String(),
+			"strict-status":       "true",
+			"read-header-timeout": (10 * time.Second).String(),
+			"shutdown-timeout":    time.Second.String(),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown preset %q: want %s or %s", preset, PresetProduction, PresetDev)
+}
+
+// applyPreset sets the flags cfg.Preset stands for on fs, which cfg's flags
+// were registered and parsed on, except those given on the command line, so
+// any one of them can still be overridden. It returns the flags it set, as
+// name=value, for logging.
+func (cfg *serverConfig) applyPreset(fs *flag.FlagSet) ([]string, error) {
+	avail, _ := availableMemory()
+	flags, err := presetFlags(cfg.Preset, avail)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -preset: %v", err)
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var applied []string
+	for name, value := range flags {
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("-preset %s: -%s: %v", cfg.Preset, name, err)
+		}
+		applied = append(applied, name+"="+value)
+	}
+	sort.Strings(applied)
+	return applied, nil
+}
+
+// describePreset renders what applyPreset set, for the startup log.
+func describePreset(preset string, applied []string) string {
+	if preset == "" {
+		return "none"
+	}
+	if len(applied) == 0 {
+		return preset + " (every flag overridden)"
+	}
+	return preset + " (" + strings.Join(applied, ", ") + ")"
+}
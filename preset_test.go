@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApplyPreset(t *testing.T) {
+	parse := func(args ...string) (*serverConfig, []string, error) {
+		t.Helper()
+		var cfg serverConfig
+		fs := flag.NewFlagSet("kitsune", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		cfg.registerFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("Parse(%v) => %v", args, err)
+		}
+		applied, err := cfg.applyPreset(fs)
+		return &cfg, applied, err
+	}
+
+	cfg, applied, err := parse()
+	if err != nil || len(applied) != 0 || cfg.TTL != DEFAULT_TTL*time.Second || cfg.StrictStatus {
+		t.Fatalf("expected no preset to change nothing, got %v, %v, %+v", applied, err, cfg)
+	}
+
+	cfg, _, err = parse("-preset", "production", "-ttl", "5m", "-strict-status=false")
+	if err != nil {
+		t.Fatalf("applyPreset => %v", err)
+	}
+	if cfg.TTL != 5*time.Minute || cfg.StrictStatus {
+		t.Fatalf("expected flags given explicitly to win, got ttl %s, strict %t", cfg.TTL, cfg.StrictStatus)
+	}
+	if cfg.ReadHeaderTimeout != 5*time.Second || cfg.ReadTimeout != 30*time.Second || cfg.ShutdownTimeout != 30*time.Second {
+		t.Fatalf("expected the preset's timeouts, got %+v", cfg)
+	}
+
+	cfg, _, _ = parse("-preset", "dev")
+	if cfg.TTL != 15*time.Minute || !cfg.StrictStatus || cfg.ShutdownTimeout != time.Second || cfg.MaxSize != DEFAULT_MAX_SIZE {
+		t.Fatalf("unexpected dev config %+v", cfg)
+	}
+
+	if _, _, err := parse("-preset", "staging"); err == nil {
+		t.Fatalf("expected an unknown preset to be rejected")
+	}
+}
+
+func TestPresetFlags_MaxSize(t *testing.T) {
+	flags, _ := presetFlags(PresetProduction, 1000)
+	if flags["max-size"] != "400" {
+		t.Fatalf("expected max-size to be bounded by available memory, got %q", flags["max-size"])
+	}
+	if flags, _ := presetFlags(PresetProduction, 0); flags["max-size"] != "" {
+		t.Fatalf("expected no max-size without a memory figure, got %q", flags["max-size"])
+	}
+}
+
+func TestHTTP_StrictStatus(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	get := func() int {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/buckets/b/missing")
+		if err != nil {
+			t.Fatalf("GET => %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected 200 by default, got %d", code)
+	}
+	cache.SetStrictStatus(true)
+	if code := get(); code != http.StatusNotFound {
+		t.Fatalf("expected 404 with strict status, got %d", code)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Forwarding headers TrustedProxies can honor.
+const (
+	headerForwardedFor = "X-Forwarded-For"
+	headerRealIP       = "X-Real-IP"
+	headerForwarded    = "Forwarded" // RFC 7239
+)
+
+// TrustedProxies finds the real client of requests relayed by reverse
+// proxies. Only peers inside CIDRs are believed, so clients connecting
+// directly can't spoof their address with a forwarding header.
+type TrustedProxies struct {
+	CIDRs   []netip.Prefix // proxies whose forwarding headers are honored
+	Headers []string       // forwarding headers to look at, first match wins
+}
+
+// parseTrustedProxies parses comma-separated CIDRs (a bare IP is a single
+// address) and header names.
+func parseTrustedProxies(cidrs, headers string) (*TrustedProxies, error) {
+	p := &TrustedProxies{}
+	for _, s := range strings.Split(cidrs, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return nil, fmt.Errorf("%q is not a CIDR or IP address", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		p.CIDRs = append(p.CIDRs, prefix.Masked())
+	}
+	for _, h := range strings.Split(headers, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		switch http.CanonicalHeaderKey(h) {
+		case http.CanonicalHeaderKey(headerForwardedFor):
+			h = headerForwardedFor
+		case http.CanonicalHeaderKey(headerRealIP):
+			h = headerRealIP
+		case headerForwarded:
+		default:
+			return nil, fmt.Errorf("unsupported forwarding header %q (want %s, %s or %s)", h, headerForwardedFor, headerRealIP, headerForwarded)
+		}
+		p.Headers = append(p.Headers, h)
+	}
+	return p, nil
+}
+
+// trusted reports whether addr is one of the proxies.
+func (p *TrustedProxies) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.CIDRs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client behind r: the first address
+// in the honored headers, read from the nearest hop back, that is not a
+// trusted proxy. A peer that is not trusted is the client itself.
+func (p *TrustedProxies) ClientIP(r *http.Request) netip.Addr {
+	peer, ok := parseHost(r.RemoteAddr)
+	if !ok || !p.trusted(peer) {
+		return peer
+	}
+	for _, h := range p.Headers {
+		var hops []string
+		switch h {
+		case headerForwarded:
+			hops = forwardedFor(r.Header.Values(h))
+		case headerRealIP:
+			hops = r.Header.Values(h)
+		default:
+			for _, v := range r.Header.Values(h) {
+				hops = append(hops, strings.Split(v, ",")...)
+			}
+		}
+		if client, ok := p.firstUntrusted(hops); ok {
+			return client
+		}
+	}
+	return peer
+}
+
+// firstUntrusted walks hops from the nearest back. It stops at an address it
+// can't parse, since the proxy that wrote it can't vouch for what is beyond.
+// If every hop is a proxy, the farthest one is the client.
+func (p *TrustedProxies) firstUntrusted(hops []string) (netip.Addr, bool) {
+	var last netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHost(strings.TrimSpace(hops[i]))
+		if !ok {
+			break
+		}
+		if !p.trusted(addr) {
+			return addr, true
+		}
+		last = addr
+	}
+	return last, last.IsValid()
+}
+
+// forwardedFor returns the for= parameters of Forwarded header values, in
+// order.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					hops = append(hops, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHost parses an IP address that may carry a port or, for IPv6,
+// brackets.
+func parseHost(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	return addr.Unmap(), err == nil
+}
+
+// Middleware replaces r.RemoteAddr with the real client address, so logging,
+// writer identity and everything else behind it see the same client.
+func (p *TrustedProxies) Middleware(next http.Handler) http.Handler {
+	if len(p.CIDRs) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer, ok := parseHost(r.RemoteAddr); ok && p.trusted(peer) {
+			r.RemoteAddr = p.ClientIP(r).String()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
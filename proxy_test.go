@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	p, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, fd00::/8", "x-forwarded-for,X-Real-IP,Forwarded")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies => %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		peer   string
+		header map[string]string
+		want   string
+	}{
+		{"direct client", "203.0.113.9:5000", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "203.0.113.9"},
+		{"no header", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"one proxy", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"spoofed leftmost hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"only proxies", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"garbage hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "nonsense, 10.0.0.2", "X-Real-IP": "198.51.100.8"}, "10.0.0.2"},
+		{"real ip", "192.168.1.1:5000", map[string]string{"X-Real-IP": "198.51.100.8"}, "198.51.100.8"},
+		{"forwarded", "[fd00::1]:5000", map[string]string{"Forwarded": `for=198.51.100.9;proto=https, for="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{"forwarded unknown", "10.0.0.1:5000", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = c.peer
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		if got := p.ClientIP(r).String(); got != c.want {
+			t.Fatalf("%s: ClientIP => %s, want %s", c.name, got, c.want)
+		}
+	}
+
+	// Headers not configured are ignored
+	p, _ = parseTrustedProxies("10.0.0.0/8", "X-Real-IP")
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if got := p.ClientIP(r).String(); got != "10.0.0.1" {
+		t.Fatalf("expected X-Forwarded-For to be ignored, got %s", got)
+	}
+
+	for _, bad := range [][2]string{{"10.0.0.0/33", ""}, {"proxy.local", ""}, {"10.0.0.0/8", "X-Client-IP"}} {
+		if _, err := parseTrustedProxies(bad[0], bad[1]); err == nil {
+			t.Fatalf("expected parseTrustedProxies(%q, %q) to fail", bad[0], bad[1])
+		}
+	}
+}
+
+func TestTrustedProxies_Middleware(t *testing.T) {
+	p, _ := parseTrustedProxies("127.0.0.1", "X-Forwarded-For")
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(p.Middleware(createHandler(cache, "__root__")))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/buckets/b/k", strings.NewReader(`{"value":"v"}`))
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if meta, _, _ := cache.Info("b", "k"); meta.WrittenBy != "198.51.100.7" {
+		t.Fatalf("expected the forwarded client as writer, got %q", meta.WrittenBy)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Overflow policies for a bucket with a quota, see BucketConfig.OnFull.
+const (
+	OnFullEvict  = "evict"  // evict the bucket's own least recently used entries
+	OnFullReject = "reject" // fail the write with a *QuotaError
+)
+
+// ErrQuotaExceeded is matched by a *QuotaError.
+var ErrQuotaExceeded = errors.New("bucket quota exceeded")
+
+// QuotaError is returned when a write would take a bucket whose OnFull is
+// "reject" past its MaxBytes.
+type QuotaError struct {
+	Bucket string `json:"bucket"`
+	Quota  int64  `json:"quota"` // the bucket's MaxBytes
+	Usage  int64  `json:"usage"` // bytes the bucket holds now
+	Need   int64  `json:"need"`  // bytes the write would add
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v: %q holds %d of %d bytes, write needs %d more", ErrQuotaExceeded, e.Bucket, e.Usage, e.Quota, e.Need)
+}
+
+func (e *QuotaError) Is(target error) bool { return target == ErrQuotaExceeded }
+
+// BucketUsage returns the bytes held by bucket, counted like the cache size:
+// bucket, key and value lengths of each entry.
+func (cs *CacheSystem) BucketUsage(bucket string) (int64, error) {
+	if err := cs.rlock(); err != nil {
+		return 0, err
+	}
+	defer cs.mu.RUnlock()
+	return cs.bucketSize[bucket], nil
+}
+
+// growthLocked returns how much storing value under key would change the
+// usage of bucket. cs.mu must be held.
+func (cs *CacheSystem) growthLocked(bucket, key, value string) int64 {
+	size := int64(len(bucket) + len(key) + len(value))
+	if elem, ok := cs.items[[2]string{bucket, key}]; ok {
+		if entry := elem.Value.(*CacheEntry); !cs.isStale(entry) {
+			size -= int64(entry.Size)
+		}
+	}
+	return size
+}
+
+// checkQuotaLocked returns a *QuotaError if writing item, unless opts.Mode
+// rules it out, would take a bucket that rejects overflow past its quota.
+// Writes that don't grow the bucket always pass, so lowering a quota never
+// blocks shrinking the bucket back under it. pending carries what earlier
+// items of the same batch add to each bucket and is updated; nil for a
+// single write. cs.mu must be held.
+func (cs *CacheSystem) checkQuotaLocked(bucket string, item BulkItem, opts WriteOptions, pending map[string]int64) error {
+	cfg := cs.GetBucketConfig(bucket)
+	if cfg.MaxBytes <= 0 || cfg.OnFull != OnFullReject || !cs.modeAllowsLocked(bucket, item.Key, opts.Mode) {
+		return nil
+	}
+	growth := cs.growthLocked(bucket, item.Key, item.Value)
+	usage := cs.bucketSize[bucket] + pending[bucket]
+	if growth > 0 && usage+growth > cfg.MaxBytes {
+		return &QuotaError{Bucket: bucket, Quota: cfg.MaxBytes, Usage: usage, Need: growth}
+	}
+	if pending != nil {
+		pending[bucket] += growth
+	}
+	return nil
+}
+
+// enforceQuotaLocked evicts entries of bucket, picked by victimLocked, until
+// it is back within its quota, if it has one and evicts on overflow. Only the
+// bucket's own entries go, so one tenant filling its bucket can't push out
+// another's. cs.mu must be held for writing.
+func (cs *CacheSystem) enforceQuotaLocked(bucket string) {
+	if cs.bucketSize[bucket] == 0 {
+		return
+	}
+	cfg := cs.GetBucketConfig(bucket)
+	if cfg.MaxBytes <= 0 || cfg.OnFull == OnFullReject {
+		return
+	}
+	for cs.bucketSize[bucket] > cfg.MaxBytes {
+		elem := cs.victimLocked(bucket)
+		if elem == nil {
+			return
+		}
+		if entry := elem.Value.(*CacheEntry); !cs.isStale(entry) {
+			cs.emit(EventEvict, entry.Bucket, entry.Key, "")
+		}
+		cs.removeElement(elem)
+	}
+}
+
+// writeQuotaError answers a write refused by a bucket quota with 507 and the
+// quota and usage, so the client can tell a full bucket from a full server.
+func writeQuotaError(w http.ResponseWriter, qe *QuotaError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInsufficientStorage)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		*QuotaError
+	}{qe.Error(), qe})
+}
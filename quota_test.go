@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCacheSystem_QuotaEvict(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	// Each entry is 1+2+4 = 7 bytes, so the bucket holds two
+	cache.SetBucketConfig("t", BucketConfig{MaxBytes: 14})
+	cache.Set("other", "k1", "aaaa")
+	cache.Set("t", "k1", "aaaa")
+	cache.Set("t", "k2", "aaaa")
+	cache.Get("t", "k1")
+	cache.Set("t", "k3", "aaaa")
+
+	if _, found, _ := cache.Lookup("t", "k2"); found {
+		t.Fatalf("expected the bucket's least recently used entry to be evicted")
+	}
+	for _, key := range []string{"k1", "k3"} {
+		if _, found, _ := cache.Lookup("t", key); !found {
+			t.Fatalf("expected %s to be kept", key)
+		}
+	}
+	if _, found, _ := cache.Lookup("other", "k1"); !found {
+		t.Fatalf("expected other buckets to be untouched by the quota")
+	}
+	if usage, _ := cache.BucketUsage("t"); usage != 14 {
+		t.Fatalf("expected usage 14, got %d", usage)
+	}
+
+	// NoEvict writes only fill what the quota has left
+	res, err := cache.SetWithOptions("t", BulkItem{Key: "k4", Value: "aaaa"}, WriteOptions{NoEvict: true})
+	if err != nil || res.Applied {
+		t.Fatalf("expected a NoEvict write past the quota to be skipped, got %+v, %v", res, err)
+	}
+
+	cache.Clear("t")
+	if usage, _ := cache.BucketUsage("t"); usage != 0 {
+		t.Fatalf("expected Clear to reset usage, got %d", usage)
+	}
+	cache.Set("t", "k1", "aaaa")
+	if usage, _ := cache.BucketUsage("t"); usage != 7 {
+		t.Fatalf("expected usage 7 after rewriting a cleared key, got %d", usage)
+	}
+}
+
+func TestCacheSystem_QuotaEvictAmongOthers(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	// Far more of other buckets' entries are older than any of the
+	// bucket's, and the bucket still evicts in its own LRU order.
+	cache.SetBucketConfig("t", BucketConfig{MaxBytes: 14})
+	for i := 0; i < 1000; i++ {
+		cache.Set("other", fmt.Sprint(i), "aaaa")
+	}
+	cache.Set("t", "k1", "aaaa")
+	cache.Set("other", "x", "aaaa")
+	cache.Set("t", "k2", "aaaa")
+	cache.Get("t", "k1")
+	cache.Set("t", "k3", "aaaa")
+	cache.Set("t", "k4", "aaaa")
+
+	for key, want := range map[string]bool{"k1": false, "k2": false, "k3": true, "k4": true} {
+		if _, found, _ := cache.Lookup("t", key); found != want {
+			t.Fatalf("expected %s found=%v", key, want)
+		}
+	}
+	if n, _ := cache.GetBucketSize("other"); n != 1001 {
+		t.Fatalf("expected other buckets to be untouched, got %d entries", n)
+	}
+	if err := cache.checkInvariants(); err != nil {
+		t.Fatalf("checkInvariants => %v", err)
+	}
+}
+
+func TestCacheSystem_QuotaReject(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.SetBucketConfig("t", BucketConfig{MaxBytes: 14, OnFull: OnFullReject})
+	cache.Set("t", "k1", "aaaa")
+	cache.Set("t", "k2", "aaaa")
+
+	err := cache.Set("t", "k3", "aaaa")
+	var qe *QuotaError
+	if !errors.As(err, &qe) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected a QuotaError, got %v", err)
+	}
+	if qe.Quota != 14 || qe.Usage != 14 || qe.Need != 7 {
+		t.Fatalf("unexpected quota detail %+v", qe)
+	}
+	for _, key := range []string{"k1", "k2"} {
+		if _, found, _ := cache.Lookup("t", key); !found {
+			t.Fatalf("expected %s to be kept", key)
+		}
+	}
+
+	// Writes that don't grow the bucket, or that the mode skips, pass
+	if err := cache.Set("t", "k1", "bb"); err != nil {
+		t.Fatalf("expected a shrinking write to pass, got %v", err)
+	}
+	if ok, err := cache.SetXX("t", "k9", "aaaaaaaa"); ok || err != nil {
+		t.Fatalf("expected SetXX on a missing key to be skipped, got %v, %v", ok, err)
+	}
+	if _, err := cache.Append("t", "k2", "aaaa"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected Append past the quota to fail, got %v", err)
+	}
+
+	// A batch is checked as a whole and written all or nothing
+	err = cache.MSet([]MultiItem{
+		{Bucket: "t", BulkItem: BulkItem{Key: "k3", Value: "a"}},
+		{Bucket: "t", BulkItem: BulkItem{Key: "k4", Value: "a"}},
+	}, WriteOptions{})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected MSet past the quota to fail, got %v", err)
+	}
+	if _, found, _ := cache.Lookup("t", "k3"); found {
+		t.Fatalf("expected a rejected MSet to write nothing")
+	}
+}
+
+func TestHTTP_QuotaReject(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	resp, err := httpPut(server.URL+"/buckets/t/config", "application/json", strings.NewReader(`{"max_bytes": 7, "on_full": "reject"}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT config => %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	resp, err = httpPut(server.URL+"/buckets/t/config", "application/json", strings.NewReader(`{"on_full": "reject"}`))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected on_full without max_bytes to be rejected, got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	cache.Set("t", "k1", "aaaa")
+
+	resp, err = httpPut(server.URL+"/buckets/t/k2", "application/json", strings.NewReader(`{"value": "aaaa"}`))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Error string `json:"error"`
+		QuotaError
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode => %v", err)
+	}
+	if resp.StatusCode != http.StatusInsufficientStorage || body.Quota != 7 || body.Usage != 7 || body.Need != 7 || !strings.Contains(body.Error, "quota") {
+		t.Fatalf("PUT past the quota => %d %+v", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotRateLimit is returned by TakeTokens when the key holds something
+// other than a rate limiter.
+var ErrNotRateLimit = errors.New("value is not a rate limiter")
+
+// ErrInvalidRateLimit is returned by TakeTokens for a limit or window that
+// isn't positive, or a cost outside [0, limit].
+var ErrInvalidRateLimit = errors.New("limit and window must be positive and cost between 0 and limit")
+
+// RateLimit is a token bucket: it holds up to Limit tokens and refills
+// completely over Window, at an even rate. The limit isn't stored, so a
+// caller can change it from one call to the next; tokens above a lowered
+// limit are dropped.
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimitResult is the outcome of TakeTokens.
+type RateLimitResult struct {
+	Allowed    bool          // whether the tokens were taken
+	Remaining  int           // whole tokens left
+	ResetAfter time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the tokens asked for are there, if not Allowed
+}
+
+// rateLimitState is the value of a rate limiter entry: its tokens as of a
+// time, from which the tokens at any later time follow.
+type rateLimitState struct {
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TakeTokens takes cost tokens from the rate limiter at key, if it has them,
+// under one lock acquisition so concurrent callers never both take the
+// last token. A missing limiter starts full. A cost of 0 reports the state
+// without taking anything. The limiter expires once it has refilled, as a
+// missing one is full anyway.
+func (cs *CacheSystem) TakeTokens(bucket, key string, limit RateLimit, cost int, opts WriteOptions) (RateLimitResult, error) {
+	if limit.Limit <= 0 || limit.Window <= 0 || cost < 0 || cost > limit.Limit {
+		return RateLimitResult{}, ErrInvalidRateLimit
+	}
+	if err := cs.lock(); err != nil {
+		return RateLimitResult{}, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return RateLimitResult{}, err
+	}
+	s, err := cs.writeSessionLocked(opts)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	now := time.Now()
+	full := float64(limit.Limit)
+	perToken := float64(limit.Window) / full // nanoseconds to refill one token
+	tokens := full
+	if entry != nil {
+		var state rateLimitState
+		dec := json.NewDecoder(strings.NewReader(entry.Value))
+		dec.DisallowUnknownFields()
+		if entry.Encoding != "" || dec.Decode(&state) != nil || state.UpdatedAt.IsZero() {
+			return RateLimitResult{}, ErrNotRateLimit
+		}
+		tokens = math.Min(full, state.Tokens+float64(now.Sub(state.UpdatedAt))/perToken)
+	}
+
+	var res RateLimitResult
+	if tokens >= float64(cost) {
+		tokens -= float64(cost)
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration(math.Ceil((float64(cost) - tokens) * perToken))
+	}
+	res.Remaining = int(tokens)
+	res.ResetAfter = time.Duration(math.Ceil((full - tokens) * perToken))
+	if !res.Allowed || cost == 0 {
+		// Nothing was taken, so don't count a write.
+		return res, nil
+	}
+	value, _ := json.Marshal(rateLimitState{Tokens: tokens, UpdatedAt: now})
+	return res, cs.rewriteLocked(bucket, key, entry, string(value), max(res.ResetAfter, time.Millisecond), opts, s)
+}
+
+// rateLimitRequest is the body of POST /ratelimit/{bucket}/{key}.
+type rateLimitRequest struct {
+	Limit  int     `json:"limit"`
+	Window jsonTTL `json:"window"`
+	Cost   *int    `json:"cost"` // absent means 1
+}
+
+// serveRateLimit handles the rate limiter endpoints:
+//
+//	POST   /ratelimit/{bucket}/{key}  => take tokens, {"limit": n, "window": "1m", "cost": 1}
+//	DELETE /ratelimit/{bucket}/{key}  => refill, by removing the limiter
+//
+// A denied request still answers 200, with "allowed": false, so it can't
+// be mistaken for the server shedding load with -shed-status 429. In
+// buckets with HashKeys, the key is hashed like any other.
+func serveRateLimit(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, key, _ := strings.Cut(r.URL.Path[len("/ratelimit/"):], "/")
+	if bucket == "" || key == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	key, _ = storedKey(cache.GetBucketConfig(bucket), key)
+
+	allowed := []string{http.MethodPost, http.MethodDelete}
+	if !slices.Contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, allowed...)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if _, err := cache.Delete(bucket, key); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req rateLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	cost := 1
+	if req.Cost != nil {
+		cost = *req.Cost
+	}
+	res, err := cache.TakeTokens(bucket, key, RateLimit{Limit: req.Limit, Window: time.Duration(req.Window)}, cost, writeOptions(r))
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64((res.RetryAfter+time.Second-1)/time.Second), 10))
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"allowed":        res.Allowed,
+		"limit":          req.Limit,
+		"remaining":      res.Remaining,
+		"reset_ms":       res.ResetAfter.Milliseconds(),
+		"retry_after_ms": res.RetryAfter.Milliseconds(),
+	})
+}
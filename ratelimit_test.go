@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_TakeTokens(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	limit := RateLimit{Limit: 3, Window: 300 * time.Millisecond}
+
+	for i := 2; i >= 0; i-- {
+		res, err := cache.TakeTokens("b", "u", limit, 1, WriteOptions{})
+		if err != nil || !res.Allowed || res.Remaining != i {
+			t.Fatalf("TakeTokens => %+v, %v, want %d remaining", res, err, i)
+		}
+	}
+	res, _ := cache.TakeTokens("b", "u", limit, 1, WriteOptions{})
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > 100*time.Millisecond || res.ResetAfter <= 200*time.Millisecond {
+		t.Fatalf("expected an empty bucket to deny, got %+v", res)
+	}
+	if ttl, _ := cache.TTL("b", "u"); ttl <= 0 || ttl > limit.Window {
+		t.Fatalf("expected the limiter to expire once refilled, got %v", ttl)
+	}
+
+	// Tokens come back at an even rate
+	time.Sleep(res.RetryAfter + 10*time.Millisecond)
+	if res, _ := cache.TakeTokens("b", "u", limit, 1, WriteOptions{}); !res.Allowed {
+		t.Fatalf("expected a refilled token to be taken, got %+v", res)
+	}
+	if res, _ := cache.TakeTokens("b", "u", RateLimit{Limit: 3, Window: time.Hour}, 0, WriteOptions{}); res.Remaining != 0 || !res.Allowed {
+		t.Fatalf("expected a cost of 0 to report the state, got %+v", res)
+	}
+
+	// Concurrent callers never take more than the limit between them
+	var taken int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, _ := cache.TakeTokens("b", "race", RateLimit{Limit: 10, Window: time.Hour}, 1, WriteOptions{}); res.Allowed {
+				atomic.AddInt64(&taken, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != 10 {
+		t.Fatalf("expected exactly 10 tokens taken, got %d", taken)
+	}
+
+	for _, c := range []struct {
+		limit RateLimit
+		cost  int
+	}{
+		{RateLimit{Limit: 0, Window: time.Second}, 0},
+		{RateLimit{Limit: 1, Window: 0}, 1},
+		{RateLimit{Limit: 1, Window: time.Second}, 2},
+		{RateLimit{Limit: 1, Window: time.Second}, -1},
+	} {
+		if _, err := cache.TakeTokens("b", "bad", c.limit, c.cost, WriteOptions{}); !errors.Is(err, ErrInvalidRateLimit) {
+			t.Fatalf("TakeTokens(%+v, %d): expected ErrInvalidRateLimit, got %v", c.limit, c.cost, err)
+		}
+	}
+	cache.Set("b", "word", `{"tokens":1}`)
+	if _, err := cache.TakeTokens("b", "word", limit, 1, WriteOptions{}); !errors.Is(err, ErrNotRateLimit) {
+		t.Fatalf("expected ErrNotRateLimit, got %v", err)
+	}
+}
+
+func TestHTTP_RateLimit(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	body := `{"limit":2,"window":"1h","cost":2}`
+	if resp, out := httpJSON(t, "POST", server.URL+"/ratelimit/b/u", body); resp.StatusCode != http.StatusOK || out["allowed"] != true || out["remaining"] != 0.0 {
+		t.Fatalf("expected the tokens to be taken, got %d %v", resp.StatusCode, out)
+	}
+	resp, out := httpJSON(t, "POST", server.URL+"/ratelimit/b/u", body)
+	if resp.StatusCode != http.StatusOK || out["allowed"] != false || resp.Header.Get("Retry-After") != "3600" {
+		t.Fatalf("expected a denial with Retry-After, got %d %v %q", resp.StatusCode, out, resp.Header.Get("Retry-After"))
+	}
+	if resp, _ := httpJSON(t, "DELETE", server.URL+"/ratelimit/b/u", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE => %d", resp.StatusCode)
+	}
+	if _, out := httpJSON(t, "POST", server.URL+"/ratelimit/b/u", body); out["allowed"] != true {
+		t.Fatalf("expected DELETE to refill the bucket, got %v", out)
+	}
+
+	cache.Set("b", "word", "hello")
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/ratelimit/b/word", body, http.StatusConflict},
+		{"POST", "/ratelimit/b/u", `{"limit":2}`, http.StatusBadRequest},
+		{"POST", "/ratelimit/b/u", `{"limit":2,"window":"soon"}`, http.StatusBadRequest},
+		{"GET", "/ratelimit/b/u", "", http.StatusMethodNotAllowed},
+		{"POST", "/ratelimit/b", body, http.StatusNotFound},
+	} {
+		if resp, _ := httpJSON(t, c.method, server.URL+c.path, c.body); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+}
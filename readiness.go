@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// warmup tracks the cache being filled at startup while it already serves,
+// as with -handover-partial.
+type warmup struct {
+	Source  string // where the entries come from, e.g. "handover"
+	started time.Time
+	loaded  atomic.Int64
+	total   atomic.Int64 // -1 until known
+}
+
+// WarmupStatus describes a startup fill in progress.
+type WarmupStatus struct {
+	Source  string   `json:"source"`
+	Loaded  int64    `json:"loaded"`
+	Total   *int64   `json:"total,omitempty"`   // absent until known
+	Percent *float64 `json:"percent,omitempty"` // absent until Total is known
+	Elapsed float64  `json:"elapsed"`           // seconds
+}
+
+// Warmup returns the progress of a startup fill, or false if the cache is
+// not being filled.
+func (cs *CacheSystem) Warmup() (WarmupStatus, bool) {
+	w := cs.warming.Load()
+	if w == nil {
+		return WarmupStatus{}, false
+	}
+	st := WarmupStatus{Source: w.Source, Loaded: w.loaded.Load(), Elapsed: time.Since(w.started).Seconds()}
+	if total := w.total.Load(); total >= 0 {
+		percent := 100.0
+		if total > 0 {
+			percent = float64(min(st.Loaded, total)) * 100 / float64(total)
+		}
+		st.Total, st.Percent = &total, &percent
+	}
+	return st, true
+}
+
+// serveReadyz handles GET /readyz: 200 once the cache holds everything it
+// starts with, 503 with the progress while it is still being filled. Unlike
+// the GET / health check, load balancers can use it to hold traffic back from
+// a partially warm instance.
+func serveReadyz(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	st, warming := cache.Warmup()
+	if !warming {
+		_ = json.NewEncoder(w).Encode(map[string]bool{"ready": true})
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"ready": false, "warmup": st})
+}
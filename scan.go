@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned by Scan for a cursor it did not issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Scan returns up to limit live keys of bucket that start with prefix and
+// match the glob pattern (empty matches anything), resuming from cursor
+// (empty to start). It takes the read lock once per hash
+// slot of the bucket rather than for the whole traversal, so scanning a big
+// bucket never stalls writers for long.
+//
+// next is the cursor for the following call, or empty once the scan is done.
+// Keys present for the whole scan are returned exactly once; keys written or
+// removed meanwhile may or may not be. Order is unspecified, and a call can
+// return fewer than limit keys (even none) before the scan is done.
+func (cs *CacheSystem) Scan(bucket, cursor, prefix, pattern string, limit int) (keys []string, next string, err error) {
+	slot, after, err := parseScanCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := validGlob(pattern); err != nil {
+		return nil, "", err
+	}
+	for ; slot < keySetSlots; slot, after = slot+1, "" {
+		if err := cs.rlock(); err != nil {
+			return nil, "", err
+		}
+		var found []string
+		now := time.Now()
+		cs.buckets[bucket].eachIn(slot, func(k string) {
+			if k <= after || !strings.HasPrefix(k, prefix) || (pattern != "" && !globMatch(pattern, k)) {
+				return
+			}
+			entry := cs.items[[2]string{bucket, k}].Value.(*CacheEntry)
+			if !entry.expiredAt(now) && !cs.sessionExpired(entry, now) {
+				found = append(found, k)
+			}
+		})
+		cs.mu.RUnlock()
+
+		sort.Strings(found)
+		if room := limit - len(keys); len(found) > room {
+			keys = append(keys, found[:room]...)
+			return keys, scanCursor(slot, keys[len(keys)-1]), nil
+		}
+		keys = append(keys, found...)
+		if len(keys) == limit && slot+1 < keySetSlots {
+			return keys, scanCursor(slot+1, ""), nil
+		}
+	}
+	return keys, "", nil
+}
+
+// scanCursor encodes a scan position: the hash slot being walked and the last
+// key returned from it.
+func scanCursor(slot int, after string) string {
+	return strconv.Itoa(slot) + ":" + after
+}
+
+func parseScanCursor(cursor string) (slot int, after string, err error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	i := strings.IndexByte(cursor, ':')
+	if i < 0 {
+		return 0, "", ErrInvalidCursor
+	}
+	slot, err = strconv.Atoi(cursor[:i])
+	if err != nil || slot < 0 || slot >= keySetSlots {
+		return 0, "", ErrInvalidCursor
+	}
+	return slot, cursor[i+1:], nil
+}
+
+// serveBucketScan handles GET /buckets/{bucket}/scan?cursor=&prefix=&match=&limit=.
+// Like /all the cursor is opaque to clients, but keys come back unordered and
+// the bucket is walked a slice at a time.
+func serveBucketScan(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	limit, cursor, ok := parsePageParams(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	keys, next, err := cache.Scan(bucket, cursor, q.Get("prefix"), q.Get("match"), limit)
+	if errors.Is(err, ErrInvalidCursor) {
+		writeError(w, http.StatusBadRequest, "invalid cursor")
+		return
+	}
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	resp := struct {
+		Keys       []string `json:"keys"`
+		NextCursor string   `json:"next_cursor,omitempty"`
+	}{Keys: keys}
+	if resp.Keys == nil {
+		resp.Keys = []string{}
+	}
+	if next != "" {
+		resp.NextCursor = encodeCursor(next)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
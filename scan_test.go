@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Scan(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		cache.Set("b", "user:"+strconv.Itoa(i), "v")
+	}
+	cache.Set("b", "order:1", "v")
+	cache.SetWithTTL("b", "user:gone", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	seen := make(map[string]bool)
+	cursor, calls := "", 0
+	for {
+		keys, next, err := cache.Scan("b", cursor, "user:", "", 7)
+		if err != nil {
+			t.Fatalf("Scan => %v", err)
+		}
+		if len(keys) > 7 {
+			t.Fatalf("expected at most 7 keys per call, got %d", len(keys))
+		}
+		for _, k := range keys {
+			if seen[k] {
+				t.Fatalf("key %q returned twice", k)
+			}
+			seen[k] = true
+		}
+		// Writes between calls must not disturb the scan
+		cache.Set("b", "order:"+strconv.Itoa(calls), "v")
+		calls++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != n || seen["order:1"] || seen["user:gone"] {
+		t.Fatalf("expected exactly the %d live user: keys, got %d", n, len(seen))
+	}
+
+	if _, _, err := cache.Scan("b", "bogus", "", "", 10); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+	if keys, next, err := cache.Scan("missing", "", "", "", 10); err != nil || len(keys) != 0 || next != "" {
+		t.Fatalf("expected an empty, finished scan of a missing bucket, got %v, %q, %v", keys, next, err)
+	}
+}
+
+func TestHTTP_BucketScan(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+	for _, k := range []string{"a1", "a2", "a3", "b1"} {
+		cache.Set("s", k, "v")
+	}
+
+	var got []string
+	cursor := ""
+	for {
+		resp, err := http.Get(server.URL + "/buckets/s/scan?prefix=a&limit=1&cursor=" + url.QueryEscape(cursor))
+		if err != nil {
+			t.Fatalf("GET scan => %v", err)
+		}
+		var page struct {
+			Keys       []string `json:"keys"`
+			NextCursor string   `json:"next_cursor"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET scan => %d, %v", resp.StatusCode, err)
+		}
+		got = append(got, page.Keys...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	sort.Strings(got)
+	if len(got) != 3 || got[0] != "a1" || got[2] != "a3" {
+		t.Fatalf("expected a1..a3, got %v", got)
+	}
+
+	for _, q := range []string{"cursor=!!", "cursor=eA", "limit=0"} {
+		resp, err := http.Get(server.URL + "/buckets/s/scan?" + q)
+		if err != nil {
+			t.Fatalf("GET scan?%s => %v", q, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", q, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// scheduleTickInterval is how often due schedules are looked for. Cron
+// expressions have minute resolution, so a run starts within this of its time.
+var scheduleTickInterval = time.Second
+
+// scheduleHistory is how many runs are kept per schedule for auditing.
+const scheduleHistory = 20
+
+// ErrScheduleNotFound is returned for a schedule name that is not defined.
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// ClearSchedule clears a bucket, or the keys in it that start with Prefix,
+// whenever Cron matches.
+type ClearSchedule struct {
+	Cron   string `json:"cron"` // five-field cron expression or @daily etc., in UTC
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"` // empty clears the whole bucket
+}
+
+// ScheduleRun records one execution of a schedule.
+type ScheduleRun struct {
+	At      time.Time `json:"at"`
+	Manual  bool      `json:"manual,omitempty"` // started through RunSchedule rather than by the clock
+	Removed int       `json:"removed"`          // entries removed
+	Error   string    `json:"error,omitempty"`  // why the run failed; empty on success
+}
+
+// ScheduleInfo describes a schedule, when it next runs and its recent runs.
+type ScheduleInfo struct {
+	Name string `json:"name"`
+	ClearSchedule
+	Next time.Time     `json:"next"`
+	Runs []ScheduleRun `json:"runs"` // oldest first, at most scheduleHistory
+}
+
+// schedule is a ClearSchedule registered with the cache.
+type schedule struct {
+	ClearSchedule
+	cron *cronSchedule
+	next time.Time
+	runs []ScheduleRun
+}
+
+func (s *schedule) info(name string) ScheduleInfo {
+	return ScheduleInfo{Name: name, ClearSchedule: s.ClearSchedule, Next: s.next, Runs: append([]ScheduleRun{}, s.runs...)}
+}
+
+// SetSchedule defines, or replaces, the schedule called name. A replaced
+// schedule keeps its run history.
+func (cs *CacheSystem) SetSchedule(name string, sc ClearSchedule) error {
+	if sc.Bucket == "" {
+		return errors.New("bucket must not be empty")
+	}
+	cron, err := parseCron(sc.Cron)
+	if err != nil {
+		return err
+	}
+	cs.schedMu.Lock()
+	defer cs.schedMu.Unlock()
+	s := &schedule{ClearSchedule: sc, cron: cron, next: cron.next(time.Now())}
+	if old, ok := cs.schedules[name]; ok {
+		s.runs = old.runs
+	}
+	cs.schedules[name] = s
+	return nil
+}
+
+// DeleteSchedule removes the schedule called name, reporting whether it existed.
+func (cs *CacheSystem) DeleteSchedule(name string) bool {
+	cs.schedMu.Lock()
+	defer cs.schedMu.Unlock()
+	_, ok := cs.schedules[name]
+	delete(cs.schedules, name)
+	return ok
+}
+
+// Schedule describes the schedule called name.
+func (cs *CacheSystem) Schedule(name string) (ScheduleInfo, error) {
+	cs.schedMu.Lock()
+	defer cs.schedMu.Unlock()
+	s, ok := cs.schedules[name]
+	if !ok {
+		return ScheduleInfo{}, fmt.Errorf("%w: %q", ErrScheduleNotFound, name)
+	}
+	return s.info(name), nil
+}
+
+// Schedules describes every schedule, sorted by name.
+func (cs *CacheSystem) Schedules() []ScheduleInfo {
+	cs.schedMu.Lock()
+	defer cs.schedMu.Unlock()
+	infos := make([]ScheduleInfo, 0, len(cs.schedules))
+	for name, s := range cs.schedules {
+		infos = append(infos, s.info(name))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// ScheduleFailures returns how many schedule runs have failed.
+func (cs *CacheSystem) ScheduleFailures() int64 {
+	return atomic.LoadInt64(&cs.scheduleFailures)
+}
+
+// RunSchedule runs the schedule called name now, outside its cron times, and
+// records the run. The error is the run's own, if it failed.
+func (cs *CacheSystem) RunSchedule(name string) (ScheduleRun, error) {
+	cs.schedMu.Lock()
+	s, ok := cs.schedules[name]
+	var sc ClearSchedule
+	if ok {
+		sc = s.ClearSchedule
+	}
+	cs.schedMu.Unlock()
+	if !ok {
+		return ScheduleRun{}, fmt.Errorf("%w: %q", ErrScheduleNotFound, name)
+	}
+	return cs.runSchedule(name, sc, time.Now(), true)
+}
+
+// runDueSchedules runs every schedule whose next time is at or before now.
+// Runs happen without schedMu held, so a slow clear does not block the API.
+func (cs *CacheSystem) runDueSchedules(now time.Time) {
+	cs.schedMu.Lock()
+	due := make(map[string]ClearSchedule)
+	for name, s := range cs.schedules {
+		if !s.next.After(now) {
+			due[name] = s.ClearSchedule
+			s.next = s.cron.next(now)
+		}
+	}
+	cs.schedMu.Unlock()
+
+	for name, sc := range due {
+		cs.runSchedule(name, sc, now, false)
+	}
+}
+
+// runSchedule carries out sc and records the outcome on the schedule called
+// name. Failures are logged and counted so they don't go unnoticed.
+func (cs *CacheSystem) runSchedule(name string, sc ClearSchedule, now time.Time, manual bool) (ScheduleRun, error) {
+	removed, err := cs.clearScheduled(sc)
+	run := ScheduleRun{At: now, Manual: manual, Removed: removed}
+	if err != nil {
+		run.Error = err.Error()
+		atomic.AddInt64(&cs.scheduleFailures, 1)
+		log.Printf("schedule %q: clearing %s%s failed: %v", name, sc.Bucket, prefixSuffix(sc.Prefix), err)
+	} else {
+		log.Printf("schedule %q: cleared %d entries from %s%s", name, removed, sc.Bucket, prefixSuffix(sc.Prefix))
+	}
+
+	cs.schedMu.Lock()
+	if s, ok := cs.schedules[name]; ok {
+		s.runs = append(s.runs, run)
+		if len(s.runs) > scheduleHistory {
+			s.runs = s.runs[len(s.runs)-scheduleHistory:]
+		}
+	}
+	cs.schedMu.Unlock()
+	return run, err
+}
+
+func prefixSuffix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return " (prefix " + prefix + ")"
+}
+
+// clearScheduled clears what sc covers and returns how many entries it removed.
+func (cs *CacheSystem) clearScheduled(sc ClearSchedule) (int, error) {
+	if sc.Prefix != "" {
+		return cs.DeletePrefix(sc.Bucket, sc.Prefix)
+	}
+	keys, gen, err := cs.detachBucket(sc.Bucket)
+	if err != nil || keys == nil {
+		return 0, err
+	}
+	cs.purgeDetached(sc.Bucket, keys, gen)
+	return keys.len(), nil
+}
+
+// serveSchedules handles the schedule endpoints:
+//
+//	GET    /schedules            => every schedule
+//	PUT    /schedules/{name}     ClearSchedule => define or replace
+//	GET    /schedules/{name}     => ScheduleInfo, including recent runs
+//	DELETE /schedules/{name}     => remove
+//	POST   /schedules/{name}/run => run now
+func serveSchedules(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/schedules"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string][]ScheduleInfo{"schedules": cache.Schedules()})
+		return
+	}
+	name, action, _ := strings.Cut(path, "/")
+	if action != "" && action != "run" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case action == "run" && r.Method == http.MethodPost:
+		run, err := cache.RunSchedule(name)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(run)
+		return
+	case action == "run":
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	case r.Method == http.MethodPut:
+		var sc ClearSchedule
+		if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if err := cache.SetSchedule(name, sc); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case r.Method == http.MethodGet:
+	case r.Method == http.MethodDelete:
+		if !cache.DeleteSchedule(name) {
+			writeCacheError(w, fmt.Errorf("%w: %q", ErrScheduleNotFound, name))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		return
+	}
+
+	info, err := cache.Schedule(name)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Schedules(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	for i := 0; i < 2*clearBatchSize+3; i++ {
+		cache.Set("b", "tmp:"+strconv.Itoa(i), "v")
+	}
+	cache.Set("b", "keep", "v")
+	cache.Set("whole", "k", "v")
+
+	if err := cache.SetSchedule("tmp", ClearSchedule{Cron: "*/5 * * * *", Bucket: "b", Prefix: "tmp:"}); err != nil {
+		t.Fatalf("SetSchedule => %v", err)
+	}
+	if err := cache.SetSchedule("whole", ClearSchedule{Cron: "@daily", Bucket: "whole"}); err != nil {
+		t.Fatalf("SetSchedule => %v", err)
+	}
+	if err := cache.SetSchedule("bad", ClearSchedule{Cron: "every day", Bucket: "b"}); err == nil {
+		t.Fatalf("expected an invalid cron expression to be rejected")
+	}
+
+	// Nothing is due yet
+	tmp, _ := cache.Schedule("tmp")
+	cache.runDueSchedules(tmp.Next.Add(-time.Second))
+	if size, _ := cache.GetBucketSize("b"); size != 2*clearBatchSize+4 {
+		t.Fatalf("expected nothing cleared before the schedule is due, got size %d", size)
+	}
+
+	cache.runDueSchedules(tmp.Next)
+	if size, _ := cache.GetBucketSize("b"); size != 1 {
+		t.Fatalf("expected only the unprefixed key to survive, got size %d", size)
+	}
+	info, _ := cache.Schedule("tmp")
+	if len(info.Runs) != 1 || info.Runs[0].Removed != 2*clearBatchSize+3 || info.Runs[0].Error != "" {
+		t.Fatalf("expected one successful run to be recorded, got %+v", info.Runs)
+	}
+	if !info.Next.After(tmp.Next) {
+		t.Fatalf("expected the next run to move forward, got %s", info.Next)
+	}
+
+	// A failed run is recorded and counted, not dropped
+	cache.Freeze("whole", 0)
+	if _, err := cache.RunSchedule("whole"); err == nil {
+		t.Fatalf("expected clearing a frozen bucket to fail")
+	}
+	info, _ = cache.Schedule("whole")
+	if len(info.Runs) != 1 || !info.Runs[0].Manual || !strings.Contains(info.Runs[0].Error, "frozen") {
+		t.Fatalf("expected the failed run to be recorded, got %+v", info.Runs)
+	}
+	if cache.ScheduleFailures() != 1 {
+		t.Fatalf("expected 1 failure, got %d", cache.ScheduleFailures())
+	}
+	cache.Thaw("whole")
+	if run, err := cache.RunSchedule("whole"); err != nil || run.Removed != 1 {
+		t.Fatalf("RunSchedule => %+v, %v", run, err)
+	}
+
+	for i := 0; i < scheduleHistory+5; i++ {
+		cache.RunSchedule("whole")
+	}
+	if info, _ := cache.Schedule("whole"); len(info.Runs) != scheduleHistory {
+		t.Fatalf("expected history capped at %d, got %d", scheduleHistory, len(info.Runs))
+	}
+
+	if !cache.DeleteSchedule("tmp") || cache.DeleteSchedule("tmp") {
+		t.Fatalf("expected DeleteSchedule to report whether the schedule existed")
+	}
+	if _, err := cache.RunSchedule("tmp"); err == nil {
+		t.Fatalf("expected running a deleted schedule to fail")
+	}
+}
+
+func TestHTTP_Schedules(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+	cache.Set("sessions", "s1", "v")
+
+	if resp, body := httpDo(t, "PUT", server.URL+"/schedules/nightly", `{"cron":"0 3 * * *","bucket":"sessions"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT => %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := httpDo(t, "PUT", server.URL+"/schedules/bad", `{"cron":"0 25 * * *","bucket":"sessions"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid cron expression, got %d", resp.StatusCode)
+	}
+	if resp, body := httpDo(t, "POST", server.URL+"/schedules/nightly/run", ""); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"removed":1`) {
+		t.Fatalf("POST run => %d %s", resp.StatusCode, body)
+	}
+
+	resp, body := httpDo(t, "GET", server.URL+"/schedules", "")
+	var list struct {
+		Schedules []ScheduleInfo `json:"schedules"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /schedules => %d %s", resp.StatusCode, body)
+	}
+	if len(list.Schedules) != 1 || list.Schedules[0].Bucket != "sessions" || len(list.Schedules[0].Runs) != 1 {
+		t.Fatalf("expected the schedule and its run to be listed, got %s", body)
+	}
+
+	if resp, _ := httpDo(t, "DELETE", server.URL+"/schedules/nightly", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE => %d", resp.StatusCode)
+	}
+	if resp, _ := httpDo(t, "GET", server.URL+"/schedules/nightly", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", resp.StatusCode)
+	}
+}
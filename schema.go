@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a compiled subset of JSON Schema (draft 2020-12) covering the
+// keywords most useful for cached payloads: type, enum, const, properties,
+// required, additionalProperties, items, numeric and length bounds, pattern,
+// and the allOf/anyOf/oneOf/not combinators.
+type jsonSchema struct {
+	alwaysFalse bool // the boolean schema `false`
+
+	types    []string
+	enum     []interface{}
+	constVal *interface{}
+
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	items                *jsonSchema
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	minLength, maxLength               *int
+	minItems, maxItems                 *int
+	pattern                            *regexp.Regexp
+
+	allOf, anyOf, oneOf []*jsonSchema
+	not                 *jsonSchema
+}
+
+// compileJSONSchema parses a schema document into a jsonSchema.
+func compileJSONSchema(raw []byte) (*jsonSchema, error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %v", err)
+	}
+	return compileSchemaNode(doc, "#")
+}
+
+func compileSchemaNode(node interface{}, at string) (*jsonSchema, error) {
+	switch n := node.(type) {
+	case bool:
+		return &jsonSchema{alwaysFalse: !n}, nil
+	case map[string]interface{}:
+		s := &jsonSchema{}
+		var err error
+		for kw, v := range n {
+			path := at + "/" + kw
+			switch kw {
+			case "type":
+				s.types, err = schemaTypes(v, path)
+			case "enum":
+				arr, ok := v.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s: must be an array", path)
+				}
+				s.enum = arr
+			case "const":
+				c := v
+				s.constVal = &c
+			case "properties":
+				props, ok := v.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s: must be an object", path)
+				}
+				s.properties = make(map[string]*jsonSchema, len(props))
+				for name, sub := range props {
+					if s.properties[name], err = compileSchemaNode(sub, path+"/"+name); err != nil {
+						return nil, err
+					}
+				}
+			case "required":
+				arr, ok := v.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s: must be an array of strings", path)
+				}
+				for _, r := range arr {
+					name, ok := r.(string)
+					if !ok {
+						return nil, fmt.Errorf("%s: must be an array of strings", path)
+					}
+					s.required = append(s.required, name)
+				}
+			case "additionalProperties":
+				s.additionalProperties, err = compileSchemaNode(v, path)
+			case "items":
+				s.items, err = compileSchemaNode(v, path)
+			case "not":
+				s.not, err = compileSchemaNode(v, path)
+			case "allOf", "anyOf", "oneOf":
+				var subs []*jsonSchema
+				if subs, err = compileSchemaList(v, path); err != nil {
+					return nil, err
+				}
+				switch kw {
+				case "allOf":
+					s.allOf = subs
+				case "anyOf":
+					s.anyOf = subs
+				default:
+					s.oneOf = subs
+				}
+			case "minimum":
+				s.minimum, err = schemaNumber(v, path)
+			case "maximum":
+				s.maximum, err = schemaNumber(v, path)
+			case "exclusiveMinimum":
+				s.exclusiveMinimum, err = schemaNumber(v, path)
+			case "exclusiveMaximum":
+				s.exclusiveMaximum, err = schemaNumber(v, path)
+			case "minLength":
+				s.minLength, err = schemaCount(v, path)
+			case "maxLength":
+				s.maxLength, err = schemaCount(v, path)
+			case "minItems":
+				s.minItems, err = schemaCount(v, path)
+			case "maxItems":
+				s.maxItems, err = schemaCount(v, path)
+			case "pattern":
+				p, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: must be a string", path)
+				}
+				if s.pattern, err = regexp.Compile(p); err != nil {
+					return nil, fmt.Errorf("%s: %v", path, err)
+				}
+			}
+			// Unknown keywords ($schema, title, description, ...) are ignored.
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("%s: schema must be an object or boolean", at)
+	}
+}
+
+func compileSchemaList(v interface{}, at string) ([]*jsonSchema, error) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) == 0 {
+		return nil, fmt.Errorf("%s: must be a non-empty array", at)
+	}
+	subs := make([]*jsonSchema, len(arr))
+	for i, sub := range arr {
+		var err error
+		if subs[i], err = compileSchemaNode(sub, at+"/"+strconv.Itoa(i)); err != nil {
+			return nil, err
+		}
+	}
+	return subs, nil
+}
+
+var schemaTypeNames = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+func schemaTypes(v interface{}, at string) ([]string, error) {
+	var names []string
+	switch t := v.(type) {
+	case string:
+		names = []string{t}
+	case []interface{}:
+		for _, e := range t {
+			name, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: must be a string or array of strings", at)
+			}
+			names = append(names, name)
+		}
+	default:
+		return nil, fmt.Errorf("%s: must be a string or array of strings", at)
+	}
+	for _, name := range names {
+		if !schemaTypeNames[name] {
+			return nil, fmt.Errorf("%s: unknown type %q", at, name)
+		}
+	}
+	return names, nil
+}
+
+func schemaNumber(v interface{}, at string) (*float64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("%s: must be a number", at)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", at, err)
+	}
+	return &f, nil
+}
+
+func schemaCount(v interface{}, at string) (*int, error) {
+	f, err := schemaNumber(v, at)
+	if err != nil {
+		return nil, err
+	}
+	if *f < 0 || *f != math.Trunc(*f) {
+		return nil, fmt.Errorf("%s: must be a non-negative integer", at)
+	}
+	n := int(*f)
+	return &n, nil
+}
+
+// ValidateValue parses value as JSON and checks it against the schema,
+// returning one message per violation (empty if the value conforms).
+func (s *jsonSchema) ValidateValue(value string) []string {
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return []string{"value is not valid JSON: " + err.Error()}
+	}
+	if dec.More() {
+		return []string{"value is not valid JSON: trailing data"}
+	}
+	var errs []string
+	s.validate(doc, "", &errs)
+	return errs
+}
+
+func (s *jsonSchema) validate(v interface{}, at string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		loc := at
+		if loc == "" {
+			loc = "/"
+		}
+		*errs = append(*errs, loc+": "+fmt.Sprintf(format, args...))
+	}
+
+	if s.alwaysFalse {
+		fail("no value is allowed here")
+		return
+	}
+	if len(s.types) > 0 && !schemaTypeMatches(s.types, v) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), schemaTypeOf(v))
+		return
+	}
+	if s.enum != nil {
+		matched := false
+		for _, e := range s.enum {
+			if schemaEqual(e, v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("value is not one of the allowed enum values")
+		}
+	}
+	if s.constVal != nil && !schemaEqual(*s.constVal, v) {
+		fail("value does not equal the required const")
+	}
+
+	switch val := v.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		if s.minimum != nil && f < *s.minimum {
+			fail("%v is less than minimum %v", val, *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			fail("%v is greater than maximum %v", val, *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+			fail("%v must be greater than %v", val, *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+			fail("%v must be less than %v", val, *s.exclusiveMaximum)
+		}
+	case string:
+		n := utf8.RuneCountInString(val)
+		if s.minLength != nil && n < *s.minLength {
+			fail("string is shorter than %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("string is longer than %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("string does not match pattern %q", s.pattern.String())
+		}
+	case []interface{}:
+		if s.minItems != nil && len(val) < *s.minItems {
+			fail("array has fewer than %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(val) > *s.maxItems {
+			fail("array has more than %d items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range val {
+				s.items.validate(item, at+"/"+strconv.Itoa(i), errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := val[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sub, declared := s.properties[name]
+			if !declared {
+				sub = s.additionalProperties
+			}
+			if sub != nil {
+				sub.validate(val[name], at+"/"+escapeJSONPointer(name), errs)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, at, errs)
+	}
+	if len(s.anyOf) > 0 && schemaMatchCount(s.anyOf, v) == 0 {
+		fail("value does not match any schema in anyOf")
+	}
+	if len(s.oneOf) > 0 && schemaMatchCount(s.oneOf, v) != 1 {
+		fail("value must match exactly one schema in oneOf")
+	}
+	if s.not != nil && schemaMatchCount([]*jsonSchema{s.not}, v) == 1 {
+		fail("value must not match the schema in not")
+	}
+}
+
+func schemaMatchCount(subs []*jsonSchema, v interface{}) int {
+	matches := 0
+	for _, sub := range subs {
+		var errs []string
+		sub.validate(v, "", &errs)
+		if len(errs) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func schemaTypeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := val.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func schemaTypeMatches(types []string, v interface{}) bool {
+	actual := schemaTypeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+		if t == "integer" && actual == "number" {
+			// 1.0 is an integer in JSON Schema
+			if f, err := v.(json.Number).Float64(); err == nil && f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func schemaEqual(a, b interface{}) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, _ := an.Float64()
+		bf, _ := bn.Float64()
+		return af == bf
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
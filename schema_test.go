@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchema_Validate(t *testing.T) {
+	schema, err := compileJSONSchema([]byte(`{
+		"type": "object",
+		"required": ["name", "age"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2}
+		},
+		"additionalProperties": false
+	}`))
+	if err != nil {
+		t.Fatalf("compile => %v", err)
+	}
+
+	if errs := schema.ValidateValue(`{"name":"fox","age":3,"tags":["a"]}`); len(errs) != 0 {
+		t.Fatalf("expected valid document, got %v", errs)
+	}
+
+	cases := map[string]string{
+		"missing required":  `{"name":"fox"}`,
+		"wrong type":        `{"name":"fox","age":"3"}`,
+		"below minimum":     `{"name":"fox","age":-1}`,
+		"bad enum item":     `{"name":"fox","age":3,"tags":["c"]}`,
+		"too many items":    `{"name":"fox","age":3,"tags":["a","b","a"]}`,
+		"additional":        `{"name":"fox","age":3,"extra":true}`,
+		"not json":          `{"name":`,
+		"not an object":     `[1,2]`,
+		"empty name string": `{"name":"","age":3}`,
+	}
+	for name, doc := range cases {
+		if errs := schema.ValidateValue(doc); len(errs) == 0 {
+			t.Fatalf("%s: expected violations for %s", name, doc)
+		}
+	}
+}
+
+func TestJSONSchema_CompileErrors(t *testing.T) {
+	bad := []string{
+		`{"type": "strnig"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"anyOf": []}`,
+		`"object"`,
+	}
+	for _, doc := range bad {
+		if _, err := compileJSONSchema([]byte(doc)); err == nil {
+			t.Fatalf("expected compile error for %s", doc)
+		}
+	}
+}
+
+func TestHTTP_BucketJSONSchema(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	cfg := []byte(`{"json_schema":{"type":"object","required":["id"]}}`)
+	resp, err := httpPut(server.URL+"/buckets/users/config", "application/json", bytes.NewReader(cfg))
+	if err != nil {
+		t.Fatalf("PUT config => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT config => expected 200, got %d", resp.StatusCode)
+	}
+
+	// Enforced: invalid value => 400 with details
+	resp, err = httpPut(server.URL+"/buckets/users/u1", "application/json", bytes.NewReader([]byte(`{"value":"{\"name\":\"x\"}"}`)))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	var errRes struct {
+		Error   string   `json:"error"`
+		Details []string `json:"details"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&errRes); err != nil {
+		t.Fatalf("decode => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || len(errRes.Details) == 0 {
+		t.Fatalf("expected 400 with details, got %d %+v", resp.StatusCode, errRes)
+	}
+	if got := cache.Get("users", "u1"); got != "" {
+		t.Fatalf("expected invalid value to be rejected, got %q", got)
+	}
+
+	// Valid value is stored
+	resp, err = httpPut(server.URL+"/buckets/users/u1", "application/json", bytes.NewReader([]byte(`{"value":"{\"id\":1}"}`)))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT valid => expected 200, got %d", resp.StatusCode)
+	}
+
+	// Warn-only: invalid value is stored with a warning header
+	cfg = []byte(`{"json_schema":{"type":"object","required":["id"]},"schema_mode":"warn"}`)
+	resp, err = httpPut(server.URL+"/buckets/users/config", "application/json", bytes.NewReader(cfg))
+	if err != nil {
+		t.Fatalf("PUT config => %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = httpPut(server.URL+"/buckets/users/u2", "application/json", bytes.NewReader([]byte(`{"value":"{}"}`)))
+	if err != nil {
+		t.Fatalf("PUT => %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT in warn mode => expected 200, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Kitsune-Schema-Warning") == "" {
+		t.Fatalf("expected a schema warning header in warn mode")
+	}
+	if got := cache.Get("users", "u2"); got != "{}" {
+		t.Fatalf("expected value to be stored in warn mode, got %q", got)
+	}
+
+	// Bulk writes report warnings the same way
+	for _, c := range []struct{ method, path, body string }{
+		{http.MethodPut, "/buckets/users", `{"u3":"{}","u4":"{\"id\":4}"}`},
+		{http.MethodPost, "/mset", `[{"bucket":"users","key":"u5","value":"{}"}]`},
+	} {
+		resp, out := httpDo(t, c.method, server.URL+c.path, c.body)
+		warning := resp.Header.Get("X-Kitsune-Schema-Warning")
+		if resp.StatusCode != http.StatusOK || !strings.Contains(warning, "missing required property") || strings.Contains(warning, "u4") {
+			t.Fatalf("%s %s in warn mode => expected 200 with a warning for the invalid key, got %d %q %s", c.method, c.path, resp.StatusCode, warning, out)
+		}
+	}
+	if cache.Get("users", "u3") != "{}" || cache.Get("users", "u5") != "{}" {
+		t.Fatalf("expected bulk values to be stored in warn mode")
+	}
+}
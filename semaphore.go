@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotSemaphore is returned by the semaphore operations when the key holds
+// something other than a semaphore.
+var ErrNotSemaphore = errors.New("value is not a semaphore")
+
+// ErrInvalidSemaphore is returned by AcquireSemaphore for a limit or ttl
+// that isn't positive, or permits outside [1, limit].
+var ErrInvalidSemaphore = errors.New("limit and ttl must be positive and permits between 1 and limit")
+
+// ErrSemaphoreNotHeld is returned when releasing permits with a token that
+// doesn't hold any, e.g. because they expired.
+var ErrSemaphoreNotHeld = errors.New("semaphore permits not held")
+
+// defaultSemaphoreTTL is how long acquired permits last if the request
+// doesn't say.
+const defaultSemaphoreTTL = 30 * time.Second
+
+// SemaphoreResult is the outcome of AcquireSemaphore.
+type SemaphoreResult struct {
+	Acquired   bool
+	Token      string        // releases the permits, if Acquired
+	ExpiresAt  time.Time     // when the permits lapse, if Acquired
+	Available  int           // permits left free
+	RetryAfter time.Duration // until enough permits lapse, if not Acquired
+}
+
+// semaphoreHold is one caller's permits.
+type semaphoreHold struct {
+	Permits   int       `json:"permits"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// semaphoreState is the value of a semaphore entry: its holders by token.
+type semaphoreState struct {
+	Holders map[string]semaphoreHold `json:"holders"`
+}
+
+// AcquireSemaphore takes permits of the limit permits of the semaphore at
+// key for ttl, if that many are free, under one lock acquisition so that
+// concurrent callers never hold more than limit between them. Like a rate
+// limiter's, the limit isn't stored, and a lowered one takes effect as
+// holders release or lapse. Permits that aren't released lapse after ttl,
+// so a worker that dies doesn't hold them forever; the semaphore expires
+// with its last holder.
+func (cs *CacheSystem) AcquireSemaphore(bucket, key string, limit, permits int, ttl time.Duration, opts WriteOptions) (SemaphoreResult, error) {
+	if limit <= 0 || ttl <= 0 || permits < 1 || permits > limit {
+		return SemaphoreResult{}, ErrInvalidSemaphore
+	}
+	token, err := leaseToken()
+	if err != nil {
+		return SemaphoreResult{}, err
+	}
+	if err := cs.lock(); err != nil {
+		return SemaphoreResult{}, err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return SemaphoreResult{}, err
+	}
+	s, err := cs.writeSessionLocked(opts)
+	if err != nil {
+		return SemaphoreResult{}, err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	now := time.Now()
+	state, err := decodeSemaphore(entry, now)
+	if err != nil {
+		return SemaphoreResult{}, err
+	}
+	held := state.held()
+	if held+permits > limit {
+		// Holds lapse soonest first; wait until enough of them have.
+		holds := make([]semaphoreHold, 0, len(state.Holders))
+		for _, h := range state.Holders {
+			holds = append(holds, h)
+		}
+		slices.SortFunc(holds, func(a, b semaphoreHold) int { return a.ExpiresAt.Compare(b.ExpiresAt) })
+		res := SemaphoreResult{Available: max(limit-held, 0)}
+		for _, h := range holds {
+			if held -= h.Permits; held+permits <= limit {
+				res.RetryAfter = h.ExpiresAt.Sub(now)
+				break
+			}
+		}
+		// Nothing was taken, so don't count a write.
+		return res, nil
+	}
+
+	hold := semaphoreHold{Permits: permits, ExpiresAt: now.Add(ttl)}
+	state.Holders[token] = hold
+	if err := cs.storeSemaphoreLocked(bucket, key, entry, state, now, opts, s); err != nil {
+		return SemaphoreResult{}, err
+	}
+	return SemaphoreResult{Acquired: true, Token: token, ExpiresAt: hold.ExpiresAt, Available: limit - held - permits}, nil
+}
+
+// ReleaseSemaphore gives back the permits token holds in the semaphore at
+// key, before they lapse, so that another caller can take them.
+func (cs *CacheSystem) ReleaseSemaphore(bucket, key, token string, opts WriteOptions) error {
+	if err := cs.lock(); err != nil {
+		return err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return err
+	}
+	s, err := cs.writeSessionLocked(opts)
+	if err != nil {
+		return err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	now := time.Now()
+	state, err := decodeSemaphore(entry, now)
+	if err != nil {
+		return err
+	}
+	if _, ok := state.Holders[token]; !ok {
+		return ErrSemaphoreNotHeld
+	}
+	delete(state.Holders, token)
+	return cs.storeSemaphoreLocked(bucket, key, entry, state, now, opts, s)
+}
+
+// SemaphoreHeld returns how many permits of the semaphore at key are held,
+// and by how many holders. A missing semaphore has none held.
+func (cs *CacheSystem) SemaphoreHeld(bucket, key string) (permits, holders int, err error) {
+	v, found, err := cs.lookupCachedValue(bucket, key)
+	if err != nil || !found {
+		return 0, 0, err
+	}
+	state, err := decodeSemaphore(&CacheEntry{Value: v.Value, Encoding: v.Encoding}, time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+	return state.held(), len(state.Holders), nil
+}
+
+// storeSemaphoreLocked writes state to key, expiring it with its last
+// holder, or removes key if state has no holders left.
+func (cs *CacheSystem) storeSemaphoreLocked(bucket, key string, entry *CacheEntry, state semaphoreState, now time.Time, opts WriteOptions, s *session) error {
+	var last time.Time
+	for _, h := range state.Holders {
+		if h.ExpiresAt.After(last) {
+			last = h.ExpiresAt
+		}
+	}
+	if len(state.Holders) == 0 {
+		if entry != nil {
+			cs.emit(EventDelete, bucket, key, "")
+			cs.removeElement(cs.items[[2]string{bucket, key}])
+		}
+		return nil
+	}
+	value, _ := json.Marshal(state)
+	return cs.rewriteLocked(bucket, key, entry, string(value), max(last.Sub(now), time.Millisecond), opts, s)
+}
+
+// decodeSemaphore returns the holders entry has as of now, dropping those
+// that lapsed. A nil entry has none.
+func decodeSemaphore(entry *CacheEntry, now time.Time) (semaphoreState, error) {
+	state := semaphoreState{Holders: make(map[string]semaphoreHold)}
+	if entry == nil {
+		return state, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(entry.Value))
+	dec.DisallowUnknownFields()
+	if entry.Encoding != "" || dec.Decode(&state) != nil || state.Holders == nil {
+		return semaphoreState{}, ErrNotSemaphore
+	}
+	for token, h := range state.Holders {
+		if !h.ExpiresAt.After(now) {
+			delete(state.Holders, token)
+		}
+	}
+	return state, nil
+}
+
+func (state semaphoreState) held() int {
+	n := 0
+	for _, h := range state.Holders {
+		n += h.Permits
+	}
+	return n
+}
+
+// semaphoreRequest is the body of POST /semaphores/{bucket}/{key}.
+type semaphoreRequest struct {
+	Limit   int     `json:"limit"`
+	Permits *int    `json:"permits"` // absent means 1
+	TTL     jsonTTL `json:"ttl"`     // absent means defaultSemaphoreTTL
+}
+
+// serveSemaphore handles the semaphore endpoints:
+//
+//	GET    /semaphores/{bucket}/{key}           => {"held": n, "holders": n}
+//	POST   /semaphores/{bucket}/{key}           => acquire, {"limit": m, "permits": 1, "ttl": "30s"}
+//	DELETE /semaphores/{bucket}/{key}?token=... => release
+//
+// As with rate limiters, a request turned away still answers 200, with
+// "acquired": false. In buckets with HashKeys, the key is hashed like any
+// other.
+func serveSemaphore(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, key, _ := strings.Cut(r.URL.Path[len("/semaphores/"):], "/")
+	if bucket == "" || key == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	key, _ = storedKey(cache.GetBucketConfig(bucket), key)
+
+	allowed := []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+	if !slices.Contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, allowed...)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		permits, holders, err := cache.SemaphoreHeld(bucket, key)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int{"held": permits, "holders": holders})
+		return
+	case http.MethodDelete:
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			writeError(w, http.StatusBadRequest, "token is required")
+			return
+		}
+		if err := cache.ReleaseSemaphore(bucket, key, token, writeOptions(r)); err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req semaphoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	permits, ttl := 1, defaultSemaphoreTTL
+	if req.Permits != nil {
+		permits = *req.Permits
+	}
+	if req.TTL != 0 {
+		ttl = time.Duration(req.TTL)
+	}
+	res, err := cache.AcquireSemaphore(bucket, key, req.Limit, permits, ttl, writeOptions(r))
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	out := map[string]interface{}{
+		"acquired":  res.Acquired,
+		"limit":     req.Limit,
+		"available": res.Available,
+	}
+	if res.Acquired {
+		out["token"] = res.Token
+		out["expires_at"] = res.ExpiresAt
+	} else {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64((res.RetryAfter+time.Second-1)/time.Second), 10))
+		out["retry_after_ms"] = res.RetryAfter.Milliseconds()
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
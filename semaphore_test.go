@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Semaphore(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	a, err := cache.AcquireSemaphore("b", "s", 3, 2, time.Hour, WriteOptions{})
+	if err != nil || !a.Acquired || a.Token == "" || a.Available != 1 {
+		t.Fatalf("AcquireSemaphore => %+v, %v", a, err)
+	}
+	short, _ := cache.AcquireSemaphore("b", "s", 3, 1, 200*time.Millisecond, WriteOptions{})
+	if !short.Acquired || short.Available != 0 {
+		t.Fatalf("expected the last permit to be acquired, got %+v", short)
+	}
+	res, _ := cache.AcquireSemaphore("b", "s", 3, 1, time.Hour, WriteOptions{})
+	if res.Acquired || res.RetryAfter <= 0 || res.RetryAfter > 200*time.Millisecond {
+		t.Fatalf("expected a full semaphore to turn the caller away until the short hold lapses, got %+v", res)
+	}
+	if held, holders, _ := cache.SemaphoreHeld("b", "s"); held != 3 || holders != 2 {
+		t.Fatalf("SemaphoreHeld => %d, %d", held, holders)
+	}
+
+	// Unreleased permits lapse after their ttl
+	time.Sleep(250 * time.Millisecond)
+	if res, _ := cache.AcquireSemaphore("b", "s", 3, 1, time.Hour, WriteOptions{}); !res.Acquired {
+		t.Fatalf("expected the lapsed permit to be free, got %+v", res)
+	}
+	if err := cache.ReleaseSemaphore("b", "s", short.Token, WriteOptions{}); !errors.Is(err, ErrSemaphoreNotHeld) {
+		t.Fatalf("expected ErrSemaphoreNotHeld for a lapsed token, got %v", err)
+	}
+	if err := cache.ReleaseSemaphore("b", "s", a.Token, WriteOptions{}); err != nil {
+		t.Fatalf("ReleaseSemaphore => %v", err)
+	}
+	if held, _, _ := cache.SemaphoreHeld("b", "s"); held != 1 {
+		t.Fatalf("expected releasing to free the permits, got %d held", held)
+	}
+
+	// Concurrent callers never hold more than the limit between them
+	var acquired int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, _ := cache.AcquireSemaphore("b", "race", 10, 1, time.Hour, WriteOptions{}); res.Acquired {
+				atomic.AddInt64(&acquired, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired != 10 {
+		t.Fatalf("expected exactly 10 permits acquired, got %d", acquired)
+	}
+
+	// The semaphore goes with its last holder
+	one, _ := cache.AcquireSemaphore("b", "one", 1, 1, time.Hour, WriteOptions{})
+	cache.ReleaseSemaphore("b", "one", one.Token, WriteOptions{})
+	if _, found, _ := cache.Peek("b", "one"); found {
+		t.Fatalf("expected the last release to remove the semaphore")
+	}
+
+	for _, c := range []struct {
+		limit, permits int
+		ttl            time.Duration
+	}{
+		{0, 1, time.Second},
+		{1, 0, time.Second},
+		{1, 2, time.Second},
+		{1, 1, 0},
+	} {
+		if _, err := cache.AcquireSemaphore("b", "bad", c.limit, c.permits, c.ttl, WriteOptions{}); !errors.Is(err, ErrInvalidSemaphore) {
+			t.Fatalf("AcquireSemaphore(%d, %d, %v): expected ErrInvalidSemaphore, got %v", c.limit, c.permits, c.ttl, err)
+		}
+	}
+	cache.Set("b", "word", "hello")
+	if _, err := cache.AcquireSemaphore("b", "word", 1, 1, time.Second, WriteOptions{}); !errors.Is(err, ErrNotSemaphore) {
+		t.Fatalf("expected ErrNotSemaphore, got %v", err)
+	}
+}
+
+func TestHTTP_Semaphore(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	body := `{"limit":2,"permits":2,"ttl":"1h"}`
+	resp, out := httpJSON(t, "POST", server.URL+"/semaphores/b/s", body)
+	token, _ := out["token"].(string)
+	if resp.StatusCode != http.StatusOK || out["acquired"] != true || token == "" || out["available"] != 0.0 {
+		t.Fatalf("expected the permits to be acquired, got %d %v", resp.StatusCode, out)
+	}
+	resp, out = httpJSON(t, "POST", server.URL+"/semaphores/b/s", `{"limit":2}`)
+	if resp.StatusCode != http.StatusOK || out["acquired"] != false || resp.Header.Get("Retry-After") != "3600" {
+		t.Fatalf("expected the caller to be turned away with Retry-After, got %d %v %q", resp.StatusCode, out, resp.Header.Get("Retry-After"))
+	}
+	if _, out := httpJSON(t, "GET", server.URL+"/semaphores/b/s", ""); out["held"] != 2.0 || out["holders"] != 1.0 {
+		t.Fatalf("unexpected GET %v", out)
+	}
+	if resp, _ := httpJSON(t, "DELETE", server.URL+"/semaphores/b/s?token="+token, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE => %d", resp.StatusCode)
+	}
+	if _, out := httpJSON(t, "POST", server.URL+"/semaphores/b/s", `{"limit":2}`); out["acquired"] != true {
+		t.Fatalf("expected the released permits to be free, got %v", out)
+	}
+
+	cache.Set("b", "word", "hello")
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/semaphores/b/word", body, http.StatusConflict},
+		{"GET", "/semaphores/b/word", "", http.StatusConflict},
+		{"DELETE", "/semaphores/b/s?token=" + token, "", http.StatusConflict},
+		{"DELETE", "/semaphores/b/s", "", http.StatusBadRequest},
+		{"POST", "/semaphores/b/s", `{"permits":1}`, http.StatusBadRequest},
+		{"POST", "/semaphores/b/s", `{"limit":2,"ttl":"soon"}`, http.StatusBadRequest},
+		{"PUT", "/semaphores/b/s", "", http.StatusMethodNotAllowed},
+		{"POST", "/semaphores/b", body, http.StatusNotFound},
+	} {
+		if resp, _ := httpJSON(t, c.method, server.URL+c.path, c.body); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+}
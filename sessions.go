@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sessionHeader tags a write with a session; the entry is removed when the
+// session ends or stops sending heartbeats.
+const sessionHeader = "X-Kitsune-Session"
+
+// sessionSweepInterval is how often expired sessions are looked for. It is
+// independent of the cleanup interval because heartbeat TTLs are short.
+var sessionSweepInterval = time.Second
+
+// ErrSessionNotFound is returned for a session that was never opened, was
+// closed, or missed its heartbeat deadline.
+var ErrSessionNotFound = errors.New("session not found")
+
+// session is a lease owned by a client. Entries written under it live only
+// as long as the client keeps renewing the lease.
+type session struct {
+	ttl     time.Duration
+	expires time.Time
+	keys    map[[2]string]struct{} // (bucket,key) of entries tagged with the session
+}
+
+// SessionInfo describes an open session.
+type SessionInfo struct {
+	ID        string `json:"id"`
+	TTL       int64  `json:"ttl"`        // heartbeat TTL in seconds
+	ExpiresIn int64  `json:"expires_in"` // seconds until the lease lapses, rounded up
+	Keys      int    `json:"keys"`       // number of entries tagged with the session
+}
+
+// OpenSession creates the session id, or renews it and changes its TTL if it
+// is already open. ttl must be positive.
+func (cs *CacheSystem) OpenSession(id string, ttl time.Duration) error {
+	if err := cs.lock(); err != nil {
+		return err
+	}
+	defer cs.unlock()
+
+	now := time.Now()
+	if s := cs.liveSessionLocked(id, now); s != nil {
+		s.ttl = ttl
+		s.expires = now.Add(ttl)
+		return nil
+	}
+	cs.sessions[id] = &session{ttl: ttl, expires: now.Add(ttl), keys: make(map[[2]string]struct{})}
+	return nil
+}
+
+// Heartbeat renews the session's lease for another TTL.
+func (cs *CacheSystem) Heartbeat(id string) error {
+	if err := cs.lock(); err != nil {
+		return err
+	}
+	defer cs.unlock()
+
+	now := time.Now()
+	s := cs.liveSessionLocked(id, now)
+	if s == nil {
+		return ErrSessionNotFound
+	}
+	s.expires = now.Add(s.ttl)
+	return nil
+}
+
+// CloseSession ends the session and removes its entries, returning how many
+// were removed.
+func (cs *CacheSystem) CloseSession(id string) (int, error) {
+	if err := cs.lock(); err != nil {
+		return 0, err
+	}
+	defer cs.unlock()
+
+	if cs.liveSessionLocked(id, time.Now()) == nil {
+		return 0, ErrSessionNotFound
+	}
+	return cs.endSessionLocked(id, EventDelete), nil
+}
+
+// Session reports on an open session.
+func (cs *CacheSystem) Session(id string) (SessionInfo, error) {
+	if err := cs.rlock(); err != nil {
+		return SessionInfo{}, err
+	}
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	s, ok := cs.sessions[id]
+	if !ok || now.After(s.expires) {
+		return SessionInfo{}, ErrSessionNotFound
+	}
+	return SessionInfo{
+		ID:        id,
+		TTL:       int64(s.ttl / time.Second),
+		ExpiresIn: int64((s.expires.Sub(now) + time.Second - 1) / time.Second),
+		Keys:      len(s.keys),
+	}, nil
+}
+
+// SetInSession is like SetWithTTL but ties the entry to an open session.
+// An empty session writes an ordinary entry.
+func (cs *CacheSystem) SetInSession(sessionID, bucket, key, value string, ttl time.Duration) error {
+	return cs.SetManyInSession(sessionID, bucket, []BulkItem{{Key: key, Value: value, TTL: ttl}})
+}
+
+// SetManyInSession is like SetMany but ties every entry to an open session.
+// An empty session writes ordinary entries.
+func (cs *CacheSystem) SetManyInSession(sessionID, bucket string, items []BulkItem) error {
+	return cs.SetManyWithOptions(bucket, items, WriteOptions{Session: sessionID})
+}
+
+// liveSessionLocked returns the session if it is open, ending it first if its
+// lease has lapsed. cs.mu must be held for writing.
+func (cs *CacheSystem) liveSessionLocked(id string, now time.Time) *session {
+	s, ok := cs.sessions[id]
+	if !ok {
+		return nil
+	}
+	if now.After(s.expires) {
+		cs.endSessionLocked(id, EventExpire)
+		return nil
+	}
+	return s
+}
+
+// endSessionLocked forgets the session and removes its entries, publishing
+// one event of type typ per entry. cs.mu must be held for writing.
+func (cs *CacheSystem) endSessionLocked(id, typ string) int {
+	s, ok := cs.sessions[id]
+	if !ok {
+		return 0
+	}
+	// Detach first so removeElement doesn't edit the set we're ranging over.
+	delete(cs.sessions, id)
+	removed := 0
+	for k := range s.keys {
+		elem, ok := cs.items[k]
+		if !ok {
+			continue
+		}
+		if entry := elem.Value.(*CacheEntry); !cs.isStale(entry) {
+			cs.emit(typ, k[0], k[1], "")
+			removed++
+		}
+		cs.removeElement(elem)
+	}
+	return removed
+}
+
+// sessionExpired reports whether entry belongs to a session whose lease has
+// lapsed but hasn't been swept yet. Safe under the read lock.
+func (cs *CacheSystem) sessionExpired(entry *CacheEntry, now time.Time) bool {
+	if entry.Session == "" {
+		return false
+	}
+	s, ok := cs.sessions[entry.Session]
+	return !ok || now.After(s.expires)
+}
+
+// expireSessions ends every session that missed its heartbeat deadline.
+func (cs *CacheSystem) expireSessions() {
+	cs.mu.RLock()
+	idle := len(cs.sessions) == 0
+	cs.mu.RUnlock()
+	if idle {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.unlock()
+	now := time.Now()
+	for id := range cs.sessions {
+		cs.liveSessionLocked(id, now)
+	}
+}
+
+// sessionRequest is the body of PUT /sessions/{id}.
+type sessionRequest struct {
+	TTL jsonTTL `json:"ttl"` // heartbeat TTL
+}
+
+// serveSession handles the session endpoints:
+//
+//	PUT    /sessions/{id}           {"ttl": seconds} => open or renew
+//	POST   /sessions/{id}/heartbeat => renew with the current TTL
+//	GET    /sessions/{id}           => SessionInfo
+//	DELETE /sessions/{id}           => end it and remove its entries
+func serveSession(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	id, action, _ := strings.Cut(r.URL.Path[len("/sessions/"):], "/")
+	if id == "" || (action != "" && action != "heartbeat") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	var err error
+	switch {
+	case action == "heartbeat" && r.Method == http.MethodPost:
+		err = cache.Heartbeat(id)
+	case action == "heartbeat":
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	case r.Method == http.MethodPut:
+		var req sessionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if req.TTL <= 0 {
+			writeError(w, http.StatusBadRequest, "ttl must be a positive number of seconds or a duration")
+			return
+		}
+		err = cache.OpenSession(id, time.Duration(req.TTL))
+	case r.Method == http.MethodGet:
+	case r.Method == http.MethodDelete:
+		var removed int
+		if removed, err = cache.CloseSession(id); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+			return
+		}
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		return
+	}
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+
+	info, err := cache.Session(id)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_Sessions(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	if err := cache.SetInSession("nope", "b", "k", "v", 0); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound for an unknown session, got %v", err)
+	}
+
+	if err := cache.OpenSession("s1", 50*time.Millisecond); err != nil {
+		t.Fatalf("OpenSession => %v", err)
+	}
+	cache.SetInSession("s1", "conn", "a", "1", 0)
+	cache.SetManyInSession("s1", "conn", []BulkItem{{Key: "b", Value: "2"}, {Key: "c", Value: "3"}})
+	cache.Set("conn", "plain", "x")
+	// Rewriting without the session takes the entry out of it
+	cache.Set("conn", "c", "3")
+
+	info, err := cache.Session("s1")
+	if err != nil || info.Keys != 2 {
+		t.Fatalf("expected 2 tagged keys, got %+v, %v", info, err)
+	}
+
+	// Heartbeats keep the session alive past its TTL
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if err := cache.Heartbeat("s1"); err != nil {
+			t.Fatalf("Heartbeat => %v", err)
+		}
+	}
+	if got := cache.Get("conn", "a"); got != "1" {
+		t.Fatalf("expected session entry to survive heartbeats, got %q", got)
+	}
+
+	// Once heartbeats stop, the session's entries go away
+	time.Sleep(70 * time.Millisecond)
+	if got := cache.Get("conn", "a"); got != "" {
+		t.Fatalf("expected session entry to be gone, got %q", got)
+	}
+	if err := cache.Heartbeat("s1"); err != ErrSessionNotFound {
+		t.Fatalf("expected lapsed session to be gone, got %v", err)
+	}
+	if size, _ := cache.GetBucketSize("conn"); size != 2 {
+		t.Fatalf("expected only untagged keys to remain, got %d", size)
+	}
+	if err := cache.checkInvariants(); err != nil {
+		t.Fatalf("invariants => %v", err)
+	}
+
+	// Closing a session removes its entries immediately
+	cache.OpenSession("s2", time.Minute)
+	cache.SetInSession("s2", "conn", "d", "4", 0)
+	if removed, err := cache.CloseSession("s2"); err != nil || removed != 1 {
+		t.Fatalf("CloseSession => %d, %v", removed, err)
+	}
+	if got := cache.Get("conn", "d"); got != "" {
+		t.Fatalf("expected closed session's entry to be gone, got %q", got)
+	}
+}
+
+func TestCacheSystem_SessionSweep(t *testing.T) {
+	defer func(d time.Duration) { sessionSweepInterval = d }(sessionSweepInterval)
+	sessionSweepInterval = 10 * time.Millisecond
+
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.OpenSession("s", 20*time.Millisecond)
+	cache.SetInSession("s", "conn", "a", "1", 0)
+	time.Sleep(100 * time.Millisecond)
+
+	// Removed by the background sweep, not by a read
+	if size, _ := cache.GetBucketSize("conn"); size != 0 {
+		t.Fatalf("expected the sweep to remove orphaned entries, %d left", size)
+	}
+}
+
+func TestHTTP_Sessions(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	do := func(method, path, session, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if session != "" {
+			req.Header.Set(sessionHeader, session)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s => %v", method, path, err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodPut, "/sessions/worker-1", "", `{"ttl": 0}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a zero ttl, got %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodPut, "/sessions/worker-1", "", `{"ttl": 30}`)
+	var info SessionInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || info.TTL != 30 || info.ExpiresIn != 30 {
+		t.Fatalf("unexpected open response %d %+v", resp.StatusCode, info)
+	}
+
+	// Tagged writes through every write path
+	resp = do(http.MethodPut, "/buckets/conn/a", "worker-1", `{"value":"1"}`)
+	resp.Body.Close()
+	resp = do(http.MethodPut, "/keys/b", "worker-1", `{"value":"2"}`)
+	resp.Body.Close()
+	resp = do(http.MethodPut, "/buckets/conn", "worker-1", `{"c":"3"}`)
+	resp.Body.Close()
+
+	resp = do(http.MethodPut, "/buckets/conn/x", "worker-2", `{"value":"1"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown session, got %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodPost, "/sessions/worker-1/heartbeat", "", "")
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || info.Keys != 3 {
+		t.Fatalf("unexpected heartbeat response %d %+v", resp.StatusCode, info)
+	}
+
+	resp = do(http.MethodDelete, "/sessions/worker-1", "", "")
+	var removed map[string]int
+	json.NewDecoder(resp.Body).Decode(&removed)
+	resp.Body.Close()
+	if removed["removed"] != 3 {
+		t.Fatalf("expected 3 entries removed, got %v", removed)
+	}
+	if cache.Get("conn", "a") != "" || cache.Get("__root__", "b") != "" {
+		t.Fatalf("expected session entries to be removed")
+	}
+
+	resp = do(http.MethodGet, "/sessions/worker-1", "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 after close, got %d", resp.StatusCode)
+	}
+}
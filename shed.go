@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Endpoint classes that load shedding can turn away, from the most to the
+// least expensive.
+const (
+	shedBulk = "bulk" // /mset, /mget, /mdelete, /imports, PUT /buckets/{bucket} and prefix deletes
+	shedScan = "scan" // /buckets/{bucket}/all, /keys and /scan
+	shedKeys = "keys" // single-key operations
+)
+
+var shedClasses = []string{shedBulk, shedScan, shedKeys}
+
+// pressureRefresh is how long a pressure reading is reused, so that requests
+// don't each pay for reading runtime metrics.
+const pressureRefresh = 100 * time.Millisecond
+
+// LoadShedding turns away requests of the configured endpoint classes once
+// the instance is under enough pressure, so that expensive scans and batch
+// operations give way before single-key reads and writes do. Pressure is the
+// higher of the concurrency load (in-flight requests over
+// -max-concurrent-requests) and memory pressure (Go memory in use over
+// GOMEMLIMIT), each from 0 to 1; without either limit it stays 0. Health
+// checks and admin, stats and metrics requests are never shed.
+type LoadShedding struct {
+	Thresholds map[string]float64 // class => pressure at which it is shed
+	Status     int                // 429 or 503
+
+	concurrency *ConcurrencyLimit
+	sheds       map[string]*int64 // class => requests shed, atomic
+
+	mu         sync.Mutex
+	memory     float64
+	memoryRead time.Time
+}
+
+// parseLoadShedding parses a -shed-endpoints spec like "scan=0.7,bulk=0.5".
+// Load is measured against concurrency, which may be nil.
+func parseLoadShedding(spec string, status int, concurrency *ConcurrencyLimit) (*LoadShedding, error) {
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return nil, fmt.Errorf("status %d must be 429 or 503", status)
+	}
+	s := &LoadShedding{
+		Thresholds:  make(map[string]float64),
+		Status:      status,
+		concurrency: concurrency,
+		sheds:       make(map[string]*int64),
+	}
+	for _, class := range shedClasses {
+		s.sheds[class] = new(int64)
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		class, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, expected class=pressure", pair)
+		}
+		if _, known := s.sheds[class]; !known {
+			return nil, fmt.Errorf("unknown endpoint class %q (want one of %s)", class, strings.Join(shedClasses, ", "))
+		}
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			return nil, fmt.Errorf("pressure %q for %s must be above 0 and at most 1", value, class)
+		}
+		s.Thresholds[class] = threshold
+	}
+	return s, nil
+}
+
+// shedClass returns the endpoint class of r, or "" if it is never shed.
+func shedClass(r *http.Request) string {
+	if requestLane(r) != laneNormal {
+		return ""
+	}
+	path := r.URL.Path
+	switch {
+	case path == "/mset", path == "/mget", path == "/mdelete", path == "/imports":
+		return shedBulk
+	case strings.HasPrefix(path, "/keys/"), strings.HasPrefix(path, "/counters/"), strings.HasPrefix(path, "/lists/"), strings.HasPrefix(path, "/hashes/"), strings.HasPrefix(path, "/zsets/"),
+		strings.HasPrefix(path, "/json/"), strings.HasPrefix(path, "/hlls/"), strings.HasPrefix(path, "/blooms/"),
+		strings.HasPrefix(path, "/bitmaps/"), strings.HasPrefix(path, "/ratelimit/"),
+		strings.HasPrefix(path, "/semaphores/"):
+		return shedKeys
+	case strings.HasPrefix(path, "/buckets/"):
+		_, sub, ok := strings.Cut(path[len("/buckets/"):], "/")
+		switch {
+		case !ok && (r.Method == http.MethodPut || r.URL.Query().Has("prefix")):
+			return shedBulk
+		case !ok:
+			return ""
+		case sub == "all", sub == "keys", sub == "scan":
+			return shedScan
+		case sub == "config", sub == "freeze", sub == "thaw":
+			return ""
+		}
+		return shedKeys
+	}
+	return ""
+}
+
+// Pressure returns the current pressure, from 0 to 1.
+func (s *LoadShedding) Pressure() float64 {
+	var load float64
+	if c := s.concurrency; c != nil && c.Max > 0 {
+		load = float64(c.InFlight()) / float64(c.Max-c.Reserved)
+	}
+	return math.Min(1, math.Max(load, s.memoryPressure()))
+}
+
+// memoryPressure returns runtimeMemoryPressure, reading it at most once per
+// pressureRefresh.
+func (s *LoadShedding) memoryPressure() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.memoryRead) >= pressureRefresh {
+		s.memoryRead = time.Now()
+		s.memory = runtimeMemoryPressure()
+	}
+	return s.memory
+}
+
+// runtimeMemoryPressure returns the Go runtime's memory use as a fraction of
+// GOMEMLIMIT, counted the way the limit counts it, or 0 if there is no limit.
+func runtimeMemoryPressure() float64 {
+	limit := debug.SetMemoryLimit(-1)
+	if limit <= 0 || limit == math.MaxInt64 {
+		return 0
+	}
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	used := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+	return float64(used) / float64(limit)
+}
+
+// Shed returns how many requests of each class were turned away.
+func (s *LoadShedding) Shed() map[string]int64 {
+	shed := make(map[string]int64, len(s.sheds))
+	for class, n := range s.sheds {
+		shed[class] = atomic.LoadInt64(n)
+	}
+	return shed
+}
+
+// String describes the thresholds for the startup log, cheapest class last.
+func (s *LoadShedding) String() string {
+	if len(s.Thresholds) == 0 {
+		return "off"
+	}
+	classes := make([]string, 0, len(s.Thresholds))
+	for class := range s.Thresholds {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool { return s.Thresholds[classes[i]] < s.Thresholds[classes[j]] })
+	parts := make([]string, len(classes))
+	for i, class := range classes {
+		parts[i] = fmt.Sprintf("%s at %g", class, s.Thresholds[class])
+	}
+	return fmt.Sprintf("%s with %d", strings.Join(parts, ", "), s.Status)
+}
+
+// Middleware answers requests of a class whose threshold the pressure has
+// reached with s.Status.
+func (s *LoadShedding) Middleware(next http.Handler) http.Handler {
+	if len(s.Thresholds) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := shedClass(r)
+		threshold, ok := s.Thresholds[class]
+		if ok && s.Pressure() >= threshold {
+			atomic.AddInt64(s.sheds[class], 1)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, s.Status, fmt.Sprintf("server under pressure, %s requests are shed; retry later", class))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShedClass(t *testing.T) {
+	for _, tc := range []struct{ method, path, want string }{
+		{http.MethodPost, "/mset", shedBulk},
+		{http.MethodPost, "/imports?id=x", shedBulk},
+		{http.MethodPut, "/buckets/b", shedBulk},
+		{http.MethodDelete, "/buckets/b?prefix=p", shedBulk},
+		{http.MethodDelete, "/buckets/b", ""},
+		{http.MethodGet, "/buckets/b/all", shedScan},
+		{http.MethodGet, "/buckets/b/scan?cursor=0", shedScan},
+		{http.MethodGet, "/buckets/b/keys", shedScan},
+		{http.MethodGet, "/buckets/b/k", shedKeys},
+		{http.MethodPost, "/buckets/b/k/incr", shedKeys},
+		{http.MethodGet, "/keys/k", shedKeys},
+		{http.MethodGet, "/buckets/b/config", ""},
+		{http.MethodGet, "/buckets/b/stats", ""},
+		{http.MethodGet, "/buckets/b/watch", ""},
+		{http.MethodGet, "/admin/usage", ""},
+		{http.MethodGet, "/", ""},
+	} {
+		if got := shedClass(httptest.NewRequest(tc.method, tc.path, nil)); got != tc.want {
+			t.Fatalf("shedClass(%s %s) = %q, want %q", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestParseLoadShedding(t *testing.T) {
+	for _, tc := range []struct {
+		spec   string
+		status int
+	}{
+		{"scan", 503},
+		{"export=0.5", 503},
+		{"scan=0", 503},
+		{"scan=1.5", 503},
+		{"scan=0.5", 500},
+	} {
+		if _, err := parseLoadShedding(tc.spec, tc.status, nil); err == nil {
+			t.Fatalf("expected an error for %q with %d", tc.spec, tc.status)
+		}
+	}
+	s, err := parseLoadShedding("", 503, nil)
+	if err != nil || len(s.Thresholds) != 0 || s.String() != "off" {
+		t.Fatalf("expected shedding to be off by default, got %v, %v", s, err)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	c, _ := parseConcurrencyLimit(12, 2)
+	s, err := parseLoadShedding("bulk=0.5, scan=0.8", http.StatusTooManyRequests, c)
+	if err != nil {
+		t.Fatalf("parseLoadShedding => %v", err)
+	}
+	if got := s.String(); got != "bulk at 0.5, scan at 0.8 with 429" {
+		t.Fatalf("String() = %q", got)
+	}
+	handler := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code
+	}
+
+	// 6 of the 10 ordinary slots: batch operations give way first
+	atomic.StoreInt64(&c.inflight, 6)
+	if p := s.Pressure(); p != 0.6 {
+		t.Fatalf("expected pressure 0.6, got %g", p)
+	}
+	if code := serve(http.MethodPost, "/mset"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected /mset to be shed with 429, got %d", code)
+	}
+	if code := serve(http.MethodGet, "/buckets/b/scan"); code != http.StatusOK {
+		t.Fatalf("expected scans to get through at 0.6, got %d", code)
+	}
+
+	// then scans, while single keys and admin stay up
+	atomic.StoreInt64(&c.inflight, 10)
+	if code := serve(http.MethodGet, "/buckets/b/scan"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected scans to be shed at 1, got %d", code)
+	}
+	for _, path := range []string{"/buckets/b/k", "/admin/usage", "/"} {
+		if code := serve(http.MethodGet, path); code != http.StatusOK {
+			t.Fatalf("expected %s to get through, got %d", path, code)
+		}
+	}
+
+	shed := s.Shed()
+	if shed[shedBulk] != 1 || shed[shedScan] != 1 || shed[shedKeys] != 0 {
+		t.Fatalf("unexpected shed counts %v", shed)
+	}
+}
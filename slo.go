@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SLO names, as used in metrics labels and webhook payloads.
+const (
+	sloAvailability = "availability"
+	sloLatency      = "latency"
+)
+
+// sloEvalInterval is how often burn rates are checked against the alert threshold.
+var sloEvalInterval = 30 * time.Second
+
+// sloConfig describes the objectives the server is held to.
+type sloConfig struct {
+	AvailabilityTarget float64       // fraction of requests that must not fail with 5xx
+	Latency            time.Duration // latency objective threshold; 0 disables the latency SLO
+	LatencyTarget      float64       // fraction of requests that must finish within Latency
+	BurnAlert          float64       // burn rate over both windows that fires an alert
+	Webhook            string        // URL alerts are POSTed to; empty for none
+}
+
+// sloWindows are the burn-rate windows. An alert fires only when both burn
+// faster than the threshold: the long window shows the problem is real, the
+// short one that it is still happening.
+var sloWindows = []struct {
+	name    string
+	minutes int64
+}{
+	{"5m", 5},
+	{"1h", 60},
+}
+
+// sloSlot counts the requests of one minute.
+type sloSlot struct {
+	epoch  int64
+	total  int64
+	errors int64
+	slow   int64
+}
+
+// sloTracker measures requests against the configured SLOs and alerts when
+// the error budget burns too fast.
+type sloTracker struct {
+	cfg    sloConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	minutes [60]sloSlot
+	total   sloSlot // lifetime counts; epoch unused
+	firing  map[string]bool
+
+	latency requestLatency // lock-free, not under mu
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newSLOTracker(cfg sloConfig) *sloTracker {
+	return &sloTracker{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 5 * time.Second},
+		firing: make(map[string]bool),
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Start begins periodic burn-rate evaluation.
+func (t *sloTracker) Start() {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(sloEvalInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stopCh:
+				return
+			case <-ticker.C:
+				t.evaluate(time.Now())
+			}
+		}
+	}()
+}
+
+// Stop ends evaluation and waits for in-flight webhooks.
+func (t *sloTracker) Stop() {
+	close(t.stopCh)
+	t.wg.Wait()
+}
+
+// targets returns the enabled SLOs and their targets.
+func (t *sloTracker) targets() map[string]float64 {
+	targets := map[string]float64{sloAvailability: t.cfg.AvailabilityTarget}
+	if t.cfg.Latency > 0 {
+		targets[sloLatency] = t.cfg.LatencyTarget
+	}
+	return targets
+}
+
+func (t *sloTracker) observe(status int, elapsed time.Duration, now time.Time) {
+	failed := status >= 500
+	slow := t.cfg.Latency > 0 && elapsed > t.cfg.Latency
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	minute := now.Unix() / 60
+	slot := &t.minutes[minute%int64(len(t.minutes))]
+	if slot.epoch != minute {
+		*slot = sloSlot{epoch: minute}
+	}
+	for _, s := range []*sloSlot{slot, &t.total} {
+		s.total++
+		if failed {
+			s.errors++
+		}
+		if slow {
+			s.slow++
+		}
+	}
+}
+
+// burnRateLocked is how fast the SLO's error budget is being spent over the
+// trailing window: 1 means exactly on budget. t.mu must be held.
+func (t *sloTracker) burnRateLocked(slo string, target float64, minutes int64, now time.Time) float64 {
+	epoch := now.Unix() / 60
+	var total, bad int64
+	for _, s := range t.minutes {
+		if s.epoch > epoch-minutes && s.epoch <= epoch {
+			total += s.total
+			if slo == sloLatency {
+				bad += s.slow
+			} else {
+				bad += s.errors
+			}
+		}
+	}
+	if total == 0 || target >= 1 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / (1 - target)
+}
+
+// sloAlert is the webhook payload sent when an alert fires or resolves.
+type sloAlert struct {
+	SLO       string             `json:"slo"`
+	State     string             `json:"state"` // "firing" or "resolved"
+	Target    float64            `json:"target"`
+	Threshold float64            `json:"threshold"`
+	BurnRates map[string]float64 `json:"burn_rates"`
+	At        time.Time          `json:"at"`
+}
+
+// evaluate compares the burn rates with the alert threshold and sends a
+// webhook for every SLO whose alert state changed.
+func (t *sloTracker) evaluate(now time.Time) []sloAlert {
+	t.mu.Lock()
+	var changed []sloAlert
+	for slo, target := range t.targets() {
+		rates := make(map[string]float64, len(sloWindows))
+		firing := t.cfg.BurnAlert > 0
+		for _, w := range sloWindows {
+			rates[w.name] = t.burnRateLocked(slo, target, w.minutes, now)
+			firing = firing && rates[w.name] >= t.cfg.BurnAlert
+		}
+		if firing == t.firing[slo] {
+			continue
+		}
+		t.firing[slo] = firing
+		state := "resolved"
+		if firing {
+			state = "firing"
+		}
+		changed = append(changed, sloAlert{SLO: slo, State: state, Target: target, Threshold: t.cfg.BurnAlert, BurnRates: rates, At: now.UTC()})
+	}
+	t.mu.Unlock()
+
+	for _, alert := range changed {
+		log.Printf("SLO %s alert %s (burn rates %v, threshold %g)", alert.SLO, alert.State, alert.BurnRates, alert.Threshold)
+		if t.cfg.Webhook != "" {
+			t.notify(alert)
+		}
+	}
+	return changed
+}
+
+func (t *sloTracker) notify(alert sloAlert) {
+	body, _ := json.Marshal(alert)
+	resp, err := t.client.Post(t.cfg.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("SLO webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("SLO webhook returned %s", resp.Status)
+	}
+}
+
+// statusRecorder captures the status code a handler writes.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// Middleware measures every request against the SLOs and records its
+// latency. Watch streams are long-lived by design and are left out.
+func (t *sloTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/watch") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			elapsed := time.Since(start)
+			t.latency.observe(r.Method, elapsed)
+			t.observe(rec.status, elapsed, start.Add(elapsed))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLOTracker_BurnRateAlerts(t *testing.T) {
+	alerts := make(chan sloAlert, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a sloAlert
+		json.NewDecoder(r.Body).Decode(&a)
+		alerts <- a
+	}))
+	defer hook.Close()
+
+	slo := newSLOTracker(sloConfig{
+		AvailabilityTarget: 0.99,
+		Latency:            10 * time.Millisecond,
+		LatencyTarget:      0.9,
+		BurnAlert:          5,
+		Webhook:            hook.URL,
+	})
+	now := time.Unix(1_700_000_000, 0)
+
+	// 10% errors against a 1% budget burns at 10x; latency is within budget
+	for i := 0; i < 100; i++ {
+		status := http.StatusOK
+		if i%10 == 0 {
+			status = http.StatusInternalServerError
+		}
+		slo.observe(status, time.Millisecond, now)
+	}
+	slo.mu.Lock()
+	burn := slo.burnRateLocked(sloAvailability, 0.99, 5, now)
+	slo.mu.Unlock()
+	if burn < 9.99 || burn > 10.01 {
+		t.Fatalf("expected a burn rate of 10, got %g", burn)
+	}
+
+	changed := slo.evaluate(now)
+	if len(changed) != 1 || changed[0].SLO != sloAvailability || changed[0].State != "firing" {
+		t.Fatalf("expected the availability alert to fire, got %+v", changed)
+	}
+	if a := <-alerts; a.SLO != sloAvailability || a.State != "firing" || a.BurnRates["1h"] < 9.99 {
+		t.Fatalf("unexpected webhook payload %+v", a)
+	}
+
+	// No repeat while the state holds
+	if changed := slo.evaluate(now); len(changed) != 0 {
+		t.Fatalf("expected no change on re-evaluation, got %+v", changed)
+	}
+
+	// Once the errors leave the short window the alert resolves
+	later := now.Add(10 * time.Minute)
+	for i := 0; i < 100; i++ {
+		slo.observe(http.StatusOK, time.Millisecond, later)
+	}
+	changed = slo.evaluate(later)
+	if len(changed) != 1 || changed[0].State != "resolved" {
+		t.Fatalf("expected the alert to resolve, got %+v", changed)
+	}
+	if a := <-alerts; a.State != "resolved" {
+		t.Fatalf("expected a resolved webhook, got %+v", a)
+	}
+}
+
+func TestHTTP_Metrics(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.Set("b", "k", "value")
+
+	limits := &RequestLimits{}
+	slo := newSLOTracker(sloConfig{AvailabilityTarget: 0.999, Latency: time.Second, LatencyTarget: 0.99, BurnAlert: 14.4})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(cache, limits, nil, nil, slo, nil))
+	mux.Handle("/", limits.Middleware(createHandler(cache, "__root__")))
+	server := httptest.NewServer(slo.Middleware(mux))
+	defer server.Close()
+
+	for _, path := range []string{"/buckets/b/k", "/nope"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s => %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics => %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		"kitsune_entries 1\n",
+		"kitsune_size_bytes 7\n",
+		`kitsune_rejected_requests_total{reason="body"} 0`,
+		"kitsune_slo_requests_total 2\n",
+		"kitsune_slo_errors_total 0\n",
+		`kitsune_slo_target{slo="availability"} 0.999`,
+		`kitsune_slo_burn_rate{slo="latency",window="1h"} 0`,
+		`kitsune_slo_alert_firing{slo="availability"} 0`,
+		`kitsune_request_duration_seconds_bucket{method="GET",le="+Inf"} 2`,
+		`kitsune_request_duration_seconds_count{method="PUT"} 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
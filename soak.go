@@ -0,0 +1,270 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// soakConfig controls the randomized workload run by `kitsune soak`.
+type soakConfig struct {
+	Duration       time.Duration
+	CheckInterval  time.Duration
+	Workers        int
+	Buckets        int
+	Keys           int
+	MaxValueSize   int
+	MaxSize        int64
+	TTL            time.Duration
+	Seed           int64
+	HeapGrowth     float64
+	GoroutineSlack int
+}
+
+// runSoak implements `kitsune soak [flags]`. It hammers an embedded cache with
+// a random mix of direct and HTTP operations, periodically verifies internal
+// invariants and resource usage, and returns 1 if any anomaly was found.
+func runSoak(args []string, out io.Writer) int {
+	var cfg soakConfig
+	fs := flag.NewFlagSet("kitsune soak", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.DurationVar(&cfg.Duration, "duration", 10*time.Minute, "How long to run the workload")
+	fs.DurationVar(&cfg.CheckInterval, "check-interval", 10*time.Second, "How often to check invariants and resource usage")
+	fs.IntVar(&cfg.Workers, "workers", runtime.NumCPU(), "Concurrent workload goroutines")
+	fs.IntVar(&cfg.Buckets, "buckets", 16, "Number of distinct buckets")
+	fs.IntVar(&cfg.Keys, "keys", 10000, "Number of distinct keys per bucket")
+	fs.IntVar(&cfg.MaxValueSize, "max-value-size", 512, "Max value size in bytes")
+	fs.Int64Var(&cfg.MaxSize, "max-size", 16<<20, "Max total cache size (bytes), small enough to force eviction")
+	ttlFlagVar(fs, &cfg.TTL, "ttl", 2*time.Second, "Entry TTL, short enough to exercise expiration")
+	fs.Int64Var(&cfg.Seed, "seed", time.Now().UnixNano(), "Random seed, printed so failures can be replayed")
+	fs.Float64Var(&cfg.HeapGrowth, "max-heap-growth", 2.0, "Max ratio of live heap to the post-warmup baseline")
+	fs.IntVar(&cfg.GoroutineSlack, "goroutine-slack", 10, "Goroutines allowed above the baseline after shutdown")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if cfg.Workers < 1 || cfg.Buckets < 1 || cfg.Keys < 1 || cfg.MaxValueSize < 1 || cfg.CheckInterval <= 0 {
+		fmt.Fprintln(out, "workers, buckets, keys, max-value-size, and check-interval must be positive")
+		return 2
+	}
+
+	anomalies := soak(cfg, out)
+	if len(anomalies) > 0 {
+		fmt.Fprintf(out, "FAILED with %d anomalies (seed %d):\n", len(anomalies), cfg.Seed)
+		for _, a := range anomalies {
+			fmt.Fprintln(out, "  -", a)
+		}
+		return 1
+	}
+	fmt.Fprintf(out, "PASSED (seed %d)\n", cfg.Seed)
+	return 0
+}
+
+// soak runs the workload described by cfg and returns the anomalies found.
+func soak(cfg soakConfig, out io.Writer) []string {
+	baseGoroutines := runtime.NumGoroutine()
+	fmt.Fprintf(out, "soak: %s with %d workers, seed %d\n", cfg.Duration, cfg.Workers, cfg.Seed)
+
+	cache := NewCache(CacheConfig{MaxEntrySize: int64(cfg.MaxValueSize), MaxSize: cfg.MaxSize, TTL: cfg.TTL, CleanupInterval: time.Second})
+	handler := createHandler(cache, DEFAULT_KEYSPACE)
+
+	var (
+		mu        sync.Mutex
+		anomalies []string
+		ops       int64
+	)
+	report := func(format string, args ...interface{}) {
+		mu.Lock()
+		anomalies = append(anomalies, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func(rng *rand.Rand) {
+			defer wg.Done()
+			var n int64
+			for {
+				select {
+				case <-stop:
+					mu.Lock()
+					ops += n
+					mu.Unlock()
+					return
+				default:
+				}
+				if err := soakStep(cache, handler, rng, cfg); err != nil {
+					report("%v", err)
+				}
+				n++
+			}
+		}(rand.New(rand.NewSource(cfg.Seed + int64(w))))
+	}
+
+	deadline := time.After(cfg.Duration)
+	ticker := time.NewTicker(cfg.CheckInterval)
+	var baseHeap uint64
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+			if err := cache.checkInvariants(); err != nil {
+				report("invariant violated: %v", err)
+			}
+			heap := liveHeap()
+			if baseHeap == 0 {
+				// The first interval is warm-up: the cache fills to max-size.
+				baseHeap = heap
+			} else if float64(heap) > cfg.HeapGrowth*float64(baseHeap) {
+				report("live heap grew from %s to %s", formatBytes(int64(baseHeap)), formatBytes(int64(heap)))
+			}
+			fmt.Fprintf(out, "soak: heap %s, goroutines %d, anomalies %d\n", formatBytes(int64(heap)), runtime.NumGoroutine(), len(anomalies))
+		}
+	}
+	ticker.Stop()
+	close(stop)
+	wg.Wait()
+
+	if err := cache.checkInvariants(); err != nil {
+		report("invariant violated at shutdown: %v", err)
+	}
+	cache.Stop()
+
+	// Give exiting goroutines a moment before declaring a leak.
+	var leaked int
+	for i := 0; i < 50; i++ {
+		if leaked = runtime.NumGoroutine() - baseGoroutines; leaked <= cfg.GoroutineSlack {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if leaked > cfg.GoroutineSlack {
+		report("%d goroutines still running after shutdown", leaked)
+	}
+	fmt.Fprintf(out, "soak: %d operations\n", ops)
+	return anomalies
+}
+
+// soakStep performs one random operation, returning an error only when the
+// cache responds in a way that can never be correct.
+func soakStep(cache *CacheSystem, handler http.Handler, rng *rand.Rand, cfg soakConfig) error {
+	bucket := "b" + strconv.Itoa(rng.Intn(cfg.Buckets))
+	key := "k" + strconv.Itoa(rng.Intn(cfg.Keys))
+
+	switch p := rng.Intn(1000); {
+	case p < 400:
+		value := strings.Repeat("x", rng.Intn(cfg.MaxValueSize)+1)
+		return cache.Set(bucket, key, value)
+	case p < 800:
+		val, found, err := cache.Lookup(bucket, key)
+		if err == nil && found && strings.Trim(val, "x") != "" {
+			return fmt.Errorf("corrupted value for %s/%s: %q", bucket, key, val)
+		}
+		return err
+	case p < 900:
+		_, err := cache.Delete(bucket, key)
+		return err
+	case p < 998:
+		// Exercise the HTTP layer too.
+		var req *http.Request
+		if rng.Intn(2) == 0 {
+			req = httptest.NewRequest(http.MethodPut, "/buckets/"+bucket+"/"+key, strings.NewReader(`{"value":"xxxx"}`))
+		} else {
+			req = httptest.NewRequest(http.MethodGet, "/buckets/"+bucket+"/"+key, nil)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			return fmt.Errorf("%s %s => %d: %s", req.Method, req.URL.Path, rec.Code, rec.Body.String())
+		}
+		return nil
+	case p < 999:
+		return cache.Clear(bucket)
+	default:
+		return cache.ClearAll()
+	}
+}
+
+// liveHeap returns the heap in use right after a collection.
+func liveHeap() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// checkInvariants verifies that the LRU lists, the item index, the bucket
+// sets, and the size accounting all agree with each other.
+func (cs *CacheSystem) checkInvariants() error {
+	cs.mu.Lock()
+	defer cs.unlock()
+
+	if cs.entries.Len() != len(cs.items) {
+		return fmt.Errorf("list has %d entries but index has %d", cs.entries.Len(), len(cs.items))
+	}
+	var size int64
+	live := 0
+	for e := cs.entries.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*CacheEntry)
+		size += int64(entry.Size)
+		if cs.items[[2]string{entry.Bucket, entry.Key}] != e {
+			return fmt.Errorf("index does not point at list element for %s/%s", entry.Bucket, entry.Key)
+		}
+		if cs.isStale(entry) {
+			continue
+		}
+		live++
+		if !cs.buckets[entry.Bucket].has(entry.Key) {
+			return fmt.Errorf("%s/%s missing from its bucket set", entry.Bucket, entry.Key)
+		}
+	}
+	if size != cs.currentSize {
+		return fmt.Errorf("currentSize is %d but entries add up to %d", cs.currentSize, size)
+	}
+	if cs.currentSize > cs.maxSize {
+		return fmt.Errorf("currentSize %d exceeds maxSize %d", cs.currentSize, cs.maxSize)
+	}
+	inSets := 0
+	for bucket, keys := range cs.buckets {
+		if keys.len() == 0 {
+			return fmt.Errorf("empty key set left behind for bucket %q", bucket)
+		}
+		inSets += keys.len()
+	}
+	if inSets != live {
+		return fmt.Errorf("bucket sets hold %d keys but %d entries are live", inSets, live)
+	}
+	inLRUs := 0
+	for bucket, lru := range cs.bucketLRU {
+		for e := lru.Front(); e != nil; e = e.Next() {
+			if entry := e.Value.(*list.Element).Value.(*CacheEntry); entry.Bucket != bucket || entry.bucketElem != e {
+				return fmt.Errorf("bucket LRU of %q holds %s/%s out of place", bucket, entry.Bucket, entry.Key)
+			}
+			inLRUs++
+		}
+	}
+	if inLRUs != cs.entries.Len() {
+		return fmt.Errorf("bucket LRUs hold %d entries but the list has %d", inLRUs, cs.entries.Len())
+	}
+	for id, s := range cs.sessions {
+		for k := range s.keys {
+			elem, ok := cs.items[k]
+			if !ok || elem.Value.(*CacheEntry).Session != id {
+				return fmt.Errorf("session %q lists %s/%s, which it does not own", id, k[0], k[1])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSoak_Short(t *testing.T) {
+	var out bytes.Buffer
+	code := runSoak([]string{
+		"-duration", "500ms",
+		"-check-interval", "100ms",
+		"-workers", "4",
+		"-buckets", "3",
+		"-keys", "200",
+		"-max-size", "65536",
+		"-ttl", "1",
+		"-seed", "42",
+		"-max-heap-growth", "10",
+	}, &out)
+	if code != 0 {
+		t.Fatalf("expected soak to pass, got exit code %d:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "PASSED (seed 42)") {
+		t.Fatalf("expected PASSED summary, got:\n%s", out.String())
+	}
+}
+
+func TestCacheSystem_CheckInvariants(t *testing.T) {
+	cache := NewCacheSystem(1024, 999999, 60, 999999)
+	defer cache.Stop()
+
+	cache.Set("b", "k1", "v1")
+	cache.Set("b", "k2", "v2")
+	if err := cache.checkInvariants(); err != nil {
+		t.Fatalf("expected consistent cache, got %v", err)
+	}
+
+	// Corrupt the size accounting and make sure it's caught
+	cache.mu.Lock()
+	cache.currentSize += 3
+	cache.mu.Unlock()
+	if err := cache.checkInvariants(); err == nil {
+		t.Fatalf("expected size drift to be detected")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatCounters counts the operations on a bucket.
+type StatCounters struct {
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Sets        int64 `json:"sets"`
+	Deletes     int64 `json:"deletes"`
+	Expirations int64 `json:"expirations"`
+	Evictions   int64 `json:"evictions"`
+}
+
+// statHit and statMiss extend the event types with read outcomes.
+const (
+	statHit  = "hit"
+	statMiss = "miss"
+)
+
+func (c *StatCounters) add(kind string) {
+	switch kind {
+	case statHit:
+		c.Hits++
+	case statMiss:
+		c.Misses++
+	case EventSet:
+		c.Sets++
+	case EventDelete:
+		c.Deletes++
+	case EventExpire:
+		c.Expirations++
+	case EventEvict:
+		c.Evictions++
+	}
+}
+
+func (c *StatCounters) merge(o StatCounters) {
+	c.Hits += o.Hits
+	c.Misses += o.Misses
+	c.Sets += o.Sets
+	c.Deletes += o.Deletes
+	c.Expirations += o.Expirations
+	c.Evictions += o.Evictions
+}
+
+// StatRates are per-second rates over a trailing window.
+type StatRates struct {
+	Hits        float64 `json:"hits"`
+	Misses      float64 `json:"misses"`
+	Sets        float64 `json:"sets"`
+	Deletes     float64 `json:"deletes"`
+	Expirations float64 `json:"expirations"`
+	Evictions   float64 `json:"evictions"`
+	HitRatio    float64 `json:"hit_ratio"` // hits / (hits + misses) within the window, 0 if no reads
+}
+
+func (c StatCounters) rates(window time.Duration) StatRates {
+	secs := window.Seconds()
+	r := StatRates{
+		Hits:        float64(c.Hits) / secs,
+		Misses:      float64(c.Misses) / secs,
+		Sets:        float64(c.Sets) / secs,
+		Deletes:     float64(c.Deletes) / secs,
+		Expirations: float64(c.Expirations) / secs,
+		Evictions:   float64(c.Evictions) / secs,
+	}
+	if reads := c.Hits + c.Misses; reads > 0 {
+		r.HitRatio = float64(c.Hits) / float64(reads)
+	}
+	return r
+}
+
+// statWindows are the trailing windows rates are reported for.
+var statWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+// statSlot holds the counts for one second or one minute, identified by epoch.
+type statSlot struct {
+	epoch int64
+	c     StatCounters
+}
+
+// bucketStats keeps lifetime counters plus two rings of recent history:
+// 60 one-second slots for the 1m window and 60 one-minute slots for longer
+// windows, so each bucket costs a fixed few kilobytes.
+type bucketStats struct {
+	since   time.Time
+	total   StatCounters
+	seconds [60]statSlot
+	minutes [60]statSlot
+}
+
+func (s *bucketStats) record(kind string, now time.Time) {
+	s.total.add(kind)
+	sec := now.Unix()
+	slotAt(&s.seconds, sec).c.add(kind)
+	slotAt(&s.minutes, sec/60).c.add(kind)
+}
+
+// slotAt returns the slot for epoch, recycling it if it last held an older one.
+func slotAt(ring *[60]statSlot, epoch int64) *statSlot {
+	slot := &ring[epoch%int64(len(ring))]
+	if slot.epoch != epoch {
+		*slot = statSlot{epoch: epoch}
+	}
+	return slot
+}
+
+// window sums the counts of the trailing window d. Windows over a minute are
+// resolved to whole minutes, including the current partial one.
+func (s *bucketStats) window(d time.Duration, now time.Time) StatCounters {
+	ring, epoch, n := &s.seconds, now.Unix(), int64(d/time.Second)
+	if d > time.Minute {
+		ring, epoch, n = &s.minutes, now.Unix()/60, int64(d/time.Minute)
+	}
+	var sum StatCounters
+	for i := range ring {
+		if slot := ring[i]; slot.epoch > epoch-n && slot.epoch <= epoch {
+			sum.merge(slot.c)
+		}
+	}
+	return sum
+}
+
+// statsRegistry holds the per-bucket stats under its own lock, so reads that
+// only hold the cache's read lock can still count hits and misses.
+type statsRegistry struct {
+	mu      sync.Mutex
+	buckets map[string]*bucketStats
+	total   StatCounters // across all buckets, unaffected by ResetStats
+}
+
+func newStatsRegistry() *statsRegistry {
+	return &statsRegistry{buckets: make(map[string]*bucketStats)}
+}
+
+func (r *statsRegistry) record(bucket, kind string) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.buckets[bucket]
+	if !ok {
+		s = &bucketStats{since: now}
+		r.buckets[bucket] = s
+	}
+	s.record(kind, now)
+	r.total.add(kind)
+}
+
+// BucketStats is a point-in-time view of a bucket's statistics.
+type BucketStats struct {
+	Bucket  string               `json:"bucket"`
+	Since   time.Time            `json:"since"` // when counting started or was last reset
+	Totals  StatCounters         `json:"totals"`
+	Windows map[string]StatRates `json:"windows"`
+}
+
+// Stats returns the bucket's counters since the last reset and its rates
+// over the trailing 1m, 5m and 1h windows.
+func (cs *CacheSystem) Stats(bucket string) BucketStats {
+	now := time.Now()
+	out := BucketStats{Bucket: bucket, Windows: make(map[string]StatRates, len(statWindows))}
+
+	cs.stats.mu.Lock()
+	defer cs.stats.mu.Unlock()
+	s, ok := cs.stats.buckets[bucket]
+	if !ok {
+		s = &bucketStats{since: now}
+	}
+	out.Since = s.since
+	out.Totals = s.total
+	for _, w := range statWindows {
+		out.Windows[w.name] = s.window(w.d, now).rates(w.d)
+	}
+	return out
+}
+
+// ResetStats zeroes the bucket's counters and history.
+func (cs *CacheSystem) ResetStats(bucket string) {
+	cs.stats.mu.Lock()
+	defer cs.stats.mu.Unlock()
+	cs.stats.buckets[bucket] = &bucketStats{since: time.Now()}
+}
+
+// serveBucketStats handles GET/DELETE /buckets/{bucket}/stats; DELETE resets.
+func serveBucketStats(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		cache.ResetStats(bucket)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cache.Stats(bucket))
+}
+
+// churnCounters measure how much of what is written gets read before it is
+// replaced. Fields are updated atomically, since reads hold only the read lock.
+type churnCounters struct {
+	overwrites   int64 // writes that replaced a live entry
+	lifetime     int64 // nanoseconds the replaced entries had lived, summed
+	bytesWritten int64 // value bytes stored
+	bytesServed  int64 // value bytes returned by reads
+}
+
+func (c *churnCounters) overwrote(age time.Duration) {
+	atomic.AddInt64(&c.overwrites, 1)
+	atomic.AddInt64(&c.lifetime, int64(age))
+}
+
+func (c *churnCounters) wrote(n int)  { atomic.AddInt64(&c.bytesWritten, int64(n)) }
+func (c *churnCounters) served(n int) { atomic.AddInt64(&c.bytesServed, int64(n)) }
+
+// ChurnStats tell callers that rewrite keys faster than they read them apart
+// from those that use the cache as intended.
+type ChurnStats struct {
+	Overwrites     int64   `json:"overwrites"`      // sets that replaced a live entry
+	OverwriteRatio float64 `json:"overwrite_ratio"` // overwrites / sets
+	// AvgLifetime is how long, in seconds, an entry lived on average
+	// before being overwritten.
+	AvgLifetime        float64 `json:"avg_lifetime"`
+	BytesWritten       int64   `json:"bytes_written"`       // value bytes stored
+	BytesServed        int64   `json:"bytes_served"`        // value bytes returned by reads
+	WriteAmplification float64 `json:"write_amplification"` // bytes written per byte served, 0 if none served
+}
+
+func (c *churnCounters) export(sets int64) ChurnStats {
+	out := ChurnStats{
+		Overwrites:   atomic.LoadInt64(&c.overwrites),
+		BytesWritten: atomic.LoadInt64(&c.bytesWritten),
+		BytesServed:  atomic.LoadInt64(&c.bytesServed),
+	}
+	if sets > 0 {
+		out.OverwriteRatio = float64(out.Overwrites) / float64(sets)
+	}
+	if out.Overwrites > 0 {
+		out.AvgLifetime = time.Duration(atomic.LoadInt64(&c.lifetime) / out.Overwrites).Seconds()
+	}
+	if out.BytesServed > 0 {
+		out.WriteAmplification = float64(out.BytesWritten) / float64(out.BytesServed)
+	}
+	return out
+}
+
+// CacheStats is a point-in-time view of the whole cache.
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`     // bytes, counted like MaxSize
+	MaxSize int64 `json:"max_size"` // the cache's size limit in bytes
+	StatCounters
+	HitRatio         float64    `json:"hit_ratio"` // hits / (hits + misses), 0 if no reads
+	StartedAt        time.Time  `json:"started_at"`
+	Uptime           int64      `json:"uptime"` // seconds since StartedAt
+	Churn            ChurnStats `json:"churn"`
+	AdmissionRejects int64      `json:"admission_rejects"` // new keys turned away, see SetTinyLFU
+	ChecksumFailures int64      `json:"checksum_failures"` // reads of corrupted values, see SetChecksums
+}
+
+// CacheStats returns the cache's size and its counters since it started,
+// summed over every bucket.
+func (cs *CacheSystem) CacheStats() CacheStats {
+	entries, size := cs.Usage()
+	cs.stats.mu.Lock()
+	totals := cs.stats.total
+	cs.stats.mu.Unlock()
+
+	out := CacheStats{
+		Entries:          entries,
+		Size:             size,
+		MaxSize:          cs.maxSize,
+		StatCounters:     totals,
+		StartedAt:        cs.started,
+		Uptime:           int64(time.Since(cs.started) / time.Second),
+		Churn:            cs.churn.export(totals.Sets),
+		AdmissionRejects: cs.AdmissionRejects(),
+		ChecksumFailures: cs.ChecksumFailures(),
+	}
+	if reads := totals.Hits + totals.Misses; reads > 0 {
+		out.HitRatio = float64(totals.Hits) / float64(reads)
+	}
+	return out
+}
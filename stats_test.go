@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBucketStats_Windows(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	s := &bucketStats{since: start}
+
+	// One hit per second for ten minutes
+	for i := 0; i < 600; i++ {
+		s.record(statHit, start.Add(time.Duration(i)*time.Second))
+	}
+	now := start.Add(599 * time.Second)
+	if got := s.window(time.Minute, now).Hits; got != 60 {
+		t.Fatalf("expected 60 hits in the last minute, got %d", got)
+	}
+	if got := s.window(time.Hour, now).Hits; got != 600 {
+		t.Fatalf("expected 600 hits in the last hour, got %d", got)
+	}
+	if got := s.window(5*time.Minute, now).Hits; got < 240 || got > 300 {
+		t.Fatalf("expected about 300 hits in the last 5 minutes, got %d", got)
+	}
+	if r := s.window(time.Minute, now).rates(time.Minute); r.Hits != 1 || r.HitRatio != 1 {
+		t.Fatalf("expected 1 hit/s with ratio 1, got %+v", r)
+	}
+
+	// Old slots age out instead of being summed
+	later := now.Add(2 * time.Hour)
+	if got := s.window(time.Hour, later).Hits; got != 0 {
+		t.Fatalf("expected no hits two hours later, got %d", got)
+	}
+	if s.total.Hits != 600 {
+		t.Fatalf("expected lifetime total of 600, got %d", s.total.Hits)
+	}
+}
+
+func TestHTTP_BucketStats(t *testing.T) {
+	cache := NewCacheSystem(1_000_000, 10_000_000, 60, 999999)
+	defer cache.Stop()
+
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	cache.Set("b", "k", "v")
+	cache.Get("b", "k")
+	cache.Get("b", "k")
+	cache.Get("b", "missing")
+	cache.Delete("b", "k")
+	cache.Get("other", "k")
+
+	fetch := func(method string) BucketStats {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+"/buckets/b/stats", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s stats => %v", method, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s stats => expected 200, got %d", method, resp.StatusCode)
+		}
+		var st BucketStats
+		if err = json.NewDecoder(resp.Body).Decode(&st); err != nil {
+			t.Fatalf("decode => %v", err)
+		}
+		return st
+	}
+
+	st := fetch(http.MethodGet)
+	want := StatCounters{Hits: 2, Misses: 1, Sets: 1, Deletes: 1}
+	if st.Totals != want {
+		t.Fatalf("expected totals %+v, got %+v", want, st.Totals)
+	}
+	if r := st.Windows["1m"]; r.Sets != 1.0/60 || r.HitRatio < 0.66 || r.HitRatio > 0.67 {
+		t.Fatalf("unexpected 1m rates %+v", r)
+	}
+	if _, ok := st.Windows["1h"]; !ok {
+		t.Fatalf("expected a 1h window, got %v", st.Windows)
+	}
+
+	before := time.Now()
+	st = fetch(http.MethodDelete)
+	if st.Totals != (StatCounters{}) || st.Since.Before(before.Add(-time.Second)) {
+		t.Fatalf("expected reset stats, got %+v", st)
+	}
+	if other := cache.Stats("other"); other.Totals.Misses != 1 {
+		t.Fatalf("expected other bucket's stats to be untouched, got %+v", other.Totals)
+	}
+}
+
+func TestHTTP_CacheStats(t *testing.T) {
+	// Room for two 4-byte entries
+	cache := NewCacheSystem(1, 8, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	cache.Set("b", "k1", "v")
+	cache.Set("b", "k2", "v")
+	cache.Set("c", "k3", "v") // evicts b/k1
+	cache.Get("b", "k2")
+	cache.Get("b", "k1")
+	cache.SetWithTTL("c", "k4", "v", time.Millisecond) // evicts b/k2
+	time.Sleep(5 * time.Millisecond)
+	cache.Get("c", "k4")
+	cache.ResetStats("b")
+
+	resp, err := http.Get(server.URL + "/stats")
+	if err != nil {
+		t.Fatalf("GET /stats => %v", err)
+	}
+	defer resp.Body.Close()
+	var st CacheStats
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatalf("decode => %v", err)
+	}
+	want := StatCounters{Hits: 1, Misses: 2, Sets: 4, Expirations: 1, Evictions: 2}
+	if st.StatCounters != want {
+		t.Fatalf("expected counters %+v regardless of bucket resets, got %+v", want, st.StatCounters)
+	}
+	if st.Entries != 1 || st.Size != 4 || st.MaxSize != 8 || st.HitRatio < 0.33 || st.HitRatio > 0.34 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if st.StartedAt.IsZero() || st.Uptime != 0 {
+		t.Fatalf("unexpected start time %v and uptime %d", st.StartedAt, st.Uptime)
+	}
+}
+
+func TestCacheSystem_Churn(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	cache.Set("b", "k", "aaaa")
+	time.Sleep(20 * time.Millisecond)
+	cache.Set("b", "k", "bbbb")  // overwrite
+	cache.Append("b", "k", "cc") // overwrite in place
+	cache.Set("b", "other", "dd")
+	cache.Get("b", "k")
+	cache.SetWithTTL("b", "gone", "x", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	cache.Set("b", "gone", "y") // replaces an expired entry, not churn
+
+	churn := cache.CacheStats().Churn
+	if churn.Overwrites != 2 || churn.OverwriteRatio != 2.0/6 {
+		t.Fatalf("unexpected overwrites %+v", churn)
+	}
+	if churn.AvgLifetime < 0.01 {
+		t.Fatalf("expected the overwritten entries to have lived ~10ms on average, got %gs", churn.AvgLifetime)
+	}
+	if churn.BytesWritten != 4+4+6+2+1+1 || churn.BytesServed != 6 || churn.WriteAmplification != 3 {
+		t.Fatalf("unexpected byte counts %+v", churn)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Store is a durable backend that writes are propagated to once one is set
+// with SetStore. Every accepted write is put, including values the cache
+// itself doesn't keep (too large, or turned away by admission), and every
+// delete is deleted, whether or not the cache still holds the key. Expiry,
+// eviction and clears only drop the cached copy.
+type Store interface {
+	// Put stores v, whose Value is in v.Encoding as the cache holds it.
+	Put(bucket, key string, v StoredValue) error
+	// Delete removes key; deleting a key that isn't there is not an error.
+	Delete(bucket, key string) error
+	// DeletePrefix removes every key of bucket that starts with prefix.
+	DeletePrefix(bucket, prefix string) error
+}
+
+// Write modes for a Store.
+const (
+	StoreWriteThrough = "write-through" // each write reaches the store before it returns
+	StoreWriteBehind  = "write-behind"  // writes are queued and stored in the background
+)
+
+// StoreOptions configures how writes reach a Store.
+type StoreOptions struct {
+	Mode      string // StoreWriteThrough or StoreWriteBehind
+	QueueSize int    // write-behind queue capacity; a full queue makes writers wait
+}
+
+// storeOp is one write waiting for the store, or, if flushed is set, a marker
+// closed once every write queued before it has been stored. A delete with
+// prefix set removes every key starting with key.
+type storeOp struct {
+	bucket, key    string
+	value          StoredValue
+	delete, prefix bool
+	flushed        chan struct{}
+}
+
+// storeWriter applies writes to a Store, directly or through a bounded
+// queue drained by one goroutine, so that the store sees them in the order
+// the cache applied them. Writes are collected under CacheSystem.mu and
+// handed on once it is released, so store I/O never holds up the cache.
+type storeWriter struct {
+	store Store
+	mode  string
+	queue chan storeOp // nil when writing through
+	quit  chan struct{}
+	done  chan struct{}
+
+	mu        sync.Mutex // held while handing on pending writes, keeping them in order
+	pendingMu sync.Mutex
+	pending   []storeOp // collected under CacheSystem.mu, not yet handed on
+
+	stored, failed, stalls atomic.Int64
+}
+
+func newStoreWriter(s Store, opts StoreOptions) (*storeWriter, error) {
+	w := &storeWriter{store: s, mode: opts.Mode, quit: make(chan struct{}), done: make(chan struct{})}
+	switch opts.Mode {
+	case StoreWriteThrough:
+		close(w.done)
+	case StoreWriteBehind:
+		if opts.QueueSize <= 0 {
+			return nil, fmt.Errorf("write-behind queue size %d must be positive", opts.QueueSize)
+		}
+		w.queue = make(chan storeOp, opts.QueueSize)
+		go w.run()
+	default:
+		return nil, fmt.Errorf("unknown store mode %q (want %s or %s)", opts.Mode, StoreWriteThrough, StoreWriteBehind)
+	}
+	return w, nil
+}
+
+func (w *storeWriter) run() {
+	defer close(w.done)
+	for {
+		select {
+		case op := <-w.queue:
+			if op.flushed != nil {
+				close(op.flushed)
+				continue
+			}
+			w.apply(op)
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// write collects op. It is called with CacheSystem.mu held, which orders
+// the writes; drain hands them on once the lock is released.
+func (w *storeWriter) write(op storeOp) {
+	w.pendingMu.Lock()
+	w.pending = append(w.pending, op)
+	w.pendingMu.Unlock()
+}
+
+// drain stores the collected writes, or queues them when writing behind,
+// in the order they were made. A writer returns from it only once its own
+// writes have been handed on, so writing through still stores each write
+// before it returns, and a full queue makes the writers wait for room
+// without holding up readers or the cache lock.
+func (w *storeWriter) drain() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pendingMu.Lock()
+	ops := w.pending
+	w.pending = nil
+	w.pendingMu.Unlock()
+	for _, op := range ops {
+		w.hand(op)
+	}
+}
+
+// hand stores op, or queues it when writing behind; w.mu must be held.
+func (w *storeWriter) hand(op storeOp) {
+	if w.queue == nil {
+		w.apply(op)
+		return
+	}
+	select {
+	case w.queue <- op:
+		return
+	default:
+	}
+	w.stalls.Add(1)
+	select {
+	case w.queue <- op:
+	case <-w.quit:
+		// Closed: nothing drains the queue any more.
+		w.apply(op)
+	}
+}
+
+// queued counts the writes not yet stored.
+func (w *storeWriter) queued() int {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	return len(w.pending) + len(w.queue)
+}
+
+func (w *storeWriter) apply(op storeOp) {
+	var err error
+	switch {
+	case op.delete && op.prefix:
+		err = w.store.DeletePrefix(op.bucket, op.key)
+	case op.delete:
+		err = w.store.Delete(op.bucket, op.key)
+	default:
+		err = w.store.Put(op.bucket, op.key, op.value)
+	}
+	if err != nil {
+		w.failed.Add(1)
+		log.Printf("store: writing %s/%s: %v", op.bucket, op.key, err)
+		return
+	}
+	w.stored.Add(1)
+}
+
+// flush waits until every write made so far has been stored.
+func (w *storeWriter) flush() {
+	w.drain()
+	if w.queue == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	select {
+	case w.queue <- storeOp{flushed: flushed}:
+		<-flushed
+	case <-w.quit:
+	}
+}
+
+// close flushes the queue and stops draining it.
+func (w *storeWriter) close() {
+	w.flush()
+	select {
+	case <-w.quit:
+	default:
+		close(w.quit)
+	}
+	<-w.done
+}
+
+// SetStore propagates writes to s as opts describes, or stops propagating
+// them if s is nil. A store that is replaced is flushed first. Stop flushes
+// the store too, so queued writes aren't lost on shutdown.
+func (cs *CacheSystem) SetStore(s Store, opts StoreOptions) error {
+	var w *storeWriter
+	if s != nil {
+		var err error
+		if w, err = newStoreWriter(s, opts); err != nil {
+			return err
+		}
+	}
+	// Writes are collected under cs.mu, so the old store sees none after
+	// the swap; closing it stores those it already has.
+	cs.mu.Lock()
+	old := cs.store.Swap(w)
+	cs.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// FlushStore waits until every write made so far has reached the store.
+func (cs *CacheSystem) FlushStore() {
+	if w := cs.store.Load(); w != nil {
+		w.flush()
+	}
+}
+
+// StoreStats describes the writes propagated to the store.
+type StoreStats struct {
+	Mode   string `json:"mode"`
+	Stored int64  `json:"stored"` // writes the store accepted
+	Failed int64  `json:"failed"` // writes the store returned an error for; they are not retried
+	Queued int    `json:"queued"` // writes not yet stored
+	Stalls int64  `json:"stalls"` // writes that waited for room in a full queue
+}
+
+// StoreStats returns the store's counters, or false if no store is set.
+func (cs *CacheSystem) StoreStats() (StoreStats, bool) {
+	w := cs.store.Load()
+	if w == nil {
+		return StoreStats{}, false
+	}
+	return StoreStats{Mode: w.mode, Stored: w.stored.Load(), Failed: w.failed.Load(), Queued: w.queued(), Stalls: w.stalls.Load()}, true
+}
+
+// storeLocked collects a write for the store, if there is one; cs.mu must
+// be held for writing, and released with unlock so the write is handed on.
+func (cs *CacheSystem) storeLocked(op storeOp) {
+	if w := cs.store.Load(); w != nil {
+		w.write(op)
+	}
+}
+
+// unlock releases cs.mu, then hands the store the writes collected while it
+// was held.
+func (cs *CacheSystem) unlock() {
+	w := cs.store.Load()
+	cs.mu.Unlock()
+	if w != nil {
+		w.drain()
+	}
+}
+
+// fileStore keeps each entry in a file of its own, at
+// {dir}/{bucket}/{key} with both names base64url-encoded, holding the value
+// uncompressed. Files are replaced by renaming, so a reader never sees a
+// partial value. Names too long to encode are hashed, see fileName.
+type fileStore struct {
+	dir string
+}
+
+// maxFileName is the longest name fileStore encodes as is. Most file
+// systems refuse names over 255 bytes, and base64 grows a name by a third.
+const maxFileName = 200
+
+// Hashed names start with hashedNamePrefix, which base64url never does, and
+// the name they stand for is kept beside them in a file with nameFileSuffix.
+const (
+	hashedNamePrefix = "~"
+	nameFileSuffix   = ".name"
+)
+
+// fileName returns the file name fileStore keeps name under: name in
+// base64url or, if that is longer than maxFileName, hashedNamePrefix and
+// the hex SHA-256 of name, with hashed set.
+func fileName(name string) (file string, hashed bool) {
+	if enc := base64.RawURLEncoding.EncodeToString([]byte(name)); len(enc) <= maxFileName {
+		return enc, false
+	}
+	sum := sha256.Sum256([]byte(name))
+	return hashedNamePrefix + hex.EncodeToString(sum[:]), true
+}
+
+// newFileStore checks that dir, a -store-dir, is a writable directory,
+// creating it if needed.
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return nil, err
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(bucket, key string) string {
+	b, _ := fileName(bucket)
+	k, _ := fileName(key)
+	return filepath.Join(s.dir, b, k)
+}
+
+func (s *fileStore) Put(bucket, key string, v StoredValue) error {
+	value := v.Value
+	if v.Encoding == encodingGzip {
+		var err error
+		if value, err = gunzip(value); err != nil {
+			return err
+		}
+	}
+	path := s.path(bucket, key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if name, hashed := fileName(bucket); hashed {
+		if _, err := os.Stat(filepath.Join(s.dir, name+nameFileSuffix)); err != nil {
+			if err := writeFileAtomic(s.dir, name+nameFileSuffix, bucket); err != nil {
+				return err
+			}
+		}
+	}
+	if name, hashed := fileName(key); hashed {
+		if err := writeFileAtomic(dir, name+nameFileSuffix, key); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(dir, filepath.Base(path), value)
+}
+
+func (s *fileStore) Delete(bucket, key string) error {
+	path := s.path(bucket, key)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if _, hashed := fileName(key); hashed {
+		if err := os.Remove(path + nameFileSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePrefix lists the bucket's directory, since the cache may no longer
+// hold every key the store does.
+func (s *fileStore) DeletePrefix(bucket, prefix string) error {
+	b, _ := fileName(bucket)
+	dir := filepath.Join(s.dir, b)
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".") || isNameFile(name) {
+			continue
+		}
+		var key string
+		if strings.HasPrefix(name, hashedNamePrefix) {
+			if key, err = hashedName(dir, name); err != nil {
+				return err
+			}
+		} else {
+			raw, err := base64.RawURLEncoding.DecodeString(name)
+			if err != nil {
+				continue // not a file fileStore wrote
+			}
+			key = string(raw)
+		}
+		if strings.HasPrefix(key, prefix) {
+			if err := s.Delete(bucket, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic replaces dir/name with data by writing a temporary file
+// and renaming it into place.
+func writeFileAtomic(dir, name, data string) error {
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore records what reaches it, optionally waiting for release
+// before each write.
+type memoryStore struct {
+	mu      sync.Mutex
+	ops     []string
+	values  map[string]string
+	release chan struct{}
+}
+
+func (s *memoryStore) Put(bucket, key string, v StoredValue) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, "put "+bucket+"/"+key)
+	s.values[bucket+"/"+key] = v.Value
+	return nil
+}
+
+func (s *memoryStore) Delete(bucket, key string) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, "delete "+bucket+"/"+key)
+	delete(s.values, bucket+"/"+key)
+	return nil
+}
+
+func (s *memoryStore) DeletePrefix(bucket, prefix string) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, "delete-prefix "+bucket+"/"+prefix)
+	for k := range s.values {
+		if strings.HasPrefix(k, bucket+"/"+prefix) {
+			delete(s.values, k)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) snapshot() ([]string, map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		values[k] = v
+	}
+	return append([]string(nil), s.ops...), values
+}
+
+func TestCacheSystem_StoreWriteThrough(t *testing.T) {
+	cache := NewCacheSystem(16, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	store := &memoryStore{values: make(map[string]string)}
+	if err := cache.SetStore(store, StoreOptions{Mode: StoreWriteThrough}); err != nil {
+		t.Fatalf("SetStore => %v", err)
+	}
+
+	cache.Set("b", "a", "1")
+	cache.SetMany("b", []BulkItem{{Key: "c", Value: "x"}, {Key: "e", Value: "y", TTL: time.Millisecond}})
+	cache.IncrBy("b", "a", 2)
+	cache.Append("b", "c", "z")
+	cache.Set("b", "big", strings.Repeat("v", 32)) // too large to cache, still stored
+	cache.SetNX("b", "a", "ignored")
+	cache.Delete("b", "c")
+	time.Sleep(5 * time.Millisecond)
+	cache.Get("b", "e") // expires from the cache only
+	cache.Clear("b")
+
+	ops, values := store.snapshot()
+	want := "put b/a,put b/c,put b/e,put b/a,put b/c,put b/big,delete b/c"
+	if got := strings.Join(ops, ","); got != want {
+		t.Fatalf("expected store ops %s, got %s", want, got)
+	}
+	if values["b/a"] != "3" || values["b/e"] != "y" || len(values["b/big"]) != 32 {
+		t.Fatalf("unexpected store contents %v", values)
+	}
+	if st, ok := cache.StoreStats(); !ok || st.Stored != 7 || st.Mode != StoreWriteThrough {
+		t.Fatalf("unexpected store stats %+v", st)
+	}
+
+	if err := cache.SetStore(store, StoreOptions{Mode: "sometimes"}); err == nil {
+		t.Fatalf("expected an unknown mode to be rejected")
+	}
+}
+
+func TestCacheSystem_StoreDeletesUncached(t *testing.T) {
+	cache := NewCacheSystem(16, 40, 60, 999999)
+	defer cache.Stop()
+	store := &memoryStore{values: make(map[string]string)}
+	if err := cache.SetStore(store, StoreOptions{Mode: StoreWriteThrough}); err != nil {
+		t.Fatalf("SetStore => %v", err)
+	}
+
+	cache.Set("b", "big", strings.Repeat("v", 32)) // too large to cache
+	for _, k := range []string{"k1", "k2", "k3", "k4", "p1"} {
+		cache.Set("b", k, "0123456789")
+	}
+	if cache.Get("b", "k1") != "" {
+		t.Fatalf("expected k1 to have been evicted")
+	}
+	cache.Delete("b", "big")
+	cache.DeleteMany([]KeyRef{{Bucket: "b", Key: "k1"}})
+	cache.GetDel("b", "k2")
+	cache.Delete("b", "never")
+	cache.DeletePrefix("b", "p")
+
+	ops, values := store.snapshot()
+	for _, op := range []string{"delete b/big", "delete b/k1", "delete b/k2", "delete b/never", "delete-prefix b/p"} {
+		if !strings.Contains(","+strings.Join(ops, ",")+",", ","+op+",") {
+			t.Fatalf("expected %s to reach the store, got %v", op, ops)
+		}
+	}
+	for _, k := range []string{"b/big", "b/k1", "b/k2", "b/p1"} {
+		if _, ok := values[k]; ok {
+			t.Fatalf("expected %s to be gone from the store, got %v", k, values)
+		}
+	}
+}
+
+func TestCacheSystem_StoreWriteBehind(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	store := &memoryStore{values: make(map[string]string), release: make(chan struct{})}
+	if err := cache.SetStore(store, StoreOptions{Mode: StoreWriteBehind, QueueSize: 2}); err != nil {
+		t.Fatalf("SetStore => %v", err)
+	}
+
+	// The drain goroutine takes one write and blocks in the store, the
+	// queue holds two more, and the last has to wait for room.
+	wrote := make(chan struct{})
+	go func() {
+		for i := 0; i < 4; i++ {
+			cache.Set("b", fmt.Sprint(i), "v")
+		}
+		close(wrote)
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if st, _ := cache.StoreStats(); st.Stalls > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a write to wait for the full queue")
+		}
+	}
+	if ops, _ := store.snapshot(); len(ops) != 0 {
+		t.Fatalf("expected nothing stored yet, got %v", ops)
+	}
+
+	close(store.release)
+	<-wrote
+	cache.Delete("b", "0")
+	cache.Stop() // flushes the queue
+	ops, _ := store.snapshot()
+	if got := strings.Join(ops, ","); got != "put b/0,put b/1,put b/2,put b/3,delete b/0" {
+		t.Fatalf("expected every write stored in order by Stop, got %s", got)
+	}
+}
+
+func TestCacheSystem_StoreOutsideLock(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	store := &memoryStore{values: make(map[string]string), release: make(chan struct{})}
+	if err := cache.SetStore(store, StoreOptions{Mode: StoreWriteThrough}); err != nil {
+		t.Fatalf("SetStore => %v", err)
+	}
+
+	// The write blocks in the store, but only after releasing the cache
+	wrote := make(chan struct{})
+	go func() {
+		cache.Set("b", "k", "v")
+		close(wrote)
+	}()
+	read := make(chan string)
+	go func() {
+		for {
+			if v, found, _ := cache.Peek("b", "k"); found {
+				read <- v
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case v := <-read:
+		if v != "v" {
+			t.Fatalf("expected v, got %q", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected reads to go on while the store is slow")
+	}
+	select {
+	case <-wrote:
+		t.Fatalf("expected a write-through write to wait for the store")
+	default:
+	}
+
+	close(store.release)
+	<-wrote
+	if _, values := store.snapshot(); values["b/k"] != "v" {
+		t.Fatalf("expected the write stored once it returned, got %v", values)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatalf("newFileStore => %v", err)
+	}
+	if err := s.Put("b", "../k", StoredValue{Value: "plain"}); err != nil {
+		t.Fatalf("Put => %v", err)
+	}
+	if err := s.Put("b", "z", StoredValue{Value: string(gzipBytes(t, "unzipped")), Encoding: encodingGzip}); err != nil {
+		t.Fatalf("Put => %v", err)
+	}
+	for key, want := range map[string]string{"../k": "plain", "z": "unzipped"} {
+		data, err := os.ReadFile(s.path("b", key))
+		if err != nil || string(data) != want {
+			t.Fatalf("expected %s to hold %q, got %q, %v", key, want, data, err)
+		}
+		if filepath.Dir(filepath.Dir(s.path("b", key))) != dir {
+			t.Fatalf("expected %s inside the store, got %s", key, s.path("b", key))
+		}
+	}
+
+	if err := s.Delete("b", "z"); err != nil {
+		t.Fatalf("Delete => %v", err)
+	}
+	if err := s.Delete("b", "z"); err != nil {
+		t.Fatalf("expected deleting a missing key to succeed, got %v", err)
+	}
+	if _, err := os.Stat(s.path("b", "z")); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be gone, got %v", err)
+	}
+
+	// Names too long for a file are hashed, and kept in a name file
+	long := strings.Repeat("k", 300)
+	if err := s.Put(long, long, StoredValue{Value: "v"}); err != nil {
+		t.Fatalf("Put with a long key => %v", err)
+	}
+	path := s.path(long, long)
+	if len(filepath.Base(path)) > maxFileName || !strings.HasPrefix(filepath.Base(path), hashedNamePrefix) {
+		t.Fatalf("expected a hashed name, got %s", path)
+	}
+	for file, want := range map[string]string{path: "v", path + nameFileSuffix: long, filepath.Dir(path) + nameFileSuffix: long} {
+		if data, err := os.ReadFile(file); err != nil || string(data) != want {
+			t.Fatalf("expected %s to hold %.10q, got %.10q, %v", file, want, data, err)
+		}
+	}
+	if err := s.Delete(long, long); err != nil {
+		t.Fatalf("Delete => %v", err)
+	}
+	if _, err := os.Stat(path + nameFileSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected the name file to be gone, got %v", err)
+	}
+
+	// Prefix deletes find the keys by listing the bucket, hashed ones too
+	for _, key := range []string{"p1", "p" + long, "q"} {
+		if err := s.Put("b", key, StoredValue{Value: "v"}); err != nil {
+			t.Fatalf("Put => %v", err)
+		}
+	}
+	if err := s.DeletePrefix("b", "p"); err != nil {
+		t.Fatalf("DeletePrefix => %v", err)
+	}
+	for key, kept := range map[string]bool{"p1": false, "p" + long: false, "q": true, "../k": true} {
+		if _, err := os.Stat(s.path("b", key)); (err == nil) != kept {
+			t.Fatalf("expected %.10q kept %v, got %v", key, kept, err)
+		}
+	}
+	if err := s.DeletePrefix("none", "p"); err != nil {
+		t.Fatalf("expected a missing bucket to have nothing to delete, got %v", err)
+	}
+
+	if _, err := newFileStore(filepath.Join(s.path("b", "../k"), "sub")); err == nil {
+		t.Fatalf("expected a path under a file to be rejected")
+	}
+}
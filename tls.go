@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is how long a -tls-self-signed certificate is valid.
+// It is regenerated on every start, so this only needs to outlive a process.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// tlsConfig builds the TLS configuration described by the config, or returns
+// nil to serve plain HTTP.
+func (cfg *serverConfig) tlsConfig() (*tls.Config, error) {
+	if !cfg.TLSSelfSigned {
+		return nil, nil
+	}
+	cert, err := selfSignedCert(cfg.certHosts())
+	if err != nil {
+		return nil, fmt.Errorf("-tls-self-signed: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// certHosts returns the names a self-signed certificate should cover: each
+// -host entry, the addresses of interfaces named there, and for a wildcard
+// address the loopback addresses, "localhost" and the machine's host name,
+// since clients can reach it by any of them.
+func (cfg *serverConfig) certHosts() []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	add := func(h string) {
+		if h != "" && !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	for _, h := range strings.Split(cfg.Host, ",") {
+		h = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(h), "["), "]")
+		if addr, err := netip.ParseAddr(h); err == nil {
+			if !addr.IsUnspecified() {
+				add(addr.WithZone("").String())
+				continue
+			}
+			add("localhost")
+			add("127.0.0.1")
+			add("::1")
+			if name, err := os.Hostname(); err == nil {
+				add(name)
+			}
+			continue
+		}
+		if ifi, err := net.InterfaceByName(h); err == nil {
+			ifHosts, _ := interfaceHosts(ifi)
+			for _, ih := range ifHosts {
+				add(strings.SplitN(ih, "%", 2)[0])
+			}
+			continue
+		}
+		add(h)
+	}
+	return hosts
+}
+
+// selfSignedCert generates a certificate and key for hosts, each an IP
+// address or a DNS name, signed by the certificate itself. It is meant for
+// exercising TLS in development, not for production: clients have to trust
+// it explicitly or skip verification.
+func selfSignedCert(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"kitsune"}, CommonName: "kitsune self-signed"},
+		NotBefore:             now.Add(-time.Hour), // tolerate clients with slow clocks
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// certFingerprint returns the SHA-256 fingerprint of cert's leaf, for clients
+// to pin a self-signed certificate by.
+func certFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestServerConfig_CertHosts(t *testing.T) {
+	cfg := serverConfig{Host: "127.0.0.1, [::1],cache.internal,127.0.0.1"}
+	if got := strings.Join(cfg.certHosts(), ","); got != "127.0.0.1,::1,cache.internal" {
+		t.Fatalf("unexpected cert hosts %s", got)
+	}
+	cfg.Host = "0.0.0.0"
+	if hosts := cfg.certHosts(); !slices.Contains(hosts, "localhost") || !slices.Contains(hosts, "127.0.0.1") || !slices.Contains(hosts, "::1") {
+		t.Fatalf("expected a wildcard to cover loopback, got %v", hosts)
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	cfg := serverConfig{Host: "127.0.0.1,localhost", TLSSelfSigned: true}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig => %v", err)
+	}
+	cert := tlsConfig.Certificates[0]
+	if cert.Leaf.DNSNames[0] != "localhost" || !cert.Leaf.IPAddresses[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("unexpected SANs %v %v", cert.Leaf.DNSNames, cert.Leaf.IPAddresses)
+	}
+	if fp := certFingerprint(cert); len(fp) != 64 {
+		t.Fatalf("unexpected fingerprint %q", fp)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen => %v", err)
+	}
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := &http.Server{Handler: createHandler(cache, "__root__"), TLSConfig: tlsConfig}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	// A client that trusts the certificate can verify it for each SAN
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		resp, err := client.Get("https://" + net.JoinHostPort(host, port) + "/")
+		if err != nil {
+			t.Fatalf("GET via %s => %v", host, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+	}
+	if _, err := http.Get("https://" + ln.Addr().String() + "/"); err == nil {
+		t.Fatalf("expected a client that doesn't trust the certificate to fail")
+	}
+
+	cfg.TLSSelfSigned = false
+	if c, err := cfg.tlsConfig(); c != nil || err != nil {
+		t.Fatalf("expected no TLS without -tls-self-signed, got %v, %v", c, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bounds on the usage tree, so a cache with millions of distinct prefixes
+// still answers with a document a dashboard can render.
+const (
+	maxUsageDepth       = 8
+	defaultUsageFanout  = 50
+	maxUsageFanout      = 1000
+	defaultUsageDepth   = 2
+	defaultUsageDelimit = ":"
+)
+
+// UsageNode is the memory held under one key prefix. Bytes and Keys cover
+// everything below the node, including what is not broken out into Children.
+type UsageNode struct {
+	Name      string       `json:"name"`                // the prefix segment, or bucket name at the top
+	Bytes     int64        `json:"bytes"`               // counted like the cache size
+	Keys      int64        `json:"keys"`                // entries under the prefix
+	Children  []*UsageNode `json:"children,omitempty"`  // largest first
+	Truncated bool         `json:"truncated,omitempty"` // more children than the fanout were left out
+}
+
+// UsageTree is the cache's memory broken down by bucket, then by key prefix.
+type UsageTree struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Delimiter   string    `json:"delimiter"`
+	Depth       int       `json:"depth"`
+	UsageNode
+}
+
+// usageNode accumulates a UsageNode.
+type usageNode struct {
+	bytes, keys int64
+	children    map[string]*usageNode
+}
+
+func (n *usageNode) child(name string) *usageNode {
+	if n.children == nil {
+		n.children = make(map[string]*usageNode)
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &usageNode{}
+		n.children[name] = c
+	}
+	return c
+}
+
+// export converts the node, keeping the fanout largest children of each.
+func (n *usageNode) export(name string, fanout int) UsageNode {
+	out := UsageNode{Name: name, Bytes: n.bytes, Keys: n.keys}
+	for childName, c := range n.children {
+		child := c.export(childName, fanout)
+		out.Children = append(out.Children, &child)
+	}
+	sort.Slice(out.Children, func(i, j int) bool {
+		a, b := out.Children[i], out.Children[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Name < b.Name
+	})
+	if len(out.Children) > fanout {
+		out.Children, out.Truncated = out.Children[:fanout], true
+	}
+	return out
+}
+
+// UsageTree sums the size of live entries by bucket and then by the first
+// depth segments of their keys split on delimiter, so "users:42:profile"
+// with ":" and depth 2 counts towards "users" and "users" > "42". A key
+// with fewer segments counts towards its deepest prefix. bucket limits the
+// tree to one bucket; fanout caps the children kept per node. It walks the
+// entries under the read lock.
+func (cs *CacheSystem) UsageTree(bucket, delimiter string, depth, fanout int) (UsageTree, error) {
+	if err := cs.rlock(); err != nil {
+		return UsageTree{}, err
+	}
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	root := &usageNode{}
+	observe := func(entry *CacheEntry) {
+		if cs.isStale(entry) || entry.expiredAt(now) || cs.sessionExpired(entry, now) {
+			return
+		}
+		size := int64(entry.Size)
+		node := root
+		node.bytes += size
+		node.keys++
+		node = node.child(entry.Bucket)
+		node.bytes += size
+		node.keys++
+		rest := entry.Key
+		for i := 0; i < depth; i++ {
+			segment, after, found := strings.Cut(rest, delimiter)
+			if !found {
+				break // the last segment is the key itself, not a prefix
+			}
+			node = node.child(segment)
+			node.bytes += size
+			node.keys++
+			rest = after
+		}
+	}
+	if bucket == "" {
+		for e := cs.entries.Front(); e != nil; e = e.Next() {
+			observe(e.Value.(*CacheEntry))
+		}
+	} else if keys, ok := cs.buckets[bucket]; ok {
+		keys.each(func(key string) {
+			if elem, ok := cs.items[[2]string{bucket, key}]; ok {
+				observe(elem.Value.(*CacheEntry))
+			}
+		})
+	}
+	return UsageTree{GeneratedAt: now.UTC(), Delimiter: delimiter, Depth: depth, UsageNode: root.export("", fanout)}, nil
+}
+
+// serveAdminUsage handles GET /admin/usage?delimiter=&depth=&fanout=&bucket=.
+func serveAdminUsage(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	q := r.URL.Query()
+	delimiter, depth, fanout := defaultUsageDelimit, defaultUsageDepth, defaultUsageFanout
+	if q.Has("delimiter") {
+		if delimiter = q.Get("delimiter"); delimiter == "" {
+			writeError(w, http.StatusBadRequest, "delimiter must not be empty")
+			return
+		}
+	}
+	if s := q.Get("depth"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxUsageDepth {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("depth must be between 0 and %d", maxUsageDepth))
+			return
+		}
+		depth = n
+	}
+	if s := q.Get("fanout"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxUsageFanout {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("fanout must be between 1 and %d", maxUsageFanout))
+			return
+		}
+		fanout = n
+	}
+	tree, err := cache.UsageTree(q.Get("bucket"), delimiter, depth, fanout)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tree)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheSystem_UsageTree(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	cache.Set("app", "users:1:profile", "aaaa")
+	cache.Set("app", "users:2:profile", "aaaa")
+	cache.Set("app", "users:2:avatar", "aa")
+	cache.Set("app", "orders:9", "a")
+	cache.Set("app", "plain", "aaaaaaaaaaaaaaaaaaaa")
+	cache.Set("other", "x:y", "v")
+
+	tree, err := cache.UsageTree("", ":", 2, 50)
+	if err != nil {
+		t.Fatalf("UsageTree => %v", err)
+	}
+	if tree.Keys != 6 || tree.Bytes != cache.CacheStats().Size {
+		t.Fatalf("expected the root to cover the cache, got %d keys, %d bytes", tree.Keys, tree.Bytes)
+	}
+	if len(tree.Children) != 2 || tree.Children[0].Name != "app" || tree.Children[0].Keys != 5 {
+		t.Fatalf("unexpected buckets: %+v", tree.Children)
+	}
+	app := tree.Children[0]
+	if len(app.Children) != 2 || app.Children[0].Name != "users" || app.Children[1].Name != "orders" {
+		t.Fatalf("expected users then orders under app, got %+v", app.Children)
+	}
+	users := app.Children[0]
+	want := int64(len("app") + len("users:1:profile") + 4 + len("app") + len("users:2:profile") + 4 + len("app") + len("users:2:avatar") + 2)
+	if users.Keys != 3 || users.Bytes != want {
+		t.Fatalf("users => %d keys, %d bytes; want 3, %d", users.Keys, users.Bytes, want)
+	}
+	if len(users.Children) != 2 || users.Children[0].Name != "2" || users.Children[0].Keys != 2 || users.Children[0].Children != nil {
+		t.Fatalf("expected users > 2 first and no deeper than depth, got %+v", users.Children)
+	}
+	if app.Children[1].Children != nil {
+		t.Fatalf("expected the key segment of orders:9 not to be a prefix, got %+v", app.Children[1].Children)
+	}
+
+	tree, _ = cache.UsageTree("app", ":", 1, 1)
+	if len(tree.Children) != 1 || !tree.Children[0].Truncated || len(tree.Children[0].Children) != 1 {
+		t.Fatalf("expected one bucket with one kept child, got %+v", tree.Children)
+	}
+}
+
+func TestHTTP_AdminUsage(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+	cache.Set("b", "a/b/c", "v")
+
+	resp, err := http.Get(server.URL + "/admin/usage?delimiter=/&depth=3")
+	if err != nil {
+		t.Fatalf("GET => %v", err)
+	}
+	var tree UsageTree
+	err = json.NewDecoder(resp.Body).Decode(&tree)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("decode => %v", err)
+	}
+	if tree.Delimiter != "/" || len(tree.Children) != 1 || tree.Children[0].Children[0].Children[0].Name != "b" {
+		t.Fatalf("unexpected tree: %+v", tree)
+	}
+
+	for _, q := range []string{"delimiter=", "depth=-1", "depth=9", "fanout=0"} {
+		resp, err := http.Get(server.URL + "/admin/usage?" + q)
+		if err != nil {
+			t.Fatalf("GET => %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("?%s => %d, want 400", q, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupBucket summarizes one bucket of a backup.
+type backupBucket struct {
+	Entries int
+	Bytes   int64
+	Sum     uint32 // CRC-32C over the keys and values, in key order
+}
+
+// backupReport is what verifyBackup found.
+type backupReport struct {
+	Buckets  map[string]*backupBucket
+	Warnings []string
+	Problems []string // anything that stops the backup restoring as it was
+}
+
+// runVerifyBackup implements `kitsune verify-backup [flags] <dir>`: it
+// checks a copy of a -store-dir, prints a summary, and returns the process
+// exit code (1 if the backup has problems). It only reads dir, so it is
+// safe to run next to the server, though a copy taken while the server was
+// writing may show interrupted writes.
+func runVerifyBackup(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("kitsune verify-backup", flag.ContinueOnError)
+	fs.SetOutput(out)
+	maxEntrySize := fs.Int64("max-entry-size", DEFAULT_MAX_ENTRY_SIZE, "Max entry size (bytes) of the server the backup is for")
+	maxSize := fs.Int64("max-size", DEFAULT_MAX_SIZE, "Max total cache size (bytes) of the server the backup is for")
+	fs.Usage = func() {
+		fmt.Fprintln(out, "usage: kitsune verify-backup [flags] <store-dir>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	report, err := verifyBackup(fs.Arg(0), CacheConfig{MaxEntrySize: *maxEntrySize, MaxSize: *maxSize})
+	if err != nil {
+		fmt.Fprintf(out, "cannot read backup: %v\n", err)
+		return 1
+	}
+	names := make([]string, 0, len(report.Buckets))
+	entries, bytes := 0, int64(0)
+	for name, b := range report.Buckets {
+		names = append(names, name)
+		entries += b.Entries
+		bytes += b.Bytes
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := report.Buckets[name]
+		fmt.Fprintf(out, "bucket %q: %d entries, %s, crc32c %08x\n", name, b.Entries, formatBytes(b.Bytes), b.Sum)
+	}
+	for _, w := range report.Warnings {
+		fmt.Fprintf(out, "[WARN] %s\n", w)
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintf(out, "[FAIL] %s\n", p)
+	}
+	if len(report.Problems) > 0 {
+		fmt.Fprintf(out, "%d problem(s) found; this backup would not restore as it was written.\n", len(report.Problems))
+		return 1
+	}
+	fmt.Fprintf(out, "Verified %d buckets, %d entries, %s.\n", len(names), entries, formatBytes(bytes))
+	return 0
+}
+
+// isNameFile reports whether file holds the name of a hashed file beside it.
+func isNameFile(file string) bool {
+	return strings.HasPrefix(file, hashedNamePrefix) && strings.HasSuffix(file, nameFileSuffix)
+}
+
+// hashedName reads the bucket or key that fileStore keeps under the hashed
+// name file in dir, checking that it hashes to file.
+func hashedName(dir, file string) (string, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, file+nameFileSuffix))
+	if err != nil {
+		return "", fmt.Errorf("hashed name without a readable name file: %v", err)
+	}
+	if want, _ := fileName(string(raw)); want != file {
+		return "", fmt.Errorf("name file holds %q, whose hash is %s", raw, want)
+	}
+	return string(raw), nil
+}
+
+// verifyBackup reads every entry of the -store-dir at dir, checking that
+// the layout fileStore writes holds, and loads them into an instance of
+// its own configured by cfg. It then checks that instance's indexes and
+// that it holds every entry, byte for byte. Store files carry no checksum
+// of their own, so the per-bucket sums are for comparing backups, e.g. a
+// copy against its original. err is set only if dir can't be read at all.
+func verifyBackup(dir string, cfg CacheConfig) (backupReport, error) {
+	report := backupReport{Buckets: make(map[string]*backupBucket)}
+	warn := func(format string, args ...interface{}) {
+		report.Warnings = append(report.Warnings, fmt.Sprintf(format, args...))
+	}
+	fail := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+	tops, err := os.ReadDir(dir)
+	if err != nil {
+		return report, err
+	}
+
+	cfg.TTL = 0 // nothing may expire while it is checked
+	cfg.CleanupInterval = time.Hour
+	cache := NewCache(cfg)
+	defer cache.Stop()
+	values := make(map[[2]string]string)
+	tooLarge := 0
+	for _, top := range tops {
+		switch name := top.Name(); {
+		case strings.HasPrefix(name, ".probe-"):
+			warn("leftover write probe %s", name)
+			continue
+		case isNameFile(name):
+			if _, err := os.Stat(filepath.Join(dir, strings.TrimSuffix(name, nameFileSuffix))); err != nil {
+				warn("name file %s without a bucket", name)
+			}
+			continue
+		case !top.IsDir():
+			fail("stray file %s outside any bucket", name)
+			continue
+		}
+		var bucket string
+		if strings.HasPrefix(top.Name(), hashedNamePrefix) {
+			if bucket, err = hashedName(dir, top.Name()); err != nil {
+				fail("directory %s: %v", top.Name(), err)
+				continue
+			}
+		} else {
+			raw, err := base64.RawURLEncoding.DecodeString(top.Name())
+			if err != nil {
+				fail("directory %s is not a base64url bucket name", top.Name())
+				continue
+			}
+			bucket = string(raw)
+		}
+		files, err := os.ReadDir(filepath.Join(dir, top.Name()))
+		if err != nil {
+			fail("bucket %q: %v", bucket, err)
+			continue
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), ".tmp-") {
+				warn("bucket %q: interrupted write %s; the entry it was replacing is intact", bucket, f.Name())
+				continue
+			}
+			if !f.Type().IsRegular() {
+				fail("bucket %q: %s is not a regular file", bucket, f.Name())
+				continue
+			}
+			if isNameFile(f.Name()) {
+				if _, err := os.Stat(filepath.Join(dir, top.Name(), strings.TrimSuffix(f.Name(), nameFileSuffix))); err != nil {
+					warn("bucket %q: name file %s without an entry, left by an interrupted write", bucket, f.Name())
+				}
+				continue
+			}
+			var key string
+			if strings.HasPrefix(f.Name(), hashedNamePrefix) {
+				if key, err = hashedName(filepath.Join(dir, top.Name()), f.Name()); err != nil {
+					fail("bucket %q: file %s: %v", bucket, f.Name(), err)
+					continue
+				}
+			} else {
+				raw, err := base64.RawURLEncoding.DecodeString(f.Name())
+				if err != nil {
+					fail("bucket %q: file %s is not a base64url key", bucket, f.Name())
+					continue
+				}
+				key = string(raw)
+			}
+			value, err := os.ReadFile(filepath.Join(dir, top.Name(), f.Name()))
+			if err != nil {
+				fail("bucket %q, key %q: %v", bucket, key, err)
+				continue
+			}
+			values[[2]string{bucket, key}] = string(value)
+			if int64(len(value)) > cache.maxEntrySize {
+				tooLarge++ // the cache drops it without an error
+			}
+			if _, err := cache.SetWithOptions(bucket, BulkItem{Key: key, Value: string(value)}, WriteOptions{}); err != nil {
+				fail("bucket %q, key %q: %v", bucket, key, err)
+			}
+		}
+	}
+
+	if err := cache.checkInvariants(); err != nil {
+		fail("restored instance is inconsistent: %v", err)
+	}
+	keys := make([][2]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+	evicted := -tooLarge
+	for _, k := range keys {
+		value := values[k]
+		b := report.Buckets[k[0]]
+		if b == nil {
+			b = &backupBucket{}
+			report.Buckets[k[0]] = b
+		}
+		b.Entries++
+		b.Bytes += int64(len(value))
+		b.Sum = crc32.Update(b.Sum, castagnoli, []byte(k[1]))
+		b.Sum = crc32.Update(b.Sum, castagnoli, []byte(value))
+
+		got, found, _ := cache.Peek(k[0], k[1])
+		switch {
+		case !found:
+			evicted++
+		case got != value:
+			fail("bucket %q, key %q: restored value differs from the file", k[0], k[1])
+		}
+	}
+	// The store keeps what the cache turns away, so neither is a problem
+	// with the backup, but a server restored from it would be missing them.
+	if tooLarge > 0 {
+		warn("%d entries are over -max-entry-size and would not be cached", tooLarge)
+	}
+	if evicted > 0 {
+		warn("%d entries would be evicted to stay under -max-size", evicted)
+	}
+	return report, nil
+}
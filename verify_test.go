@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatalf("newFileStore => %v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		store.Put("users", key, StoredValue{Value: "value of " + key})
+	}
+	store.Put("big", "blob", StoredValue{Value: strings.Repeat("x", 100)})
+
+	var out bytes.Buffer
+	if code := runVerifyBackup([]string{dir}, &out); code != 0 {
+		t.Fatalf("expected a clean backup to verify, got code %d:\n%s", code, out.String())
+	}
+	for _, want := range []string{`bucket "users": 3 entries`, `bucket "big": 1 entries`, "Verified 2 buckets, 4 entries"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in:\n%s", want, out.String())
+		}
+	}
+	sum := out.String()
+
+	// Entries the configured server couldn't hold are warnings
+	out.Reset()
+	if code := runVerifyBackup([]string{"-max-entry-size", "50", dir}, &out); code != 0 || !strings.Contains(out.String(), "1 entries are over -max-entry-size") {
+		t.Fatalf("expected a warning for the oversized entry, got code %d:\n%s", code, out.String())
+	}
+
+	// An interrupted write leaves the entry intact; a different value
+	// changes the bucket's checksum
+	users := filepath.Dir(store.path("users", "a"))
+	os.WriteFile(filepath.Join(users, ".tmp-123"), []byte("partial"), 0o644)
+	store.Put("users", "a", StoredValue{Value: "changed"})
+	out.Reset()
+	if code := runVerifyBackup([]string{dir}, &out); code != 0 || !strings.Contains(out.String(), "[WARN] bucket \"users\": interrupted write .tmp-123") {
+		t.Fatalf("expected a warning for the temp file, got code %d:\n%s", code, out.String())
+	}
+	if strings.Split(out.String(), "\n")[1] == strings.Split(sum, "\n")[1] {
+		t.Fatalf("expected the checksum of users to change:\n%s", out.String())
+	}
+
+	// Files that aren't entries are problems
+	os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644)
+	os.WriteFile(filepath.Join(users, "not base64!"), nil, 0o644)
+	out.Reset()
+	if code := runVerifyBackup([]string{dir}, &out); code != 1 {
+		t.Fatalf("expected failure, got code %d:\n%s", code, out.String())
+	}
+	for _, want := range []string{"[FAIL] stray file notes.txt", "[FAIL] bucket \"users\": file not base64! is not a base64url key", "2 problem(s) found"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if code := runVerifyBackup([]string{filepath.Join(dir, "missing")}, &out); code != 1 {
+		t.Fatalf("expected a missing directory to fail, got %d", code)
+	}
+	if code := runVerifyBackup(nil, &out); code != 2 {
+		t.Fatalf("expected exit code 2 without a directory, got %d", code)
+	}
+}
+
+func TestVerifyBackup_HashedNames(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileStore(dir)
+	if err != nil {
+		t.Fatalf("newFileStore => %v", err)
+	}
+	long := strings.Repeat("k", 300)
+	store.Put(long, long, StoredValue{Value: "v"})
+	store.Put("b", long, StoredValue{Value: "w"})
+
+	var out bytes.Buffer
+	if code := runVerifyBackup([]string{dir}, &out); code != 0 || !strings.Contains(out.String(), "Verified 2 buckets, 2 entries") {
+		t.Fatalf("expected hashed names to verify, got code %d:\n%s", code, out.String())
+	}
+
+	// A hashed name is only as good as its name file
+	os.WriteFile(store.path("b", long)+nameFileSuffix, []byte("other"), 0o644)
+	out.Reset()
+	if code := runVerifyBackup([]string{dir}, &out); code != 1 || !strings.Contains(out.String(), `name file holds "other"`) {
+		t.Fatalf("expected a mismatched name file to fail, got code %d:\n%s", code, out.String())
+	}
+}
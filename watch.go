@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// watchHeartbeat is how often an idle watch stream sends an SSE comment so
+// proxies and clients don't time the connection out.
+var watchHeartbeat = 15 * time.Second
+
+// serveBucketWatch handles GET /buckets/{bucket}/watch as a Server-Sent Events
+// stream. A fresh watch receives one "snapshot" event per entry followed by a
+// "ready" event, then "set"/"delete"/"expire"/"evict"/"clear" events as they
+// happen. Every event after the snapshot carries an id; reconnecting with it in
+// Last-Event-ID (or ?since=) resumes without a new snapshot as long as the
+// missed events are still buffered, and otherwise starts over with "reset".
+func serveBucketWatch(w http.ResponseWriter, r *http.Request, cache *CacheSystem, bucket string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported by this connection")
+		return
+	}
+
+	token := r.Header.Get("Last-Event-ID")
+	if s := r.URL.Query().Get("since"); s != "" {
+		token = s
+	}
+	var since uint64
+	resume := token != ""
+	if resume {
+		var err error
+		if since, err = strconv.ParseUint(token, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid resume token")
+			return
+		}
+	}
+
+	cache.enableEvents()
+	watch, err := cache.watchBucket(bucket, since, resume)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	defer cache.events.unsubscribe(watch.sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if watch.Resumed {
+		for _, e := range watch.Backlog {
+			writeSSE(w, e.Seq, e.Type, e)
+		}
+	} else {
+		if resume {
+			// The requested position is gone; tell the client to drop its state.
+			writeSSE(w, 0, "reset", struct{}{})
+		}
+		for _, entry := range watch.Snapshot {
+			writeSSE(w, 0, "snapshot", entry)
+		}
+		writeSSE(w, watch.Seq, "ready", struct{}{})
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case e, open := <-watch.sub.ch:
+			if !open {
+				// Dropped for falling behind; the client resumes from its last id.
+				return
+			}
+			writeSSE(w, e.Seq, e.Type, e)
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSSE writes one Server-Sent Event. An id of 0 is omitted.
+func writeSSE(w http.ResponseWriter, id uint64, event string, data interface{}) {
+	payload, _ := json.Marshal(data)
+	if id != 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotZSet is returned by the sorted set operations when the key holds
+// something other than a sorted set.
+var ErrNotZSet = errors.New("value is not a sorted set")
+
+// ErrInvalidScore is returned for a score, or a score after an increment,
+// that isn't a finite number.
+var ErrInvalidScore = errors.New("score must be a finite number")
+
+// ZMember is a member of a sorted set and its score.
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// ZSetOptions controls an update of a sorted set. Sorted sets are entries
+// holding a JSON array of members in ascending order of score, ties broken
+// by member, so ranges are read without sorting and the sets are readable
+// as ordinary keys. Each update rewrites the whole array.
+type ZSetOptions struct {
+	WriteOptions
+	// TTL, if set, restarts the set's expiration. Otherwise a new set gets
+	// the default TTL and an existing one keeps its own.
+	TTL time.Duration
+}
+
+// ZSetUpdate is the outcome of UpdateZSet.
+type ZSetUpdate struct {
+	Added   int `json:"added"`   // members that weren't in the set before
+	Removed int `json:"removed"` // members that were and were removed
+	Length  int `json:"length"`  // members left
+}
+
+// UpdateZSet sets the scores in set and removes the members in remove,
+// under one lock acquisition, creating a missing set. Removing the last
+// member deletes the set.
+func (cs *CacheSystem) UpdateZSet(bucket, key string, set map[string]float64, remove []string, opts ZSetOptions) (ZSetUpdate, error) {
+	for _, score := range set {
+		if math.IsNaN(score) || math.IsInf(score, 0) {
+			return ZSetUpdate{}, ErrInvalidScore
+		}
+	}
+	var u ZSetUpdate
+	err := cs.updateZSet(bucket, key, opts, func(scores map[string]float64) bool {
+		for _, m := range remove {
+			if _, ok := scores[m]; ok {
+				delete(scores, m)
+				u.Removed++
+			}
+		}
+		for m, score := range set {
+			if _, ok := scores[m]; !ok {
+				u.Added++
+			}
+			scores[m] = score
+		}
+		u.Length = len(scores)
+		return len(set) > 0 || u.Removed > 0
+	})
+	if err != nil {
+		return ZSetUpdate{}, err
+	}
+	return u, nil
+}
+
+// IncrZSet adds delta to member's score, which starts from 0 if the member
+// or the set is missing, and returns the new score.
+func (cs *CacheSystem) IncrZSet(bucket, key, member string, delta float64, opts ZSetOptions) (float64, error) {
+	var score float64
+	var bad bool
+	err := cs.updateZSet(bucket, key, opts, func(scores map[string]float64) bool {
+		score = scores[member] + delta
+		if math.IsNaN(score) || math.IsInf(score, 0) {
+			bad = true
+			return false
+		}
+		scores[member] = score
+		return true
+	})
+	if err == nil && bad {
+		err = ErrInvalidScore
+	}
+	return score, err
+}
+
+// updateZSet runs update on the scores of the set and, if it reports a
+// change, writes the set back.
+func (cs *CacheSystem) updateZSet(bucket, key string, opts ZSetOptions, update func(scores map[string]float64) bool) error {
+	if err := cs.lock(); err != nil {
+		return err
+	}
+	defer cs.unlock()
+	if err := cs.writableLocked(bucket); err != nil {
+		return err
+	}
+	s, err := cs.writeSessionLocked(opts.WriteOptions)
+	if err != nil {
+		return err
+	}
+
+	entry := cs.liveEntryLocked(bucket, key)
+	members, err := decodeZSet(entry)
+	if err != nil {
+		return err
+	}
+	scores := make(map[string]float64, len(members))
+	for _, m := range members {
+		scores[m.Member] = m.Score
+	}
+	if !update(scores) {
+		return nil
+	}
+	if len(scores) == 0 {
+		if entry != nil {
+			cs.emit(EventDelete, bucket, key, "")
+			cs.removeElement(cs.items[[2]string{bucket, key}])
+		}
+		return nil
+	}
+	members = members[:0]
+	for m, score := range scores {
+		members = append(members, ZMember{Member: m, Score: score})
+	}
+	sortZSet(members)
+	value, _ := json.Marshal(members)
+	return cs.rewriteLocked(bucket, key, entry, string(value), opts.TTL, opts.WriteOptions, s)
+}
+
+// ZSetRange returns the members of the set ranked start to stop, inclusive,
+// along with its length. Rank 0 is the lowest score, or the highest if rev
+// is set, and negative ranks count from the other end. It reads the set
+// like LookupValue but never from the loader.
+func (cs *CacheSystem) ZSetRange(bucket, key string, start, stop int, rev bool) ([]ZMember, int, bool, error) {
+	members, found, err := cs.lookupZSet(bucket, key)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	if rev {
+		slices.Reverse(members)
+	}
+	lo, hi := indexRange(len(members), start, stop)
+	return members[lo:hi], len(members), true, nil
+}
+
+// ZSetRangeByScore returns up to limit members, or all of them if limit is
+// 0, with scores from minScore to maxScore inclusive, in ascending order of
+// score, or descending if rev is set, along with the set's length.
+func (cs *CacheSystem) ZSetRangeByScore(bucket, key string, minScore, maxScore float64, limit int, rev bool) ([]ZMember, int, bool, error) {
+	members, found, err := cs.lookupZSet(bucket, key)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	lo := sort.Search(len(members), func(i int) bool { return members[i].Score >= minScore })
+	hi := sort.Search(len(members), func(i int) bool { return members[i].Score > maxScore })
+	in := members[lo:max(lo, hi)]
+	if rev {
+		slices.Reverse(in)
+	}
+	if limit > 0 && len(in) > limit {
+		in = in[:limit]
+	}
+	return in, len(members), true, nil
+}
+
+// ZSetRank returns member's score and rank, counted from the lowest score,
+// or the highest if rev is set. found is false if the set or the member is
+// missing.
+func (cs *CacheSystem) ZSetRank(bucket, key, member string, rev bool) (score float64, rank int, found bool, err error) {
+	members, found, err := cs.lookupZSet(bucket, key)
+	if err != nil || !found {
+		return 0, 0, false, err
+	}
+	for i, m := range members {
+		if m.Member == member {
+			if rev {
+				i = len(members) - 1 - i
+			}
+			return m.Score, i, true, nil
+		}
+	}
+	return 0, 0, false, nil
+}
+
+func (cs *CacheSystem) lookupZSet(bucket, key string) ([]ZMember, bool, error) {
+	v, found, err := cs.lookupCachedValue(bucket, key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	members, err := decodeZSet(&CacheEntry{Value: v.Value, Encoding: v.Encoding})
+	if err != nil {
+		return nil, false, err
+	}
+	return members, true, nil
+}
+
+// decodeZSet returns the members entry holds, which are none for a nil
+// entry.
+func decodeZSet(entry *CacheEntry) ([]ZMember, error) {
+	if entry == nil {
+		return nil, nil
+	}
+	if entry.Encoding != "" || !strings.HasPrefix(entry.Value, "[") {
+		return nil, ErrNotZSet
+	}
+	var members []ZMember
+	dec := json.NewDecoder(strings.NewReader(entry.Value))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&members); err != nil {
+		return nil, ErrNotZSet
+	}
+	return members, nil
+}
+
+// sortZSet orders members by score, then by member.
+func sortZSet(members []ZMember) {
+	slices.SortFunc(members, func(a, b ZMember) int {
+		if c := cmp.Compare(a.Score, b.Score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Member, b.Member)
+	})
+}
+
+// zsetRequest is the body of PATCH /zsets/{bucket}/{key}, a JSON merge
+// patch of the scores where null removes a member, and of POST .../incr.
+type zsetRequest struct {
+	Members map[string]*float64 `json:"members"` // PATCH
+	Member  string              `json:"member"`  // incr
+	By      *float64            `json:"by"`      // incr; absent means 1
+	TTL     jsonTTL             `json:"ttl"`     // restarts the expiration if set
+}
+
+// serveZSet handles the sorted set endpoints:
+//
+//	GET    /zsets/{bucket}/{key}?start=&stop=[&rev=true]       => {"members": [...], "length": n}, by rank
+//	GET    /zsets/{bucket}/{key}?min=&max=[&limit=&rev=true]   => likewise, by score
+//	GET    /zsets/{bucket}/{key}?member=m[&rev=true]           => {"member": m, "score": s, "rank": r}
+//	PATCH  /zsets/{bucket}/{key}                               => set and remove members, {"members": {...}, "ttl": ...}
+//	POST   /zsets/{bucket}/{key}/incr                          => {"member": m, "by": 5, "ttl": ...}
+//	DELETE /zsets/{bucket}/{key}?member=m...                   => remove members
+//	DELETE /zsets/{bucket}/{key}                               => remove the set
+//
+// In buckets with HashKeys, the key is hashed like any other.
+func serveZSet(w http.ResponseWriter, r *http.Request, cache *CacheSystem) {
+	bucket, key, _ := strings.Cut(r.URL.Path[len("/zsets/"):], "/")
+	incr := false
+	if k, ok := strings.CutSuffix(key, "/incr"); ok && k != "" {
+		key, incr = k, true
+	}
+	if bucket == "" || key == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	key, _ = storedKey(cache.GetBucketConfig(bucket), key)
+	q := r.URL.Query()
+
+	allowed := []string{http.MethodGet, http.MethodPatch, http.MethodDelete}
+	if incr {
+		allowed = []string{http.MethodPost}
+	}
+	if !slices.Contains(allowed, r.Method) {
+		writeMethodNotAllowed(w, allowed...)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		serveZSetRead(w, q, cache, bucket, key)
+		return
+	case http.MethodDelete:
+		names := q["member"]
+		if len(names) == 0 {
+			if _, err := cache.Delete(bucket, key); err != nil {
+				writeCacheError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		u, err := cache.UpdateZSet(bucket, key, nil, names, ZSetOptions{WriteOptions: writeOptions(r)})
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(u)
+		return
+	}
+
+	var req zsetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TTL < 0 {
+		writeError(w, http.StatusBadRequest, "ttl must not be negative")
+		return
+	}
+	opts := ZSetOptions{WriteOptions: writeOptions(r), TTL: time.Duration(req.TTL)}
+	w.Header().Set("Content-Type", "application/json")
+	if incr {
+		if req.Member == "" {
+			writeError(w, http.StatusBadRequest, "member must not be empty")
+			return
+		}
+		by := 1.0
+		if req.By != nil {
+			by = *req.By
+		}
+		score, err := cache.IncrZSet(bucket, key, req.Member, by, opts)
+		if err != nil {
+			writeCacheError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]float64{"score": score})
+		return
+	}
+	if len(req.Members) == 0 {
+		writeError(w, http.StatusBadRequest, "members must not be empty")
+		return
+	}
+	set := make(map[string]float64, len(req.Members))
+	var remove []string
+	for m, score := range req.Members {
+		if score == nil {
+			remove = append(remove, m)
+		} else {
+			set[m] = *score
+		}
+	}
+	u, err := cache.UpdateZSet(bucket, key, set, remove, opts)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(u)
+}
+
+// serveZSetRead answers a GET of a sorted set, by rank, by score or for
+// one member, as the query asks.
+func serveZSetRead(w http.ResponseWriter, q url.Values, cache *CacheSystem, bucket, key string) {
+	get := q.Get
+	rev := get("rev") == "true"
+	ints := map[string]int{"start": 0, "stop": -1, "limit": 0}
+	for name := range ints {
+		if s := get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || (name == "limit" && n < 0) {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", name, s))
+				return
+			}
+			ints[name] = n
+		}
+	}
+	scores := map[string]float64{"min": math.Inf(-1), "max": math.Inf(1)}
+	byScore := false
+	for name := range scores {
+		if s := get(name); s != "" {
+			// An unescaped + in "+inf" arrives as a space.
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil || math.IsNaN(f) {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %s (want a number, -inf or +inf)", name, s))
+				return
+			}
+			scores[name], byScore = f, true
+		}
+	}
+
+	var (
+		out   interface{}
+		found bool
+		err   error
+	)
+	switch member := get("member"); {
+	case member != "":
+		var score float64
+		var rank int
+		score, rank, found, err = cache.ZSetRank(bucket, key, member, rev)
+		out = map[string]interface{}{"member": member, "score": score, "rank": rank}
+	case byScore:
+		var members []ZMember
+		var n int
+		members, n, found, err = cache.ZSetRangeByScore(bucket, key, scores["min"], scores["max"], ints["limit"], rev)
+		out = map[string]interface{}{"members": members, "length": n}
+	default:
+		var members []ZMember
+		var n int
+		members, n, found, err = cache.ZSetRange(bucket, key, ints["start"], ints["stop"], rev)
+		out = map[string]interface{}{"members": members, "length": n}
+	}
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSystem_ZSet(t *testing.T) {
+	cache := NewCacheSystem(256, 1_000_000, 60, 999999)
+	defer cache.Stop()
+
+	u, err := cache.UpdateZSet("b", "board", map[string]float64{"ada": 30, "bob": 10, "cy": 20, "dee": 20}, nil, ZSetOptions{TTL: time.Hour})
+	if err != nil || u != (ZSetUpdate{Added: 4, Length: 4}) {
+		t.Fatalf("UpdateZSet => %+v, %v", u, err)
+	}
+	if got := cache.Get("b", "board"); !strings.HasPrefix(got, `[{"member":"bob","score":10},{"member":"cy","score":20}`) {
+		t.Fatalf("expected members stored in score order, ties by member, got %s", got)
+	}
+
+	names := func(members []ZMember) string {
+		var s []string
+		for _, m := range members {
+			s = append(s, m.Member)
+		}
+		return strings.Join(s, ",")
+	}
+	for _, c := range []struct {
+		start, stop int
+		rev         bool
+		want        string
+	}{
+		{0, -1, false, "bob,cy,dee,ada"},
+		{0, 1, true, "ada,dee"},
+		{-2, -1, false, "dee,ada"},
+		{3, 10, false, "ada"},
+		{5, 10, false, ""},
+	} {
+		members, n, found, err := cache.ZSetRange("b", "board", c.start, c.stop, c.rev)
+		if err != nil || !found || n != 4 || names(members) != c.want {
+			t.Fatalf("ZSetRange(%d, %d, %t) => %v, %d, %v, %v, want %s", c.start, c.stop, c.rev, members, n, found, err, c.want)
+		}
+	}
+	for _, c := range []struct {
+		min, max float64
+		limit    int
+		rev      bool
+		want     string
+	}{
+		{20, 30, 0, false, "cy,dee,ada"},
+		{math.Inf(-1), 20, 0, true, "dee,cy,bob"},
+		{15, math.Inf(1), 2, false, "cy,dee"},
+		{31, 40, 0, false, ""},
+		{30, 10, 0, false, ""},
+	} {
+		members, _, _, err := cache.ZSetRangeByScore("b", "board", c.min, c.max, c.limit, c.rev)
+		if err != nil || names(members) != c.want {
+			t.Fatalf("ZSetRangeByScore(%g, %g) => %v, %v, want %s", c.min, c.max, members, err, c.want)
+		}
+	}
+
+	// Increments move a member and keep the TTL
+	if score, err := cache.IncrZSet("b", "board", "bob", 25, ZSetOptions{}); err != nil || score != 35 {
+		t.Fatalf("IncrZSet => %g, %v", score, err)
+	}
+	if score, rank, found, _ := cache.ZSetRank("b", "board", "bob", true); !found || score != 35 || rank != 0 {
+		t.Fatalf("expected bob to lead, got %g, %d, %v", score, rank, found)
+	}
+	if _, _, found, _ := cache.ZSetRank("b", "board", "zed", false); found {
+		t.Fatalf("expected a missing member not to be found")
+	}
+	if ttl, _ := cache.TTL("b", "board"); ttl <= time.Minute {
+		t.Fatalf("expected the set to keep its TTL, got %v", ttl)
+	}
+	if _, err := cache.IncrZSet("b", "board", "bob", math.MaxFloat64, ZSetOptions{}); err != nil {
+		t.Fatalf("IncrZSet => %v", err)
+	}
+	if _, err := cache.IncrZSet("b", "board", "bob", math.MaxFloat64, ZSetOptions{}); !errors.Is(err, ErrInvalidScore) {
+		t.Fatalf("expected an infinite score to be refused, got %v", err)
+	}
+	if _, err := cache.UpdateZSet("b", "board", map[string]float64{"x": math.NaN()}, nil, ZSetOptions{}); !errors.Is(err, ErrInvalidScore) {
+		t.Fatalf("expected NaN to be refused, got %v", err)
+	}
+	if _, err := cache.UpdateZSet("b", "board", map[string]float64{strings.Repeat("x", 256): 1}, nil, ZSetOptions{}); !errors.Is(err, ErrEntryTooLarge) {
+		t.Fatalf("expected ErrEntryTooLarge, got %v", err)
+	}
+
+	// Removing the last member removes the set
+	if u, _ := cache.UpdateZSet("b", "board", nil, []string{"ada", "bob", "cy", "dee"}, ZSetOptions{}); u != (ZSetUpdate{Removed: 4}) {
+		t.Fatalf("unexpected update %+v", u)
+	}
+	if _, _, found, _ := cache.ZSetRange("b", "board", 0, -1, false); found {
+		t.Fatalf("expected the set to be gone")
+	}
+
+	cache.Set("b", "word", "hello")
+	cache.PushList("b", "list", []string{"a"}, false, ListOptions{})
+	for _, key := range []string{"word", "list"} {
+		if _, err := cache.IncrZSet("b", key, "a", 1, ZSetOptions{}); !errors.Is(err, ErrNotZSet) {
+			t.Fatalf("%s: expected ErrNotZSet, got %v", key, err)
+		}
+	}
+}
+
+func TestHTTP_ZSets(t *testing.T) {
+	cache := NewCacheSystem(1024, 1_000_000, 60, 999999)
+	defer cache.Stop()
+	server := httptest.NewServer(createHandler(cache, "__root__"))
+	defer server.Close()
+
+	first := func(out map[string]interface{}) string {
+		members, _ := out["members"].([]interface{})
+		if len(members) == 0 {
+			return ""
+		}
+		return members[0].(map[string]interface{})["member"].(string)
+	}
+
+	if resp, out := httpJSON(t, "PATCH", server.URL+"/zsets/b/z", `{"members":{"ada":3,"bob":1,"cy":2},"ttl":"1h"}`); resp.StatusCode != http.StatusOK || out["added"] != 3.0 {
+		t.Fatalf("expected PATCH to create the set, got %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "POST", server.URL+"/zsets/b/z/incr", `{"member":"bob","by":5}`); resp.StatusCode != http.StatusOK || out["score"] != 6.0 {
+		t.Fatalf("expected incr to return the new score, got %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "GET", server.URL+"/zsets/b/z?rev=true&stop=0", ""); resp.StatusCode != http.StatusOK || first(out) != "bob" || out["length"] != 3.0 {
+		t.Fatalf("unexpected range by rank %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "GET", server.URL+"/zsets/b/z?min=2&max=3", ""); resp.StatusCode != http.StatusOK || first(out) != "cy" || len(out["members"].([]interface{})) != 2 {
+		t.Fatalf("unexpected range by score %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "GET", server.URL+"/zsets/b/z?max=-inf", ""); resp.StatusCode != http.StatusOK || len(out["members"].([]interface{})) != 0 {
+		t.Fatalf("expected an empty range, got %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "GET", server.URL+"/zsets/b/z?member=ada", ""); resp.StatusCode != http.StatusOK || out["rank"] != 1.0 || out["score"] != 3.0 {
+		t.Fatalf("unexpected rank %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "PATCH", server.URL+"/zsets/b/z", `{"members":{"cy":null}}`); resp.StatusCode != http.StatusOK || out["removed"] != 1.0 {
+		t.Fatalf("expected null to remove a member, got %d %v", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "DELETE", server.URL+"/zsets/b/z?member=ada", ""); resp.StatusCode != http.StatusOK || out["length"] != 1.0 {
+		t.Fatalf("expected DELETE ?member= to remove it, got %d %v", resp.StatusCode, out)
+	}
+
+	// /buckets has no zset route, so a key named a/zset is an ordinary key
+	if resp, out := httpDo(t, "PUT", server.URL+"/buckets/b/a/zset", `{"value":"plain"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected PUT to store a key named a/zset, got %d %s", resp.StatusCode, out)
+	}
+	if resp, out := httpJSON(t, "GET", server.URL+"/buckets/b/a/zset", ""); resp.StatusCode != http.StatusOK || out["value"] != "plain" {
+		t.Fatalf("expected GET to read the key named a/zset, got %d %v", resp.StatusCode, out)
+	}
+
+	cache.Set("b", "word", "hello")
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"PATCH", "/zsets/b/word", `{"members":{"a":1}}`, http.StatusConflict},
+		{"GET", "/zsets/b/word", "", http.StatusConflict},
+		{"PATCH", "/zsets/b/z", `{"members":{}}`, http.StatusBadRequest},
+		{"PATCH", "/zsets/b/z", `{"members":{"a":"1"}}`, http.StatusBadRequest},
+		{"POST", "/zsets/b/z/incr", `{"by":1}`, http.StatusBadRequest},
+		{"GET", "/zsets/b/z?min=low", "", http.StatusBadRequest},
+		{"GET", "/zsets/b/z?limit=-1&min=0", "", http.StatusBadRequest},
+		{"GET", "/zsets/b/z?member=ada", "", http.StatusNotFound},
+		{"PATCH", "/zsets/b/big", `{"members":{"` + strings.Repeat("x", 1024) + `":1}}`, http.StatusRequestEntityTooLarge},
+		{"PUT", "/zsets/b/z", "", http.StatusMethodNotAllowed},
+		{"GET", "/zsets/b/z/incr", "", http.StatusMethodNotAllowed},
+		{"GET", "/zsets/b", "", http.StatusNotFound},
+		{"DELETE", "/zsets/b/z", "", http.StatusOK},
+		{"GET", "/zsets/b/z", "", http.StatusNotFound},
+	} {
+		if resp, _ := httpJSON(t, c.method, server.URL+c.path, c.body); resp.StatusCode != c.code {
+			t.Fatalf("%s %s: expected %d, got %d", c.method, c.path, c.code, resp.StatusCode)
+		}
+	}
+}